@@ -0,0 +1,74 @@
+// gengraph generates synthetic social graphs in the Matrix Market format
+// so that they can be loaded with loadgraph and used by loadgen
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"socialnetwork/pkg/graph"
+)
+
+const (
+	MODEL_BARABASI_ALBERT = "ba"
+	MODEL_WATTS_STROGATZ  = "ws"
+	MODEL_CELEBRITY       = "celebrity"
+)
+
+func main() {
+	model := flag.String("model", MODEL_BARABASI_ALBERT, "Graph model: ba (Barabási–Albert), ws (Watts–Strogatz) or celebrity (power-law followers)")
+	nodes := flag.Int64("nodes", 10000, "Number of users")
+	seed := flag.Int64("seed", 1, "Seed of the random generator")
+	m := flag.Int("m", 10, "[ba] Number of edges of every new node")
+	k := flag.Int("k", 20, "[ws] Number of nearest neighbours in the ring lattice (even)")
+	beta := flag.Float64("beta", 0.1, "[ws] Rewiring probability")
+	degree := flag.Float64("degree", 20, "[celebrity] Average number of followees per user")
+	exponent := flag.Float64("exponent", 2.1, "[celebrity] Power-law exponent of the number of followers")
+	out := flag.String("out", "", "Output file (default social-graph/datasets/<model>-<nodes>-<seed>/<model>-<nodes>-<seed>.mtx)")
+	flag.Parse()
+
+	start := time.Now()
+	var g *graph.Graph
+	var params string
+	var err error
+	switch *model {
+	case MODEL_BARABASI_ALBERT:
+		g, err = graph.BarabasiAlbert(*nodes, *m, *seed)
+		params = fmt.Sprintf("m=%d", *m)
+	case MODEL_WATTS_STROGATZ:
+		g, err = graph.WattsStrogatz(*nodes, *k, *beta, *seed)
+		params = fmt.Sprintf("k=%d beta=%v", *k, *beta)
+	case MODEL_CELEBRITY:
+		g, err = graph.Celebrity(*nodes, *degree, *exponent, *seed)
+		params = fmt.Sprintf("degree=%v exponent=%v", *degree, *exponent)
+	default:
+		log.Fatalf("unknown model %q", *model)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *out == "" {
+		name := fmt.Sprintf("%s-%d-%d", *model, *nodes, *seed)
+		*out = filepath.Join("social-graph", "datasets", name, name+".mtx")
+	}
+	err = os.MkdirAll(filepath.Dir(*out), 0755)
+	if err != nil {
+		log.Fatal(err)
+	}
+	file, err := os.Create(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+	comment := fmt.Sprintf("generated by gengraph: model=%s nodes=%d seed=%d %s", *model, *nodes, *seed, params)
+	err = graph.WriteMTX(file, g, comment)
+	if err != nil {
+		log.Fatalf("error writing graph: %s", err.Error())
+	}
+	log.Printf("generated %s graph with %d users and %d edges in %s at %s", *model, g.Nodes, len(g.Edges), time.Since(start).Round(time.Millisecond), *out)
+}
@@ -0,0 +1,220 @@
+// loadgen is a constant-throughput, open-loop load generator for the wrk2 api
+//
+// requests are scheduled at fixed (or exponentially distributed) intended start times
+// regardless of how long previous requests take, and latencies are measured from the
+// intended start time so that queueing delays are not hidden (coordinated omission)
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"socialnetwork/pkg/graph"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+const DEFAULT_NUM_USERS int64 = 962
+
+// latencies are recorded in microseconds up to one minute with 3 significant digits
+const HISTOGRAM_MAX_LATENCY_US int64 = 60_000_000
+const HISTOGRAM_SIGNIFICANT_FIGURES int = 3
+
+type stats struct {
+	mu        sync.Mutex
+	histogram *hdrhistogram.Histogram
+	errors    int64
+}
+
+func (s *stats) record(latency time.Duration, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.histogram.RecordValue(min(latency.Microseconds(), HISTOGRAM_MAX_LATENCY_US))
+	if failed {
+		s.errors++
+	}
+}
+
+func main() {
+	hostEU := flag.String("eu", os.Getenv("HOST_EU"), "Host of the region serving compose requests (default $HOST_EU)")
+	hostUS := flag.String("us", os.Getenv("HOST_US"), "Host of the region serving timeline reads (default $HOST_US)")
+	deployment := flag.String("deployment", "local", "Deployment name used in the output directory (local or gcp)")
+	timestamp := flag.String("timestamp", time.Now().Format("2006-01-02_15:04:05"), "Timestamp used in the output directory")
+	rate := flag.Float64("rate", 50, "Number of requests per second")
+	duration := flag.Duration("duration", 30*time.Second, "Duration of the workload")
+	conns := flag.Int("conns", 64, "Maximum number of concurrent connections")
+	distribution := flag.String("dist", "exp", "Distribution of request inter-arrival times (const or exp)")
+	composeWeight := flag.Float64("compose", 1, "Weight of compose post requests in the workload mix")
+	homeWeight := flag.Float64("home", 0, "Weight of read home timeline requests in the workload mix")
+	userWeight := flag.Float64("user", 0, "Weight of read user timeline requests in the workload mix")
+	graphPath := flag.String("graph", "social-graph/datasets/socfb-Reed98/socfb-Reed98.mtx", "Social graph (.mtx) whose users are picked by the workload")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "Seed of the random generator")
+	authMode := flag.String("auth", AUTH_NONE, "Tokens sent by the requests: none (for deployments with auth_disabled), login (log in every user through the api) or key (sign them with the jwt secrets of the deployment)")
+	jwtKid := flag.String("jwt-kid", "k1", "Key id of the jwt secret used to sign the tokens in key mode")
+	jwtSecretsFile := flag.String("jwt-secrets-file", "", "Toml file with the jwt secrets of the deployment in key mode (or set $SN_JWT_SECRETS)")
+	flag.Parse()
+
+	if *hostEU == "" || *hostUS == "" {
+		log.Fatal("must provide the hosts with -eu and -us flags or HOST_EU and HOST_US env vars")
+	}
+	if *rate <= 0 {
+		log.Fatal("rate must be positive")
+	}
+	if *distribution != "const" && *distribution != "exp" {
+		log.Fatalf("unknown distribution %q", *distribution)
+	}
+
+	numUsers := DEFAULT_NUM_USERS
+	if *graphPath != "" {
+		g, err := graph.ReadMTX(*graphPath)
+		if err != nil {
+			log.Fatalf("error loading social graph: %s", err.Error())
+		}
+		numUsers = g.Nodes
+	}
+	w, err := newWorkload(*hostEU, *hostUS, numUsers, *composeWeight, *homeWeight, *userWeight)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.tokens, err = newTokenSource(*authMode, *hostEU, *jwtKid, *jwtSecretsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	log.Printf("running workload for %s at %.1f req/s (dist=%s, conns=%d, users=%d, auth=%s)", *duration, *rate, *distribution, *conns, numUsers, *authMode)
+	results, elapsed := run(ctx, w, *rate, *duration, *conns, *distribution, rand.New(rand.NewSource(*seed)))
+
+	dir := filepath.Join("evaluation", *deployment, *timestamp)
+	err = writeResults(dir, results, elapsed)
+	if err != nil {
+		log.Fatalf("error writing results: %s", err.Error())
+	}
+	log.Printf("workload results saved at %s", dir)
+}
+
+// run issues requests at their intended start times until the duration expires
+// the number of in-flight requests is bounded by conns, but waiting for a connection
+// counts towards the latency of the request since it is measured from the intended start
+func run(ctx context.Context, w *workload, rate float64, duration time.Duration, conns int, distribution string, rnd *rand.Rand) (map[string]*stats, time.Duration) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			MaxIdleConns:        conns,
+			MaxIdleConnsPerHost: conns,
+			MaxConnsPerHost:     conns,
+		},
+	}
+	results := make(map[string]*stats)
+	for _, e := range w.endpoints {
+		results[e.name] = &stats{histogram: hdrhistogram.New(1, HISTOGRAM_MAX_LATENCY_US, HISTOGRAM_SIGNIFICANT_FIGURES)}
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, conns)
+	interval := float64(time.Second) / rate
+	start := time.Now()
+	intended := start
+	for intended.Sub(start) < duration {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return results, time.Since(start)
+		case <-time.After(time.Until(intended)):
+		}
+
+		name, userID, req, err := w.next(rnd)
+		if err != nil {
+			log.Printf("error building %s request: %s", name, err.Error())
+		} else {
+			wg.Add(1)
+			go func(intended time.Time, s *stats, userID int64, req *http.Request) {
+				defer wg.Done()
+				slots <- struct{}{}
+				defer func() { <-slots }()
+				// logging in counts towards the latency of the first request of the user (and of every token renewal)
+				err := w.authorize(req, userID)
+				if err != nil {
+					log.Printf("error authorizing %s request: %s", name, err.Error())
+					s.record(time.Since(intended), true)
+					return
+				}
+				s.record(time.Since(intended), !send(client, req))
+			}(intended, results[name], userID, req)
+		}
+
+		if distribution == "exp" {
+			intended = intended.Add(time.Duration(rnd.ExpFloat64() * interval))
+		} else {
+			intended = intended.Add(time.Duration(interval))
+		}
+	}
+	wg.Wait()
+	return results, time.Since(start)
+}
+
+// send returns false if the request failed or the response is not successful
+func send(client *http.Client, req *http.Request) bool {
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+func writeResults(dir string, results map[string]*stats, elapsed time.Duration) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(results))
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	summary, err := os.Create(filepath.Join(dir, "loadgen.out"))
+	if err != nil {
+		return err
+	}
+	defer summary.Close()
+	out := io.MultiWriter(summary, os.Stdout)
+
+	fmt.Fprintf(out, "duration: %.2fs\n", elapsed.Seconds())
+	for _, name := range names {
+		h := results[name].histogram
+		fmt.Fprintf(out, "\n%s\n", name)
+		fmt.Fprintf(out, "  requests:   %d (%.2f req/s)\n", h.TotalCount(), float64(h.TotalCount())/elapsed.Seconds())
+		fmt.Fprintf(out, "  errors:     %d\n", results[name].errors)
+		for _, q := range []float64{50, 75, 90, 99, 99.9, 99.99} {
+			fmt.Fprintf(out, "  p%-9v %.3fms\n", q, float64(h.ValueAtQuantile(q))/1000)
+		}
+		fmt.Fprintf(out, "  max:        %.3fms\n", float64(h.Max())/1000)
+
+		// hdrhistogram percentile distribution in milliseconds, same format as wrk2 -L
+		hgrm, err := os.Create(filepath.Join(dir, fmt.Sprintf("loadgen-%s.hgrm", name)))
+		if err != nil {
+			return err
+		}
+		_, err = h.PercentilesPrint(hgrm, 5, 1000)
+		hgrm.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"socialnetwork/pkg/auth"
+)
+
+const (
+	// no tokens, for deployments with auth_disabled
+	AUTH_NONE = "none"
+	// log in every user through the api
+	AUTH_LOGIN = "login"
+	// sign the tokens with the jwt secrets of the deployment
+	AUTH_KEY = "key"
+)
+
+// tokens are renewed this long before they expire, so that in-flight requests are not rejected
+const TOKEN_RENEW_MARGIN time.Duration = 30 * time.Second
+const LOGIN_TIMEOUT time.Duration = 10 * time.Second
+
+// tokenSource issues the bearer tokens of the users of the workload and reuses them until they are about to expire
+type tokenSource struct {
+	issue  func(userID int64) (string, error)
+	mu     sync.Mutex
+	tokens map[int64]cachedToken
+}
+
+type cachedToken struct {
+	token   string
+	renewAt time.Time
+}
+
+// same users as cmd/loadgraph and social-graph/init_social_graph.py
+func username(userID int64) string {
+	return "username_" + strconv.FormatInt(userID, 10)
+}
+
+func password(userID int64) string {
+	return "password_" + strconv.FormatInt(userID, 10)
+}
+
+func newTokenSource(mode string, host string, kid string, secretsFile string) (*tokenSource, error) {
+	switch mode {
+	case AUTH_NONE:
+		return nil, nil
+	case AUTH_LOGIN:
+		return &tokenSource{issue: loginIssuer(host), tokens: make(map[int64]cachedToken)}, nil
+	case AUTH_KEY:
+		secrets, err := auth.LoadSecrets(nil, secretsFile)
+		if err != nil {
+			return nil, err
+		}
+		keyring, err := auth.NewKeyring(kid, secrets)
+		if err != nil {
+			return nil, fmt.Errorf("error loading jwt secrets: %s", err.Error())
+		}
+		issue := func(userID int64) (string, error) {
+			return keyring.Sign(username(userID), userID)
+		}
+		return &tokenSource{issue: issue, tokens: make(map[int64]cachedToken)}, nil
+	}
+	return nil, fmt.Errorf("unknown auth mode %q", mode)
+}
+
+// loginIssuer logs in the user with the v2 api, which returns the token as json
+func loginIssuer(host string) func(userID int64) (string, error) {
+	client := &http.Client{Timeout: LOGIN_TIMEOUT}
+	return func(userID int64) (string, error) {
+		body, err := json.Marshal(map[string]string{"username": username(userID), "password": password(userID)})
+		if err != nil {
+			return "", err
+		}
+		resp, err := client.Post(host+"/api/v2/users/login", "application/json", bytes.NewReader(body))
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("login of user %d failed with status %d", userID, resp.StatusCode)
+		}
+		var login struct {
+			Token string `json:"token"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&login)
+		if err != nil {
+			return "", fmt.Errorf("error parsing login response: %s", err.Error())
+		}
+		return login.Token, nil
+	}
+}
+
+// authorize sets the bearer token of the user in the request
+func (t *tokenSource) authorize(req *http.Request, userID int64) error {
+	t.mu.Lock()
+	cached, ok := t.tokens[userID]
+	t.mu.Unlock()
+	if !ok || time.Now().After(cached.renewAt) {
+		token, err := t.issue(userID)
+		if err != nil {
+			return err
+		}
+		cached = cachedToken{token: token, renewAt: time.Now().Add(auth.TOKEN_TTL - TOKEN_RENEW_MARGIN)}
+		t.mu.Lock()
+		t.tokens[userID] = cached
+		t.mu.Unlock()
+	}
+	req.Header.Set("Authorization", "Bearer "+cached.token)
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	ENDPOINT_COMPOSE_POST       = "compose-post"
+	ENDPOINT_READ_HOME_TIMELINE = "read-home-timeline"
+	ENDPOINT_READ_USER_TIMELINE = "read-user-timeline"
+)
+
+const POST_TEXT_LENGTH int = 256
+
+const charset = "qwertyuiopasdfghjklzxcvbnmQWERTYUIOPASDFGHJKLZXCVBNM1234567890"
+
+// endpoint builds the requests of one of the wrk2 api endpoints
+type endpoint struct {
+	name   string
+	weight float64
+	build  func(rnd *rand.Rand, userID int64) (*http.Request, error)
+}
+
+// workload picks endpoints according to their weights and users uniformly from the social graph
+type workload struct {
+	endpoints []endpoint
+	total     float64
+	numUsers  int64
+	// nil if requests are sent without tokens
+	tokens *tokenSource
+}
+
+func newWorkload(hostEU string, hostUS string, numUsers int64, composeWeight float64, homeWeight float64, userWeight float64) (*workload, error) {
+	if numUsers <= 0 {
+		return nil, fmt.Errorf("social graph has no users")
+	}
+	candidates := []endpoint{
+		{name: ENDPOINT_COMPOSE_POST, weight: composeWeight, build: composePostRequest(hostEU)},
+		{name: ENDPOINT_READ_HOME_TIMELINE, weight: homeWeight, build: readTimelineRequest(hostUS + "/wrk2-api/home-timeline/read")},
+		{name: ENDPOINT_READ_USER_TIMELINE, weight: userWeight, build: readTimelineRequest(hostUS + "/wrk2-api/user-timeline/read")},
+	}
+	w := &workload{numUsers: numUsers}
+	for _, e := range candidates {
+		if e.weight < 0 {
+			return nil, fmt.Errorf("invalid negative weight for %s", e.name)
+		}
+		if e.weight > 0 {
+			w.endpoints = append(w.endpoints, e)
+			w.total += e.weight
+		}
+	}
+	if len(w.endpoints) == 0 {
+		return nil, fmt.Errorf("workload mix must have at least one endpoint with positive weight")
+	}
+	return w, nil
+}
+
+// next returns the endpoint, user and request of the next request
+func (w *workload) next(rnd *rand.Rand) (string, int64, *http.Request, error) {
+	userID := rnd.Int63n(w.numUsers) + 1
+	pick := rnd.Float64() * w.total
+	for _, e := range w.endpoints {
+		if pick < e.weight {
+			req, err := e.build(rnd, userID)
+			return e.name, userID, req, err
+		}
+		pick -= e.weight
+	}
+	e := w.endpoints[len(w.endpoints)-1]
+	req, err := e.build(rnd, userID)
+	return e.name, userID, req, err
+}
+
+// authorize sets the token of the user in the request, if the workload sends tokens
+// it is called right before sending the request, since logging in may take a round trip
+func (w *workload) authorize(req *http.Request, userID int64) error {
+	if w.tokens == nil {
+		return nil
+	}
+	return w.tokens.authorize(req, userID)
+}
+
+func randomText(rnd *rand.Rand, length int) string {
+	var sb strings.Builder
+	sb.Grow(length)
+	for i := 0; i < length; i++ {
+		sb.WriteByte(charset[rnd.Intn(len(charset))])
+	}
+	return sb.String()
+}
+
+// same parameters as wrk2/scripts/social-network/compose-post.lua
+func composePostRequest(host string) func(*rand.Rand, int64) (*http.Request, error) {
+	return func(rnd *rand.Rand, userID int64) (*http.Request, error) {
+		form := url.Values{}
+		form.Set("username", username(userID))
+		form.Set("user_id", strconv.FormatInt(userID, 10))
+		form.Set("text", randomText(rnd, POST_TEXT_LENGTH))
+		form.Set("media_ids", "[]")
+		form.Set("media_types", "[]")
+		form.Set("post_type", "0")
+		req, err := http.NewRequest(http.MethodPost, host+"/wrk2-api/post/compose", strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	}
+}
+
+// same parameters as wrk2/scripts/social-network/read-{home,user}-timeline.lua
+func readTimelineRequest(path string) func(*rand.Rand, int64) (*http.Request, error) {
+	return func(rnd *rand.Rand, userID int64) (*http.Request, error) {
+		start := rnd.Intn(101)
+		query := url.Values{}
+		query.Set("user_id", strconv.FormatInt(userID, 10))
+		query.Set("start", strconv.Itoa(start))
+		query.Set("stop", strconv.Itoa(start+10))
+		return http.NewRequest(http.MethodGet, path+"?"+query.Encode(), nil)
+	}
+}
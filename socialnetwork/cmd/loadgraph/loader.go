@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"socialnetwork/pkg/model"
+	"socialnetwork/pkg/repository"
+	"socialnetwork/pkg/services"
+
+	"github.com/BurntSushi/toml"
+)
+
+// loader writes batches of users and follow edges
+// both operations are idempotent so that batches can be retried after a failure
+type loader interface {
+	registerUsers(ctx context.Context, users []model.UserRegistration) error
+	follow(ctx context.Context, edges []model.FollowEdge) error
+	close(ctx context.Context) error
+}
+
+// httpLoader goes through the batch endpoints of the wrk2 api
+// (i.e. UserService.BatchRegisterUsersWithId and SocialGraphService.BatchFollow)
+type httpLoader struct {
+	client *http.Client
+	host   string
+}
+
+func newHTTPLoader(host string) *httpLoader {
+	return &httpLoader{client: &http.Client{}, host: host}
+}
+
+func (l *httpLoader) post(ctx context.Context, path string, body any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.host+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	response, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s: %s", path, resp.Status, bytes.TrimSpace(response))
+	}
+	return nil
+}
+
+func (l *httpLoader) registerUsers(ctx context.Context, users []model.UserRegistration) error {
+	return l.post(ctx, "/wrk2-api/user/register-batch", map[string]any{"users": users})
+}
+
+func (l *httpLoader) follow(ctx context.Context, edges []model.FollowEdge) error {
+	return l.post(ctx, "/wrk2-api/user/follow-batch", map[string]any{"edges": edges})
+}
+
+func (l *httpLoader) close(ctx context.Context) error {
+	l.client.CloseIdleConnections()
+	return nil
+}
+
+// datastore addresses of the services in the weaver config file
+type weaverConfig struct {
+	UserService struct {
+		MongoDBAddr string `toml:"mongodb_address"`
+		MongoDBPort int    `toml:"mongodb_port"`
+	} `toml:"socialnetwork/pkg/services/UserService"`
+	SocialGraphService struct {
+		MongoDBAddr string `toml:"mongodb_address"`
+		MongoDBPort int    `toml:"mongodb_port"`
+		RedisAddr   string `toml:"redis_address"`
+		RedisPort   int    `toml:"redis_port"`
+	} `toml:"socialnetwork/pkg/services/SocialGraphService"`
+}
+
+// offlineLoader writes straight to the datastores of the user and social graph services
+// so that the graph can be loaded before deploying the application
+type offlineLoader struct {
+	users repository.UserRepository
+	graph repository.SocialGraphRepository
+}
+
+func newOfflineLoader(ctx context.Context, configPath string) (*offlineLoader, error) {
+	var config weaverConfig
+	_, err := toml.DecodeFile(configPath, &config)
+	if err != nil {
+		return nil, fmt.Errorf("error reading weaver config: %s", err.Error())
+	}
+	l := &offlineLoader{}
+	l.users, err = repository.NewUserRepository(ctx, repository.Options{
+		MongoDBAddr: config.UserService.MongoDBAddr,
+		MongoDBPort: config.UserService.MongoDBPort,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = l.users.EnsureIndexes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	l.graph, err = repository.NewSocialGraphRepository(ctx, repository.Options{
+		MongoDBAddr: config.SocialGraphService.MongoDBAddr,
+		MongoDBPort: config.SocialGraphService.MongoDBPort,
+		CacheAddr:   config.SocialGraphService.RedisAddr,
+		CachePort:   config.SocialGraphService.RedisPort,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *offlineLoader) registerUsers(ctx context.Context, users []model.UserRegistration) error {
+	_, err := services.RegisterUsersBatch(ctx, l.users, users)
+	if err != nil {
+		return err
+	}
+	userIDs := make([]int64, 0, len(users))
+	for _, user := range users {
+		userIDs = append(userIDs, user.UserID)
+	}
+	_, err = l.graph.InsertUsers(ctx, userIDs)
+	return err
+}
+
+func (l *offlineLoader) follow(ctx context.Context, edges []model.FollowEdge) error {
+	_, err := l.graph.Follow(ctx, edges)
+	return err
+}
+
+// repositories keep their connections open, which are released when the process exits after loading the graph
+func (l *offlineLoader) close(ctx context.Context) error {
+	return nil
+}
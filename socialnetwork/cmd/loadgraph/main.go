@@ -0,0 +1,211 @@
+// loadgraph registers the users and follow edges of a social graph in the Matrix Market format
+//
+// users and edges are written in batches, either through the batch endpoints of the wrk2 api
+// (online mode) or straight to the datastores (offline mode); the progress is saved to a
+// checkpoint file after every batch so that an interrupted load resumes where it stopped
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"socialnetwork/pkg/graph"
+	"socialnetwork/pkg/model"
+)
+
+const (
+	MODE_ONLINE  = "online"
+	MODE_OFFLINE = "offline"
+)
+
+// checkpoint is the number of users and (mtx) edges of the graph that were already loaded
+type checkpoint struct {
+	Graph     string `json:"graph"`
+	Nodes     int64  `json:"nodes"`
+	Edges     int    `json:"edges"`
+	UsersDone int64  `json:"users_done"`
+	EdgesDone int    `json:"edges_done"`
+}
+
+func loadCheckpoint(path string, g *graph.Graph, graphPath string) (*checkpoint, error) {
+	cp := &checkpoint{Graph: graphPath, Nodes: g.Nodes, Edges: len(g.Edges)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved checkpoint
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing checkpoint %s: %s", path, err.Error())
+	}
+	if saved.Nodes != cp.Nodes || saved.Edges != cp.Edges {
+		return nil, fmt.Errorf("checkpoint %s belongs to a different graph (%d nodes, %d edges), use -reset to start over", path, saved.Nodes, saved.Edges)
+	}
+	return &saved, nil
+}
+
+// save writes the checkpoint atomically so that an interrupted write never corrupts it
+func (cp *checkpoint) save(path string) error {
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+type progress struct {
+	label string
+	total int64
+	start time.Time
+}
+
+func (p *progress) report(done int64) {
+	elapsed := time.Since(p.start).Seconds()
+	log.Printf("%s: %d/%d (%.1f%%, %.0f/s)", p.label, done, p.total, 100*float64(done)/float64(max(p.total, 1)), float64(done)/max(elapsed, 1e-3))
+}
+
+func main() {
+	graphPath := flag.String("graph", "social-graph/datasets/socfb-Reed98/socfb-Reed98.mtx", "Social graph (.mtx) to load")
+	mode := flag.String("mode", MODE_ONLINE, "Load through the wrk2 api (online) or straight to the datastores (offline)")
+	host := flag.String("host", os.Getenv("HOST_EU"), "Host of the wrk2 api in online mode (default $HOST_EU)")
+	configPath := flag.String("config", "weaver-local.toml", "Weaver config with the datastore addresses in offline mode")
+	batchSize := flag.Int("batch", 500, "Number of users or edges per batch")
+	directed := flag.Bool("directed", false, "Only follow from the first to the second node of each edge, even if the graph is undirected")
+	checkpointPath := flag.String("checkpoint", "", "Checkpoint file (default <graph>.checkpoint)")
+	reset := flag.Bool("reset", false, "Ignore the checkpoint and load the whole graph again")
+	flag.Parse()
+
+	if *batchSize <= 0 {
+		log.Fatal("batch size must be positive")
+	}
+	if *checkpointPath == "" {
+		*checkpointPath = *graphPath + ".checkpoint"
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	var l loader
+	var err error
+	switch *mode {
+	case MODE_ONLINE:
+		if *host == "" {
+			log.Fatal("must provide the host with -host flag or HOST_EU env var")
+		}
+		l = newHTTPLoader(*host)
+	case MODE_OFFLINE:
+		l, err = newOfflineLoader(ctx, *configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("unknown mode %q", *mode)
+	}
+	defer l.close(context.Background())
+
+	g, err := graph.ReadMTX(*graphPath)
+	if err != nil {
+		log.Fatalf("error loading social graph: %s", err.Error())
+	}
+	if *reset {
+		os.Remove(*checkpointPath)
+	}
+	cp, err := loadCheckpoint(*checkpointPath, g, *graphPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("loading %s (%d users, %d edges) in %s mode, resuming from %d users and %d edges",
+		filepath.Base(*graphPath), g.Nodes, len(g.Edges), *mode, cp.UsersDone, cp.EdgesDone)
+
+	err = registerUsers(ctx, l, g, cp, *checkpointPath, *batchSize)
+	if err != nil {
+		log.Fatalf("error registering users (progress saved to %s): %s", *checkpointPath, err.Error())
+	}
+	err = followEdges(ctx, l, g, cp, *checkpointPath, *batchSize, *directed || g.Directed)
+	if err != nil {
+		log.Fatalf("error following users (progress saved to %s): %s", *checkpointPath, err.Error())
+	}
+	log.Printf("done! loaded %d users and %d edges", g.Nodes, len(g.Edges))
+}
+
+// same users as social-graph/init_social_graph.py
+func userRegistration(userID int64) model.UserRegistration {
+	id := strconv.FormatInt(userID, 10)
+	return model.UserRegistration{
+		UserID:    userID,
+		FirstName: "first_name_" + id,
+		LastName:  "last_name_" + id,
+		Username:  "username_" + id,
+		Password:  "password_" + id,
+	}
+}
+
+func registerUsers(ctx context.Context, l loader, g *graph.Graph, cp *checkpoint, checkpointPath string, batchSize int) error {
+	p := progress{label: "registered users", total: g.Nodes, start: time.Now()}
+	for cp.UsersDone < g.Nodes {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		end := min(cp.UsersDone+int64(batchSize), g.Nodes)
+		users := make([]model.UserRegistration, 0, end-cp.UsersDone)
+		for userID := cp.UsersDone + 1; userID <= end; userID++ {
+			users = append(users, userRegistration(userID))
+		}
+		err := l.registerUsers(ctx, users)
+		if err != nil {
+			return err
+		}
+		cp.UsersDone = end
+		err = cp.save(checkpointPath)
+		if err != nil {
+			return err
+		}
+		p.report(cp.UsersDone)
+	}
+	return nil
+}
+
+func followEdges(ctx context.Context, l loader, g *graph.Graph, cp *checkpoint, checkpointPath string, batchSize int, directed bool) error {
+	p := progress{label: "followed edges", total: int64(len(g.Edges)), start: time.Now()}
+	for cp.EdgesDone < len(g.Edges) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		end := min(cp.EdgesDone+batchSize, len(g.Edges))
+		edges := make([]model.FollowEdge, 0, 2*(end-cp.EdgesDone))
+		for _, edge := range g.Edges[cp.EdgesDone:end] {
+			edges = append(edges, model.FollowEdge{UserID: edge[0], FolloweeID: edge[1]})
+			if !directed {
+				edges = append(edges, model.FollowEdge{UserID: edge[1], FolloweeID: edge[0]})
+			}
+		}
+		err := l.follow(ctx, edges)
+		if err != nil {
+			return err
+		}
+		cp.EdgesDone = end
+		err = cp.save(checkpointPath)
+		if err != nil {
+			return err
+		}
+		p.report(int64(cp.EdgesDone))
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+// rebuildtimelines regenerates the home timelines from the social graph and post storage
+//
+// the rebuilt timelines replace the ones stored in mongodb and cached in redis, e.g. to recover
+// from a lost home-timeline database or to backfill timelines of a graph loaded with loadgraph
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"socialnetwork/pkg/repository"
+	"socialnetwork/pkg/services"
+
+	"github.com/BurntSushi/toml"
+)
+
+// datastore addresses of the services in the weaver config file
+type weaverConfig struct {
+	SocialGraphService struct {
+		MongoDBAddr string `toml:"mongodb_address"`
+		MongoDBPort int    `toml:"mongodb_port"`
+		RedisAddr   string `toml:"redis_address"`
+		RedisPort   int    `toml:"redis_port"`
+	} `toml:"socialnetwork/pkg/services/SocialGraphService"`
+	PostStorageService struct {
+		MongoDBAddr string `toml:"mongodb_address"`
+		MongoDBPort int    `toml:"mongodb_port"`
+	} `toml:"socialnetwork/pkg/services/PostStorageService"`
+	HomeTimelineService struct {
+		RedisAddr string `toml:"redis_address"`
+		RedisPort int    `toml:"redis_port"`
+	} `toml:"socialnetwork/pkg/services/HomeTimelineService"`
+	WriteHomeTimelineService struct {
+		RedisAddr               string `toml:"redis_address"`
+		RedisPort               int    `toml:"redis_port"`
+		HomeTimelineMongoDBAddr string `toml:"home_timeline_mongodb_address"`
+		HomeTimelineMongoDBPort int    `toml:"home_timeline_mongodb_port"`
+	} `toml:"socialnetwork/pkg/services/WriteHomeTimelineService"`
+}
+
+type cacheAddress struct {
+	addr string
+	port int
+}
+
+func newStores(ctx context.Context, configPath string) (services.HomeTimelineStores, error) {
+	var stores services.HomeTimelineStores
+	var config weaverConfig
+	_, err := toml.DecodeFile(configPath, &config)
+	if err != nil {
+		return stores, fmt.Errorf("error reading weaver config: %s", err.Error())
+	}
+	stores.SocialGraph, err = repository.NewSocialGraphRepository(ctx, repository.Options{
+		MongoDBAddr: config.SocialGraphService.MongoDBAddr,
+		MongoDBPort: config.SocialGraphService.MongoDBPort,
+		CacheAddr:   config.SocialGraphService.RedisAddr,
+		CachePort:   config.SocialGraphService.RedisPort,
+	})
+	if err != nil {
+		return stores, err
+	}
+	stores.Posts, err = repository.NewPostRepository(ctx, repository.Options{
+		MongoDBAddr: config.PostStorageService.MongoDBAddr,
+		MongoDBPort: config.PostStorageService.MongoDBPort,
+	})
+	if err != nil {
+		return stores, err
+	}
+	// the reader and writer of home timelines may use different caches (e.g. the writer runs in another region)
+	caches := []cacheAddress{{config.HomeTimelineService.RedisAddr, config.HomeTimelineService.RedisPort}}
+	if config.WriteHomeTimelineService.RedisAddr != config.HomeTimelineService.RedisAddr || config.WriteHomeTimelineService.RedisPort != config.HomeTimelineService.RedisPort {
+		caches = append(caches, cacheAddress{config.WriteHomeTimelineService.RedisAddr, config.WriteHomeTimelineService.RedisPort})
+	}
+	for _, cache := range caches {
+		// the rebuilt timelines are cached whole, without trimming or expiration
+		timelines, err := repository.NewTimelineRepository(ctx, repository.Options{
+			MongoDBAddr: config.WriteHomeTimelineService.HomeTimelineMongoDBAddr,
+			MongoDBPort: config.WriteHomeTimelineService.HomeTimelineMongoDBPort,
+			CacheAddr:   cache.addr,
+			CachePort:   cache.port,
+		}, "home-timeline", repository.TimelineCachePolicy{})
+		if err != nil {
+			return stores, err
+		}
+		err = timelines.EnsureIndexes(ctx)
+		if err != nil {
+			return stores, err
+		}
+		stores.HomeTimelines = append(stores.HomeTimelines, timelines)
+	}
+	return stores, nil
+}
+
+func parseUserIDs(users string) ([]int64, error) {
+	var userIDs []int64
+	for _, user := range strings.Split(users, ",") {
+		userID, err := strconv.ParseInt(strings.TrimSpace(user), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user id %q", user)
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, nil
+}
+
+func main() {
+	configPath := flag.String("config", "weaver-local.toml", "Weaver config with the datastore addresses")
+	users := flag.String("users", "", "Comma-separated ids of the users whose timelines are rebuilt (default all users in the social graph)")
+	limit := flag.Int64("limit", 0, "Maximum number of posts per timeline, newest first (0 for no limit)")
+	workers := flag.Int("workers", 8, "Number of timelines rebuilt concurrently")
+	flag.Parse()
+
+	if *workers <= 0 {
+		log.Fatal("number of workers must be positive")
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	stores, err := newStores(ctx, *configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var userIDs []int64
+	if *users != "" {
+		userIDs, err = parseUserIDs(*users)
+	} else {
+		userIDs, err = stores.SocialGraph.ListUsers(ctx)
+	}
+	if err != nil {
+		log.Fatalf("error listing users: %s", err.Error())
+	}
+	log.Printf("rebuilding %d home timelines", len(userIDs))
+
+	start := time.Now()
+	var done, posts atomic.Int64
+	var failed atomic.Bool
+	jobs := make(chan int64)
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for userID := range jobs {
+				n, err := services.RebuildHomeTimeline(ctx, stores, userID, *limit)
+				if err != nil {
+					log.Printf("error rebuilding home timeline of user %d: %s", userID, err.Error())
+					failed.Store(true)
+					continue
+				}
+				posts.Add(int64(n))
+				if d := done.Add(1); d%1000 == 0 {
+					log.Printf("rebuilt timelines: %d/%d (%.0f/s)", d, len(userIDs), float64(d)/time.Since(start).Seconds())
+				}
+			}
+		}()
+	}
+	for _, userID := range userIDs {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- userID
+	}
+	close(jobs)
+	wg.Wait()
+
+	if ctx.Err() != nil || failed.Load() {
+		log.Fatalf("rebuilt %d/%d home timelines, run again to retry the remaining ones", done.Load(), len(userIDs))
+	}
+	log.Printf("done! rebuilt %d home timelines with %d posts in %s", done.Load(), posts.Load(), time.Since(start).Round(time.Millisecond))
+}
@@ -3,6 +3,7 @@ module socialnetwork
 go 1.21.5
 
 require (
+	github.com/HdrHistogram/hdrhistogram-go v1.1.2
 	github.com/ServiceWeaver/weaver v0.22.1-0.20231019162801-c2294d1ae0e8
 	github.com/rabbitmq/amqp091-go v1.9.0
 )
@@ -22,7 +23,7 @@ require (
 )
 
 require (
-	github.com/BurntSushi/toml v1.3.2 // indirect
+	github.com/BurntSushi/toml v1.3.2
 	github.com/DataDog/hyperloglog v0.0.0-20220804205443-1806d9b66146 // indirect
 	github.com/antlr/antlr4/runtime/Go/antlr/v4 v4.0.0-20230305170008-8188dc5388df // indirect
 	github.com/bradfitz/gomemcache v0.0.0-20230905024940-24af94b03874
@@ -105,6 +105,14 @@ def run_workload(timestamp, deployment, url, threads, conns, duration, rate):
   progress_thread.join()
   return output
 
+def run_loadgen(timestamp, deployment, url_eu, url_us, conns, duration, rate, compose, home, user, auth_args=[]):
+  from plumbum import local
+  go = local['go']
+  go['run', './cmd/loadgen', '-eu', url_eu, '-us', url_us, '-deployment', deployment, '-timestamp', timestamp,
+    '-conns', str(conns), '-duration', f'{duration}s', '-rate', str(rate),
+    '-compose', str(compose), '-home', str(home), '-user', str(user), *auth_args] & FG
+  print(f"[INFO] workload results saved at evaluation/{deployment}/{timestamp}/")
+
 def gen_weaver_config_gcp():
   host_eu = get_instance_host(GCP_INSTANCE_DB_EU, GCP_ZONE_EU)
   host_us = get_instance_host(GCP_INSTANCE_DB_US, GCP_ZONE_US)
@@ -144,6 +152,19 @@ def gen_weaver_config_gcp():
 
   print(f"[INFO] generated app config for GCP at {filepath_eu} and {filepath_us}")
 
+def gen_jwt_secrets_gcp():
+  import secrets
+
+  # both regions share the secret, so that tokens issued in one region are accepted in the other
+  filepath = "deploy/tmp/jwt-secrets.toml"
+  if os.path.exists(filepath):
+    print(f"[INFO] reusing jwt secrets at {filepath}")
+    return
+  fd = os.open(filepath, os.O_WRONLY | os.O_CREAT | os.O_EXCL, 0o600)
+  with os.fdopen(fd, 'w') as f:
+    f.write(f'k1 = "{secrets.token_urlsafe(32)}"\n')
+  print(f"[INFO] generated jwt secrets for GCP at {filepath}")
+
 def gen_ansible_vars(workload_timestamp=None, deployment_type=None):
   import yaml
 
@@ -258,30 +279,72 @@ def metrics(deployment, timestamp=None):
   write_post_duration_metrics = get_filter_metrics('sn_write_post_duration_ms')
   write_post_duration_metrics_values = pattern.findall(write_post_duration_metrics)
   write_post_duration_avg_ms = sum(float(value) for value in write_post_duration_metrics_values)/len(write_post_duration_metrics_values) if write_post_duration_metrics_values else 0
+  post_cache_hits_metrics = get_filter_metrics('sn_post_cache_hits')
+  post_cache_hits_count = sum(int(value) for value in pattern.findall(post_cache_hits_metrics))
+  post_cache_misses_metrics = get_filter_metrics('sn_post_cache_misses')
+  post_cache_misses_count = sum(int(value) for value in pattern.findall(post_cache_misses_metrics))
+  missing_posts_metrics = get_filter_metrics('sn_missing_posts')
+  missing_posts_count = sum(int(value) for value in pattern.findall(missing_posts_metrics))
   # write home timeline service
   queue_duration_metrics = get_filter_metrics('sn_queue_duration_ms')
   queue_duration_metrics_values = pattern.findall(queue_duration_metrics)
   queue_duration_avg_ms = sum(float(value) for value in queue_duration_metrics_values)/len(queue_duration_metrics_values) if queue_duration_metrics_values else 0
   received_notifications_metrics = get_filter_metrics('sn_received_notifications')
   received_notifications_count = sum(int(value) for value in pattern.findall(received_notifications_metrics))
+  retried_notifications_metrics = get_filter_metrics('sn_retried_notifications')
+  retried_notifications_count = sum(int(value) for value in pattern.findall(retried_notifications_metrics))
+  dead_lettered_notifications_metrics = get_filter_metrics('sn_dead_lettered_notifications')
+  dead_lettered_notifications_count = sum(int(value) for value in pattern.findall(dead_lettered_notifications_metrics))
+  pushed_timeline_writes_metrics = get_filter_metrics('sn_pushed_timeline_writes')
+  pushed_timeline_writes_count = sum(int(value) for value in pattern.findall(pushed_timeline_writes_metrics))
+  pull_fanouts_metrics = get_filter_metrics('sn_pull_fanouts')
+  pull_fanouts_count = sum(int(value) for value in pattern.findall(pull_fanouts_metrics))
+  fanout_duration_metrics = get_filter_metrics('sn_fanout_duration_ms')
+  fanout_duration_metrics_values = pattern.findall(fanout_duration_metrics)
+  fanout_duration_avg_ms = sum(float(value) for value in fanout_duration_metrics_values)/len(fanout_duration_metrics_values) if fanout_duration_metrics_values else 0
+  failed_fanout_chunks_metrics = get_filter_metrics('sn_failed_fanout_chunks')
+  failed_fanout_chunks_count = sum(int(value) for value in pattern.findall(failed_fanout_chunks_metrics))
+  backfilled_timeline_posts_metrics = get_filter_metrics('sn_backfilled_timeline_posts')
+  backfilled_timeline_posts_count = sum(int(value) for value in pattern.findall(backfilled_timeline_posts_metrics))
+  removed_timeline_posts_metrics = get_filter_metrics('sn_removed_timeline_posts')
+  removed_timeline_posts_count = sum(int(value) for value in pattern.findall(removed_timeline_posts_metrics))
+  # home timeline service
+  pulled_timeline_posts_metrics = get_filter_metrics('sn_pulled_timeline_posts')
+  pulled_timeline_posts_count = sum(int(value) for value in pattern.findall(pulled_timeline_posts_metrics))
+  compacted_timeline_posts_metrics = get_filter_metrics('sn_compacted_timeline_posts')
+  compacted_timeline_posts_count = sum(int(value) for value in pattern.findall(compacted_timeline_posts_metrics))
   inconsitencies_metrics = get_filter_metrics('sn_inconsistencies')
   inconsistencies_count = sum(int(value) for value in pattern.findall(inconsitencies_metrics))
   
   pc_inconsistencies = "{:.2f}".format((inconsistencies_count / received_notifications_count) * 100) if received_notifications_count != 0 else 0
+  pc_post_cache_hits = "{:.2f}".format((post_cache_hits_count / (post_cache_hits_count + post_cache_misses_count)) * 100) if post_cache_hits_count + post_cache_misses_count != 0 else 0
   #pc_received_notifications = "{:.2f}".format((received_notifications_count / composed_posts_count) * 100) if composed_posts_count else 0
 
   compose_post_duration_avg_ms = "{:.2f}".format(compose_post_duration_avg_ms)
   write_post_duration_avg_ms = "{:.2f}".format(write_post_duration_avg_ms)
   queue_duration_avg_ms = "{:.2f}".format(queue_duration_avg_ms)
+  fanout_duration_avg_ms = "{:.2f}".format(fanout_duration_avg_ms)
 
   results = {
     'num_composed_posts': int(composed_posts_count),
     'num_received_notifications': int(received_notifications_count),
+    'num_retried_notifications': int(retried_notifications_count),
+    'num_dead_lettered_notifications': int(dead_lettered_notifications_count),
+    'num_pushed_timeline_writes': int(pushed_timeline_writes_count),
+    'num_pull_fanouts': int(pull_fanouts_count),
+    'num_failed_fanout_chunks': int(failed_fanout_chunks_count),
+    'num_pulled_timeline_posts': int(pulled_timeline_posts_count),
+    'num_backfilled_timeline_posts': int(backfilled_timeline_posts_count),
+    'num_removed_timeline_posts': int(removed_timeline_posts_count),
+    'num_compacted_timeline_posts': int(compacted_timeline_posts_count),
+    'num_missing_posts': int(missing_posts_count),
+    'per_post_cache_hits': float(pc_post_cache_hits),
     'num_inconsistencies': int(inconsistencies_count),
     'per_inconsistencies': float(pc_inconsistencies),
     'avg_compose_post_duration_ms': float(compose_post_duration_avg_ms),
     'avg_write_post_duration_msg': float(write_post_duration_avg_ms),
     'avg_queue_duration_ms': float(queue_duration_avg_ms),
+    'avg_fanout_duration_ms': float(fanout_duration_avg_ms),
   }
 
   # save file if we ran workload
@@ -374,6 +437,8 @@ def gcp_deploy():
   gen_ansible_config()
   # generate weaver config with hosts of datastores in gcp machines
   gen_weaver_config_gcp()
+  # generate the jwt secrets of the app, which are not checked in
+  gen_jwt_secrets_gcp()
   # generate ansible inventory with hosts of all gcp machines
   gen_ansible_inventory_gcp()
   # generate ansible inventory with extra variables for current deployment
@@ -423,6 +488,10 @@ def gcp_init_social_graph():
   print("[INFO] nothing to be done for gcp")
   exit(0)
 
+def gcp_rebuild_timelines(limit):
+  print("[INFO] nothing to be done for gcp")
+  exit(0)
+
 def gcp_metrics(timestamp):
   metrics('gcp', timestamp)
 
@@ -435,20 +504,41 @@ def gcp_wrk2(threads, conns, duration, rate):
   ansible_playbook["deploy/ansible/playbooks/gather-metrics.yml", "-i", "deploy/tmp/ansible-inventory.cfg", "--extra-vars", "@deploy/tmp/ansible-vars.yml"] & FG
   print(f"[INFO] metrics results saved at evaluation/gcp/{timestamp}/ in metrics-eu.yaml and metrics-us.yaml files")
 
+def gcp_loadgen(conns, duration, rate, compose, home, user):
+  from plumbum.cmd import ansible_playbook
+  host_eu = get_instance_host(GCP_INSTANCE_APP_EU, GCP_ZONE_EU)
+  host_us = get_instance_host(GCP_INSTANCE_APP_US, GCP_ZONE_US)
+  timestamp = datetime.datetime.now().strftime("%Y-%m-%d_%H:%M:%S")
+  # gcp deployments have auth enabled, so tokens are signed with the generated jwt secrets
+  run_loadgen(timestamp, 'gcp', f"http://{host_eu}:{APP_PORT}", f"http://{host_us}:{APP_PORT}", conns, duration, rate, compose, home, user,
+    ['-auth', 'key', '-jwt-secrets-file', 'deploy/tmp/jwt-secrets.toml'])
+  gen_ansible_vars(timestamp, 'gcp')
+  ansible_playbook["deploy/ansible/playbooks/gather-metrics.yml", "-i", "deploy/tmp/ansible-inventory.cfg", "--extra-vars", "@deploy/tmp/ansible-vars.yml"] & FG
+  print(f"[INFO] metrics results saved at evaluation/gcp/{timestamp}/ in metrics-eu.yaml and metrics-us.yaml files")
+
 # --------------------
 # LOCAL
 # --------------------
 
 def local_init_social_graph():
   from plumbum import local
-  with local.env(HOST_EU=f"http://127.0.0.1:{APP_PORT}", HOST_US=f"http://127.0.0.1:{APP_PORT}"):
-    local['./social-graph/init_social_graph.py'] & FG
+  local['go']['run', './cmd/loadgraph', '-host', f"http://127.0.0.1:{APP_PORT}"] & FG
+
+def local_rebuild_timelines(limit):
+  from plumbum import local
+  local['go']['run', './cmd/rebuildtimelines', '-config', 'weaver-local.toml', '-limit', limit] & FG
 
 def local_wrk2(threads, conns, duration, rate):
   timestamp = datetime.datetime.now().strftime("%Y-%m-%d_%H:%M:%S")
   run_workload(timestamp, 'local', f"http://127.0.0.1:{APP_PORT}", threads, conns, duration, rate)
   metrics('local', timestamp)
 
+def local_loadgen(conns, duration, rate, compose, home, user):
+  timestamp = datetime.datetime.now().strftime("%Y-%m-%d_%H:%M:%S")
+  url = f"http://127.0.0.1:{APP_PORT}"
+  run_loadgen(timestamp, 'local', url, url, conns, duration, rate, compose, home, user)
+  metrics('local', timestamp)
+
 def local_metrics(timestamp):
   metrics('local', timestamp)
 
@@ -524,12 +614,22 @@ if __name__ == "__main__":
 
   # eval
   command_parser.add_parser('init-social-graph')
+  rebuild_timelines_parser = command_parser.add_parser('rebuild-timelines')
+  rebuild_timelines_parser.add_argument('-l', '--limit', default=0, help="Maximum number of posts per home timeline (0 for no limit)")
   # eval wkr2
   eval_wrk2_parser = command_parser.add_parser('wrk2')
   eval_wrk2_parser.add_argument('-t', '--threads', default=2, help="Number of threads")
   eval_wrk2_parser.add_argument('-c', '--conns', default=2, help="Number of connections")
   eval_wrk2_parser.add_argument('-d', '--duration', default=30, help="Duration")
   eval_wrk2_parser.add_argument('-r', '--rate', default=50, help="Number of requests per second")
+  # eval go load generator
+  eval_loadgen_parser = command_parser.add_parser('loadgen')
+  eval_loadgen_parser.add_argument('-c', '--conns', default=64, help="Maximum number of concurrent connections")
+  eval_loadgen_parser.add_argument('-d', '--duration', default=30, help="Duration")
+  eval_loadgen_parser.add_argument('-r', '--rate', default=50, help="Number of requests per second")
+  eval_loadgen_parser.add_argument('--compose', default=1, help="Weight of compose post requests")
+  eval_loadgen_parser.add_argument('--home', default=0, help="Weight of read home timeline requests")
+  eval_loadgen_parser.add_argument('--user', default=0, help="Weight of read user timeline requests")
   # eval metrics
   eval_metrics_parser = command_parser.add_parser('metrics')
   eval_metrics_parser.add_argument('-t', '--timestamp', help="Timestamp of workload")
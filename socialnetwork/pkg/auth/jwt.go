@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// tokens expire after this long and clients must login again
+const TOKEN_TTL time.Duration = 6 * time.Minute
+
+type Claims struct {
+	Username  string `json:"username"`
+	UserID    int64  `json:"user_id"`
+	Timestamp int64  `json:"timestamp"`
+	jwt.StandardClaims
+}
+
+// Keyring holds the HS256 secrets indexed by their key id (kid)
+// tokens are signed with the active key and verified with the key in their header,
+// so keys can be rotated by adding a new key, making it active, and later removing the old one
+type Keyring struct {
+	activeKid string
+	keys      map[string][]byte
+}
+
+func NewKeyring(activeKid string, secrets map[string]string) (*Keyring, error) {
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("no jwt secrets configured")
+	}
+	keyring := &Keyring{activeKid: activeKid, keys: make(map[string][]byte, len(secrets))}
+	for kid, secret := range secrets {
+		if secret == "" {
+			return nil, fmt.Errorf("empty jwt secret for kid %q", kid)
+		}
+		keyring.keys[kid] = []byte(secret)
+	}
+	if _, ok := keyring.keys[activeKid]; !ok {
+		return nil, fmt.Errorf("active jwt kid %q has no secret", activeKid)
+	}
+	return keyring, nil
+}
+
+// Sign returns a token for the user signed with the active key
+func (k *Keyring) Sign(username string, userID int64) (string, error) {
+	now := time.Now()
+	claims := &Claims{
+		Username:       username,
+		UserID:         userID,
+		Timestamp:      now.UnixMilli(),
+		StandardClaims: jwt.StandardClaims{ExpiresAt: now.Add(TOKEN_TTL).Unix()},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = k.activeKid
+	return token.SignedString(k.keys[k.activeKid])
+}
+
+// Verify parses the token and checks its signature and expiration time
+func (k *Keyring) Verify(tokenStr string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		key, ok := k.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown kid %q", kid)
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// BearerToken returns the token in the "Authorization: Bearer <token>" header of the request
+func BearerToken(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return "", fmt.Errorf("missing authorization header")
+	}
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", fmt.Errorf("authorization header must be \"Bearer <token>\"")
+	}
+	return token, nil
+}
+
+type userKey struct{}
+
+// WithUser returns a copy of the context with the authenticated user
+func WithUser(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, userKey{}, claims)
+}
+
+// UserFromContext returns the authenticated user of the request, if any
+func UserFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(userKey{}).(*Claims)
+	return claims, ok
+}
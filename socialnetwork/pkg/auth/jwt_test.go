@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func mustKeyring(t *testing.T, activeKid string, secrets map[string]string) *Keyring {
+	t.Helper()
+	keyring, err := NewKeyring(activeKid, secrets)
+	if err != nil {
+		t.Fatalf("error creating keyring: %s", err.Error())
+	}
+	return keyring
+}
+
+// signToken signs the claims of the user with the method and key, with the kid in the header (if not empty)
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, expiresAt time.Time) string {
+	t.Helper()
+	claims := &Claims{
+		Username:       "ana",
+		UserID:         1,
+		Timestamp:      time.Now().UnixMilli(),
+		StandardClaims: jwt.StandardClaims{ExpiresAt: expiresAt.Unix()},
+	}
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	tokenStr, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("error signing token: %s", err.Error())
+	}
+	return tokenStr
+}
+
+// tamperUserID replaces the user id in the claims of the token, keeping its header and signature
+func tamperUserID(t *testing.T, tokenStr string, userID int64) string {
+	t.Helper()
+	parts := strings.Split(tokenStr, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatalf("error decoding claims: %s", err.Error())
+	}
+	var claims map[string]interface{}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		t.Fatalf("error parsing claims: %s", err.Error())
+	}
+	claims["user_id"] = userID
+	payload, err = json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("error encoding claims: %s", err.Error())
+	}
+	parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+	return strings.Join(parts, ".")
+}
+
+func TestVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := time.Now().Add(TOKEN_TTL)
+	k1 := []byte("secret-1")
+	k2 := []byte("secret-2")
+	// k1 was rotated out, k2 is active
+	rotated := mustKeyring(t, "k2", map[string]string{"k2": string(k2)})
+	// k2 was added and made active, k1 is still accepted
+	rotating := mustKeyring(t, "k2", map[string]string{"k1": string(k1), "k2": string(k2)})
+	signed := mustKeyring(t, "k1", map[string]string{"k1": string(k1)})
+	signedToken, err := signed.Sign("ana", 1)
+	if err != nil {
+		t.Fatalf("error signing token: %s", err.Error())
+	}
+
+	for _, test := range []struct {
+		name    string
+		keyring *Keyring
+		token   string
+		valid   bool
+	}{
+		{"signed with active key", signed, signedToken, true},
+		{"signed with previous key during rotation", rotating, signedToken, true},
+		{"signed with rotated-out key", rotated, signedToken, false},
+		{"expired", signed, signToken(t, jwt.SigningMethodHS256, k1, "k1", time.Now().Add(-time.Minute)), false},
+		{"unknown kid", rotating, signToken(t, jwt.SigningMethodHS256, k1, "k3", valid), false},
+		{"missing kid", rotating, signToken(t, jwt.SigningMethodHS256, k1, "", valid), false},
+		{"secret of another kid", rotating, signToken(t, jwt.SigningMethodHS256, k1, "k2", valid), false},
+		{"alg none", signed, signToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "k1", valid), false},
+		{"alg RS256", signed, signToken(t, jwt.SigningMethodRS256, rsaKey, "k1", valid), false},
+		{"alg HS512 with the same secret", signed, signToken(t, jwt.SigningMethodHS512, k1, "k1", valid), false},
+		{"tampered claims", signed, tamperUserID(t, signedToken, 2), false},
+		{"malformed", signed, "not-a-token", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := test.keyring.Verify(test.token)
+			if !test.valid {
+				if err == nil {
+					t.Errorf("got claims %+v, want an invalid token", claims)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error verifying valid token: %s", err.Error())
+			}
+			if claims.Username != "ana" || claims.UserID != 1 {
+				t.Errorf("got user %s (%d), want ana (1)", claims.Username, claims.UserID)
+			}
+		})
+	}
+}
+
+func TestNewKeyring(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		activeKid string
+		secrets   map[string]string
+	}{
+		{"no secrets", "k1", nil},
+		{"empty secret", "k1", map[string]string{"k1": ""}},
+		{"active kid without secret", "k2", map[string]string{"k1": "secret-1"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewKeyring(test.activeKid, test.secrets)
+			if err == nil {
+				t.Errorf("got keyring, want an error")
+			}
+		})
+	}
+}
+
+func TestLoadSecrets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwt-secrets.toml")
+	err := os.WriteFile(path, []byte("k1 = \"file-1\"\nk2 = \"file-2\"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(JWT_SECRETS_ENV, "k2=env-2, k3=env-3")
+	secrets, err := LoadSecrets(map[string]string{"k0": "config-0", "k1": "config-1"}, path)
+	if err != nil {
+		t.Fatalf("error loading secrets: %s", err.Error())
+	}
+	// the file takes precedence over the config, and the environment over both
+	expected := map[string]string{"k0": "config-0", "k1": "file-1", "k2": "env-2", "k3": "env-3"}
+	if len(secrets) != len(expected) {
+		t.Errorf("got secrets %v, want %v", secrets, expected)
+	}
+	for kid, secret := range expected {
+		if secrets[kid] != secret {
+			t.Errorf("got secret %q for %s, want %q", secrets[kid], kid, secret)
+		}
+	}
+
+	t.Setenv(JWT_SECRETS_ENV, "k1")
+	_, err = LoadSecrets(nil, "")
+	if err == nil {
+		t.Errorf("got secrets from an invalid environment variable, want an error")
+	}
+}
@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// secrets can be kept out of the (checked in) weaver configs, either in a toml file of kid = "secret" pairs
+// or in this environment variable as comma-separated kid=secret pairs, which take precedence over both
+const JWT_SECRETS_ENV string = "SN_JWT_SECRETS"
+
+// LoadSecrets merges the secrets of the config with the ones of the secrets file (if set) and of the environment
+func LoadSecrets(secrets map[string]string, path string) (map[string]string, error) {
+	merged := make(map[string]string, len(secrets))
+	for kid, secret := range secrets {
+		merged[kid] = secret
+	}
+	if path != "" {
+		var fileSecrets map[string]string
+		_, err := toml.DecodeFile(path, &fileSecrets)
+		if err != nil {
+			return nil, fmt.Errorf("error reading jwt secrets file %s: %s", path, err.Error())
+		}
+		for kid, secret := range fileSecrets {
+			merged[kid] = secret
+		}
+	}
+	if env := os.Getenv(JWT_SECRETS_ENV); env != "" {
+		for _, pair := range strings.Split(env, ",") {
+			kid, secret, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || kid == "" {
+				return nil, fmt.Errorf("invalid jwt secret in %s, must be kid=secret", JWT_SECRETS_ENV)
+			}
+			merged[kid] = secret
+		}
+	}
+	return merged, nil
+}
@@ -0,0 +1,162 @@
+package graph
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+const CELEBRITY_MAX_ATTEMPTS_PER_EDGE int64 = 100
+
+// edgeSet deduplicates edges and discards self-loops
+// in undirected graphs, (a, b) and (b, a) are the same edge
+type edgeSet struct {
+	seen     map[[2]int64]struct{}
+	edges    [][2]int64
+	directed bool
+}
+
+func newEdgeSet(capacity int, directed bool) *edgeSet {
+	return &edgeSet{
+		seen:     make(map[[2]int64]struct{}, capacity),
+		edges:    make([][2]int64, 0, capacity),
+		directed: directed,
+	}
+}
+
+func (s *edgeSet) key(a int64, b int64) [2]int64 {
+	if !s.directed && a > b {
+		return [2]int64{b, a}
+	}
+	return [2]int64{a, b}
+}
+
+func (s *edgeSet) has(a int64, b int64) bool {
+	_, ok := s.seen[s.key(a, b)]
+	return ok
+}
+
+// add returns false if the edge is a self-loop or already exists
+func (s *edgeSet) add(a int64, b int64) bool {
+	if a == b || s.has(a, b) {
+		return false
+	}
+	s.seen[s.key(a, b)] = struct{}{}
+	s.edges = append(s.edges, [2]int64{a, b})
+	return true
+}
+
+func (s *edgeSet) remove(a int64, b int64) {
+	delete(s.seen, s.key(a, b))
+}
+
+// BarabasiAlbert generates an undirected scale-free graph by preferential attachment
+// it starts from a clique of m+1 nodes and every new node links to m existing nodes
+// with a probability proportional to their degree
+func BarabasiAlbert(nodes int64, m int, seed int64) (*Graph, error) {
+	if m < 1 || int64(m) >= nodes {
+		return nil, fmt.Errorf("barabasi-albert requires 1 <= m < nodes")
+	}
+	rnd := rand.New(rand.NewSource(seed))
+	set := newEdgeSet(int(nodes)*m, false)
+	// every node appears once per incident edge so that uniform picks are degree-proportional
+	targets := make([]int64, 0, 2*int(nodes)*m)
+	for a := int64(1); a <= int64(m)+1; a++ {
+		for b := a + 1; b <= int64(m)+1; b++ {
+			set.add(a, b)
+			targets = append(targets, a, b)
+		}
+	}
+	for node := int64(m) + 2; node <= nodes; node++ {
+		linked := 0
+		for linked < m {
+			target := targets[rnd.Intn(len(targets))]
+			if set.add(node, target) {
+				targets = append(targets, target)
+				linked++
+			}
+		}
+		for i := 0; i < m; i++ {
+			targets = append(targets, node)
+		}
+	}
+	return &Graph{Nodes: nodes, Edges: set.edges}, nil
+}
+
+// WattsStrogatz generates an undirected small-world graph
+// it starts from a ring lattice where every node links to its k nearest neighbours
+// and rewires each edge to a random node with probability beta
+func WattsStrogatz(nodes int64, k int, beta float64, seed int64) (*Graph, error) {
+	if k < 2 || k%2 != 0 || int64(k) >= nodes {
+		return nil, fmt.Errorf("watts-strogatz requires an even k with 2 <= k < nodes")
+	}
+	if beta < 0 || beta > 1 {
+		return nil, fmt.Errorf("watts-strogatz requires 0 <= beta <= 1")
+	}
+	rnd := rand.New(rand.NewSource(seed))
+	set := newEdgeSet(int(nodes)*k/2, false)
+	for node := int64(1); node <= nodes; node++ {
+		for j := int64(1); j <= int64(k/2); j++ {
+			set.add(node, (node+j-1)%nodes+1)
+		}
+	}
+	for i, edge := range set.edges {
+		if rnd.Float64() >= beta {
+			continue
+		}
+		// give up rewiring nodes that are already linked to (almost) every other node
+		for attempt := 0; attempt < k; attempt++ {
+			target := rnd.Int63n(nodes) + 1
+			if target == edge[0] || set.has(edge[0], target) {
+				continue
+			}
+			set.remove(edge[0], edge[1])
+			set.seen[set.key(edge[0], target)] = struct{}{}
+			set.edges[i] = [2]int64{edge[0], target}
+			break
+		}
+	}
+	return &Graph{Nodes: nodes, Edges: set.edges}, nil
+}
+
+// Celebrity generates a directed graph whose follower counts follow a power law with the given exponent
+// every user follows a few others on average, but a small number of "celebrities" are followed by
+// a large fraction of the users, which stresses the fan-out of their posts
+func Celebrity(nodes int64, avgDegree float64, exponent float64, seed int64) (*Graph, error) {
+	if nodes < 2 {
+		return nil, fmt.Errorf("celebrity graph requires at least 2 nodes")
+	}
+	if exponent <= 1 {
+		return nil, fmt.Errorf("celebrity graph requires a power-law exponent > 1")
+	}
+	numEdges := int64(avgDegree * float64(nodes))
+	if avgDegree <= 0 || numEdges > nodes*(nodes-1)/2 {
+		return nil, fmt.Errorf("celebrity graph requires 0 < average degree < (nodes - 1) / 2")
+	}
+	rnd := rand.New(rand.NewSource(seed))
+
+	// the popularity of the node with rank r is proportional to r^(-1/(exponent-1)),
+	// which results in a power-law distribution of in-degrees (i.e. followers)
+	// nodes are shuffled so that celebrities are not always the first user ids
+	ranks := rnd.Perm(int(nodes))
+	cumulative := make([]float64, nodes)
+	total := 0.0
+	for i := int64(0); i < nodes; i++ {
+		total += math.Pow(float64(ranks[i]+1), -1/(exponent-1))
+		cumulative[i] = total
+	}
+
+	set := newEdgeSet(int(numEdges), true)
+	// with very skewed distributions, the top celebrities are soon followed by everyone else
+	// and most samples become duplicates, so we bound the number of attempts
+	for attempts := int64(0); int64(len(set.edges)) < numEdges; attempts++ {
+		if attempts > CELEBRITY_MAX_ATTEMPTS_PER_EDGE*numEdges {
+			return nil, fmt.Errorf("celebrity graph is too skewed to sample %d edges, try a higher exponent or lower average degree", numEdges)
+		}
+		follower := rnd.Int63n(nodes) + 1
+		followee := int64(sort.SearchFloat64s(cumulative, rnd.Float64()*total)) + 1
+		set.add(follower, min(followee, nodes))
+	}
+	return &Graph{Nodes: nodes, Edges: set.edges, Directed: true}, nil
+}
@@ -0,0 +1,100 @@
+package graph
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const MTX_BANNER = "%%MatrixMarket"
+
+// Graph is a social graph whose nodes are the user ids from 1 to Nodes
+// in directed graphs, the first node of each edge follows the second one,
+// otherwise both nodes follow each other
+type Graph struct {
+	Nodes    int64
+	Edges    [][2]int64
+	Directed bool
+}
+
+// ReadMTX parses a graph in the Matrix Market coordinate format (e.g. socfb-Reed98.mtx)
+// lines starting with '%' are comments and the first remaining line is the "rows cols entries" header
+// the graph is undirected unless the banner declares a general (i.e. non-symmetric) matrix
+func ReadMTX(path string) (*Graph, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	graph := &Graph{}
+	header := false
+	lineno := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, MTX_BANNER) {
+			graph.Directed = strings.Contains(line, "general")
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "%") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid mtx line %d: %q", lineno, line)
+		}
+		a, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mtx line %d: %s", lineno, err.Error())
+		}
+		b, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mtx line %d: %s", lineno, err.Error())
+		}
+		if !header {
+			header = true
+			graph.Nodes = max(a, b)
+			if len(fields) >= 3 {
+				entries, err := strconv.Atoi(fields[2])
+				if err == nil {
+					graph.Edges = make([][2]int64, 0, entries)
+				}
+			}
+			continue
+		}
+		if a < 1 || b < 1 || a > graph.Nodes || b > graph.Nodes {
+			return nil, fmt.Errorf("invalid mtx line %d: node out of range [1, %d]", lineno, graph.Nodes)
+		}
+		graph.Edges = append(graph.Edges, [2]int64{a, b})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !header {
+		return nil, fmt.Errorf("missing mtx header in %s", path)
+	}
+	return graph, nil
+}
+
+// WriteMTX writes the graph in the Matrix Market coordinate format with an optional comment line
+func WriteMTX(w io.Writer, graph *Graph, comment string) error {
+	symmetry := "symmetric"
+	if graph.Directed {
+		symmetry = "general"
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s matrix coordinate pattern %s\n", MTX_BANNER, symmetry)
+	if comment != "" {
+		fmt.Fprintf(bw, "%% %s\n", comment)
+	}
+	fmt.Fprintf(bw, "%d %d %d\n", graph.Nodes, graph.Nodes, len(graph.Edges))
+	for _, edge := range graph.Edges {
+		fmt.Fprintf(bw, "%d %d\n", edge[0], edge[1])
+	}
+	return bw.Flush()
+}
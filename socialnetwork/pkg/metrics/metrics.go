@@ -6,6 +6,24 @@ type RegionLabel struct {
     Region string
 }
 
+type ReplicationLabel struct {
+    SourceRegion string
+    Region       string
+}
+
+type RabbitMQPoolLabel struct {
+    Addr string
+}
+
+type FaultLabel struct {
+    Addr  string
+    Fault string
+}
+
+type FaultTargetLabel struct {
+    Addr string
+}
+
 var (
 	// wrk2 api
 	ComposePostDuration = metrics.NewHistogramMap[RegionLabel](
@@ -24,6 +42,34 @@ var (
 		"Duration of queue in milliseconds in the current region",
 		metrics.NonNegativeBuckets,
 	)
+	RelayedNotifications = metrics.NewCounterMap[RegionLabel](
+		"sn_relayed_notifications",
+		"The number of outbox entries published by the post storage outbox relay in the current region",
+	)
+	FailedOutboxPublishes = metrics.NewCounterMap[RegionLabel](
+		"sn_failed_outbox_publishes",
+		"The number of outbox entries that the post storage outbox relay failed to publish in the current region",
+	)
+	FailedOutboxReleases = metrics.NewCounterMap[RegionLabel](
+		"sn_failed_outbox_releases",
+		"The number of claims of unpublished outbox entries that could not be released, which stay leased until the lease expires, in the current region",
+	)
+	PostCacheHits = metrics.NewCounterMap[RegionLabel](
+		"sn_post_cache_hits",
+		"The number of posts read from memcached by the post storage service in the current region",
+	)
+	PostCacheMisses = metrics.NewCounterMap[RegionLabel](
+		"sn_post_cache_misses",
+		"The number of posts not found in memcached by the post storage service in the current region",
+	)
+	FailedPostCacheWrites = metrics.NewCounterMap[RegionLabel](
+		"sn_failed_post_cache_writes",
+		"The number of posts that the post storage service failed to write through to memcached in the current region",
+	)
+	MissingPosts = metrics.NewCounterMap[RegionLabel](
+		"sn_missing_posts",
+		"The number of requested posts not found in the post storage of the current region",
+	)
 	// write home timeline service
 	QueueDurationMs = metrics.NewHistogramMap[RegionLabel](
 		"sn_queue_duration_ms",
@@ -34,8 +80,106 @@ var (
 		"sn_received_notifications",
 		"The number of received notifications in the current region",
 	)
+	DuplicateNotifications = metrics.NewCounterMap[RegionLabel](
+		"sn_duplicate_notifications",
+		"The number of discarded notifications that were already processed in the current region",
+	)
+	RetriedNotifications = metrics.NewCounterMap[RegionLabel](
+		"sn_retried_notifications",
+		"The number of notifications scheduled for delayed redelivery in the current region",
+	)
+	DeadLetteredNotifications = metrics.NewCounterMap[RegionLabel](
+		"sn_dead_lettered_notifications",
+		"The number of notifications moved to the dead-letter queue after exhausting all attempts in the current region",
+	)
 	Inconsistencies = metrics.NewCounterMap[RegionLabel](
 		"sn_inconsistencies",
 		"The number of times an cross-service inconsistency has occured in the current region",
 	)
+	BarrierWaitDurationMs = metrics.NewHistogramMap[RegionLabel](
+		"sn_barrier_wait_duration_ms",
+		"Duration of the wait for the post-storage replica to catch up with the post version in milliseconds in the current region",
+		metrics.NonNegativeBuckets,
+	)
+	BarrierTimeouts = metrics.NewCounterMap[RegionLabel](
+		"sn_barrier_timeouts",
+		"The number of times the consistency barrier deadline expired before the post became visible in the current region",
+	)
+	PostVisibilityLagMs = metrics.NewHistogramMap[ReplicationLabel](
+		"sn_post_visibility_lag_ms",
+		"Time from the write of a post in its source region until it is readable in the post-storage replica of the current region in milliseconds",
+		metrics.NonNegativeBuckets,
+	)
+	VisibilityProbeTimeouts = metrics.NewCounterMap[ReplicationLabel](
+		"sn_visibility_probe_timeouts",
+		"The number of posts of the source region still not readable in the post-storage replica of the current region when the visibility probe gave up",
+	)
+	PushedTimelineWrites = metrics.NewCounterMap[RegionLabel](
+		"sn_pushed_timeline_writes",
+		"The number of posts written to home timelines (one per follower or mentioned user) in the current region",
+	)
+	PullFanouts = metrics.NewCounterMap[RegionLabel](
+		"sn_pull_fanouts",
+		"The number of posts not pushed to the followers of their author because it is above the fan-out threshold in the current region",
+	)
+	FanoutSize = metrics.NewHistogramMap[RegionLabel](
+		"sn_fanout_size",
+		"The number of home timelines written per notification in the current region",
+		metrics.NonNegativeBuckets,
+	)
+	FanoutDurationMs = metrics.NewHistogramMap[RegionLabel](
+		"sn_fanout_duration_ms",
+		"Duration of the fan-out of a post to home timelines in milliseconds in the current region",
+		metrics.NonNegativeBuckets,
+	)
+	FailedFanoutChunks = metrics.NewCounterMap[RegionLabel](
+		"sn_failed_fanout_chunks",
+		"The number of failed writes of a chunk of home timelines (including retried ones) in the current region",
+	)
+	BackfilledTimelinePosts = metrics.NewCounterMap[RegionLabel](
+		"sn_backfilled_timeline_posts",
+		"The number of posts of followees merged into home timelines on follow in the current region",
+	)
+	SupersededGraphEvents = metrics.NewCounterMap[RegionLabel](
+		"sn_superseded_graph_events",
+		"The number of follow and unfollow events discarded for being undone by a later event in the current region",
+	)
+	RemovedTimelinePosts = metrics.NewCounterMap[RegionLabel](
+		"sn_removed_timeline_posts",
+		"The number of posts of unfollowed users removed from home timelines in the current region",
+	)
+	// home and user timeline services
+	CompactedTimelinePosts = metrics.NewCounterMap[RegionLabel](
+		"sn_compacted_timeline_posts",
+		"The number of posts trimmed from cached timelines by the background compaction in the current region",
+	)
+	// home timeline service
+	PulledTimelinePosts = metrics.NewCounterMap[RegionLabel](
+		"sn_pulled_timeline_posts",
+		"The number of posts of high-degree followees merged into home timelines at read time in the current region",
+	)
+	// rabbitmq client pool
+	RabbitMQPoolSize = metrics.NewGaugeMap[RabbitMQPoolLabel](
+		"sn_rabbitmq_pool_size",
+		"The number of open channels (idle and in use) of the rabbitmq client pool",
+	)
+	RabbitMQPoolWaitDurationMs = metrics.NewHistogramMap[RabbitMQPoolLabel](
+		"sn_rabbitmq_pool_wait_duration_ms",
+		"Duration of the wait to pop a channel from the rabbitmq client pool in milliseconds",
+		metrics.NonNegativeBuckets,
+	)
+	RabbitMQReconnections = metrics.NewCounterMap[RabbitMQPoolLabel](
+		"sn_rabbitmq_reconnections",
+		"The number of times the rabbitmq client pool reconnected after losing the connection",
+	)
+	// datastore fault injection
+	InjectedFaults = metrics.NewCounterMap[FaultLabel](
+		"sn_injected_faults",
+		"The number of requests and connections to a datastore failed (error) or held by a partition (partition) by the fault injection",
+	)
+	InjectedLatencyMs = metrics.NewHistogramMap[FaultTargetLabel](
+		"sn_injected_latency_ms",
+		"Latency added to the requests sent to a datastore by the fault injection in milliseconds",
+		metrics.NonNegativeBuckets,
+	)
 )
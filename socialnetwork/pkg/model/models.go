@@ -6,17 +6,50 @@ import (
 	sn_trace "socialnetwork/pkg/trace"
 )
 
+// types of the messages consumed by the write home timeline service
+const (
+	MESSAGE_TYPE_POST     = "post"
+	MESSAGE_TYPE_FOLLOW   = "follow"
+	MESSAGE_TYPE_UNFOLLOW = "unfollow"
+	MESSAGE_TYPE_EDIT     = "edit"
+	MESSAGE_TYPE_DELETE   = "delete"
+)
+
 type Message struct {
 	weaver.AutoMarshal
+	// new post (default), edit or deletion of a post, or change of the social graph
+	Type           string      			 `json:"type"`
 	ReqID          int64       			 `json:"req_id"`
 	UserID         int64       			 `json:"user_id"`
 	PostID         int64       			 `json:"post_id"`
 	Timestamp      int64       			 `json:"timestamp"`
 	UserMentionIDs []int64     			 `json:"user_mention_ids"`
+	// followed or unfollowed user of follow and unfollow events (UserID is the follower)
+	FolloweeID     int64       			 `json:"followee_id"`
+	// consistency barrier
+	PostVersion    VersionToken 		 `json:"post_version"`
+	// outbox entry id used by consumers to discard duplicates
+	NotificationID string 				 `json:"notification_id"`
 	// tracing
 	SpanContext    	sn_trace.SpanContext `json:"span_context"`
 	// evaluation metrics
 	NotificationSendTs 	int64 `json:"notification_write"`
+	// region and time (ms) of the post-storage write of the post, to measure its visibility lag in other regions
+	SourceRegion 		string `json:"source_region"`
+	PostWriteTs 		int64 `json:"post_write_ts"`
+}
+
+// VersionToken identifies the point in the post-storage replication log
+// at which a post was written (i.e. the mongodb operation time)
+type VersionToken struct {
+	weaver.AutoMarshal
+	T uint32 `json:"t"`
+	I uint32 `json:"i"`
+}
+
+// IsZero returns true if the token was not set by the writer
+func (v VersionToken) IsZero() bool {
+	return v.T == 0 && v.I == 0
 }
 
 type Creator struct {
@@ -47,6 +80,23 @@ type User struct {
 	Salt      string `bson:"salt"`
 }
 
+// UserRegistration is a user registered in bulk by the social graph loader
+type UserRegistration struct {
+	weaver.AutoMarshal
+	UserID    int64  `json:"user_id"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+}
+
+// FollowEdge is a follow relationship from the user to the followee
+type FollowEdge struct {
+	weaver.AutoMarshal
+	UserID     int64 `json:"user_id"`
+	FolloweeID int64 `json:"followee_id"`
+}
+
 type UserMention struct {
 	weaver.AutoMarshal
 	UserID   int64  `bson:"user_id"`
@@ -75,14 +125,70 @@ type Post struct {
 	URLs         []URL         `bson:"urls"`
 	Timestamp    int64         `bson:"timestamp"`
 	PostType     PostType      `bson:"posttype"`
+	// replied post (replies) or original post (reposts)
+	ParentPostID int64 `bson:"parent_post_id"`
+	// first post of the conversation (replies)
+	RootPostID int64 `bson:"root_post_id"`
+	// previous versions of the text, oldest first, and time of the last edit (0 if never edited)
+	EditHistory []PostEdit `bson:"edit_history"`
+	EditedAt    int64      `bson:"edited_at"`
+	// deleted posts are kept as tombstones without content, e.g. so that threads keep their replies
+	Deleted   bool  `bson:"deleted"`
+	DeletedAt int64 `bson:"deleted_at"`
 }
 
-type TimelinePostInfo struct {
-	PostID    int64 `bson:"post_id"`
+// PostEdit is a previous version of the text of a post
+type PostEdit struct {
+	weaver.AutoMarshal
+	Text string `bson:"text"`
+	// time the version was written
 	Timestamp int64 `bson:"timestamp"`
 }
 
+type TimelinePostInfo struct {
+	weaver.AutoMarshal `bson:"-"`
+	PostID             int64 `bson:"post_id"`
+	Timestamp          int64 `bson:"timestamp"`
+}
+
 type Timeline struct {
 	UserID int64              `bson:"user_id"`
 	Posts  []TimelinePostInfo `bson:"posts"`
 }
+
+// TimelineQuery selects a page of a timeline, whose posts are sorted from newest to oldest
+// start and stop are offsets within the posts that match the cursors and the time range
+type TimelineQuery struct {
+	weaver.AutoMarshal
+	Start int64 `json:"start"`
+	Stop  int64 `json:"stop"`
+	// only posts older than max_id and newer than since_id (0 if unset)
+	MaxID   int64 `json:"max_id"`
+	SinceID int64 `json:"since_id"`
+	// only posts with since <= timestamp <= until, in unix milliseconds (0 if unset)
+	Since int64 `json:"since"`
+	Until int64 `json:"until"`
+	// timestamps of max_id and since_id, looked up in the timeline if unset (0)
+	// they are set by services that merge several timelines, whose cursors may belong to any of them
+	MaxIDTimestamp   int64 `json:"max_id_timestamp"`
+	SinceIDTimestamp int64 `json:"since_id_timestamp"`
+}
+
+type TimelinePage struct {
+	weaver.AutoMarshal
+	Posts []Post `json:"posts"`
+	// original posts of the reposts in the page (posts cannot hold them since recursive types are not serializable)
+	RepostedPosts []Post `json:"reposted_posts"`
+	// max_id that selects the next (older) page, or 0 if this is the last page
+	NextMaxID int64 `json:"next_max_id"`
+}
+
+// Conversation is the inbox of the direct messages between its participants
+type Conversation struct {
+	weaver.AutoMarshal
+	// participant ids in ascending order joined by "-", so that the same participants share the conversation
+	ConversationID string  `bson:"conversation_id" json:"conversation_id"`
+	ParticipantIDs []int64 `bson:"participant_ids" json:"participant_ids"`
+	// timestamp of the newest message
+	LastTimestamp int64 `bson:"last_timestamp" json:"last_timestamp"`
+}
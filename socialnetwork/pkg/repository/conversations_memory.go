@@ -0,0 +1,115 @@
+package repository
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"socialnetwork/pkg/model"
+)
+
+type memoryConversation struct {
+	conversation model.Conversation
+	// sorted like the timelines
+	messages []model.TimelinePostInfo
+}
+
+type memoryConversations struct {
+	mu            sync.Mutex
+	conversations map[string]*memoryConversation
+}
+
+type memoryConversationRepository struct {
+	store *memoryConversations
+}
+
+func newMemoryConversationRepository(opts Options) *memoryConversationRepository {
+	store := memoryDatastore(opts.MongoDBAddr, opts.MongoDBPort, "direct-messages", func() *memoryConversations {
+		return &memoryConversations{conversations: make(map[string]*memoryConversation)}
+	})
+	return &memoryConversationRepository{store: store}
+}
+
+func (r *memoryConversationRepository) EnsureIndexes(ctx context.Context) error {
+	return nil
+}
+
+func (r *memoryConversationRepository) AddMessage(ctx context.Context, participantIDs []int64, message DirectMessage) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	c, ok := r.store.conversations[message.ConversationID]
+	if !ok {
+		c = &memoryConversation{conversation: model.Conversation{
+			ConversationID: message.ConversationID,
+			ParticipantIDs: append([]int64{}, participantIDs...),
+		}}
+		r.store.conversations[message.ConversationID] = c
+	}
+	c.conversation.LastTimestamp = max(c.conversation.LastTimestamp, message.Timestamp)
+	for _, other := range c.messages {
+		if other.PostID == message.PostID {
+			return nil
+		}
+	}
+	c.messages = append(c.messages, model.TimelinePostInfo{PostID: message.PostID, Timestamp: message.Timestamp})
+	sort.SliceStable(c.messages, func(i, j int) bool {
+		return OlderThan(c.messages[j], c.messages[i])
+	})
+	return nil
+}
+
+func (r *memoryConversationRepository) FindConversation(ctx context.Context, conversationID string, userID int64) (model.Conversation, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	c, ok := r.store.conversations[conversationID]
+	if !ok || !containsID(c.conversation.ParticipantIDs, userID) {
+		return model.Conversation{}, ErrNotFound
+	}
+	conversation := c.conversation
+	conversation.ParticipantIDs = append([]int64{}, conversation.ParticipantIDs...)
+	return conversation, nil
+}
+
+func (r *memoryConversationRepository) ReadMessages(ctx context.Context, conversationID string, query model.TimelineQuery) ([]model.TimelinePostInfo, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	c, ok := r.store.conversations[conversationID]
+	if !ok {
+		return nil, nil
+	}
+	found, err := ResolveCursors(&query, func(postID int64) (int64, bool, error) {
+		for _, message := range c.messages {
+			if message.PostID == postID {
+				return message.Timestamp, true, nil
+			}
+		}
+		return 0, false, nil
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+	return pageTimelinePosts(c.messages, query), nil
+}
+
+func (r *memoryConversationRepository) ListConversations(ctx context.Context, userID int64, start int64, stop int64) ([]model.Conversation, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	conversations := []model.Conversation{}
+	for _, c := range r.store.conversations {
+		if containsID(c.conversation.ParticipantIDs, userID) {
+			conversation := c.conversation
+			conversation.ParticipantIDs = append([]int64{}, conversation.ParticipantIDs...)
+			conversations = append(conversations, conversation)
+		}
+	}
+	sort.Slice(conversations, func(i, j int) bool {
+		if conversations[i].LastTimestamp != conversations[j].LastTimestamp {
+			return conversations[i].LastTimestamp > conversations[j].LastTimestamp
+		}
+		return conversations[i].ConversationID < conversations[j].ConversationID
+	})
+	if start >= int64(len(conversations)) {
+		return []model.Conversation{}, nil
+	}
+	return conversations[start:min(stop, int64(len(conversations)))], nil
+}
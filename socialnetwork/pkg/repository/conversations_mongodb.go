@@ -0,0 +1,140 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"socialnetwork/pkg/model"
+	"socialnetwork/pkg/storage"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// every conversation has a document in the conversations collection and each of its messages
+// a document in the messages collection of the "direct-messages" database
+type mongoDBConversationRepository struct {
+	client *mongo.Client
+}
+
+func newMongoDBConversationRepository(ctx context.Context, opts Options) (*mongoDBConversationRepository, error) {
+	client, err := storage.MongoDBClient(ctx, opts.MongoDBAddr, opts.MongoDBPort)
+	if err != nil {
+		return nil, err
+	}
+	return &mongoDBConversationRepository{client: client}, nil
+}
+
+func (r *mongoDBConversationRepository) EnsureIndexes(ctx context.Context) error {
+	primary, err := storage.IsMongoDBPrimary(ctx, r.client)
+	if err != nil || !primary {
+		return err
+	}
+	_, err = r.conversations().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "conversation_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "participant_ids", Value: 1}, {Key: "last_timestamp", Value: -1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating conversations indexes: %s", err.Error())
+	}
+	// the unique post makes redelivered messages no-ops
+	_, err = r.messages().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "conversation_id", Value: 1}, {Key: "post_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "conversation_id", Value: 1}, {Key: "timestamp", Value: -1}, {Key: "post_id", Value: -1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating messages indexes: %s", err.Error())
+	}
+	return nil
+}
+
+func (r *mongoDBConversationRepository) conversations() *mongo.Collection {
+	return r.client.Database("direct-messages").Collection("conversations")
+}
+
+func (r *mongoDBConversationRepository) messages() *mongo.Collection {
+	return r.client.Database("direct-messages").Collection("messages")
+}
+
+func (r *mongoDBConversationRepository) AddMessage(ctx context.Context, participantIDs []int64, message DirectMessage) error {
+	_, err := r.messages().InsertOne(ctx, message)
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("error writing direct message: %s", err.Error())
+	}
+	update := bson.D{
+		{Key: "$setOnInsert", Value: bson.D{{Key: "participant_ids", Value: participantIDs}}},
+		{Key: "$max", Value: bson.D{{Key: "last_timestamp", Value: message.Timestamp}}},
+	}
+	_, err = r.conversations().UpdateOne(ctx, bson.D{{Key: "conversation_id", Value: message.ConversationID}}, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("error updating conversation: %s", err.Error())
+	}
+	return nil
+}
+
+func (r *mongoDBConversationRepository) FindConversation(ctx context.Context, conversationID string, userID int64) (model.Conversation, error) {
+	filter := bson.D{{Key: "conversation_id", Value: conversationID}, {Key: "participant_ids", Value: userID}}
+	var conversation model.Conversation
+	err := r.conversations().FindOne(ctx, filter).Decode(&conversation)
+	if err == mongo.ErrNoDocuments {
+		return model.Conversation{}, ErrNotFound
+	}
+	if err != nil {
+		return model.Conversation{}, err
+	}
+	return conversation, nil
+}
+
+func (r *mongoDBConversationRepository) ReadMessages(ctx context.Context, conversationID string, query model.TimelineQuery) ([]model.TimelinePostInfo, error) {
+	found, err := ResolveCursors(&query, func(postID int64) (int64, bool, error) {
+		var message DirectMessage
+		err := r.messages().FindOne(ctx, bson.D{{Key: "conversation_id", Value: conversationID}, {Key: "post_id", Value: postID}}).Decode(&message)
+		if err == mongo.ErrNoDocuments {
+			return 0, false, nil
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		return message.Timestamp, true, nil
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+
+	filter := bson.D{{Key: "conversation_id", Value: conversationID}}
+	if queryFilter := timelineQueryFilter(query); len(queryFilter) > 0 {
+		filter = bson.D{{Key: "$and", Value: bson.A{filter, queryFilter}}}
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "post_id", Value: -1}}).
+		SetSkip(query.Start).
+		SetLimit(query.Stop - query.Start + 1)
+	cur, err := r.messages().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var posts []model.TimelinePostInfo
+	err = cur.All(ctx, &posts)
+	if err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+func (r *mongoDBConversationRepository) ListConversations(ctx context.Context, userID int64, start int64, stop int64) ([]model.Conversation, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "last_timestamp", Value: -1}, {Key: "conversation_id", Value: 1}}).
+		SetSkip(start).
+		SetLimit(stop - start)
+	cur, err := r.conversations().Find(ctx, bson.D{{Key: "participant_ids", Value: userID}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	conversations := []model.Conversation{}
+	err = cur.All(ctx, &conversations)
+	if err != nil {
+		return nil, err
+	}
+	return conversations, nil
+}
@@ -0,0 +1,67 @@
+package repository
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type memoryDraft struct {
+	fields        map[string][]byte
+	numComponents int64
+	expiresAt     time.Time
+}
+
+type memoryDrafts struct {
+	mu     sync.Mutex
+	drafts map[int64]*memoryDraft
+}
+
+type memoryDraftRepository struct {
+	store *memoryDrafts
+}
+
+func newMemoryDraftRepository(opts Options) *memoryDraftRepository {
+	store := memoryDatastore(opts.CacheAddr, opts.CachePort, "drafts", func() *memoryDrafts {
+		return &memoryDrafts{drafts: make(map[int64]*memoryDraft)}
+	})
+	return &memoryDraftRepository{store: store}
+}
+
+// draft returns the draft of the request unless it expired
+func (s *memoryDrafts) draft(reqID int64) (*memoryDraft, bool) {
+	draft, ok := s.drafts[reqID]
+	if ok && !time.Now().Before(draft.expiresAt) {
+		delete(s.drafts, reqID)
+		return nil, false
+	}
+	return draft, ok
+}
+
+func (r *memoryDraftRepository) SaveComponent(ctx context.Context, reqID int64, fields map[string][]byte, ttl time.Duration) (int64, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	draft, ok := r.store.draft(reqID)
+	if !ok {
+		draft = &memoryDraft{fields: make(map[string][]byte)}
+		r.store.drafts[reqID] = draft
+	}
+	for field, value := range fields {
+		draft.fields[field] = append([]byte{}, value...)
+	}
+	draft.numComponents++
+	draft.expiresAt = time.Now().Add(ttl)
+	return draft.numComponents, nil
+}
+
+func (r *memoryDraftRepository) LoadFields(ctx context.Context, reqID int64) (map[string][]byte, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	fields := make(map[string][]byte)
+	if draft, ok := r.store.draft(reqID); ok {
+		for field, value := range draft.fields {
+			fields[field] = append([]byte{}, value...)
+		}
+	}
+	return fields, nil
+}
@@ -0,0 +1,57 @@
+package repository
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"socialnetwork/pkg/storage"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// every draft is a hash keyed by the request id, with a field per component field and the number of components
+type redisDraftRepository struct {
+	client *redis.Client
+}
+
+func newRedisDraftRepository(opts Options) (*redisDraftRepository, error) {
+	client, err := storage.RedisClient(opts.CacheAddr, opts.CachePort)
+	if err != nil {
+		return nil, err
+	}
+	return &redisDraftRepository{client: client}, nil
+}
+
+func (r *redisDraftRepository) SaveComponent(ctx context.Context, reqID int64, fields map[string][]byte, ttl time.Duration) (int64, error) {
+	key := strconv.FormatInt(reqID, 10)
+	var numComponents *redis.IntCmd
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		values := make([]interface{}, 0, 2*len(fields))
+		for field, value := range fields {
+			values = append(values, field, value)
+		}
+		pipe.HSet(ctx, key, values...)
+		numComponents = pipe.HIncrBy(ctx, key, "num_components", 1)
+		pipe.Expire(ctx, key, ttl)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return numComponents.Val(), nil
+}
+
+func (r *redisDraftRepository) LoadFields(ctx context.Context, reqID int64) (map[string][]byte, error) {
+	values, err := r.client.HGetAll(ctx, strconv.FormatInt(reqID, 10)).Result()
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string][]byte, len(values))
+	for field, value := range values {
+		if field != "num_components" {
+			fields[field] = []byte(value)
+		}
+	}
+	return fields, nil
+}
@@ -0,0 +1,237 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"socialnetwork/pkg/model"
+)
+
+// in-memory datastores are shared by the repositories of the components running in the same process
+// (e.g. weaver single deployments and tests), which find them by the address of the datastore they replace
+// and the name of the database, so that components configured with the same database share its data
+var memoryDatastores = struct {
+	mu     sync.Mutex
+	stores map[string]any
+	// replicas of the primary addresses (host:port) set with ReplicateMemoryDatastores
+	replicas map[string][]MemoryReplica
+	// primary address of every replica address
+	primaries map[string]string
+}{
+	stores:    make(map[string]any),
+	replicas:  make(map[string][]MemoryReplica),
+	primaries: make(map[string]string),
+}
+
+// MemoryReplica is the address of an in-memory replica and the lag of the writes it receives from its primary
+type MemoryReplica struct {
+	Addr string
+	Port int
+	Lag  time.Duration
+}
+
+func memoryAddress(addr string, port int) string {
+	return fmt.Sprintf("%s:%d", addr, port)
+}
+
+// ReplicateMemoryDatastores makes the in-memory datastores at the replica addresses read-only replicas of the ones
+// at the primary address, like the mongodb replicas of other regions
+// only the post, user, social graph and url databases are replicated, while the others are kept by every address
+// it must be called before the repositories of these addresses are created
+func ReplicateMemoryDatastores(primaryAddr string, primaryPort int, replicas []MemoryReplica) error {
+	memoryDatastores.mu.Lock()
+	defer memoryDatastores.mu.Unlock()
+	primary := memoryAddress(primaryAddr, primaryPort)
+	addresses := []string{primary}
+	for _, replica := range replicas {
+		addresses = append(addresses, memoryAddress(replica.Addr, replica.Port))
+	}
+	for i, address := range addresses {
+		if _, ok := memoryDatastores.primaries[address]; ok || len(memoryDatastores.replicas[address]) > 0 {
+			return fmt.Errorf("in-memory datastores at %s are already replicated", address)
+		}
+		for key := range memoryDatastores.stores {
+			if strings.HasPrefix(key, address+"/") {
+				return fmt.Errorf("in-memory datastores at %s already exist", address)
+			}
+		}
+		if i > 0 {
+			memoryDatastores.primaries[address] = primary
+		}
+	}
+	memoryDatastores.replicas[primary] = append([]MemoryReplica(nil), replicas...)
+	return nil
+}
+
+func memoryDatastore[T any](addr string, port int, name string, create func() *T) *T {
+	address := memoryAddress(addr, port)
+	key := fmt.Sprintf("%s/%s", address, name)
+	memoryDatastores.mu.Lock()
+	defer memoryDatastores.mu.Unlock()
+	store, ok := memoryDatastores.stores[key]
+	if ok {
+		return store.(*T)
+	}
+	primary, ok := memoryDatastores.primaries[address]
+	if !ok {
+		primary = address
+	}
+	replicas := memoryDatastores.replicas[primary]
+	created := create()
+	primaryStore, ok := any(created).(memoryReplicated)
+	if !ok || len(replicas) == 0 {
+		memoryDatastores.stores[key] = created
+		return created
+	}
+	// the primary and its replicas are created together, so that none of them misses any write
+	if address != primary {
+		primaryStore = any(create()).(memoryReplicated)
+	}
+	memoryDatastores.stores[fmt.Sprintf("%s/%s", primary, name)] = primaryStore
+	for _, replica := range replicas {
+		replicaAddress := memoryAddress(replica.Addr, replica.Port)
+		replicaStore := any(created).(memoryReplicated)
+		if replicaAddress != address {
+			replicaStore = any(create()).(memoryReplicated)
+		}
+		memoryDatastores.stores[fmt.Sprintf("%s/%s", replicaAddress, name)] = replicaStore
+		replicate(primaryStore.datastore(), replicaStore, replica.Lag)
+	}
+	return created
+}
+
+// memoryReplicated is implemented by the in-memory datastores that can be replicated
+type memoryReplicated interface {
+	datastore() *memoryStore
+}
+
+// memoryStore is embedded in the in-memory datastores that can be replicated
+// the writes of a primary are applied to its replicas in the same order, after the replication lag
+type memoryStore struct {
+	mu       sync.Mutex
+	replica  bool
+	replicas []*memoryReplica
+	// closed after every write, to wake up the readers waiting for it
+	written chan struct{}
+}
+
+func (s *memoryStore) datastore() *memoryStore {
+	return s
+}
+
+// notifyWrite wakes up the readers waiting for a write, must be called with the lock held
+func (s *memoryStore) notifyWrite() {
+	if s.written != nil {
+		close(s.written)
+		s.written = nil
+	}
+}
+
+// waitFor blocks until the condition (checked with the lock held) is met, or fails if the context is done first
+// the lock is held when it returns without an error
+func (s *memoryStore) waitFor(ctx context.Context, condition func() bool) error {
+	s.mu.Lock()
+	for !condition() {
+		if s.written == nil {
+			s.written = make(chan struct{})
+		}
+		written := s.written
+		s.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-written:
+		}
+		s.mu.Lock()
+	}
+	return nil
+}
+
+// memoryReplica applies the writes of the primary to a replica in order, once their lag has elapsed
+type memoryReplica struct {
+	replica memoryReplicated
+	lag     time.Duration
+	mu      sync.Mutex
+	pending []memoryReplicatedWrite
+	wake    chan struct{}
+}
+
+type memoryReplicatedWrite struct {
+	applyAt time.Time
+	apply   func(replica memoryReplicated)
+}
+
+func replicate(primary *memoryStore, replica memoryReplicated, lag time.Duration) {
+	replica.datastore().replica = true
+	r := &memoryReplica{replica: replica, lag: lag, wake: make(chan struct{}, 1)}
+	primary.replicas = append(primary.replicas, r)
+	// replicas live as long as the process, like the datastores
+	go r.run()
+}
+
+func (r *memoryReplica) push(apply func(replica memoryReplicated)) {
+	r.mu.Lock()
+	r.pending = append(r.pending, memoryReplicatedWrite{applyAt: time.Now().Add(r.lag), apply: apply})
+	r.mu.Unlock()
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *memoryReplica) run() {
+	for {
+		r.mu.Lock()
+		if len(r.pending) == 0 {
+			r.mu.Unlock()
+			<-r.wake
+			continue
+		}
+		write := r.pending[0]
+		r.pending = r.pending[1:]
+		r.mu.Unlock()
+		time.Sleep(time.Until(write.applyAt))
+		store := r.replica.datastore()
+		store.mu.Lock()
+		write.apply(r.replica)
+		store.notifyWrite()
+		store.mu.Unlock()
+	}
+}
+
+// memoryWrite applies the write to the datastore with its lock held, and then to its replicas
+// writes to replicas fail with ErrReadOnlyReplica, like writes to mongodb secondaries
+// the write must only depend on the datastore, since replicas apply it again later
+func memoryWrite[S memoryReplicated, R any](store S, write func(s S) R) (R, error) {
+	s := store.datastore()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.replica {
+		var zero R
+		return zero, ErrReadOnlyReplica
+	}
+	result := write(store)
+	replicateWrite(store, func(s S) { write(s) })
+	return result, nil
+}
+
+// replicateWrite sends a write already applied to the datastore to its replicas, must be called with the lock held
+func replicateWrite[S memoryReplicated](store S, write func(s S)) {
+	s := store.datastore()
+	s.notifyWrite()
+	for _, replica := range s.replicas {
+		replica.push(func(replica memoryReplicated) { write(replica.(S)) })
+	}
+}
+
+// clonePost copies the slices of the post, so that callers cannot modify the stored copy
+func clonePost(post model.Post) model.Post {
+	post.UserMentions = append([]model.UserMention(nil), post.UserMentions...)
+	post.Media = append([]model.Media(nil), post.Media...)
+	post.URLs = append([]model.URL(nil), post.URLs...)
+	post.EditHistory = append([]model.PostEdit(nil), post.EditHistory...)
+	return post
+}
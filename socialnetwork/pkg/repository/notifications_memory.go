@@ -0,0 +1,46 @@
+package repository
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type memoryNotifications struct {
+	mu sync.Mutex
+	// expiration of every processed notification, zero if it does not expire
+	processed map[string]time.Time
+}
+
+type memoryNotificationRepository struct {
+	store *memoryNotifications
+}
+
+func newMemoryNotificationRepository(opts Options) *memoryNotificationRepository {
+	store := memoryDatastore(opts.CacheAddr, opts.CachePort, "notifications", func() *memoryNotifications {
+		return &memoryNotifications{processed: make(map[string]time.Time)}
+	})
+	return &memoryNotificationRepository{store: store}
+}
+
+func (r *memoryNotificationRepository) IsProcessed(ctx context.Context, notificationID string) (bool, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	expiresAt, ok := r.store.processed[notificationID]
+	if ok && !expiresAt.IsZero() && !time.Now().Before(expiresAt) {
+		delete(r.store.processed, notificationID)
+		return false, nil
+	}
+	return ok, nil
+}
+
+func (r *memoryNotificationRepository) MarkProcessed(ctx context.Context, notificationID string, ttl time.Duration) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+	r.store.processed[notificationID] = expiresAt
+	return nil
+}
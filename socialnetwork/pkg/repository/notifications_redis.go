@@ -0,0 +1,35 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"socialnetwork/pkg/storage"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// every processed notification is a "notification:<notification id>" key that expires after its ttl
+type redisNotificationRepository struct {
+	client *redis.Client
+}
+
+func newRedisNotificationRepository(opts Options) (*redisNotificationRepository, error) {
+	client, err := storage.RedisClient(opts.CacheAddr, opts.CachePort)
+	if err != nil {
+		return nil, err
+	}
+	return &redisNotificationRepository{client: client}, nil
+}
+
+func (r *redisNotificationRepository) IsProcessed(ctx context.Context, notificationID string) (bool, error) {
+	processed, err := r.client.Exists(ctx, "notification:"+notificationID).Result()
+	if err != nil {
+		return false, err
+	}
+	return processed > 0, nil
+}
+
+func (r *redisNotificationRepository) MarkProcessed(ctx context.Context, notificationID string, ttl time.Duration) error {
+	return r.client.Set(ctx, "notification:"+notificationID, 1, ttl).Err()
+}
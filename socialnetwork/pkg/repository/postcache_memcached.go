@@ -0,0 +1,67 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"socialnetwork/pkg/model"
+	"socialnetwork/pkg/storage"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// memCachedPostCache caches the posts as json by their post id
+type memCachedPostCache struct {
+	client *memcache.Client
+}
+
+func newMemCachedPostCache(opts Options) (*memCachedPostCache, error) {
+	client, err := storage.MemCachedClient(opts.CacheAddr, opts.CachePort)
+	if err != nil {
+		return nil, err
+	}
+	return &memCachedPostCache{client: client}, nil
+}
+
+func (c *memCachedPostCache) GetPosts(ctx context.Context, postIDs []int64) (map[int64]model.Post, error) {
+	keys := make([]string, 0, len(postIDs))
+	for _, postID := range postIDs {
+		keys = append(keys, strconv.FormatInt(postID, 10))
+	}
+	items, err := c.client.GetMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+	posts := make(map[int64]model.Post, len(items))
+	for _, item := range items {
+		var post model.Post
+		err := json.Unmarshal(item.Value, &post)
+		if err != nil {
+			return nil, err
+		}
+		posts[post.PostID] = post
+	}
+	return posts, nil
+}
+
+func (c *memCachedPostCache) SetPost(ctx context.Context, post model.Post, ttl time.Duration) error {
+	postJSON, err := json.Marshal(post)
+	if err != nil {
+		return err
+	}
+	return c.client.Set(&memcache.Item{
+		Key:        strconv.FormatInt(post.PostID, 10),
+		Value:      postJSON,
+		Expiration: int32(ttl.Seconds()),
+	})
+}
+
+func (c *memCachedPostCache) DeletePost(ctx context.Context, postID int64) error {
+	err := c.client.Delete(strconv.FormatInt(postID, 10))
+	if err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
+	return nil
+}
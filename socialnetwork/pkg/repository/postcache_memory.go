@@ -0,0 +1,68 @@
+package repository
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"socialnetwork/pkg/model"
+)
+
+type memoryCachedPost struct {
+	post model.Post
+	// zero if the post does not expire
+	expiresAt time.Time
+}
+
+type memoryPostCacheStore struct {
+	mu    sync.Mutex
+	posts map[int64]memoryCachedPost
+}
+
+type memoryPostCache struct {
+	store *memoryPostCacheStore
+}
+
+func newMemoryPostCache(opts Options) *memoryPostCache {
+	store := memoryDatastore(opts.CacheAddr, opts.CachePort, "post-cache", func() *memoryPostCacheStore {
+		return &memoryPostCacheStore{posts: make(map[int64]memoryCachedPost)}
+	})
+	return &memoryPostCache{store: store}
+}
+
+func (c *memoryPostCache) GetPosts(ctx context.Context, postIDs []int64) (map[int64]model.Post, error) {
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	now := time.Now()
+	posts := make(map[int64]model.Post, len(postIDs))
+	for _, postID := range postIDs {
+		cached, ok := c.store.posts[postID]
+		if !ok {
+			continue
+		}
+		if !cached.expiresAt.IsZero() && !now.Before(cached.expiresAt) {
+			delete(c.store.posts, postID)
+			continue
+		}
+		posts[postID] = clonePost(cached.post)
+	}
+	return posts, nil
+}
+
+func (c *memoryPostCache) SetPost(ctx context.Context, post model.Post, ttl time.Duration) error {
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	cached := memoryCachedPost{post: clonePost(post)}
+	if ttl > 0 {
+		cached.expiresAt = time.Now().Add(ttl)
+	}
+	c.store.posts[post.PostID] = cached
+	return nil
+}
+
+func (c *memoryPostCache) DeletePost(ctx context.Context, postID int64) error {
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	delete(c.store.posts, postID)
+	return nil
+}
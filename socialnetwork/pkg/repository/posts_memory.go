@@ -0,0 +1,250 @@
+package repository
+
+import (
+	"context"
+	"sort"
+	"strconv"
+
+	"socialnetwork/pkg/model"
+)
+
+// memoryPosts is the in-memory post-storage database
+// transactions hold the lock until they commit, so they are serializable
+type memoryPosts struct {
+	memoryStore
+	posts map[int64]model.Post
+	// the outbox is not replicated, since only the primary relays its entries
+	outbox []*OutboxEntry
+	// number of committed transactions, used as the version of their writes
+	version uint32
+}
+
+type memoryPostRepository struct {
+	store *memoryPosts
+}
+
+// memoryPostTransaction buffers the writes of the transaction until it commits
+type memoryPostTransaction struct {
+	store  *memoryPosts
+	posts  map[int64]model.Post
+	outbox []OutboxEntry
+}
+
+func newMemoryPostRepository(opts Options) *memoryPostRepository {
+	store := memoryDatastore(opts.MongoDBAddr, opts.MongoDBPort, "post-storage", func() *memoryPosts {
+		return &memoryPosts{posts: make(map[int64]model.Post)}
+	})
+	return &memoryPostRepository{store: store}
+}
+
+func (r *memoryPostRepository) IsPrimary(ctx context.Context) (bool, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	return !r.store.replica, nil
+}
+
+func (r *memoryPostRepository) EnsureIndexes(ctx context.Context) error {
+	return nil
+}
+
+func (r *memoryPostRepository) Transaction(ctx context.Context, fn func(ctx context.Context, tx PostTransaction) error) (model.VersionToken, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	if r.store.replica {
+		return model.VersionToken{}, ErrReadOnlyReplica
+	}
+	tx := &memoryPostTransaction{store: r.store, posts: make(map[int64]model.Post)}
+	err := fn(ctx, tx)
+	if err != nil {
+		return model.VersionToken{}, err
+	}
+	if len(tx.posts) == 0 && len(tx.outbox) == 0 {
+		return model.VersionToken{}, nil
+	}
+	posts := tx.posts
+	commit := func(s *memoryPosts) {
+		for postID, post := range posts {
+			s.posts[postID] = clonePost(post)
+		}
+		s.version++
+	}
+	commit(r.store)
+	replicateWrite(r.store, commit)
+	for i := range tx.outbox {
+		entry := tx.outbox[i]
+		entry.ID = strconv.Itoa(len(r.store.outbox) + 1)
+		r.store.outbox = append(r.store.outbox, &entry)
+	}
+	return model.VersionToken{I: r.store.version}, nil
+}
+
+func (tx *memoryPostTransaction) FindPost(ctx context.Context, postID int64) (model.Post, error) {
+	post, ok := tx.posts[postID]
+	if !ok {
+		post, ok = tx.store.posts[postID]
+	}
+	if !ok {
+		return model.Post{}, ErrNotFound
+	}
+	return clonePost(post), nil
+}
+
+func (tx *memoryPostTransaction) InsertPost(ctx context.Context, post model.Post) error {
+	tx.posts[post.PostID] = clonePost(post)
+	return nil
+}
+
+func (tx *memoryPostTransaction) ReplacePost(ctx context.Context, post model.Post) error {
+	if _, err := tx.FindPost(ctx, post.PostID); err != nil {
+		// like a mongodb replacement, which does not insert missing posts
+		return nil
+	}
+	tx.posts[post.PostID] = clonePost(post)
+	return nil
+}
+
+func (tx *memoryPostTransaction) InsertOutboxEntries(ctx context.Context, entries []OutboxEntry) error {
+	tx.outbox = append(tx.outbox, entries...)
+	return nil
+}
+
+// FindPost waits until the datastore has applied the transaction of the version, which is only needed by
+// replicas, like the reads of mongodb replicas with afterClusterTime
+func (r *memoryPostRepository) FindPost(ctx context.Context, postID int64, version model.VersionToken) (model.Post, error) {
+	err := r.store.waitFor(ctx, func() bool { return r.store.version >= version.I })
+	if err != nil {
+		return model.Post{}, err
+	}
+	defer r.store.mu.Unlock()
+	post, ok := r.store.posts[postID]
+	if !ok {
+		return model.Post{}, ErrNotFound
+	}
+	return clonePost(post), nil
+}
+
+func (r *memoryPostRepository) FindPosts(ctx context.Context, postIDs []int64) ([]model.Post, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	posts := []model.Post{}
+	seen := make(map[int64]bool, len(postIDs))
+	for _, postID := range postIDs {
+		if post, ok := r.store.posts[postID]; ok && !seen[postID] {
+			posts = append(posts, clonePost(post))
+		}
+		seen[postID] = true
+	}
+	return posts, nil
+}
+
+func (r *memoryPostRepository) FindThread(ctx context.Context, rootPostID int64) ([]model.Post, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	posts := []model.Post{}
+	for _, post := range r.store.posts {
+		if post.PostID == rootPostID || post.RootPostID == rootPostID {
+			posts = append(posts, clonePost(post))
+		}
+	}
+	sort.Slice(posts, func(i, j int) bool {
+		if posts[i].Timestamp != posts[j].Timestamp {
+			return posts[i].Timestamp < posts[j].Timestamp
+		}
+		return posts[i].PostID < posts[j].PostID
+	})
+	return posts, nil
+}
+
+func mentions(post model.Post, userID int64) bool {
+	for _, mention := range post.UserMentions {
+		if mention.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *memoryPostRepository) FindCreatorPostIDs(ctx context.Context, postIDs []int64, creatorID int64, notMentionedUserID int64) ([]int64, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	ids := []int64{}
+	seen := make(map[int64]bool, len(postIDs))
+	for _, postID := range postIDs {
+		post, ok := r.store.posts[postID]
+		if ok && !seen[postID] && post.Creator.UserID == creatorID && !mentions(post, notMentionedUserID) {
+			ids = append(ids, postID)
+		}
+		seen[postID] = true
+	}
+	return ids, nil
+}
+
+func (r *memoryPostRepository) FindTimelinePosts(ctx context.Context, creatorIDs []int64, mentionedUserID int64, limit int64) ([]model.TimelinePostInfo, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	creators := make(map[int64]bool, len(creatorIDs))
+	for _, creatorID := range creatorIDs {
+		creators[creatorID] = true
+	}
+	posts := []model.TimelinePostInfo{}
+	for _, post := range r.store.posts {
+		if post.PostType == model.POST_TYPE_DM || post.Deleted {
+			continue
+		}
+		if creators[post.Creator.UserID] || mentions(post, mentionedUserID) {
+			posts = append(posts, model.TimelinePostInfo{PostID: post.PostID, Timestamp: post.Timestamp})
+		}
+	}
+	sort.Slice(posts, func(i, j int) bool {
+		if posts[i].Timestamp != posts[j].Timestamp {
+			return posts[i].Timestamp > posts[j].Timestamp
+		}
+		return posts[i].PostID > posts[j].PostID
+	})
+	if limit > 0 && int64(len(posts)) > limit {
+		posts = posts[:limit]
+	}
+	return posts, nil
+}
+
+func (r *memoryPostRepository) ClaimOutboxEntry(ctx context.Context, now int64, claimedUntil int64) (OutboxEntry, model.VersionToken, bool, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	// entries are appended in creation order
+	for _, entry := range r.store.outbox {
+		if entry.Status == OUTBOX_STATUS_PENDING || (entry.Status == OUTBOX_STATUS_CLAIMED && entry.ClaimedUntil < now) {
+			entry.Status = OUTBOX_STATUS_CLAIMED
+			entry.ClaimedUntil = claimedUntil
+			return *entry, model.VersionToken{I: r.store.version}, true, nil
+		}
+	}
+	return OutboxEntry{}, model.VersionToken{}, false, nil
+}
+
+func (r *memoryPostRepository) MarkOutboxEntrySent(ctx context.Context, entryID string, sentAt int64) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	if entry := r.store.outboxEntry(entryID); entry != nil {
+		entry.Status = OUTBOX_STATUS_SENT
+		entry.SentAt = sentAt
+	}
+	return nil
+}
+
+func (r *memoryPostRepository) ReleaseOutboxEntry(ctx context.Context, entryID string) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	if entry := r.store.outboxEntry(entryID); entry != nil {
+		entry.Status = OUTBOX_STATUS_PENDING
+	}
+	return nil
+}
+
+// outboxEntry returns the entry with the id, which is its position in the outbox starting at 1
+func (s *memoryPosts) outboxEntry(entryID string) *OutboxEntry {
+	i, err := strconv.Atoi(entryID)
+	if err != nil || i < 1 || i > len(s.outbox) {
+		return nil
+	}
+	return s.outbox[i-1]
+}
@@ -0,0 +1,302 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"socialnetwork/pkg/model"
+	"socialnetwork/pkg/storage"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoOutboxEntry is the document of an outbox entry in the post-storage database
+type mongoOutboxEntry struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty"`
+	PostID       int64              `bson:"post_id"`
+	Region       string             `bson:"region"`
+	RoutingKey   string             `bson:"routing_key"`
+	Message      model.Message      `bson:"message"`
+	Status       string             `bson:"status"`
+	ClaimedUntil int64              `bson:"claimed_until"`
+	CreatedAt    int64              `bson:"created_at"`
+	SentAt       int64              `bson:"sent_at"`
+}
+
+type mongoDBPostRepository struct {
+	client *mongo.Client
+}
+
+type mongoDBPostTransaction struct {
+	db *mongo.Database
+}
+
+func newMongoDBPostRepository(ctx context.Context, opts Options) (*mongoDBPostRepository, error) {
+	client, err := storage.MongoDBClient(ctx, opts.MongoDBAddr, opts.MongoDBPort)
+	if err != nil {
+		return nil, err
+	}
+	return &mongoDBPostRepository{client: client}, nil
+}
+
+func (r *mongoDBPostRepository) IsPrimary(ctx context.Context) (bool, error) {
+	return storage.IsMongoDBPrimary(ctx, r.client)
+}
+
+func (r *mongoDBPostRepository) EnsureIndexes(ctx context.Context) error {
+	primary, err := r.IsPrimary(ctx)
+	if err != nil || !primary {
+		return err
+	}
+	_, err = r.outbox().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating outbox index: %s", err.Error())
+	}
+	// replies are read by the root of their conversation
+	_, err = r.posts().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "root_post_id", Value: 1}},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating posts index: %s", err.Error())
+	}
+	return nil
+}
+
+func (r *mongoDBPostRepository) posts() *mongo.Collection {
+	return r.client.Database("post-storage").Collection("posts")
+}
+
+func (r *mongoDBPostRepository) outbox() *mongo.Collection {
+	return r.client.Database("post-storage").Collection("outbox")
+}
+
+// Transaction runs fn in a mongodb transaction of an explicit session, whose operation time is the
+// version token that consumers in other regions can wait for
+func (r *mongoDBPostRepository) Transaction(ctx context.Context, fn func(ctx context.Context, tx PostTransaction) error) (model.VersionToken, error) {
+	var version model.VersionToken
+	session, err := r.client.StartSession()
+	if err != nil {
+		return version, err
+	}
+	defer session.EndSession(ctx)
+
+	tx := &mongoDBPostTransaction{db: r.client.Database("post-storage")}
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sessCtx, tx)
+	})
+	if err != nil {
+		return version, err
+	}
+	if opTime := session.OperationTime(); opTime != nil {
+		version = model.VersionToken{T: opTime.T, I: opTime.I}
+	}
+	return version, nil
+}
+
+func (tx *mongoDBPostTransaction) FindPost(ctx context.Context, postID int64) (model.Post, error) {
+	return findPost(ctx, tx.db.Collection("posts"), postID)
+}
+
+func (tx *mongoDBPostTransaction) InsertPost(ctx context.Context, post model.Post) error {
+	_, err := tx.db.Collection("posts").InsertOne(ctx, post)
+	return err
+}
+
+func (tx *mongoDBPostTransaction) ReplacePost(ctx context.Context, post model.Post) error {
+	_, err := tx.db.Collection("posts").ReplaceOne(ctx, bson.D{{Key: "post_id", Value: post.PostID}}, post)
+	return err
+}
+
+func (tx *mongoDBPostTransaction) InsertOutboxEntries(ctx context.Context, entries []OutboxEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		docs = append(docs, mongoOutboxEntry{
+			PostID:       entry.PostID,
+			Region:       entry.Region,
+			RoutingKey:   entry.RoutingKey,
+			Message:      entry.Message,
+			Status:       entry.Status,
+			ClaimedUntil: entry.ClaimedUntil,
+			CreatedAt:    entry.CreatedAt,
+			SentAt:       entry.SentAt,
+		})
+	}
+	_, err := tx.db.Collection("outbox").InsertMany(ctx, docs)
+	return err
+}
+
+func findPost(ctx context.Context, collection *mongo.Collection, postID int64) (model.Post, error) {
+	var post model.Post
+	err := collection.FindOne(ctx, bson.D{{Key: "post_id", Value: postID}}).Decode(&post)
+	if err == mongo.ErrNoDocuments {
+		return post, ErrNotFound
+	}
+	return post, err
+}
+
+// FindPost reads the post in a causally consistent session if the version is set, whose reads are sent
+// with afterClusterTime set to the version so the replica only replies after applying the oplog up to it
+func (r *mongoDBPostRepository) FindPost(ctx context.Context, postID int64, version model.VersionToken) (model.Post, error) {
+	if version.IsZero() {
+		return findPost(ctx, r.posts(), postID)
+	}
+	session, err := r.client.StartSession(options.Session().SetCausalConsistency(true))
+	if err != nil {
+		return model.Post{}, err
+	}
+	defer session.EndSession(ctx)
+	err = session.AdvanceOperationTime(&primitive.Timestamp{T: version.T, I: version.I})
+	if err != nil {
+		return model.Post{}, err
+	}
+	return findPost(mongo.NewSessionContext(ctx, session), r.posts(), postID)
+}
+
+func (r *mongoDBPostRepository) FindPosts(ctx context.Context, postIDs []int64) ([]model.Post, error) {
+	filter := bson.D{{Key: "post_id", Value: bson.D{{Key: "$in", Value: postIDs}}}}
+	return r.findAll(ctx, filter, nil)
+}
+
+func (r *mongoDBPostRepository) FindThread(ctx context.Context, rootPostID int64) ([]model.Post, error) {
+	filter := bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "post_id", Value: rootPostID}},
+		bson.D{{Key: "root_post_id", Value: rootPostID}},
+	}}}
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "post_id", Value: 1}})
+	return r.findAll(ctx, filter, opts)
+}
+
+func (r *mongoDBPostRepository) findAll(ctx context.Context, filter bson.D, opts *options.FindOptions) ([]model.Post, error) {
+	cur, err := r.posts().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	posts := []model.Post{}
+	err = cur.All(ctx, &posts)
+	if err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+func (r *mongoDBPostRepository) FindCreatorPostIDs(ctx context.Context, postIDs []int64, creatorID int64, notMentionedUserID int64) ([]int64, error) {
+	filter := bson.D{
+		{Key: "post_id", Value: bson.D{{Key: "$in", Value: postIDs}}},
+		{Key: "creator.user_id", Value: creatorID},
+		{Key: "user_mentions.user_id", Value: bson.D{{Key: "$ne", Value: notMentionedUserID}}},
+	}
+	cur, err := r.posts().Find(ctx, filter, options.Find().SetProjection(bson.D{{Key: "post_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var posts []model.TimelinePostInfo
+	err = cur.All(ctx, &posts)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, 0, len(posts))
+	for _, post := range posts {
+		ids = append(ids, post.PostID)
+	}
+	return ids, nil
+}
+
+func (r *mongoDBPostRepository) FindTimelinePosts(ctx context.Context, creatorIDs []int64, mentionedUserID int64, limit int64) ([]model.TimelinePostInfo, error) {
+	ids := bson.A{}
+	for _, creatorID := range creatorIDs {
+		ids = append(ids, creatorID)
+	}
+	filter := bson.D{
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "creator.user_id", Value: bson.D{{Key: "$in", Value: ids}}}},
+			bson.D{{Key: "user_mentions.user_id", Value: mentionedUserID}},
+		}},
+		{Key: "posttype", Value: bson.D{{Key: "$ne", Value: model.POST_TYPE_DM}}},
+		{Key: "deleted", Value: bson.D{{Key: "$ne", Value: true}}},
+	}
+	opts := options.Find().
+		SetProjection(bson.D{{Key: "post_id", Value: 1}, {Key: "timestamp", Value: 1}}).
+		SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "post_id", Value: -1}}).
+		SetLimit(limit)
+	cur, err := r.posts().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	posts := []model.TimelinePostInfo{}
+	err = cur.All(ctx, &posts)
+	if err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+// ClaimOutboxEntry claims the entry in a causally consistent session so that its operation time
+// is at least the commit time of the post and can be used as the post version
+func (r *mongoDBPostRepository) ClaimOutboxEntry(ctx context.Context, now int64, claimedUntil int64) (OutboxEntry, model.VersionToken, bool, error) {
+	var version model.VersionToken
+	session, err := r.client.StartSession(options.Session().SetCausalConsistency(true))
+	if err != nil {
+		return OutboxEntry{}, version, false, err
+	}
+	defer session.EndSession(ctx)
+
+	filter := bson.M{"$or": bson.A{
+		bson.M{"status": OUTBOX_STATUS_PENDING},
+		bson.M{"status": OUTBOX_STATUS_CLAIMED, "claimed_until": bson.M{"$lt": now}},
+	}}
+	update := bson.M{"$set": bson.M{
+		"status":        OUTBOX_STATUS_CLAIMED,
+		"claimed_until": claimedUntil,
+	}}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "created_at", Value: 1}}).
+		SetReturnDocument(options.After)
+	var doc mongoOutboxEntry
+	err = r.outbox().FindOneAndUpdate(mongo.NewSessionContext(ctx, session), filter, update, opts).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return OutboxEntry{}, version, false, nil
+	}
+	if err != nil {
+		return OutboxEntry{}, version, false, err
+	}
+	if opTime := session.OperationTime(); opTime != nil {
+		version = model.VersionToken{T: opTime.T, I: opTime.I}
+	}
+	entry := OutboxEntry{
+		ID:           doc.ID.Hex(),
+		PostID:       doc.PostID,
+		Region:       doc.Region,
+		RoutingKey:   doc.RoutingKey,
+		Message:      doc.Message,
+		Status:       doc.Status,
+		ClaimedUntil: doc.ClaimedUntil,
+		CreatedAt:    doc.CreatedAt,
+		SentAt:       doc.SentAt,
+	}
+	return entry, version, true, nil
+}
+
+func (r *mongoDBPostRepository) MarkOutboxEntrySent(ctx context.Context, entryID string, sentAt int64) error {
+	return r.updateOutboxEntry(ctx, entryID, bson.M{"status": OUTBOX_STATUS_SENT, "sent_at": sentAt})
+}
+
+func (r *mongoDBPostRepository) ReleaseOutboxEntry(ctx context.Context, entryID string) error {
+	return r.updateOutboxEntry(ctx, entryID, bson.M{"status": OUTBOX_STATUS_PENDING})
+}
+
+func (r *mongoDBPostRepository) updateOutboxEntry(ctx context.Context, entryID string, set bson.M) error {
+	id, err := primitive.ObjectIDFromHex(entryID)
+	if err != nil {
+		return err
+	}
+	_, err = r.outbox().UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": set})
+	return err
+}
@@ -0,0 +1,304 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"socialnetwork/pkg/model"
+)
+
+// repositories hide the datastores of the services behind the operations they need, so that every component
+// runs either against mongodb and its cache (redis or memcached) or against in-memory datastores (e.g. in tests)
+
+const (
+	BACKEND_MONGODB = "mongodb"
+	BACKEND_MEMORY  = "memory"
+)
+
+// ErrNotFound is returned when the requested post, user or conversation does not exist
+var ErrNotFound = errors.New("not found")
+
+// ErrReadOnlyReplica is returned when writing to an in-memory replica (see ReplicateMemoryDatastores)
+var ErrReadOnlyReplica = errors.New("cannot write to a replica")
+
+// ErrUsernameTaken is returned when registering a username that is already registered
+var ErrUsernameTaken = errors.New("username already registered")
+
+// ErrUserIDTaken is returned when registering a user with the id of another user
+var ErrUserIDTaken = errors.New("user id already registered")
+
+type Options struct {
+	// Backend is one of "mongodb" (default) or "memory"
+	Backend     string
+	MongoDBAddr string
+	MongoDBPort int
+	// cache in front of mongodb, or the store itself for repositories only kept in a cache
+	// (redis or memcached, depending on the repository)
+	CacheAddr string
+	CachePort int
+}
+
+// PostRepository stores the posts together with the outbox of their notifications
+type PostRepository interface {
+	// Transaction runs fn atomically and returns the version of its writes (zero if nothing was written)
+	Transaction(ctx context.Context, fn func(ctx context.Context, tx PostTransaction) error) (model.VersionToken, error)
+	// FindPost returns the post once the repository has applied the writes up to the version (zero for any version)
+	FindPost(ctx context.Context, postID int64, version model.VersionToken) (model.Post, error)
+	// FindPosts returns the posts that exist, in no particular order
+	FindPosts(ctx context.Context, postIDs []int64) ([]model.Post, error)
+	// FindThread returns the root post and all of its replies, sorted by timestamp and post id
+	FindThread(ctx context.Context, rootPostID int64) ([]model.Post, error)
+	// FindCreatorPostIDs returns the ids of the posts created by the creator that do not mention the user
+	FindCreatorPostIDs(ctx context.Context, postIDs []int64, creatorID int64, notMentionedUserID int64) ([]int64, error)
+	// FindTimelinePosts returns the newest posts (all of them if limit is 0) created by the creators or that mention the user,
+	// except for direct messages and deleted posts
+	FindTimelinePosts(ctx context.Context, creatorIDs []int64, mentionedUserID int64, limit int64) ([]model.TimelinePostInfo, error)
+	// ClaimOutboxEntry claims the oldest pending entry, or claimed entry whose lease expired before now, until claimedUntil
+	// the returned version is at least the version of the write of the entry
+	ClaimOutboxEntry(ctx context.Context, now int64, claimedUntil int64) (OutboxEntry, model.VersionToken, bool, error)
+	MarkOutboxEntrySent(ctx context.Context, entryID string, sentAt int64) error
+	// ReleaseOutboxEntry makes the claimed entry pending again
+	ReleaseOutboxEntry(ctx context.Context, entryID string) error
+	// IsPrimary tells whether the repository accepts writes, which replicas (e.g. of other regions) do not
+	IsPrimary(ctx context.Context) (bool, error)
+	// EnsureIndexes creates the missing indexes on the primary, and does nothing on replicas,
+	// which replicate the indexes of their primary
+	EnsureIndexes(ctx context.Context) error
+}
+
+// PostTransaction is the set of writes of PostRepository.Transaction, which only become visible once it commits
+type PostTransaction interface {
+	FindPost(ctx context.Context, postID int64) (model.Post, error)
+	InsertPost(ctx context.Context, post model.Post) error
+	ReplacePost(ctx context.Context, post model.Post) error
+	InsertOutboxEntries(ctx context.Context, entries []OutboxEntry) error
+}
+
+const (
+	OUTBOX_STATUS_PENDING = "pending"
+	OUTBOX_STATUS_CLAIMED = "claimed"
+	OUTBOX_STATUS_SENT    = "sent"
+)
+
+// OutboxEntry is a home timeline notification for one region
+// written in the same transaction as the post
+type OutboxEntry struct {
+	// set when the entry is inserted
+	ID           string
+	PostID       int64
+	Region       string
+	RoutingKey   string
+	Message      model.Message
+	Status       string
+	ClaimedUntil int64
+	CreatedAt    int64
+	SentAt       int64
+}
+
+// PostCache caches posts in front of the post repository
+type PostCache interface {
+	GetPosts(ctx context.Context, postIDs []int64) (map[int64]model.Post, error)
+	// SetPost caches the post until it expires after ttl (0 for no expiration)
+	SetPost(ctx context.Context, post model.Post, ttl time.Duration) error
+	// DeletePost removes the post from the cache, if cached
+	DeletePost(ctx context.Context, postID int64) error
+}
+
+// UserRepository stores the registered users by their username
+type UserRepository interface {
+	// InsertUser returns ErrUsernameTaken if the username is already registered, or ErrUserIDTaken if the id is
+	InsertUser(ctx context.Context, user model.User) error
+	// InsertUsers inserts the users whose username and id are not registered yet and returns the number of new users
+	InsertUsers(ctx context.Context, users []model.User) (int, error)
+	FindUser(ctx context.Context, username string) (model.User, error)
+	// FindUserIDs returns the ids of the registered usernames
+	FindUserIDs(ctx context.Context, usernames []string) (map[string]int64, error)
+	// EnsureIndexes creates the missing indexes (e.g. of the unique user ids) on the primary, and does nothing on replicas
+	EnsureIndexes(ctx context.Context) error
+}
+
+// SocialGraphRepository stores the followers and followees of the users
+type SocialGraphRepository interface {
+	// InsertUsers adds the users that are not in the graph yet and returns the number of new users
+	InsertUsers(ctx context.Context, userIDs []int64) (int, error)
+	// Follow adds the edges between users of the graph that do not exist yet and returns the number of new edges
+	Follow(ctx context.Context, edges []model.FollowEdge) (int, error)
+	Unfollow(ctx context.Context, userID int64, followeeID int64) error
+	GetFollowers(ctx context.Context, userID int64) ([]int64, error)
+	GetFollowees(ctx context.Context, userID int64) ([]int64, error)
+	CountFollowers(ctx context.Context, userIDs []int64) ([]int64, error)
+	IsFollowing(ctx context.Context, userID int64, followeeID int64) (bool, error)
+	// ListUsers returns the ids of every user in the graph in ascending order
+	ListUsers(ctx context.Context) ([]int64, error)
+}
+
+// TimelineRepository stores the timelines (user or home timelines) of the users, newest posts first
+type TimelineRepository interface {
+	// ReadTimeline returns the posts of the page plus one past its end, to tell whether there are older posts
+	// cursors that are not in the timeline (and not resolved by the caller) result in an empty page
+	ReadTimeline(ctx context.Context, userID int64, query model.TimelineQuery) ([]model.TimelinePostInfo, error)
+	// ReadPostIDs returns the ids of every post of the timeline
+	ReadPostIDs(ctx context.Context, userID int64) ([]int64, error)
+	// PushPost adds the post to the timelines of the users that do not have it yet
+	PushPost(ctx context.Context, userIDs []int64, post model.TimelinePostInfo) error
+	// AddPosts adds older posts (e.g. backfilled ones) that the timeline of the user does not have yet
+	AddPosts(ctx context.Context, userID int64, posts []model.TimelinePostInfo) error
+	RemovePosts(ctx context.Context, userID int64, postIDs []int64) error
+	// RemovePost removes the post from the timelines of the users
+	RemovePost(ctx context.Context, userIDs []int64, postID int64) error
+	ReplaceTimeline(ctx context.Context, userID int64, posts []model.TimelinePostInfo) error
+	// Compact trims every cached timeline to the cache policy and returns the number of removed posts
+	Compact(ctx context.Context) (int64, error)
+	// AddPullUser records that posts of the user were not pushed to the timelines, which must pull them instead
+	// users are never removed, so that their posts keep being pulled after they drop below the fan-out threshold
+	AddPullUser(ctx context.Context, userID int64) error
+	// FilterPullUsers returns the users added with AddPullUser among userIDs, in the same order
+	FilterPullUsers(ctx context.Context, userIDs []int64) ([]int64, error)
+	// EnsureIndexes creates the missing indexes on the primary, and does nothing on replicas
+	EnsureIndexes(ctx context.Context) error
+}
+
+// DirectMessage is the entry of a post in the inbox of its conversation
+type DirectMessage struct {
+	ConversationID string `bson:"conversation_id"`
+	PostID         int64  `bson:"post_id"`
+	SenderID       int64  `bson:"sender_id"`
+	Timestamp      int64  `bson:"timestamp"`
+}
+
+// ConversationRepository stores the conversations and their direct messages
+type ConversationRepository interface {
+	// AddMessage adds the message to its conversation between the participants, which is created if it does not exist
+	// messages that are already in the conversation are skipped
+	AddMessage(ctx context.Context, participantIDs []int64, message DirectMessage) error
+	// FindConversation returns ErrNotFound if the conversation does not exist or the user is not one of its participants
+	FindConversation(ctx context.Context, conversationID string, userID int64) (model.Conversation, error)
+	// ReadMessages returns the messages of the page, newest first, with the same semantics as TimelineRepository.ReadTimeline
+	ReadMessages(ctx context.Context, conversationID string, query model.TimelineQuery) ([]model.TimelinePostInfo, error)
+	// ListConversations returns the conversations of the user in [start, stop), the most recently active first
+	ListConversations(ctx context.Context, userID int64, start int64, stop int64) ([]model.Conversation, error)
+	// EnsureIndexes creates the missing indexes on the primary, and does nothing on replicas
+	EnsureIndexes(ctx context.Context) error
+}
+
+// URLRepository stores the shortened urls
+type URLRepository interface {
+	InsertURLs(ctx context.Context, urls []model.URL) error
+	// FindURLs returns the urls that exist, in no particular order
+	FindURLs(ctx context.Context, shortenedUrls []string) ([]model.URL, error)
+}
+
+// DraftRepository keeps the components of the posts being composed
+type DraftRepository interface {
+	// SaveComponent adds the fields of a component to the draft of the request, which expires after ttl,
+	// and returns the number of components saved so far
+	SaveComponent(ctx context.Context, reqID int64, fields map[string][]byte, ttl time.Duration) (int64, error)
+	// LoadFields returns every field of the draft of the request
+	LoadFields(ctx context.Context, reqID int64) (map[string][]byte, error)
+}
+
+// NotificationRepository remembers the processed notifications to discard their duplicates
+type NotificationRepository interface {
+	IsProcessed(ctx context.Context, notificationID string) (bool, error)
+	// MarkProcessed remembers the notification for ttl
+	MarkProcessed(ctx context.Context, notificationID string, ttl time.Duration) error
+}
+
+func NewPostRepository(ctx context.Context, opts Options) (PostRepository, error) {
+	switch opts.Backend {
+	case BACKEND_MONGODB, "":
+		return newMongoDBPostRepository(ctx, opts)
+	case BACKEND_MEMORY:
+		return newMemoryPostRepository(opts), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend: %s", opts.Backend)
+}
+
+// NewPostCache returns a memcached cache, or an in-memory one for the memory backend
+func NewPostCache(opts Options) (PostCache, error) {
+	switch opts.Backend {
+	case BACKEND_MONGODB, "":
+		return newMemCachedPostCache(opts)
+	case BACKEND_MEMORY:
+		return newMemoryPostCache(opts), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend: %s", opts.Backend)
+}
+
+// NewUserRepository returns a repository stored in mongodb and cached in memcached, or an in-memory one
+func NewUserRepository(ctx context.Context, opts Options) (UserRepository, error) {
+	switch opts.Backend {
+	case BACKEND_MONGODB, "":
+		return newMongoDBUserRepository(ctx, opts)
+	case BACKEND_MEMORY:
+		return newMemoryUserRepository(opts), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend: %s", opts.Backend)
+}
+
+// NewSocialGraphRepository returns a repository stored in mongodb and cached in redis, or an in-memory one
+func NewSocialGraphRepository(ctx context.Context, opts Options) (SocialGraphRepository, error) {
+	switch opts.Backend {
+	case BACKEND_MONGODB, "":
+		return newMongoDBSocialGraphRepository(ctx, opts)
+	case BACKEND_MEMORY:
+		return newMemorySocialGraphRepository(opts), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend: %s", opts.Backend)
+}
+
+// NewTimelineRepository returns the timelines with the given name (e.g. "home-timeline"),
+// stored in mongodb and cached in redis according to the policy, or in memory without a cache
+func NewTimelineRepository(ctx context.Context, opts Options, name string, policy TimelineCachePolicy) (TimelineRepository, error) {
+	switch opts.Backend {
+	case BACKEND_MONGODB, "":
+		return newMongoDBTimelineRepository(ctx, opts, name, policy)
+	case BACKEND_MEMORY:
+		return newMemoryTimelineRepository(opts, name), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend: %s", opts.Backend)
+}
+
+func NewConversationRepository(ctx context.Context, opts Options) (ConversationRepository, error) {
+	switch opts.Backend {
+	case BACKEND_MONGODB, "":
+		return newMongoDBConversationRepository(ctx, opts)
+	case BACKEND_MEMORY:
+		return newMemoryConversationRepository(opts), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend: %s", opts.Backend)
+}
+
+func NewURLRepository(ctx context.Context, opts Options) (URLRepository, error) {
+	switch opts.Backend {
+	case BACKEND_MONGODB, "":
+		return newMongoDBURLRepository(ctx, opts)
+	case BACKEND_MEMORY:
+		return newMemoryURLRepository(opts), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend: %s", opts.Backend)
+}
+
+// NewDraftRepository returns a repository kept in redis, or an in-memory one
+func NewDraftRepository(opts Options) (DraftRepository, error) {
+	switch opts.Backend {
+	case BACKEND_MONGODB, "":
+		return newRedisDraftRepository(opts)
+	case BACKEND_MEMORY:
+		return newMemoryDraftRepository(opts), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend: %s", opts.Backend)
+}
+
+// NewNotificationRepository returns a repository kept in redis, or an in-memory one
+func NewNotificationRepository(opts Options) (NotificationRepository, error) {
+	switch opts.Backend {
+	case BACKEND_MONGODB, "":
+		return newRedisNotificationRepository(opts)
+	case BACKEND_MEMORY:
+		return newMemoryNotificationRepository(opts), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend: %s", opts.Backend)
+}
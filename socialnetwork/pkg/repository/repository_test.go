@@ -0,0 +1,302 @@
+package repository_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"socialnetwork/pkg/model"
+	"socialnetwork/pkg/repository"
+	"socialnetwork/pkg/repository/repositorytest"
+	"socialnetwork/pkg/storage"
+)
+
+// the conformance suite always runs against the in-memory repositories, and against mongodb, redis and memcached
+// if their addresses (host:port) are set in SN_TEST_MONGODB_ADDRESS, SN_TEST_REDIS_ADDRESS and SN_TEST_MEMCACHED_ADDRESS
+// the databases of the repositories are dropped and the caches flushed before every test, so the datastores must not
+// hold any other data, and mongodb must be a replica set (e.g. a single-node one) for the transactions of the posts
+
+const (
+	CACHE_NONE      = ""
+	CACHE_REDIS     = "redis"
+	CACHE_MEMCACHED = "memcached"
+)
+
+// memoryOptions returns options for in-memory datastores that are not shared with other tests
+func memoryOptions(t *testing.T) repository.Options {
+	return repository.Options{Backend: repository.BACKEND_MEMORY, MongoDBAddr: t.Name(), CacheAddr: t.Name()}
+}
+
+func envAddress(t *testing.T, name string) (string, int) {
+	address := os.Getenv(name)
+	if address == "" {
+		t.Skipf("%s is not set", name)
+	}
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		t.Fatalf("invalid %s: %s", name, err.Error())
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		t.Fatalf("invalid port in %s: %s", name, err.Error())
+	}
+	return host, port
+}
+
+// datastoreOptions returns options for mongodb and the cache, which are emptied for the test,
+// or skips the test if they are not configured
+func datastoreOptions(t *testing.T, cache string, databases ...string) repository.Options {
+	ctx := context.Background()
+	var opts repository.Options
+	if len(databases) > 0 {
+		opts.MongoDBAddr, opts.MongoDBPort = envAddress(t, "SN_TEST_MONGODB_ADDRESS")
+		client, err := storage.MongoDBClient(ctx, opts.MongoDBAddr, opts.MongoDBPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Disconnect(ctx)
+		for _, database := range databases {
+			err = client.Database(database).Drop(ctx)
+			if err != nil {
+				t.Fatalf("error dropping database %s: %s", database, err.Error())
+			}
+		}
+	}
+	switch cache {
+	case CACHE_REDIS:
+		opts.CacheAddr, opts.CachePort = envAddress(t, "SN_TEST_REDIS_ADDRESS")
+		client, err := storage.RedisClient(opts.CacheAddr, opts.CachePort)
+		if err != nil {
+			t.Fatalf("error connecting to redis: %s", err.Error())
+		}
+		defer client.Close()
+		err = client.FlushDB(ctx).Err()
+		if err != nil {
+			t.Fatalf("error flushing redis: %s", err.Error())
+		}
+	case CACHE_MEMCACHED:
+		opts.CacheAddr, opts.CachePort = envAddress(t, "SN_TEST_MEMCACHED_ADDRESS")
+		client, err := storage.MemCachedClient(opts.CacheAddr, opts.CachePort)
+		if err != nil {
+			t.Fatalf("error connecting to memcached: %s", err.Error())
+		}
+		err = client.DeleteAll()
+		if err != nil {
+			t.Fatalf("error flushing memcached: %s", err.Error())
+		}
+	}
+	return opts
+}
+
+// must returns a function that fails the test if the repository could not be created, and returns it otherwise
+// e.g. must(repository.NewPostRepository(ctx, opts))(t)
+func must[T any](repo T, err error) func(t *testing.T) T {
+	return func(t *testing.T) T {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("error creating repository: %s", err.Error())
+		}
+		return repo
+	}
+}
+
+func TestPostRepository(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		repositorytest.TestPostRepository(t, func(t *testing.T) repository.PostRepository {
+			return must(repository.NewPostRepository(context.Background(), memoryOptions(t)))(t)
+		})
+	})
+	t.Run("mongodb", func(t *testing.T) {
+		repositorytest.TestPostRepository(t, func(t *testing.T) repository.PostRepository {
+			return must(repository.NewPostRepository(context.Background(), datastoreOptions(t, CACHE_NONE, "post-storage")))(t)
+		})
+	})
+}
+
+func TestPostCache(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		repositorytest.TestPostCache(t, func(t *testing.T) repository.PostCache {
+			return must(repository.NewPostCache(memoryOptions(t)))(t)
+		})
+	})
+	t.Run("memcached", func(t *testing.T) {
+		repositorytest.TestPostCache(t, func(t *testing.T) repository.PostCache {
+			return must(repository.NewPostCache(datastoreOptions(t, CACHE_MEMCACHED)))(t)
+		})
+	})
+}
+
+func TestUserRepository(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		repositorytest.TestUserRepository(t, func(t *testing.T) repository.UserRepository {
+			return must(repository.NewUserRepository(context.Background(), memoryOptions(t)))(t)
+		})
+	})
+	t.Run("mongodb", func(t *testing.T) {
+		repositorytest.TestUserRepository(t, func(t *testing.T) repository.UserRepository {
+			users := must(repository.NewUserRepository(context.Background(), datastoreOptions(t, CACHE_MEMCACHED, "user")))(t)
+			err := users.EnsureIndexes(context.Background())
+			if err != nil {
+				t.Fatalf("error creating indexes: %s", err.Error())
+			}
+			return users
+		})
+	})
+}
+
+func TestSocialGraphRepository(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		repositorytest.TestSocialGraphRepository(t, func(t *testing.T) repository.SocialGraphRepository {
+			return must(repository.NewSocialGraphRepository(context.Background(), memoryOptions(t)))(t)
+		})
+	})
+	t.Run("mongodb", func(t *testing.T) {
+		repositorytest.TestSocialGraphRepository(t, func(t *testing.T) repository.SocialGraphRepository {
+			return must(repository.NewSocialGraphRepository(context.Background(), datastoreOptions(t, CACHE_REDIS, "social-graph")))(t)
+		})
+	})
+}
+
+func TestTimelineRepository(t *testing.T) {
+	// a short max length, so that reads past the cached timelines fall back to mongodb
+	policy := repository.NewTimelineCachePolicy(3, 60)
+	t.Run("memory", func(t *testing.T) {
+		repositorytest.TestTimelineRepository(t, func(t *testing.T) repository.TimelineRepository {
+			return must(repository.NewTimelineRepository(context.Background(), memoryOptions(t), "home-timeline", policy))(t)
+		})
+	})
+	t.Run("mongodb", func(t *testing.T) {
+		repositorytest.TestTimelineRepository(t, func(t *testing.T) repository.TimelineRepository {
+			opts := datastoreOptions(t, CACHE_REDIS, "home-timeline")
+			timelines := must(repository.NewTimelineRepository(context.Background(), opts, "home-timeline", policy))(t)
+			err := timelines.EnsureIndexes(context.Background())
+			if err != nil {
+				t.Fatalf("error creating indexes: %s", err.Error())
+			}
+			return timelines
+		})
+	})
+}
+
+func TestConversationRepository(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		repositorytest.TestConversationRepository(t, func(t *testing.T) repository.ConversationRepository {
+			return must(repository.NewConversationRepository(context.Background(), memoryOptions(t)))(t)
+		})
+	})
+	t.Run("mongodb", func(t *testing.T) {
+		repositorytest.TestConversationRepository(t, func(t *testing.T) repository.ConversationRepository {
+			conversations := must(repository.NewConversationRepository(context.Background(), datastoreOptions(t, CACHE_NONE, "direct-messages")))(t)
+			err := conversations.EnsureIndexes(context.Background())
+			if err != nil {
+				t.Fatalf("error creating indexes: %s", err.Error())
+			}
+			return conversations
+		})
+	})
+}
+
+func TestURLRepository(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		repositorytest.TestURLRepository(t, func(t *testing.T) repository.URLRepository {
+			return must(repository.NewURLRepository(context.Background(), memoryOptions(t)))(t)
+		})
+	})
+	t.Run("mongodb", func(t *testing.T) {
+		repositorytest.TestURLRepository(t, func(t *testing.T) repository.URLRepository {
+			return must(repository.NewURLRepository(context.Background(), datastoreOptions(t, CACHE_NONE, "url-shorten")))(t)
+		})
+	})
+}
+
+func TestDraftRepository(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		repositorytest.TestDraftRepository(t, func(t *testing.T) repository.DraftRepository {
+			return must(repository.NewDraftRepository(memoryOptions(t)))(t)
+		})
+	})
+	t.Run("redis", func(t *testing.T) {
+		repositorytest.TestDraftRepository(t, func(t *testing.T) repository.DraftRepository {
+			return must(repository.NewDraftRepository(datastoreOptions(t, CACHE_REDIS)))(t)
+		})
+	})
+}
+
+func TestNotificationRepository(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		repositorytest.TestNotificationRepository(t, func(t *testing.T) repository.NotificationRepository {
+			return must(repository.NewNotificationRepository(memoryOptions(t)))(t)
+		})
+	})
+	t.Run("redis", func(t *testing.T) {
+		repositorytest.TestNotificationRepository(t, func(t *testing.T) repository.NotificationRepository {
+			return must(repository.NewNotificationRepository(datastoreOptions(t, CACHE_REDIS)))(t)
+		})
+	})
+}
+
+// number of replicated datastores, which tells apart the runs of the same test (e.g. with -count)
+var replications atomic.Int64
+
+func TestMemoryReplication(t *testing.T) {
+	ctx := context.Background()
+	lag := 100 * time.Millisecond
+	name := fmt.Sprintf("%s/%d", t.Name(), replications.Add(1))
+	err := repository.ReplicateMemoryDatastores(name+"/primary", 0, []repository.MemoryReplica{{Addr: name + "/replica", Lag: lag}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	primaryOpts := repository.Options{Backend: repository.BACKEND_MEMORY, MongoDBAddr: name + "/primary", CacheAddr: name + "/primary"}
+	replicaOpts := repository.Options{Backend: repository.BACKEND_MEMORY, MongoDBAddr: name + "/replica", CacheAddr: name + "/replica"}
+	primary := must(repository.NewPostRepository(ctx, primaryOpts))(t)
+	replica := must(repository.NewPostRepository(ctx, replicaOpts))(t)
+
+	post := model.Post{PostID: 1, Text: "replicated"}
+	start := time.Now()
+	version, err := primary.Transaction(ctx, func(ctx context.Context, tx repository.PostTransaction) error {
+		return tx.InsertPost(ctx, post)
+	})
+	if err != nil {
+		t.Fatalf("error storing post: %s", err.Error())
+	}
+	_, err = replica.FindPost(ctx, post.PostID, model.VersionToken{})
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("got error %v reading post from replica before the lag, want ErrNotFound", err)
+	}
+	// reads of the version wait for the replica
+	found, err := replica.FindPost(ctx, post.PostID, version)
+	if err != nil {
+		t.Fatalf("error reading post version from replica: %s", err.Error())
+	}
+	if found.Text != post.Text || time.Since(start) < lag {
+		t.Errorf("got post %+v after %s, want %+v after %s", found, time.Since(start), post, lag)
+	}
+
+	_, err = replica.Transaction(ctx, func(ctx context.Context, tx repository.PostTransaction) error {
+		return tx.InsertPost(ctx, model.Post{PostID: 2})
+	})
+	if !errors.Is(err, repository.ErrReadOnlyReplica) {
+		t.Errorf("got error %v writing to replica, want ErrReadOnlyReplica", err)
+	}
+	for repo, wantPrimary := range map[repository.PostRepository]bool{primary: true, replica: false} {
+		isPrimary, err := repo.IsPrimary(ctx)
+		if err != nil || isPrimary != wantPrimary {
+			t.Errorf("got primary %t and error %v, want %t", isPrimary, err, wantPrimary)
+		}
+	}
+	_, err = must(repository.NewUserRepository(ctx, replicaOpts))(t).InsertUsers(ctx, []model.User{{UserID: 1, Username: "ana"}})
+	if !errors.Is(err, repository.ErrReadOnlyReplica) {
+		t.Errorf("got error %v writing users to replica, want ErrReadOnlyReplica", err)
+	}
+	// datastores that are not replicated (e.g. caches) are writable at every address
+	_, err = must(repository.NewDraftRepository(replicaOpts))(t).SaveComponent(ctx, 1, map[string][]byte{"text": []byte("draft")}, time.Minute)
+	if err != nil {
+		t.Errorf("error writing draft to replica address: %s", err.Error())
+	}
+}
@@ -0,0 +1,64 @@
+package repositorytest
+
+import (
+	"testing"
+	"time"
+
+	"socialnetwork/pkg/repository"
+)
+
+// TestDraftRepository checks the components of the drafts and their expiration
+func TestDraftRepository(t *testing.T, newRepo func(t *testing.T) repository.DraftRepository) {
+	t.Run("SaveAndLoad", func(t *testing.T) {
+		ctx := testContext(t)
+		drafts := newRepo(t)
+		for i, fields := range []map[string][]byte{
+			{"text": []byte("text of the post"), "user_mentions": []byte("[]")},
+			{"unique_id": []byte("100001")},
+			{"text": []byte("saved again")},
+		} {
+			numComponents, err := drafts.SaveComponent(ctx, 1, fields, time.Minute)
+			if err != nil {
+				t.Fatalf("error saving component: %s", err.Error())
+			}
+			if numComponents != int64(i+1) {
+				t.Errorf("got %d saved components, want %d", numComponents, i+1)
+			}
+		}
+		fields, err := drafts.LoadFields(ctx, 1)
+		if err != nil {
+			t.Fatalf("error loading fields: %s", err.Error())
+		}
+		if len(fields) != 3 || string(fields["text"]) != "saved again" || string(fields["user_mentions"]) != "[]" || string(fields["unique_id"]) != "100001" {
+			t.Errorf("got fields %q", fields)
+		}
+		fields, err = drafts.LoadFields(ctx, 2)
+		if err != nil || len(fields) != 0 {
+			t.Errorf("got fields %q and error %v for missing draft", fields, err)
+		}
+	})
+
+	t.Run("Expiration", func(t *testing.T) {
+		ctx := testContext(t)
+		drafts := newRepo(t)
+		_, err := drafts.SaveComponent(ctx, 1, map[string][]byte{"text": []byte("text of the post")}, time.Second)
+		if err != nil {
+			t.Fatalf("error saving component: %s", err.Error())
+		}
+		expired := eventually(t, 5*time.Second, func() bool {
+			fields, err := drafts.LoadFields(ctx, 1)
+			return err == nil && len(fields) == 0
+		})
+		if !expired {
+			t.Fatalf("draft did not expire")
+		}
+		// the components of expired drafts are not counted
+		numComponents, err := drafts.SaveComponent(ctx, 1, map[string][]byte{"text": []byte("text of the post")}, time.Minute)
+		if err != nil {
+			t.Fatalf("error saving component: %s", err.Error())
+		}
+		if numComponents != 1 {
+			t.Errorf("got %d saved components after expiration, want 1", numComponents)
+		}
+	})
+}
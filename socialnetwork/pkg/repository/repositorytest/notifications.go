@@ -0,0 +1,50 @@
+package repositorytest
+
+import (
+	"testing"
+	"time"
+
+	"socialnetwork/pkg/repository"
+)
+
+// TestNotificationRepository checks the processed notifications and their expiration
+func TestNotificationRepository(t *testing.T, newRepo func(t *testing.T) repository.NotificationRepository) {
+	expectProcessed := func(t *testing.T, notifications repository.NotificationRepository, notificationID string, expected bool) {
+		t.Helper()
+		processed, err := notifications.IsProcessed(testContext(t), notificationID)
+		if err != nil {
+			t.Fatalf("error reading processed notification: %s", err.Error())
+		}
+		if processed != expected {
+			t.Errorf("got processed %t for notification %s, want %t", processed, notificationID, expected)
+		}
+	}
+
+	t.Run("MarkProcessed", func(t *testing.T) {
+		ctx := testContext(t)
+		notifications := newRepo(t)
+		expectProcessed(t, notifications, "notification-1", false)
+		err := notifications.MarkProcessed(ctx, "notification-1", time.Minute)
+		if err != nil {
+			t.Fatalf("error marking notification as processed: %s", err.Error())
+		}
+		expectProcessed(t, notifications, "notification-1", true)
+		expectProcessed(t, notifications, "notification-2", false)
+	})
+
+	t.Run("Expiration", func(t *testing.T) {
+		ctx := testContext(t)
+		notifications := newRepo(t)
+		err := notifications.MarkProcessed(ctx, "notification-1", time.Second)
+		if err != nil {
+			t.Fatalf("error marking notification as processed: %s", err.Error())
+		}
+		expired := eventually(t, 5*time.Second, func() bool {
+			processed, err := notifications.IsProcessed(ctx, "notification-1")
+			return err == nil && !processed
+		})
+		if !expired {
+			t.Errorf("processed notification did not expire")
+		}
+	})
+}
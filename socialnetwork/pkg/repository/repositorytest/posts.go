@@ -0,0 +1,361 @@
+package repositorytest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"socialnetwork/pkg/model"
+	"socialnetwork/pkg/repository"
+)
+
+var errAborted = errors.New("aborted")
+
+func newPost(postID int64, creatorID int64, timestamp int64, mentionIDs ...int64) model.Post {
+	post := model.Post{
+		PostID:    postID,
+		Creator:   model.Creator{UserID: creatorID, Username: fmt.Sprintf("username_%d", creatorID)},
+		Text:      "text of the post",
+		Timestamp: timestamp,
+		PostType:  model.POST_TYPE_POST,
+	}
+	for _, mentionID := range mentionIDs {
+		post.UserMentions = append(post.UserMentions, model.UserMention{UserID: mentionID})
+	}
+	return post
+}
+
+func insertPosts(t *testing.T, ctx context.Context, posts repository.PostRepository, inserted ...model.Post) model.VersionToken {
+	t.Helper()
+	version, err := posts.Transaction(ctx, func(ctx context.Context, tx repository.PostTransaction) error {
+		for _, post := range inserted {
+			err := tx.InsertPost(ctx, post)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error inserting posts: %s", err.Error())
+	}
+	return version
+}
+
+// expectPost fails the test if the posts differ, ignoring empty and nil slices
+func expectPost(t *testing.T, got model.Post, want model.Post) {
+	t.Helper()
+	if got.PostID != want.PostID || got.Text != want.Text || got.Creator != want.Creator || got.Timestamp != want.Timestamp ||
+		got.PostType != want.PostType || got.ParentPostID != want.ParentPostID || got.RootPostID != want.RootPostID ||
+		got.EditedAt != want.EditedAt || got.Deleted != want.Deleted || len(got.UserMentions) != len(want.UserMentions) ||
+		len(got.EditHistory) != len(want.EditHistory) {
+		t.Errorf("got post %+v, want %+v", got, want)
+	}
+}
+
+// TestPostRepository checks the posts, their transactions and the outbox of their notifications
+func TestPostRepository(t *testing.T, newRepo func(t *testing.T) repository.PostRepository) {
+	t.Run("InsertAndFind", func(t *testing.T) {
+		ctx := testContext(t)
+		posts := newRepo(t)
+		post := newPost(100001, 1, 1000, 2)
+		version := insertPosts(t, ctx, posts, post)
+		if version.IsZero() {
+			t.Errorf("got zero version for a committed write")
+		}
+		found, err := posts.FindPost(ctx, post.PostID, version)
+		if err != nil {
+			t.Fatalf("error finding post: %s", err.Error())
+		}
+		expectPost(t, found, post)
+		found, err = posts.FindPost(ctx, post.PostID, model.VersionToken{})
+		if err != nil {
+			t.Fatalf("error finding post without version: %s", err.Error())
+		}
+		expectPost(t, found, post)
+		_, err = posts.FindPost(ctx, 199999, model.VersionToken{})
+		if !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("got error %v for missing post, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("AbortedTransaction", func(t *testing.T) {
+		ctx := testContext(t)
+		posts := newRepo(t)
+		_, err := posts.Transaction(ctx, func(ctx context.Context, tx repository.PostTransaction) error {
+			err := tx.InsertPost(ctx, newPost(100001, 1, 1000))
+			if err != nil {
+				return err
+			}
+			return errAborted
+		})
+		if !errors.Is(err, errAborted) {
+			t.Fatalf("got error %v, want the error of the transaction", err)
+		}
+		_, err = posts.FindPost(ctx, 100001, model.VersionToken{})
+		if !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("got error %v for post of aborted transaction, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("ReplacePost", func(t *testing.T) {
+		ctx := testContext(t)
+		posts := newRepo(t)
+		post := newPost(100001, 1, 1000)
+		insertPosts(t, ctx, posts, post)
+		_, err := posts.Transaction(ctx, func(ctx context.Context, tx repository.PostTransaction) error {
+			stored, err := tx.FindPost(ctx, post.PostID)
+			if err != nil {
+				return err
+			}
+			stored.EditHistory = append(stored.EditHistory, model.PostEdit{Text: stored.Text, Timestamp: stored.Timestamp})
+			stored.Text = "edited text"
+			stored.EditedAt = 2000
+			err = tx.ReplacePost(ctx, stored)
+			if err != nil {
+				return err
+			}
+			// missing posts are not inserted
+			return tx.ReplacePost(ctx, newPost(100002, 1, 1000))
+		})
+		if err != nil {
+			t.Fatalf("error replacing post: %s", err.Error())
+		}
+		found, err := posts.FindPost(ctx, post.PostID, model.VersionToken{})
+		if err != nil {
+			t.Fatalf("error finding post: %s", err.Error())
+		}
+		if found.Text != "edited text" || found.EditedAt != 2000 || len(found.EditHistory) != 1 || found.EditHistory[0].Text != post.Text {
+			t.Errorf("got post %+v, want the edited post", found)
+		}
+		_, err = posts.FindPost(ctx, 100002, model.VersionToken{})
+		if !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("got error %v for replaced missing post, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("TransactionReadsItsWrites", func(t *testing.T) {
+		ctx := testContext(t)
+		posts := newRepo(t)
+		_, err := posts.Transaction(ctx, func(ctx context.Context, tx repository.PostTransaction) error {
+			err := tx.InsertPost(ctx, newPost(100001, 1, 1000))
+			if err != nil {
+				return err
+			}
+			_, err = tx.FindPost(ctx, 100001)
+			return err
+		})
+		if err != nil {
+			t.Errorf("error reading post inserted in the same transaction: %s", err.Error())
+		}
+	})
+
+	t.Run("FindPosts", func(t *testing.T) {
+		ctx := testContext(t)
+		posts := newRepo(t)
+		insertPosts(t, ctx, posts, newPost(100001, 1, 1000), newPost(100002, 1, 1001), newPost(100003, 2, 1002))
+		found, err := posts.FindPosts(ctx, []int64{100001, 199999, 100003, 100001})
+		if err != nil {
+			t.Fatalf("error finding posts: %s", err.Error())
+		}
+		ids := make([]int64, 0, len(found))
+		for _, post := range found {
+			ids = append(ids, post.PostID)
+		}
+		if !equalIDs(sortedIDs(ids), []int64{100001, 100003}) {
+			t.Errorf("got posts %v, want [100001 100003]", ids)
+		}
+	})
+
+	t.Run("FindThread", func(t *testing.T) {
+		ctx := testContext(t)
+		posts := newRepo(t)
+		root := newPost(100001, 1, 1000)
+		reply := newPost(100002, 2, 1001)
+		reply.PostType, reply.ParentPostID, reply.RootPostID = model.POST_TYPE_REPLY, root.PostID, root.PostID
+		nested := newPost(100003, 1, 1002)
+		nested.PostType, nested.ParentPostID, nested.RootPostID = model.POST_TYPE_REPLY, reply.PostID, root.PostID
+		insertPosts(t, ctx, posts, nested, newPost(100004, 1, 1003), reply, root)
+		thread, err := posts.FindThread(ctx, root.PostID)
+		if err != nil {
+			t.Fatalf("error finding thread: %s", err.Error())
+		}
+		ids := make([]int64, 0, len(thread))
+		for _, post := range thread {
+			ids = append(ids, post.PostID)
+		}
+		if !equalIDs(ids, []int64{100001, 100002, 100003}) {
+			t.Errorf("got thread %v, want [100001 100002 100003]", ids)
+		}
+	})
+
+	t.Run("FindCreatorPostIDs", func(t *testing.T) {
+		ctx := testContext(t)
+		posts := newRepo(t)
+		insertPosts(t, ctx, posts, newPost(100001, 1, 1000), newPost(100002, 1, 1001, 2), newPost(100003, 3, 1002), newPost(100004, 1, 1003))
+		ids, err := posts.FindCreatorPostIDs(ctx, []int64{100001, 100002, 100003, 199999}, 1, 2)
+		if err != nil {
+			t.Fatalf("error finding posts of creator: %s", err.Error())
+		}
+		if !equalIDs(sortedIDs(ids), []int64{100001}) {
+			t.Errorf("got posts %v, want [100001]", ids)
+		}
+	})
+
+	t.Run("FindTimelinePosts", func(t *testing.T) {
+		ctx := testContext(t)
+		posts := newRepo(t)
+		dm := newPost(100003, 1, 1003, 5)
+		dm.PostType = model.POST_TYPE_DM
+		deleted := newPost(100004, 1, 1004)
+		deleted.Deleted, deleted.DeletedAt = true, 1005
+		insertPosts(t, ctx, posts,
+			newPost(100001, 1, 1000), newPost(100002, 3, 1002, 2), dm, deleted, newPost(100005, 4, 1005), newPost(100006, 1, 1002))
+		timeline, err := posts.FindTimelinePosts(ctx, []int64{1}, 2, 0)
+		if err != nil {
+			t.Fatalf("error finding timeline posts: %s", err.Error())
+		}
+		expectPostIDs(t, "timeline posts", timeline, 100006, 100002, 100001)
+		timeline, err = posts.FindTimelinePosts(ctx, []int64{1}, 2, 2)
+		if err != nil {
+			t.Fatalf("error finding timeline posts: %s", err.Error())
+		}
+		expectPostIDs(t, "limited timeline posts", timeline, 100006, 100002)
+	})
+
+	t.Run("Outbox", func(t *testing.T) {
+		ctx := testContext(t)
+		posts := newRepo(t)
+		post := newPost(100001, 1, 1000)
+		_, err := posts.Transaction(ctx, func(ctx context.Context, tx repository.PostTransaction) error {
+			err := tx.InsertPost(ctx, post)
+			if err != nil {
+				return err
+			}
+			entries := []repository.OutboxEntry{}
+			for i, region := range []string{"eu", "us"} {
+				entries = append(entries, repository.OutboxEntry{
+					PostID:     post.PostID,
+					Region:     region,
+					RoutingKey: "write-home-timeline-" + region,
+					Message:    model.Message{PostID: post.PostID, UserID: 1, Timestamp: post.Timestamp},
+					Status:     repository.OUTBOX_STATUS_PENDING,
+					CreatedAt:  int64(i + 1),
+				})
+			}
+			return tx.InsertOutboxEntries(ctx, entries)
+		})
+		if err != nil {
+			t.Fatalf("error inserting outbox entries: %s", err.Error())
+		}
+
+		claim := func(now int64, claimedUntil int64) (repository.OutboxEntry, bool) {
+			t.Helper()
+			entry, version, found, err := posts.ClaimOutboxEntry(ctx, now, claimedUntil)
+			if err != nil {
+				t.Fatalf("error claiming outbox entry: %s", err.Error())
+			}
+			if found && version.IsZero() {
+				t.Errorf("got zero version for claimed entry %s", entry.Region)
+			}
+			return entry, found
+		}
+		expectClaim := func(now int64, claimedUntil int64, region string) repository.OutboxEntry {
+			t.Helper()
+			entry, found := claim(now, claimedUntil)
+			if !found || entry.Region != region {
+				t.Fatalf("got claimed entry %+v (found %t), want the entry of %s", entry, found, region)
+			}
+			if entry.Status != repository.OUTBOX_STATUS_CLAIMED || entry.ClaimedUntil != claimedUntil || entry.Message.PostID != post.PostID {
+				t.Errorf("got claimed entry %+v", entry)
+			}
+			return entry
+		}
+
+		eu := expectClaim(100, 200, "eu")
+		us := expectClaim(100, 200, "us")
+		if _, found := claim(100, 200); found {
+			t.Errorf("claimed an entry whose lease did not expire")
+		}
+		err = posts.MarkOutboxEntrySent(ctx, us.ID, 150)
+		if err != nil {
+			t.Fatalf("error marking outbox entry as sent: %s", err.Error())
+		}
+		err = posts.ReleaseOutboxEntry(ctx, eu.ID)
+		if err != nil {
+			t.Fatalf("error releasing outbox entry: %s", err.Error())
+		}
+		expectClaim(150, 300, "eu")
+		if _, found := claim(250, 400); found {
+			t.Errorf("claimed a sent entry or an entry whose lease did not expire")
+		}
+		// the lease of the eu entry expired
+		expectClaim(301, 400, "eu")
+	})
+}
+
+// TestPostCache checks the cached posts and their expiration
+func TestPostCache(t *testing.T, newCache func(t *testing.T) repository.PostCache) {
+	t.Run("SetGetDelete", func(t *testing.T) {
+		ctx := testContext(t)
+		cache := newCache(t)
+		post := newPost(100001, 1, 1000, 2)
+		err := cache.SetPost(ctx, post, 0)
+		if err != nil {
+			t.Fatalf("error caching post: %s", err.Error())
+		}
+		cached, err := cache.GetPosts(ctx, []int64{post.PostID, 199999})
+		if err != nil {
+			t.Fatalf("error reading cached posts: %s", err.Error())
+		}
+		if len(cached) != 1 {
+			t.Fatalf("got %d cached posts, want 1", len(cached))
+		}
+		expectPost(t, cached[post.PostID], post)
+
+		post.Text = "edited text"
+		err = cache.SetPost(ctx, post, 0)
+		if err != nil {
+			t.Fatalf("error caching post: %s", err.Error())
+		}
+		cached, err = cache.GetPosts(ctx, []int64{post.PostID})
+		if err != nil {
+			t.Fatalf("error reading cached posts: %s", err.Error())
+		}
+		expectPost(t, cached[post.PostID], post)
+
+		err = cache.DeletePost(ctx, post.PostID)
+		if err != nil {
+			t.Fatalf("error deleting cached post: %s", err.Error())
+		}
+		err = cache.DeletePost(ctx, 199999)
+		if err != nil {
+			t.Errorf("error deleting post that is not cached: %s", err.Error())
+		}
+		cached, err = cache.GetPosts(ctx, []int64{post.PostID})
+		if err != nil {
+			t.Fatalf("error reading cached posts: %s", err.Error())
+		}
+		if len(cached) != 0 {
+			t.Errorf("got %d cached posts after deleting them, want 0", len(cached))
+		}
+	})
+
+	t.Run("Expiration", func(t *testing.T) {
+		ctx := testContext(t)
+		cache := newCache(t)
+		err := cache.SetPost(ctx, newPost(100001, 1, 1000), time.Second)
+		if err != nil {
+			t.Fatalf("error caching post: %s", err.Error())
+		}
+		expired := eventually(t, 5*time.Second, func() bool {
+			cached, err := cache.GetPosts(ctx, []int64{100001})
+			return err == nil && len(cached) == 0
+		})
+		if !expired {
+			t.Errorf("cached post did not expire")
+		}
+	})
+}
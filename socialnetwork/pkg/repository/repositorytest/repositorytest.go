@@ -0,0 +1,81 @@
+// Package repositorytest is the conformance suite of the repositories, which every backend must pass
+//
+// each suite takes a constructor of empty repositories, called once per subtest, e.g.
+//
+//	repositorytest.TestPostRepository(t, func(t *testing.T) repository.PostRepository {
+//		posts, err := repository.NewPostRepository(ctx, repository.Options{Backend: repository.BACKEND_MEMORY, MongoDBAddr: t.Name()})
+//		...
+//	})
+//
+// posts with the same timestamp are sorted by their numeric post id in mongodb but by their string post id
+// in redis and in memory, so the post ids of the suites have the same number of digits
+package repositorytest
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"socialnetwork/pkg/model"
+)
+
+// timeout of every subtest, which also covers slow datastores on the first connection
+const TEST_TIMEOUT time.Duration = 30 * time.Second
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), TEST_TIMEOUT)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// sortedIDs returns a sorted copy of the ids, for comparisons where the order is not specified
+func sortedIDs(ids []int64) []int64 {
+	sorted := append([]int64{}, ids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+func equalIDs(a []int64, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func postIDs(posts []model.TimelinePostInfo) []int64 {
+	ids := make([]int64, 0, len(posts))
+	for _, post := range posts {
+		ids = append(ids, post.PostID)
+	}
+	return ids
+}
+
+// expectPostIDs fails the test if the posts do not have the expected ids, in this order
+func expectPostIDs(t *testing.T, what string, posts []model.TimelinePostInfo, expected ...int64) {
+	t.Helper()
+	if ids := postIDs(posts); !equalIDs(ids, expected) {
+		t.Errorf("%s: got posts %v, want %v", what, ids, expected)
+	}
+}
+
+// eventually polls the condition until it holds or the timeout expires,
+// e.g. to wait for the expiration of cached entries with a granularity of seconds
+func eventually(t *testing.T, timeout time.Duration, condition func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		if condition() {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,307 @@
+package repositorytest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"socialnetwork/pkg/model"
+	"socialnetwork/pkg/repository"
+)
+
+func timelinePost(postID int64, timestamp int64) model.TimelinePostInfo {
+	return model.TimelinePostInfo{PostID: postID, Timestamp: timestamp}
+}
+
+func pushPosts(t *testing.T, ctx context.Context, timelines repository.TimelineRepository, userIDs []int64, posts ...model.TimelinePostInfo) {
+	t.Helper()
+	for _, post := range posts {
+		err := timelines.PushPost(ctx, userIDs, post)
+		if err != nil {
+			t.Fatalf("error pushing post %d: %s", post.PostID, err.Error())
+		}
+	}
+}
+
+func readTimeline(t *testing.T, ctx context.Context, timelines repository.TimelineRepository, userID int64, query model.TimelineQuery) []model.TimelinePostInfo {
+	t.Helper()
+	posts, err := timelines.ReadTimeline(ctx, userID, query)
+	if err != nil {
+		t.Fatalf("error reading timeline of user %d: %s", userID, err.Error())
+	}
+	return posts
+}
+
+// TestTimelineRepository checks the writes and paginated reads of timelines
+// the repository may cache any prefix of the timelines, e.g. with a small max length, since reads must not depend on it
+func TestTimelineRepository(t *testing.T, newRepo func(t *testing.T) repository.TimelineRepository) {
+	t.Run("PushPost", func(t *testing.T) {
+		ctx := testContext(t)
+		timelines := newRepo(t)
+		pushPosts(t, ctx, timelines, []int64{1, 2}, timelinePost(100001, 1000))
+		pushPosts(t, ctx, timelines, []int64{1}, timelinePost(100002, 1001), timelinePost(100003, 1001))
+		// redelivered posts are no-ops
+		pushPosts(t, ctx, timelines, []int64{1, 2}, timelinePost(100001, 1000))
+		expectPostIDs(t, "timeline of 1", readTimeline(t, ctx, timelines, 1, model.TimelineQuery{Stop: 10}), 100003, 100002, 100001)
+		expectPostIDs(t, "timeline of 2", readTimeline(t, ctx, timelines, 2, model.TimelineQuery{Stop: 10}), 100001)
+		expectPostIDs(t, "timeline of 3", readTimeline(t, ctx, timelines, 3, model.TimelineQuery{Stop: 10}))
+
+		postIDs, err := timelines.ReadPostIDs(ctx, 1)
+		if err != nil {
+			t.Fatalf("error reading post ids: %s", err.Error())
+		}
+		if !equalIDs(sortedIDs(postIDs), []int64{100001, 100002, 100003}) {
+			t.Errorf("got post ids %v, want [100001 100002 100003]", postIDs)
+		}
+		postIDs, err = timelines.ReadPostIDs(ctx, 3)
+		if err != nil || len(postIDs) != 0 {
+			t.Errorf("got post ids %v and error %v for empty timeline", postIDs, err)
+		}
+	})
+
+	t.Run("Pagination", func(t *testing.T) {
+		ctx := testContext(t)
+		timelines := newRepo(t)
+		for i := int64(1); i <= 5; i++ {
+			pushPosts(t, ctx, timelines, []int64{1}, timelinePost(100000+i, 1000+i))
+		}
+		for _, page := range []struct {
+			what     string
+			query    model.TimelineQuery
+			expected []int64
+		}{
+			// one post past the end of the page is returned
+			{"first page", model.TimelineQuery{Start: 0, Stop: 2}, []int64{100005, 100004, 100003}},
+			{"second page", model.TimelineQuery{Start: 2, Stop: 4}, []int64{100003, 100002, 100001}},
+			{"last page", model.TimelineQuery{Start: 4, Stop: 6}, []int64{100001}},
+			{"page past the end", model.TimelineQuery{Start: 10, Stop: 12}, nil},
+			{"max_id", model.TimelineQuery{Stop: 10, MaxID: 100004}, []int64{100003, 100002, 100001}},
+			{"since_id", model.TimelineQuery{Stop: 10, SinceID: 100002}, []int64{100005, 100004, 100003}},
+			{"max_id and since_id", model.TimelineQuery{Stop: 10, MaxID: 100005, SinceID: 100002}, []int64{100004, 100003}},
+			{"page after max_id", model.TimelineQuery{Start: 1, Stop: 2, MaxID: 100005}, []int64{100003, 100002}},
+			{"missing max_id", model.TimelineQuery{Stop: 10, MaxID: 199999}, nil},
+			{"time range", model.TimelineQuery{Stop: 10, Since: 1002, Until: 1004}, []int64{100004, 100003, 100002}},
+			// cursors with a timestamp are not looked up, and posts with the same timestamp are compared by their id
+			{"resolved max_id", model.TimelineQuery{Stop: 10, MaxID: 199999, MaxIDTimestamp: 1003}, []int64{100003, 100002, 100001}},
+		} {
+			expectPostIDs(t, page.what, readTimeline(t, ctx, timelines, 1, page.query), page.expected...)
+		}
+	})
+
+	t.Run("SameTimestamp", func(t *testing.T) {
+		ctx := testContext(t)
+		timelines := newRepo(t)
+		pushPosts(t, ctx, timelines, []int64{1}, timelinePost(100002, 1000), timelinePost(100001, 1000), timelinePost(100004, 1001), timelinePost(100003, 1000))
+		expectPostIDs(t, "timeline", readTimeline(t, ctx, timelines, 1, model.TimelineQuery{Stop: 10}), 100004, 100003, 100002, 100001)
+		// posts written in the same millisecond are neither skipped nor repeated across pages
+		expectPostIDs(t, "page after max_id", readTimeline(t, ctx, timelines, 1, model.TimelineQuery{Stop: 10, MaxID: 100003}), 100002, 100001)
+		expectPostIDs(t, "page after since_id", readTimeline(t, ctx, timelines, 1, model.TimelineQuery{Stop: 10, SinceID: 100002}), 100004, 100003)
+	})
+
+	t.Run("AddPosts", func(t *testing.T) {
+		ctx := testContext(t)
+		timelines := newRepo(t)
+		pushPosts(t, ctx, timelines, []int64{1}, timelinePost(100005, 1005))
+		readTimeline(t, ctx, timelines, 1, model.TimelineQuery{Stop: 10})
+		err := timelines.AddPosts(ctx, 1, []model.TimelinePostInfo{timelinePost(100001, 1001), timelinePost(100002, 1002), timelinePost(100005, 1005)})
+		if err != nil {
+			t.Fatalf("error adding posts: %s", err.Error())
+		}
+		err = timelines.AddPosts(ctx, 2, []model.TimelinePostInfo{timelinePost(100001, 1001)})
+		if err != nil {
+			t.Fatalf("error adding posts to empty timeline: %s", err.Error())
+		}
+		expectPostIDs(t, "timeline of 1", readTimeline(t, ctx, timelines, 1, model.TimelineQuery{Stop: 10}), 100005, 100002, 100001)
+		expectPostIDs(t, "timeline of 2", readTimeline(t, ctx, timelines, 2, model.TimelineQuery{Stop: 10}), 100001)
+	})
+
+	t.Run("RemovePosts", func(t *testing.T) {
+		ctx := testContext(t)
+		timelines := newRepo(t)
+		pushPosts(t, ctx, timelines, []int64{1, 2}, timelinePost(100001, 1001), timelinePost(100002, 1002), timelinePost(100003, 1003))
+		err := timelines.RemovePosts(ctx, 1, []int64{100002, 199999})
+		if err != nil {
+			t.Fatalf("error removing posts: %s", err.Error())
+		}
+		expectPostIDs(t, "timeline of 1", readTimeline(t, ctx, timelines, 1, model.TimelineQuery{Stop: 10}), 100003, 100001)
+		err = timelines.RemovePost(ctx, []int64{1, 2, 3}, 100003)
+		if err != nil {
+			t.Fatalf("error removing post: %s", err.Error())
+		}
+		expectPostIDs(t, "timeline of 1", readTimeline(t, ctx, timelines, 1, model.TimelineQuery{Stop: 10}), 100001)
+		expectPostIDs(t, "timeline of 2", readTimeline(t, ctx, timelines, 2, model.TimelineQuery{Stop: 10}), 100002, 100001)
+	})
+
+	t.Run("ReplaceTimeline", func(t *testing.T) {
+		ctx := testContext(t)
+		timelines := newRepo(t)
+		pushPosts(t, ctx, timelines, []int64{1}, timelinePost(100001, 1001))
+		err := timelines.ReplaceTimeline(ctx, 1, []model.TimelinePostInfo{timelinePost(100003, 1003), timelinePost(100002, 1002)})
+		if err != nil {
+			t.Fatalf("error replacing timeline: %s", err.Error())
+		}
+		expectPostIDs(t, "replaced timeline", readTimeline(t, ctx, timelines, 1, model.TimelineQuery{Stop: 10}), 100003, 100002)
+		err = timelines.ReplaceTimeline(ctx, 1, []model.TimelinePostInfo{})
+		if err != nil {
+			t.Fatalf("error replacing timeline: %s", err.Error())
+		}
+		expectPostIDs(t, "emptied timeline", readTimeline(t, ctx, timelines, 1, model.TimelineQuery{Stop: 10}))
+	})
+
+	t.Run("Compact", func(t *testing.T) {
+		ctx := testContext(t)
+		timelines := newRepo(t)
+		posts := make([]model.TimelinePostInfo, 0, 10)
+		for i := int64(10); i >= 1; i-- {
+			posts = append(posts, timelinePost(100000+i, 1000+i))
+		}
+		err := timelines.ReplaceTimeline(ctx, 1, posts)
+		if err != nil {
+			t.Fatalf("error replacing timeline: %s", err.Error())
+		}
+		_, err = timelines.Compact(ctx)
+		if err != nil {
+			t.Fatalf("error compacting timelines: %s", err.Error())
+		}
+		// compaction only trims the cache
+		expectPostIDs(t, "compacted timeline", readTimeline(t, ctx, timelines, 1, model.TimelineQuery{Start: 7, Stop: 10}), 100003, 100002, 100001)
+		expectPostIDs(t, "compacted timeline", readTimeline(t, ctx, timelines, 1, model.TimelineQuery{Stop: 2}), 100010, 100009, 100008)
+	})
+
+	t.Run("PullUsers", func(t *testing.T) {
+		ctx := testContext(t)
+		timelines := newRepo(t)
+		for _, userID := range []int64{3, 1, 3} {
+			err := timelines.AddPullUser(ctx, userID)
+			if err != nil {
+				t.Fatalf("error adding pull user %d: %s", userID, err.Error())
+			}
+		}
+		pullUserIDs, err := timelines.FilterPullUsers(ctx, []int64{4, 3, 2, 1})
+		if err != nil {
+			t.Fatalf("error filtering pull users: %s", err.Error())
+		}
+		if !equalIDs(pullUserIDs, []int64{3, 1}) {
+			t.Errorf("got pull users %v, want [3 1]", pullUserIDs)
+		}
+		pullUserIDs, err = timelines.FilterPullUsers(ctx, []int64{2})
+		if err != nil || len(pullUserIDs) != 0 {
+			t.Errorf("got pull users %v and error %v, want none", pullUserIDs, err)
+		}
+	})
+}
+
+// TestConversationRepository checks the conversations and the paginated reads of their messages
+func TestConversationRepository(t *testing.T, newRepo func(t *testing.T) repository.ConversationRepository) {
+	message := func(conversationID string, postID int64, senderID int64, timestamp int64) repository.DirectMessage {
+		return repository.DirectMessage{ConversationID: conversationID, PostID: postID, SenderID: senderID, Timestamp: timestamp}
+	}
+	addMessages := func(t *testing.T, ctx context.Context, conversations repository.ConversationRepository, participantIDs []int64, messages ...repository.DirectMessage) {
+		t.Helper()
+		for _, message := range messages {
+			err := conversations.AddMessage(ctx, participantIDs, message)
+			if err != nil {
+				t.Fatalf("error adding message %d: %s", message.PostID, err.Error())
+			}
+		}
+	}
+
+	t.Run("AddAndReadMessages", func(t *testing.T) {
+		ctx := testContext(t)
+		conversations := newRepo(t)
+		addMessages(t, ctx, conversations, []int64{1, 2},
+			message("1-2", 100001, 1, 1001), message("1-2", 100002, 2, 1002), message("1-2", 100003, 1, 1003),
+			// redelivered messages are no-ops
+			message("1-2", 100002, 2, 1002))
+		conversation, err := conversations.FindConversation(ctx, "1-2", 2)
+		if err != nil {
+			t.Fatalf("error finding conversation: %s", err.Error())
+		}
+		if conversation.ConversationID != "1-2" || !equalIDs(conversation.ParticipantIDs, []int64{1, 2}) || conversation.LastTimestamp != 1003 {
+			t.Errorf("got conversation %+v", conversation)
+		}
+		for _, page := range []struct {
+			what     string
+			query    model.TimelineQuery
+			expected []int64
+		}{
+			{"messages", model.TimelineQuery{Stop: 10}, []int64{100003, 100002, 100001}},
+			{"first page", model.TimelineQuery{Stop: 1}, []int64{100003, 100002}},
+			{"max_id", model.TimelineQuery{Stop: 10, MaxID: 100003}, []int64{100002, 100001}},
+			{"since_id", model.TimelineQuery{Stop: 10, SinceID: 100001}, []int64{100003, 100002}},
+			{"missing max_id", model.TimelineQuery{Stop: 10, MaxID: 199999}, nil},
+		} {
+			posts, err := conversations.ReadMessages(ctx, "1-2", page.query)
+			if err != nil {
+				t.Fatalf("error reading messages: %s", err.Error())
+			}
+			expectPostIDs(t, page.what, posts, page.expected...)
+		}
+		posts, err := conversations.ReadMessages(ctx, "1-3", model.TimelineQuery{Stop: 10})
+		if err != nil || len(posts) != 0 {
+			t.Errorf("got messages %v and error %v for missing conversation", posts, err)
+		}
+	})
+
+	t.Run("FindConversation", func(t *testing.T) {
+		ctx := testContext(t)
+		conversations := newRepo(t)
+		addMessages(t, ctx, conversations, []int64{1, 2}, message("1-2", 100001, 1, 1001))
+		for _, lookup := range []struct {
+			conversationID string
+			userID         int64
+		}{{"1-2", 3}, {"1-3", 1}} {
+			_, err := conversations.FindConversation(ctx, lookup.conversationID, lookup.userID)
+			if !errors.Is(err, repository.ErrNotFound) {
+				t.Errorf("got error %v for conversation %s of user %d, want ErrNotFound", err, lookup.conversationID, lookup.userID)
+			}
+		}
+	})
+
+	t.Run("ListConversations", func(t *testing.T) {
+		ctx := testContext(t)
+		conversations := newRepo(t)
+		addMessages(t, ctx, conversations, []int64{1, 2}, message("1-2", 100001, 1, 1001), message("1-2", 100004, 2, 1004))
+		addMessages(t, ctx, conversations, []int64{1, 3}, message("1-3", 100002, 1, 1002))
+		addMessages(t, ctx, conversations, []int64{1, 2, 3}, message("1-2-3", 100003, 3, 1003))
+		addMessages(t, ctx, conversations, []int64{2, 3}, message("2-3", 100005, 3, 1005))
+		// messages delivered out of order do not move the conversation back
+		addMessages(t, ctx, conversations, []int64{1, 3}, message("1-3", 100000, 3, 1000))
+
+		list := func(userID int64, start int64, stop int64) []string {
+			t.Helper()
+			found, err := conversations.ListConversations(ctx, userID, start, stop)
+			if err != nil {
+				t.Fatalf("error listing conversations: %s", err.Error())
+			}
+			ids := make([]string, 0, len(found))
+			for _, conversation := range found {
+				ids = append(ids, conversation.ConversationID)
+			}
+			return ids
+		}
+		for _, page := range []struct {
+			userID   int64
+			start    int64
+			stop     int64
+			expected []string
+		}{
+			{1, 0, 10, []string{"1-2", "1-2-3", "1-3"}},
+			{1, 1, 2, []string{"1-2-3"}},
+			{3, 0, 10, []string{"2-3", "1-2-3", "1-3"}},
+			{4, 0, 10, []string{}},
+		} {
+			ids := list(page.userID, page.start, page.stop)
+			if len(ids) != len(page.expected) {
+				t.Errorf("got conversations %v of user %d in [%d, %d), want %v", ids, page.userID, page.start, page.stop, page.expected)
+				continue
+			}
+			for i := range ids {
+				if ids[i] != page.expected[i] {
+					t.Errorf("got conversations %v of user %d in [%d, %d), want %v", ids, page.userID, page.start, page.stop, page.expected)
+					break
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,40 @@
+package repositorytest
+
+import (
+	"sort"
+	"testing"
+
+	"socialnetwork/pkg/model"
+	"socialnetwork/pkg/repository"
+)
+
+// TestURLRepository checks the lookups of the shortened urls
+func TestURLRepository(t *testing.T, newRepo func(t *testing.T) repository.URLRepository) {
+	t.Run("InsertAndFindURLs", func(t *testing.T) {
+		ctx := testContext(t)
+		urls := newRepo(t)
+		err := urls.InsertURLs(ctx, []model.URL{
+			{ShortenedUrl: "http://short-url/a", ExpandedUrl: "http://example.com/a"},
+			{ShortenedUrl: "http://short-url/b", ExpandedUrl: "http://example.com/b"},
+		})
+		if err != nil {
+			t.Fatalf("error inserting urls: %s", err.Error())
+		}
+		err = urls.InsertURLs(ctx, []model.URL{{ShortenedUrl: "http://short-url/c", ExpandedUrl: "http://example.com/c"}})
+		if err != nil {
+			t.Fatalf("error inserting urls: %s", err.Error())
+		}
+		found, err := urls.FindURLs(ctx, []string{"http://short-url/c", "http://short-url/missing", "http://short-url/a", "http://short-url/c"})
+		if err != nil {
+			t.Fatalf("error finding urls: %s", err.Error())
+		}
+		sort.Slice(found, func(i, j int) bool { return found[i].ShortenedUrl < found[j].ShortenedUrl })
+		if len(found) != 2 || found[0].ExpandedUrl != "http://example.com/a" || found[1].ExpandedUrl != "http://example.com/c" {
+			t.Errorf("got urls %+v, want the urls of a and c", found)
+		}
+		found, err = urls.FindURLs(ctx, []string{"http://short-url/missing"})
+		if err != nil || len(found) != 0 {
+			t.Errorf("got urls %+v and error %v for missing url", found, err)
+		}
+	})
+}
@@ -0,0 +1,228 @@
+package repositorytest
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"socialnetwork/pkg/model"
+	"socialnetwork/pkg/repository"
+)
+
+func newUser(userID int64) model.User {
+	return model.User{
+		UserID:    userID,
+		FirstName: "first_name",
+		LastName:  "last_name",
+		Username:  fmt.Sprintf("username_%d", userID),
+		PwdHashed: "pwd_hashed",
+		Salt:      "salt",
+	}
+}
+
+// TestUserRepository checks the registered users and the lookups of their ids
+func TestUserRepository(t *testing.T, newRepo func(t *testing.T) repository.UserRepository) {
+	t.Run("InsertAndFindUser", func(t *testing.T) {
+		ctx := testContext(t)
+		users := newRepo(t)
+		user := newUser(1)
+		err := users.InsertUser(ctx, user)
+		if err != nil {
+			t.Fatalf("error inserting user: %s", err.Error())
+		}
+		// the second read may be served by the cache
+		for i := 0; i < 2; i++ {
+			found, err := users.FindUser(ctx, user.Username)
+			if err != nil {
+				t.Fatalf("error finding user: %s", err.Error())
+			}
+			if found != user {
+				t.Errorf("got user %+v, want %+v", found, user)
+			}
+		}
+		taken := newUser(2)
+		taken.Username = user.Username
+		err = users.InsertUser(ctx, taken)
+		if !errors.Is(err, repository.ErrUsernameTaken) {
+			t.Errorf("got error %v for registered username, want ErrUsernameTaken", err)
+		}
+		takenID := newUser(1)
+		takenID.Username = "other"
+		err = users.InsertUser(ctx, takenID)
+		if !errors.Is(err, repository.ErrUserIDTaken) {
+			t.Errorf("got error %v for registered user id, want ErrUserIDTaken", err)
+		}
+		_, err = users.FindUser(ctx, "missing")
+		if !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("got error %v for missing user, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("InsertUsers", func(t *testing.T) {
+		ctx := testContext(t)
+		users := newRepo(t)
+		inserted, err := users.InsertUsers(ctx, []model.User{newUser(1), newUser(2)})
+		if err != nil {
+			t.Fatalf("error inserting users: %s", err.Error())
+		}
+		if inserted != 2 {
+			t.Errorf("got %d inserted users, want 2", inserted)
+		}
+		inserted, err = users.InsertUsers(ctx, []model.User{newUser(2), newUser(3)})
+		if err != nil {
+			t.Fatalf("error inserting users again: %s", err.Error())
+		}
+		if inserted != 1 {
+			t.Errorf("got %d inserted users, want 1", inserted)
+		}
+		// users with the id of another user are skipped
+		takenID := newUser(4)
+		takenID.UserID = 1
+		inserted, err = users.InsertUsers(ctx, []model.User{takenID})
+		if err != nil || inserted != 0 {
+			t.Errorf("got %d inserted users and error %v for registered user id, want 0", inserted, err)
+		}
+		_, err = users.FindUser(ctx, newUser(3).Username)
+		if err != nil {
+			t.Errorf("error finding inserted user: %s", err.Error())
+		}
+	})
+
+	t.Run("FindUserIDs", func(t *testing.T) {
+		ctx := testContext(t)
+		users := newRepo(t)
+		_, err := users.InsertUsers(ctx, []model.User{newUser(1), newUser(2), newUser(3)})
+		if err != nil {
+			t.Fatalf("error inserting users: %s", err.Error())
+		}
+		// the second lookup may be served by the cache
+		for i := 0; i < 2; i++ {
+			userIDs, err := users.FindUserIDs(ctx, []string{"username_1", "missing", "username_3"})
+			if err != nil {
+				t.Fatalf("error finding user ids: %s", err.Error())
+			}
+			if len(userIDs) != 2 || userIDs["username_1"] != 1 || userIDs["username_3"] != 3 {
+				t.Errorf("got user ids %v, want map[username_1:1 username_3:3]", userIDs)
+			}
+		}
+		userIDs, err := users.FindUserIDs(ctx, nil)
+		if err != nil || len(userIDs) != 0 {
+			t.Errorf("got user ids %v and error %v for no usernames", userIDs, err)
+		}
+	})
+}
+
+// TestSocialGraphRepository checks the users of the graph and the edges between them
+// followers and followees are compared in any order
+func TestSocialGraphRepository(t *testing.T, newRepo func(t *testing.T) repository.SocialGraphRepository) {
+	t.Run("InsertUsers", func(t *testing.T) {
+		ctx := testContext(t)
+		graph := newRepo(t)
+		inserted, err := graph.InsertUsers(ctx, []int64{3, 1, 2})
+		if err != nil {
+			t.Fatalf("error inserting users: %s", err.Error())
+		}
+		if inserted != 3 {
+			t.Errorf("got %d inserted users, want 3", inserted)
+		}
+		inserted, err = graph.InsertUsers(ctx, []int64{3, 4})
+		if err != nil {
+			t.Fatalf("error inserting users again: %s", err.Error())
+		}
+		if inserted != 1 {
+			t.Errorf("got %d inserted users, want 1", inserted)
+		}
+		userIDs, err := graph.ListUsers(ctx)
+		if err != nil {
+			t.Fatalf("error listing users: %s", err.Error())
+		}
+		if !equalIDs(userIDs, []int64{1, 2, 3, 4}) {
+			t.Errorf("got users %v, want [1 2 3 4]", userIDs)
+		}
+	})
+
+	t.Run("FollowAndUnfollow", func(t *testing.T) {
+		ctx := testContext(t)
+		graph := newRepo(t)
+		_, err := graph.InsertUsers(ctx, []int64{1, 2, 3, 4})
+		if err != nil {
+			t.Fatalf("error inserting users: %s", err.Error())
+		}
+		followed, err := graph.Follow(ctx, []model.FollowEdge{{UserID: 1, FolloweeID: 2}, {UserID: 1, FolloweeID: 3}, {UserID: 3, FolloweeID: 2}})
+		if err != nil {
+			t.Fatalf("error following users: %s", err.Error())
+		}
+		if followed != 3 {
+			t.Errorf("got %d new edges, want 3", followed)
+		}
+		followed, err = graph.Follow(ctx, []model.FollowEdge{{UserID: 1, FolloweeID: 2}})
+		if err != nil {
+			t.Fatalf("error following users again: %s", err.Error())
+		}
+		if followed != 0 {
+			t.Errorf("got %d new edges for existing edge, want 0", followed)
+		}
+
+		expectEdges := func(what string, get func() ([]int64, error), expected ...int64) {
+			t.Helper()
+			ids, err := get()
+			if err != nil {
+				t.Fatalf("error reading %s: %s", what, err.Error())
+			}
+			if !equalIDs(sortedIDs(ids), expected) {
+				t.Errorf("got %s %v, want %v", what, ids, expected)
+			}
+		}
+		followers := func(userID int64) func() ([]int64, error) {
+			return func() ([]int64, error) { return graph.GetFollowers(ctx, userID) }
+		}
+		followees := func(userID int64) func() ([]int64, error) {
+			return func() ([]int64, error) { return graph.GetFollowees(ctx, userID) }
+		}
+		// reads are repeated, since the first one may cache the edges read by the second one
+		for i := 0; i < 2; i++ {
+			expectEdges("followers of 2", followers(2), 1, 3)
+			expectEdges("followees of 1", followees(1), 2, 3)
+			expectEdges("followers of 4", followers(4))
+			expectEdges("followers of missing user", followers(9))
+		}
+
+		// edges added and removed after being read
+		_, err = graph.Follow(ctx, []model.FollowEdge{{UserID: 4, FolloweeID: 2}})
+		if err != nil {
+			t.Fatalf("error following user: %s", err.Error())
+		}
+		expectEdges("followers of 2", followers(2), 1, 3, 4)
+		err = graph.Unfollow(ctx, 1, 2)
+		if err != nil {
+			t.Fatalf("error unfollowing user: %s", err.Error())
+		}
+		err = graph.Unfollow(ctx, 2, 1)
+		if err != nil {
+			t.Errorf("error unfollowing user that is not followed: %s", err.Error())
+		}
+		expectEdges("followers of 2", followers(2), 3, 4)
+		expectEdges("followees of 1", followees(1), 3)
+
+		counts, err := graph.CountFollowers(ctx, []int64{2, 3, 1, 9})
+		if err != nil {
+			t.Fatalf("error counting followers: %s", err.Error())
+		}
+		if !equalIDs(counts, []int64{2, 1, 0, 0}) {
+			t.Errorf("got follower counts %v, want [2 1 0 0]", counts)
+		}
+		for _, edge := range []struct {
+			userID     int64
+			followeeID int64
+			following  bool
+		}{{1, 3, true}, {4, 2, true}, {1, 2, false}, {2, 1, false}, {9, 1, false}} {
+			following, err := graph.IsFollowing(ctx, edge.userID, edge.followeeID)
+			if err != nil {
+				t.Fatalf("error reading edge: %s", err.Error())
+			}
+			if following != edge.following {
+				t.Errorf("got following %t for %d->%d, want %t", following, edge.userID, edge.followeeID, edge.following)
+			}
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package repository
+
+import (
+	"context"
+	"sort"
+
+	"socialnetwork/pkg/model"
+)
+
+// memorySocialGraphUser keeps the followers and followees of a user in the order they were added
+type memorySocialGraphUser struct {
+	followers []int64
+	followees []int64
+}
+
+type memorySocialGraph struct {
+	memoryStore
+	users map[int64]*memorySocialGraphUser
+}
+
+type memorySocialGraphRepository struct {
+	store *memorySocialGraph
+}
+
+func newMemorySocialGraphRepository(opts Options) *memorySocialGraphRepository {
+	store := memoryDatastore(opts.MongoDBAddr, opts.MongoDBPort, "social-graph", func() *memorySocialGraph {
+		return &memorySocialGraph{users: make(map[int64]*memorySocialGraphUser)}
+	})
+	return &memorySocialGraphRepository{store: store}
+}
+
+func (r *memorySocialGraphRepository) InsertUsers(ctx context.Context, userIDs []int64) (int, error) {
+	return memoryWrite(r.store, func(s *memorySocialGraph) int {
+		inserted := 0
+		for _, userID := range userIDs {
+			if _, ok := s.users[userID]; !ok {
+				s.users[userID] = &memorySocialGraphUser{}
+				inserted++
+			}
+		}
+		return inserted
+	})
+}
+
+func containsID(ids []int64, id int64) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
+
+func removeID(ids []int64, id int64) []int64 {
+	kept := ids[:0]
+	for _, other := range ids {
+		if other != id {
+			kept = append(kept, other)
+		}
+	}
+	return kept
+}
+
+// Follow skips the edges of users that are not in the graph, like the conditional updates in mongodb
+func (r *memorySocialGraphRepository) Follow(ctx context.Context, edges []model.FollowEdge) (int, error) {
+	return memoryWrite(r.store, func(s *memorySocialGraph) int {
+		followed := 0
+		for _, edge := range edges {
+			user, ok1 := s.users[edge.UserID]
+			followee, ok2 := s.users[edge.FolloweeID]
+			if !ok1 || !ok2 || containsID(user.followees, edge.FolloweeID) {
+				continue
+			}
+			user.followees = append(user.followees, edge.FolloweeID)
+			followee.followers = append(followee.followers, edge.UserID)
+			followed++
+		}
+		return followed
+	})
+}
+
+func (r *memorySocialGraphRepository) Unfollow(ctx context.Context, userID int64, followeeID int64) error {
+	_, err := memoryWrite(r.store, func(s *memorySocialGraph) struct{} {
+		if user, ok := s.users[userID]; ok {
+			user.followees = removeID(user.followees, followeeID)
+		}
+		if followee, ok := s.users[followeeID]; ok {
+			followee.followers = removeID(followee.followers, userID)
+		}
+		return struct{}{}
+	})
+	return err
+}
+
+func (r *memorySocialGraphRepository) GetFollowers(ctx context.Context, userID int64) ([]int64, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	if user, ok := r.store.users[userID]; ok {
+		return append([]int64{}, user.followers...), nil
+	}
+	return []int64{}, nil
+}
+
+func (r *memorySocialGraphRepository) GetFollowees(ctx context.Context, userID int64) ([]int64, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	if user, ok := r.store.users[userID]; ok {
+		return append([]int64{}, user.followees...), nil
+	}
+	return []int64{}, nil
+}
+
+func (r *memorySocialGraphRepository) CountFollowers(ctx context.Context, userIDs []int64) ([]int64, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	counts := make([]int64, 0, len(userIDs))
+	for _, userID := range userIDs {
+		var count int64
+		if user, ok := r.store.users[userID]; ok {
+			count = int64(len(user.followers))
+		}
+		counts = append(counts, count)
+	}
+	return counts, nil
+}
+
+func (r *memorySocialGraphRepository) IsFollowing(ctx context.Context, userID int64, followeeID int64) (bool, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	user, ok := r.store.users[userID]
+	return ok && containsID(user.followees, followeeID), nil
+}
+
+func (r *memorySocialGraphRepository) ListUsers(ctx context.Context) ([]int64, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	userIDs := make([]int64, 0, len(r.store.users))
+	for userID := range r.store.users {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Slice(userIDs, func(i, j int) bool { return userIDs[i] < userIDs[j] })
+	return userIDs, nil
+}
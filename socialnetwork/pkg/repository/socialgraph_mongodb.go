@@ -0,0 +1,278 @@
+package repository
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"socialnetwork/pkg/model"
+	"socialnetwork/pkg/storage"
+
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// every user has a document with its followers and followees in mongodb, which are cached
+// in the "<user id>:followers" and "<user id>:followees" sorted sets in redis
+type socialGraphEdge struct {
+	UserID int64 `bson:"user_id"`
+}
+
+type socialGraphUser struct {
+	UserID    int64             `bson:"user_id"`
+	Followers []socialGraphEdge `bson:"followers"`
+	Followees []socialGraphEdge `bson:"followees"`
+}
+
+// cachedEdgeAdd adds the edge to the cached sorted set only if it is cached, since a partial set would
+// be mistaken for the whole set of followers or followees
+var cachedEdgeAdd = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return redis.call("ZADD", KEYS[1], "NX", ARGV[1], ARGV[2])
+end
+return 0
+`)
+
+type mongoDBSocialGraphRepository struct {
+	client      *mongo.Client
+	cacheClient *redis.Client
+}
+
+func newMongoDBSocialGraphRepository(ctx context.Context, opts Options) (*mongoDBSocialGraphRepository, error) {
+	client, err := storage.MongoDBClient(ctx, opts.MongoDBAddr, opts.MongoDBPort)
+	if err != nil {
+		return nil, err
+	}
+	cacheClient, err := storage.RedisClient(opts.CacheAddr, opts.CachePort)
+	if err != nil {
+		return nil, err
+	}
+	return &mongoDBSocialGraphRepository{client: client, cacheClient: cacheClient}, nil
+}
+
+func (r *mongoDBSocialGraphRepository) graph() *mongo.Collection {
+	return r.client.Database("social-graph").Collection("social-graph")
+}
+
+// InsertUsers upserts the documents of the users, so that inserting the same users twice is a no-op
+func (r *mongoDBSocialGraphRepository) InsertUsers(ctx context.Context, userIDs []int64) (int, error) {
+	if len(userIDs) == 0 {
+		return 0, nil
+	}
+	writes := make([]mongo.WriteModel, 0, len(userIDs))
+	for _, userID := range userIDs {
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"user_id": userID}).
+			SetUpdate(bson.M{"$setOnInsert": bson.M{
+				"user_id":   userID,
+				"followers": bson.A{},
+				"followees": bson.A{},
+			}}).
+			SetUpsert(true))
+	}
+	result, err := r.graph().BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return 0, err
+	}
+	return int(result.UpsertedCount), nil
+}
+
+// Follow adds the follower->followee and followee->follower edges in mongodb and then in redis
+func (r *mongoDBSocialGraphRepository) Follow(ctx context.Context, edges []model.FollowEdge) (int, error) {
+	if len(edges) == 0 {
+		return 0, nil
+	}
+	timestamp := time.Now()
+	writes := make([]mongo.WriteModel, 0, 2*len(edges))
+	for _, edge := range edges {
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"user_id": edge.UserID, "followees.user_id": bson.M{"$ne": edge.FolloweeID}}).
+			SetUpdate(bson.M{"$push": bson.M{"followees": bson.M{"user_id": edge.FolloweeID, "timestamp": timestamp.String()}}}))
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"user_id": edge.FolloweeID, "followers.user_id": bson.M{"$ne": edge.UserID}}).
+			SetUpdate(bson.M{"$push": bson.M{"followers": bson.M{"user_id": edge.UserID, "timestamp": timestamp.String()}}}))
+	}
+	result, err := r.graph().BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = r.cacheClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, edge := range edges {
+			cachedEdgeAdd.Eval(ctx, pipe, []string{strconv.FormatInt(edge.UserID, 10) + ":followees"}, timestamp.Unix(), edge.FolloweeID)
+			cachedEdgeAdd.Eval(ctx, pipe, []string{strconv.FormatInt(edge.FolloweeID, 10) + ":followers"}, timestamp.Unix(), edge.UserID)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	// every edge updates two documents
+	return int(result.ModifiedCount) / 2, nil
+}
+
+// Unfollow removes the edges in mongodb and then in redis
+func (r *mongoDBSocialGraphRepository) Unfollow(ctx context.Context, userID int64, followeeID int64) error {
+	writes := []mongo.WriteModel{
+		mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"user_id": userID}).
+			SetUpdate(bson.M{"$pull": bson.M{"followees": bson.M{"user_id": followeeID}}}),
+		mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"user_id": followeeID}).
+			SetUpdate(bson.M{"$pull": bson.M{"followers": bson.M{"user_id": userID}}}),
+	}
+	_, err := r.graph().BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return err
+	}
+	_, err = r.cacheClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, strconv.FormatInt(userID, 10)+":followees", followeeID)
+		pipe.ZRem(ctx, strconv.FormatInt(followeeID, 10)+":followers", userID)
+		return nil
+	})
+	return err
+}
+
+func (r *mongoDBSocialGraphRepository) GetFollowers(ctx context.Context, userID int64) ([]int64, error) {
+	return r.getEdges(ctx, userID, "followers")
+}
+
+func (r *mongoDBSocialGraphRepository) GetFollowees(ctx context.Context, userID int64) ([]int64, error) {
+	return r.getEdges(ctx, userID, "followees")
+}
+
+// getEdges reads the followers or followees of the user from redis if cached,
+// otherwise it reads them from mongodb and caches them in redis
+func (r *mongoDBSocialGraphRepository) getEdges(ctx context.Context, userID int64, field string) ([]int64, error) {
+	key := strconv.FormatInt(userID, 10) + ":" + field
+	members, err := r.cacheClient.ZRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	userIDs := make([]int64, 0, len(members))
+	if len(members) > 0 {
+		for _, member := range members {
+			id, err := strconv.ParseInt(member, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			userIDs = append(userIDs, id)
+		}
+		return userIDs, nil
+	}
+
+	var user socialGraphUser
+	opts := options.FindOne().SetProjection(bson.D{{Key: field + ".user_id", Value: 1}})
+	err = r.graph().FindOne(ctx, bson.D{{Key: "user_id", Value: userID}}, opts).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return userIDs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	edges := user.Followers
+	if field == "followees" {
+		edges = user.Followees
+	}
+	if len(edges) == 0 {
+		return userIDs, nil
+	}
+	// the edges are cached in the order they were added
+	cached := make([]redis.Z, 0, len(edges))
+	for i, edge := range edges {
+		userIDs = append(userIDs, edge.UserID)
+		cached = append(cached, redis.Z{Member: edge.UserID, Score: float64(i)})
+	}
+	err = r.cacheClient.ZAddNX(ctx, key, cached...).Err()
+	if err != nil {
+		return nil, err
+	}
+	return userIDs, nil
+}
+
+// CountFollowers reads the number of followers from redis, and from mongodb for the users whose followers are not cached
+func (r *mongoDBSocialGraphRepository) CountFollowers(ctx context.Context, userIDs []int64) ([]int64, error) {
+	cmds := make([]*redis.IntCmd, 0, len(userIDs))
+	_, err := r.cacheClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, userID := range userIDs {
+			cmds = append(cmds, pipe.ZCard(ctx, strconv.FormatInt(userID, 10)+":followers"))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	counts := make([]int64, 0, len(cmds))
+	var notCached bson.A
+	for i, cmd := range cmds {
+		counts = append(counts, cmd.Val())
+		if cmd.Val() == 0 {
+			notCached = append(notCached, userIDs[i])
+		}
+	}
+	if len(notCached) == 0 {
+		return counts, nil
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "user_id", Value: bson.D{{Key: "$in", Value: notCached}}}}}},
+		{{Key: "$project", Value: bson.D{
+			{Key: "user_id", Value: 1},
+			{Key: "count", Value: bson.D{{Key: "$size", Value: "$followers"}}},
+		}}},
+	}
+	cur, err := r.graph().Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var stored []struct {
+		UserID int64 `bson:"user_id"`
+		Count  int64 `bson:"count"`
+	}
+	err = cur.All(ctx, &stored)
+	if err != nil {
+		return nil, err
+	}
+	storedCounts := make(map[int64]int64, len(stored))
+	for _, user := range stored {
+		storedCounts[user.UserID] = user.Count
+	}
+	for i, userID := range userIDs {
+		if counts[i] == 0 {
+			counts[i] = storedCounts[userID]
+		}
+	}
+	return counts, nil
+}
+
+func (r *mongoDBSocialGraphRepository) IsFollowing(ctx context.Context, userID int64, followeeID int64) (bool, error) {
+	filter := bson.D{
+		{Key: "user_id", Value: userID},
+		{Key: "followees.user_id", Value: followeeID},
+	}
+	count, err := r.graph().CountDocuments(ctx, filter, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (r *mongoDBSocialGraphRepository) ListUsers(ctx context.Context) ([]int64, error) {
+	opts := options.Find().SetProjection(bson.D{{Key: "user_id", Value: 1}}).SetSort(bson.D{{Key: "user_id", Value: 1}})
+	cur, err := r.graph().Find(ctx, bson.D{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var users []socialGraphUser
+	err = cur.All(ctx, &users)
+	if err != nil {
+		return nil, err
+	}
+	userIDs := make([]int64, 0, len(users))
+	for _, user := range users {
+		userIDs = append(userIDs, user.UserID)
+	}
+	return userIDs, nil
+}
@@ -0,0 +1,77 @@
+package repository
+
+import (
+	"strconv"
+	"time"
+
+	"socialnetwork/pkg/model"
+)
+
+// timelines are sorted by timestamp (newest first) and then by post id
+// the max_id and since_id cursors are resolved to their (timestamp, post id) position so that
+// posts written in the same millisecond are neither skipped nor repeated across pages
+
+// ResolveCursors sets the timestamps of the max_id and since_id cursors that are not set yet
+// it returns false if any of the cursors is not found
+func ResolveCursors(query *model.TimelineQuery, lookup func(postID int64) (int64, bool, error)) (bool, error) {
+	for _, cursor := range []struct {
+		postID    int64
+		timestamp *int64
+	}{{query.MaxID, &query.MaxIDTimestamp}, {query.SinceID, &query.SinceIDTimestamp}} {
+		if cursor.postID == 0 || *cursor.timestamp != 0 {
+			continue
+		}
+		timestamp, found, err := lookup(cursor.postID)
+		if err != nil || !found {
+			return false, err
+		}
+		*cursor.timestamp = timestamp
+	}
+	return true, nil
+}
+
+// OlderThan returns true if the post comes after the cursor in the timeline,
+// following the order of ZREVRANGEBYSCORE (i.e. post ids are compared as strings)
+func OlderThan(post model.TimelinePostInfo, cursor model.TimelinePostInfo) bool {
+	return post.Timestamp < cursor.Timestamp || (post.Timestamp == cursor.Timestamp &&
+		strconv.FormatInt(post.PostID, 10) < strconv.FormatInt(cursor.PostID, 10))
+}
+
+// TimelineCachePolicy bounds the timelines cached in redis, while mongodb keeps every post
+// so that reads of trimmed or expired posts fall back to mongodb
+type TimelineCachePolicy struct {
+	// cached timelines keep the newest maxLength posts (0 for no limit)
+	maxLength int64
+	// cached timelines expire after ttl without being read (0 for no expiration)
+	ttl time.Duration
+}
+
+func NewTimelineCachePolicy(maxLength int, ttlS int) TimelineCachePolicy {
+	return TimelineCachePolicy{maxLength: int64(max(maxLength, 0)), ttl: time.Duration(max(ttlS, 0)) * time.Second}
+}
+
+// pageTimelinePosts returns the posts of the page plus one past its end from the sorted posts of a timeline,
+// with the semantics of TimelineRepository.ReadTimeline for resolved cursors
+func pageTimelinePosts(posts []model.TimelinePostInfo, query model.TimelineQuery) []model.TimelinePostInfo {
+	maxCursor := model.TimelinePostInfo{PostID: query.MaxID, Timestamp: query.MaxIDTimestamp}
+	sinceCursor := model.TimelinePostInfo{PostID: query.SinceID, Timestamp: query.SinceIDTimestamp}
+	var page []model.TimelinePostInfo
+	skipped := int64(0)
+	for _, post := range posts {
+		if (query.Since > 0 && post.Timestamp < query.Since) || (query.Until > 0 && post.Timestamp > query.Until) {
+			continue
+		}
+		if (query.MaxID != 0 && !OlderThan(post, maxCursor)) || (query.SinceID != 0 && !OlderThan(sinceCursor, post)) {
+			continue
+		}
+		if skipped < query.Start {
+			skipped++
+			continue
+		}
+		page = append(page, post)
+		if int64(len(page)) > query.Stop-query.Start {
+			break
+		}
+	}
+	return page
+}
@@ -0,0 +1,161 @@
+package repository
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"socialnetwork/pkg/model"
+)
+
+// memoryTimelines keeps every timeline sorted like the cached timelines in redis
+type memoryTimelines struct {
+	mu        sync.Mutex
+	timelines map[int64][]model.TimelinePostInfo
+	pullUsers map[int64]bool
+}
+
+type memoryTimelineRepository struct {
+	store *memoryTimelines
+}
+
+func newMemoryTimelineRepository(opts Options, name string) *memoryTimelineRepository {
+	store := memoryDatastore(opts.MongoDBAddr, opts.MongoDBPort, name, func() *memoryTimelines {
+		return &memoryTimelines{timelines: make(map[int64][]model.TimelinePostInfo), pullUsers: make(map[int64]bool)}
+	})
+	return &memoryTimelineRepository{store: store}
+}
+
+func (r *memoryTimelineRepository) EnsureIndexes(ctx context.Context) error {
+	return nil
+}
+
+// insert adds the posts the timeline does not have yet, keeping it sorted
+func (s *memoryTimelines) insert(userID int64, posts ...model.TimelinePostInfo) {
+	timeline := s.timelines[userID]
+	for _, post := range posts {
+		found := false
+		for _, other := range timeline {
+			if other.PostID == post.PostID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			timeline = append(timeline, post)
+		}
+	}
+	sort.SliceStable(timeline, func(i, j int) bool {
+		return OlderThan(timeline[j], timeline[i])
+	})
+	s.timelines[userID] = timeline
+}
+
+func (s *memoryTimelines) remove(userID int64, postIDs ...int64) {
+	timeline, ok := s.timelines[userID]
+	if !ok {
+		return
+	}
+	kept := timeline[:0]
+	for _, post := range timeline {
+		if !containsID(postIDs, post.PostID) {
+			kept = append(kept, post)
+		}
+	}
+	s.timelines[userID] = kept
+}
+
+func (r *memoryTimelineRepository) ReadTimeline(ctx context.Context, userID int64, query model.TimelineQuery) ([]model.TimelinePostInfo, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	timeline := r.store.timelines[userID]
+	found, err := ResolveCursors(&query, func(postID int64) (int64, bool, error) {
+		for _, post := range timeline {
+			if post.PostID == postID {
+				return post.Timestamp, true, nil
+			}
+		}
+		return 0, false, nil
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+	return pageTimelinePosts(timeline, query), nil
+}
+
+func (r *memoryTimelineRepository) ReadPostIDs(ctx context.Context, userID int64) ([]int64, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	postIDs := make([]int64, 0, len(r.store.timelines[userID]))
+	for _, post := range r.store.timelines[userID] {
+		postIDs = append(postIDs, post.PostID)
+	}
+	return postIDs, nil
+}
+
+func (r *memoryTimelineRepository) PushPost(ctx context.Context, userIDs []int64, post model.TimelinePostInfo) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	for _, userID := range userIDs {
+		r.store.insert(userID, post)
+	}
+	return nil
+}
+
+func (r *memoryTimelineRepository) AddPosts(ctx context.Context, userID int64, posts []model.TimelinePostInfo) error {
+	if len(posts) == 0 {
+		return nil
+	}
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	r.store.insert(userID, posts...)
+	return nil
+}
+
+func (r *memoryTimelineRepository) RemovePosts(ctx context.Context, userID int64, postIDs []int64) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	r.store.remove(userID, postIDs...)
+	return nil
+}
+
+func (r *memoryTimelineRepository) RemovePost(ctx context.Context, userIDs []int64, postID int64) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	for _, userID := range userIDs {
+		r.store.remove(userID, postID)
+	}
+	return nil
+}
+
+func (r *memoryTimelineRepository) ReplaceTimeline(ctx context.Context, userID int64, posts []model.TimelinePostInfo) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	delete(r.store.timelines, userID)
+	r.store.insert(userID, posts...)
+	return nil
+}
+
+// Compact is a no-op, since in-memory timelines have no cache to trim
+func (r *memoryTimelineRepository) Compact(ctx context.Context) (int64, error) {
+	return 0, nil
+}
+
+func (r *memoryTimelineRepository) AddPullUser(ctx context.Context, userID int64) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	r.store.pullUsers[userID] = true
+	return nil
+}
+
+func (r *memoryTimelineRepository) FilterPullUsers(ctx context.Context, userIDs []int64) ([]int64, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	var pullUserIDs []int64
+	for _, userID := range userIDs {
+		if r.store.pullUsers[userID] {
+			pullUserIDs = append(pullUserIDs, userID)
+		}
+	}
+	return pullUserIDs, nil
+}
@@ -0,0 +1,578 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"socialnetwork/pkg/model"
+	"socialnetwork/pkg/storage"
+
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const MONGODB_DUPLICATE_KEY_ERROR int = 11000
+
+// number of keys scanned per round trip by the timeline cache compaction
+const TIMELINE_COMPACTION_SCAN_COUNT int64 = 1000
+
+// mongoDBTimelineRepository stores every timeline in a document of the collection with the name of the timelines
+// (in the database with the same name), and caches the newest posts in a sorted set per user in redis
+// the cached timeline is always a gapless prefix of the stored one
+type mongoDBTimelineRepository struct {
+	client      *mongo.Client
+	cacheClient *redis.Client
+	name        string
+	policy      TimelineCachePolicy
+}
+
+func newMongoDBTimelineRepository(ctx context.Context, opts Options, name string, policy TimelineCachePolicy) (*mongoDBTimelineRepository, error) {
+	client, err := storage.MongoDBClient(ctx, opts.MongoDBAddr, opts.MongoDBPort)
+	if err != nil {
+		return nil, err
+	}
+	cacheClient, err := storage.RedisClient(opts.CacheAddr, opts.CachePort)
+	if err != nil {
+		return nil, err
+	}
+	r := &mongoDBTimelineRepository{
+		client:      client,
+		cacheClient: cacheClient,
+		name:        name,
+		policy:      policy,
+	}
+	return r, nil
+}
+
+// EnsureIndexes makes user_id unique, which the upserts of PushPost and AddPullUser rely on
+func (r *mongoDBTimelineRepository) EnsureIndexes(ctx context.Context) error {
+	primary, err := storage.IsMongoDBPrimary(ctx, r.client)
+	if err != nil || !primary {
+		return err
+	}
+	for _, collection := range []*mongo.Collection{r.timelines(), r.pullUsers()} {
+		_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "user_id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		})
+		if err != nil {
+			return fmt.Errorf("error creating %s index: %s", collection.Name(), err.Error())
+		}
+	}
+	return nil
+}
+
+func (r *mongoDBTimelineRepository) timelines() *mongo.Collection {
+	return r.client.Database(r.name).Collection(r.name)
+}
+
+// pullUsers holds a document per user added with AddPullUser, in the database of the timelines
+func (r *mongoDBTimelineRepository) pullUsers() *mongo.Collection {
+	return r.client.Database(r.name).Collection(r.name + "-pull-users")
+}
+
+// ReadTimeline reads the posts of the page from redis, or from mongodb if the cached timeline
+// is missing the posts of the page (e.g. after being flushed, trimmed or expired)
+// in the latter case, every post down to the oldest one of the page is cached again, so that
+// the cached timeline remains a gapless prefix of the stored one
+func (r *mongoDBTimelineRepository) ReadTimeline(ctx context.Context, userID int64, query model.TimelineQuery) ([]model.TimelinePostInfo, error) {
+	key := strconv.FormatInt(userID, 10)
+	found, err := ResolveCursors(&query, func(postID int64) (int64, bool, error) {
+		score, err := r.cacheClient.ZScore(ctx, key, strconv.FormatInt(postID, 10)).Result()
+		if err == nil {
+			return int64(score), true, nil
+		}
+		if err != redis.Nil {
+			return 0, false, err
+		}
+		return r.postTimestamp(ctx, userID, postID)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error resolving timeline cursors: %s", err.Error())
+	}
+	if !found {
+		return nil, nil
+	}
+
+	cachedPosts, err := readCachedTimelinePage(ctx, r.cacheClient, key, query)
+	if err != nil {
+		return nil, fmt.Errorf("error reading timeline from redis: %s", err.Error())
+	}
+	err = r.policy.touch(ctx, r.cacheClient, key)
+	if err != nil {
+		return nil, fmt.Errorf("error refreshing timeline ttl in redis: %s", err.Error())
+	}
+	// a short page means that either the timeline has no older posts or they are not cached
+	if int64(len(cachedPosts)) > query.Stop-query.Start {
+		return cachedPosts, nil
+	}
+	storedPosts, err := r.aggregate(ctx, userID, timelineQueryFilter(query), query.Start, query.Stop-query.Start+1)
+	if err != nil {
+		return nil, fmt.Errorf("error reading timeline from mongodb: %s", err.Error())
+	}
+	if len(storedPosts) <= len(cachedPosts) {
+		return cachedPosts, nil
+	}
+
+	// every post of the stored timeline down to the oldest post of the page
+	prefixFilter := bson.D{{Key: "timestamp", Value: bson.D{{Key: "$gte", Value: storedPosts[len(storedPosts)-1].Timestamp}}}}
+	prefix, err := r.aggregate(ctx, userID, prefixFilter, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error reading timeline from mongodb: %s", err.Error())
+	}
+	// pages past the max length are trimmed right away and keep being read from mongodb
+	_, err = r.cacheClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		r.policy.cachePosts(ctx, pipe, key, prefix...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error updating redis with timeline posts: %s", err.Error())
+	}
+	return storedPosts, nil
+}
+
+// readCachedTimelinePage reads the posts of the page from the timeline sorted set in redis
+// one post past the end of the page is also returned to tell whether there are older posts
+// the cursors of the query must be resolved
+func readCachedTimelinePage(ctx context.Context, client *redis.Client, key string, query model.TimelineQuery) ([]model.TimelinePostInfo, error) {
+	rangeBy := &redis.ZRangeBy{
+		Min:    "-inf",
+		Max:    "+inf",
+		Offset: query.Start,
+		Count:  query.Stop - query.Start + 1,
+	}
+	if query.Until > 0 {
+		rangeBy.Max = strconv.FormatInt(query.Until, 10)
+	}
+	if query.Since > 0 {
+		rangeBy.Min = strconv.FormatInt(query.Since, 10)
+	}
+
+	maxCursor := model.TimelinePostInfo{PostID: query.MaxID, Timestamp: query.MaxIDTimestamp}
+	if query.MaxID != 0 && (query.Until == 0 || maxCursor.Timestamp <= query.Until) {
+		// skip max_id and the newer posts with the same timestamp
+		maxScoreStr := strconv.FormatInt(maxCursor.Timestamp, 10)
+		ties, err := client.ZRevRangeByScore(ctx, key, &redis.ZRangeBy{Min: maxScoreStr, Max: maxScoreStr}).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range ties {
+			postID, err := strconv.ParseInt(member, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			if !OlderThan(model.TimelinePostInfo{PostID: postID, Timestamp: maxCursor.Timestamp}, maxCursor) {
+				rangeBy.Offset++
+			}
+		}
+		rangeBy.Max = maxScoreStr
+	}
+
+	sinceCursor := model.TimelinePostInfo{PostID: query.SinceID, Timestamp: query.SinceIDTimestamp}
+	if query.SinceID != 0 && sinceCursor.Timestamp >= query.Since {
+		rangeBy.Min = strconv.FormatInt(sinceCursor.Timestamp, 10)
+	}
+
+	result, err := client.ZRevRangeByScoreWithScores(ctx, key, rangeBy).Result()
+	if err != nil {
+		return nil, err
+	}
+	var posts []model.TimelinePostInfo
+	for _, z := range result {
+		postID, err := strconv.ParseInt(z.Member.(string), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		post := model.TimelinePostInfo{PostID: postID, Timestamp: int64(z.Score)}
+		// since_id is the oldest post that may be returned, so every post past it is discarded
+		if query.SinceID != 0 && !OlderThan(sinceCursor, post) {
+			break
+		}
+		posts = append(posts, post)
+	}
+	return posts, nil
+}
+
+// timelineQueryFilter matches the timestamp and post_id fields against the time range and the resolved cursors of the query
+// note that posts with the same timestamp are sorted by their numeric post id in mongodb, unlike in redis
+func timelineQueryFilter(query model.TimelineQuery) bson.D {
+	filter := bson.D{}
+	timestampRange := bson.D{}
+	if query.Since > 0 {
+		timestampRange = append(timestampRange, bson.E{Key: "$gte", Value: query.Since})
+	}
+	if query.Until > 0 {
+		timestampRange = append(timestampRange, bson.E{Key: "$lte", Value: query.Until})
+	}
+	if len(timestampRange) > 0 {
+		filter = append(filter, bson.E{Key: "timestamp", Value: timestampRange})
+	}
+	for _, cursor := range []struct {
+		postID    int64
+		timestamp int64
+		op        string
+	}{{query.MaxID, query.MaxIDTimestamp, "$lt"}, {query.SinceID, query.SinceIDTimestamp, "$gt"}} {
+		if cursor.postID == 0 {
+			continue
+		}
+		filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+			bson.D{{Key: "timestamp", Value: bson.D{{Key: cursor.op, Value: cursor.timestamp}}}},
+			bson.D{
+				{Key: "timestamp", Value: cursor.timestamp},
+				{Key: "post_id", Value: bson.D{{Key: cursor.op, Value: cursor.postID}}},
+			},
+		}})
+	}
+	// every cursor adds an $or clause, so they are combined with $and
+	if len(filter) > 1 {
+		conditions := bson.A{}
+		for _, e := range filter {
+			conditions = append(conditions, bson.D{e})
+		}
+		filter = bson.D{{Key: "$and", Value: conditions}}
+	}
+	return filter
+}
+
+// aggregate returns the sorted posts of the timeline document that match the filter
+// all posts past skip are returned if limit is 0
+func (r *mongoDBTimelineRepository) aggregate(ctx context.Context, userID int64, filter bson.D, skip int64, limit int64) ([]model.TimelinePostInfo, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "user_id", Value: userID}}}},
+		{{Key: "$unwind", Value: "$posts"}},
+		{{Key: "$replaceRoot", Value: bson.D{{Key: "newRoot", Value: "$posts"}}}},
+		{{Key: "$match", Value: filter}},
+		{{Key: "$sort", Value: bson.D{{Key: "timestamp", Value: -1}, {Key: "post_id", Value: -1}}}},
+		{{Key: "$skip", Value: skip}},
+	}
+	if limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit}})
+	}
+	cur, err := r.timelines().Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var posts []model.TimelinePostInfo
+	err = cur.All(ctx, &posts)
+	if err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+// postTimestamp returns the timestamp of the post in the timeline document of the user
+func (r *mongoDBTimelineRepository) postTimestamp(ctx context.Context, userID int64, postID int64) (int64, bool, error) {
+	filter := bson.D{
+		{Key: "user_id", Value: userID},
+		{Key: "posts.post_id", Value: postID},
+	}
+	opts := options.FindOne().SetProjection(bson.D{{Key: "posts.$", Value: 1}})
+	var timeline model.Timeline
+	err := r.timelines().FindOne(ctx, filter, opts).Decode(&timeline)
+	if err == mongo.ErrNoDocuments || (err == nil && len(timeline.Posts) == 0) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return timeline.Posts[0].Timestamp, true, nil
+}
+
+// ReadPostIDs reads the ids of the posts of the timeline document in mongodb
+func (r *mongoDBTimelineRepository) ReadPostIDs(ctx context.Context, userID int64) ([]int64, error) {
+	var timeline model.Timeline
+	opts := options.FindOne().SetProjection(bson.D{{Key: "posts.post_id", Value: 1}})
+	err := r.timelines().FindOne(ctx, bson.D{{Key: "user_id", Value: userID}}, opts).Decode(&timeline)
+	if err == mongo.ErrNoDocuments {
+		return []int64{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	postIDs := make([]int64, 0, len(timeline.Posts))
+	for _, post := range timeline.Posts {
+		postIDs = append(postIDs, post.PostID)
+	}
+	return postIDs, nil
+}
+
+// PushPost adds the post to the front of the timeline documents of the users in mongodb and then to their cached timelines
+// users that already have the post are skipped, so that redelivered notifications are no-ops
+func (r *mongoDBTimelineRepository) PushPost(ctx context.Context, userIDs []int64, post model.TimelinePostInfo) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+	writes := make([]mongo.WriteModel, 0, len(userIDs))
+	for _, userID := range userIDs {
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{
+				{Key: "user_id", Value: userID},
+				{Key: "posts.post_id", Value: bson.D{{Key: "$ne", Value: post.PostID}}},
+			}).
+			SetUpdate(bson.D{{Key: "$push", Value: bson.D{
+				{Key: "posts", Value: bson.D{
+					{Key: "$each", Value: bson.A{post}},
+					{Key: "$position", Value: 0},
+				}},
+			}}}).
+			SetUpsert(true))
+	}
+	_, err := r.timelines().BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	if err != nil && !onlyDuplicateKeyErrors(err) {
+		return fmt.Errorf("error writing timelines to mongodb: %s", err.Error())
+	}
+	_, err = r.cacheClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, userID := range userIDs {
+			r.policy.cachePosts(ctx, pipe, strconv.FormatInt(userID, 10), post)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error writing timelines to redis: %s", err.Error())
+	}
+	return nil
+}
+
+// onlyDuplicateKeyErrors returns true if all writes failed because of an existing user_id,
+// i.e. the upsert did not match because the user's timeline already has the post
+func onlyDuplicateKeyErrors(err error) bool {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		return false
+	}
+	for _, writeErr := range bulkErr.WriteErrors {
+		if writeErr.Code != MONGODB_DUPLICATE_KEY_ERROR {
+			return false
+		}
+	}
+	return true
+}
+
+// AddPosts adds the posts to the timeline document of the user in mongodb, and to its cached timeline
+// those older than the oldest cached post so that it remains a gapless prefix of the stored timeline
+// nothing is cached if the timeline is not, since the next read repopulates it from mongodb
+func (r *mongoDBTimelineRepository) AddPosts(ctx context.Context, userID int64, posts []model.TimelinePostInfo) error {
+	if len(posts) == 0 {
+		return nil
+	}
+	each := bson.A{}
+	for _, post := range posts {
+		each = append(each, post)
+	}
+	update := bson.D{{Key: "$addToSet", Value: bson.D{
+		{Key: "posts", Value: bson.D{{Key: "$each", Value: each}}},
+	}}}
+	_, err := r.timelines().UpdateOne(ctx, bson.D{{Key: "user_id", Value: userID}}, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("error writing timeline to mongodb: %s", err.Error())
+	}
+
+	key := strconv.FormatInt(userID, 10)
+	oldest, err := r.cacheClient.ZRangeWithScores(ctx, key, 0, 0).Result()
+	if err != nil || len(oldest) == 0 {
+		return err
+	}
+	oldestPostID, err := strconv.ParseInt(oldest[0].Member.(string), 10, 64)
+	if err != nil {
+		return err
+	}
+	cursor := model.TimelinePostInfo{PostID: oldestPostID, Timestamp: int64(oldest[0].Score)}
+	var newer []model.TimelinePostInfo
+	for _, post := range posts {
+		if !OlderThan(post, cursor) {
+			newer = append(newer, post)
+		}
+	}
+	_, err = r.cacheClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		r.policy.cachePosts(ctx, pipe, key, newer...)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error writing timeline to redis: %s", err.Error())
+	}
+	return nil
+}
+
+// RemovePosts removes the posts from the timeline of the user, both in mongodb and in the cache
+func (r *mongoDBTimelineRepository) RemovePosts(ctx context.Context, userID int64, postIDs []int64) error {
+	if len(postIDs) == 0 {
+		return nil
+	}
+	update := bson.D{{Key: "$pull", Value: bson.D{
+		{Key: "posts", Value: bson.D{{Key: "post_id", Value: bson.D{{Key: "$in", Value: postIDs}}}}},
+	}}}
+	_, err := r.timelines().UpdateOne(ctx, bson.D{{Key: "user_id", Value: userID}}, update)
+	if err != nil {
+		return err
+	}
+	members := make([]interface{}, 0, len(postIDs))
+	for _, postID := range postIDs {
+		members = append(members, postID)
+	}
+	return r.cacheClient.ZRem(ctx, strconv.FormatInt(userID, 10), members...).Err()
+}
+
+// RemovePost removes the post from the timelines of the users, both in mongodb and in the cache
+func (r *mongoDBTimelineRepository) RemovePost(ctx context.Context, userIDs []int64, postID int64) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+	filter := bson.D{{Key: "user_id", Value: bson.D{{Key: "$in", Value: userIDs}}}}
+	update := bson.D{{Key: "$pull", Value: bson.D{
+		{Key: "posts", Value: bson.D{{Key: "post_id", Value: postID}}},
+	}}}
+	_, err := r.timelines().UpdateMany(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	_, err = r.cacheClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, userID := range userIDs {
+			pipe.ZRem(ctx, strconv.FormatInt(userID, 10), postID)
+		}
+		return nil
+	})
+	return err
+}
+
+// ReplaceTimeline replaces the stored timeline of the user and its cached timeline, which holds every post
+// until the next compaction
+func (r *mongoDBTimelineRepository) ReplaceTimeline(ctx context.Context, userID int64, posts []model.TimelinePostInfo) error {
+	timeline := model.Timeline{UserID: userID, Posts: posts}
+	_, err := r.timelines().ReplaceOne(ctx, bson.D{{Key: "user_id", Value: userID}}, timeline, options.Replace().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+	key := strconv.FormatInt(userID, 10)
+	members := make([]redis.Z, 0, len(posts))
+	for _, post := range posts {
+		members = append(members, redis.Z{Member: post.PostID, Score: float64(post.Timestamp)})
+	}
+	_, err = r.cacheClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		if len(members) > 0 {
+			pipe.ZAdd(ctx, key, members...)
+		}
+		return nil
+	})
+	return err
+}
+
+// Compact trims every cached timeline, e.g. those that grew past the max length before
+// it was lowered or that were rebuilt in full
+// other sorted sets in the same redis instance (e.g. "<user id>:followers") are skipped
+func (r *mongoDBTimelineRepository) Compact(ctx context.Context) (int64, error) {
+	if r.policy.maxLength == 0 && r.policy.ttl == 0 {
+		return 0, nil
+	}
+	var removed int64
+	var cursor uint64
+	for {
+		keys, next, err := r.cacheClient.ScanType(ctx, cursor, "*", TIMELINE_COMPACTION_SCAN_COUNT, "zset").Result()
+		if err != nil {
+			return removed, err
+		}
+		var cmds []*redis.IntCmd
+		_, err = r.cacheClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, key := range keys {
+				if _, err := strconv.ParseInt(key, 10, 64); err != nil {
+					continue
+				}
+				if cmd := r.policy.trim(ctx, pipe, key); cmd != nil {
+					cmds = append(cmds, cmd)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return removed, err
+		}
+		for _, cmd := range cmds {
+			removed += cmd.Val()
+		}
+		cursor = next
+		if cursor == 0 {
+			return removed, nil
+		}
+	}
+}
+
+// AddPullUser upserts the document of the user in mongodb, which is never cached
+// so that readers of the timelines always find it once it is written
+func (r *mongoDBTimelineRepository) AddPullUser(ctx context.Context, userID int64) error {
+	filter := bson.D{{Key: "user_id", Value: userID}}
+	update := bson.D{{Key: "$setOnInsert", Value: bson.D{{Key: "user_id", Value: userID}}}}
+	_, err := r.pullUsers().UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("error writing pull user to mongodb: %s", err.Error())
+	}
+	return nil
+}
+
+func (r *mongoDBTimelineRepository) FilterPullUsers(ctx context.Context, userIDs []int64) ([]int64, error) {
+	if len(userIDs) == 0 {
+		return nil, nil
+	}
+	filter := bson.D{{Key: "user_id", Value: bson.D{{Key: "$in", Value: userIDs}}}}
+	opts := options.Find().SetProjection(bson.D{{Key: "user_id", Value: 1}, {Key: "_id", Value: 0}})
+	cur, err := r.pullUsers().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error reading pull users from mongodb: %s", err.Error())
+	}
+	var docs []struct {
+		UserID int64 `bson:"user_id"`
+	}
+	err = cur.All(ctx, &docs)
+	if err != nil {
+		return nil, fmt.Errorf("error reading pull users from mongodb: %s", err.Error())
+	}
+	found := make(map[int64]bool, len(docs))
+	for _, doc := range docs {
+		found[doc.UserID] = true
+	}
+	var pullUserIDs []int64
+	for _, userID := range userIDs {
+		if found[userID] {
+			pullUserIDs = append(pullUserIDs, userID)
+		}
+	}
+	return pullUserIDs, nil
+}
+
+// cachePosts queues the writes of the posts to the cached timeline, followed by its trimming
+func (p TimelineCachePolicy) cachePosts(ctx context.Context, pipe redis.Pipeliner, key string, posts ...model.TimelinePostInfo) {
+	if len(posts) == 0 {
+		return
+	}
+	members := make([]redis.Z, 0, len(posts))
+	for _, post := range posts {
+		members = append(members, redis.Z{Member: post.PostID, Score: float64(post.Timestamp)})
+	}
+	pipe.ZAddNX(ctx, key, members...)
+	p.trim(ctx, pipe, key)
+}
+
+// trim queues the removal of the posts past the max length of the cached timeline
+// and sets its ttl if it has none, so that writes alone do not keep unread timelines cached
+func (p TimelineCachePolicy) trim(ctx context.Context, pipe redis.Pipeliner, key string) *redis.IntCmd {
+	var cmd *redis.IntCmd
+	if p.maxLength > 0 {
+		// ranks are in ascending order, so the oldest posts are removed and the cached timeline remains a prefix
+		cmd = pipe.ZRemRangeByRank(ctx, key, 0, -p.maxLength-1)
+	}
+	if p.ttl > 0 {
+		pipe.ExpireNX(ctx, key, p.ttl)
+	}
+	return cmd
+}
+
+// touch extends the ttl of the cached timeline after a read
+func (p TimelineCachePolicy) touch(ctx context.Context, client *redis.Client, key string) error {
+	if p.ttl <= 0 {
+		return nil
+	}
+	return client.Expire(ctx, key, p.ttl).Err()
+}
@@ -0,0 +1,47 @@
+package repository
+
+import (
+	"context"
+
+	"socialnetwork/pkg/model"
+)
+
+type memoryURLs struct {
+	memoryStore
+	urls map[string]model.URL
+}
+
+type memoryURLRepository struct {
+	store *memoryURLs
+}
+
+func newMemoryURLRepository(opts Options) *memoryURLRepository {
+	store := memoryDatastore(opts.MongoDBAddr, opts.MongoDBPort, "url-shorten", func() *memoryURLs {
+		return &memoryURLs{urls: make(map[string]model.URL)}
+	})
+	return &memoryURLRepository{store: store}
+}
+
+func (r *memoryURLRepository) InsertURLs(ctx context.Context, urls []model.URL) error {
+	_, err := memoryWrite(r.store, func(s *memoryURLs) struct{} {
+		for _, url := range urls {
+			s.urls[url.ShortenedUrl] = url
+		}
+		return struct{}{}
+	})
+	return err
+}
+
+func (r *memoryURLRepository) FindURLs(ctx context.Context, shortenedUrls []string) ([]model.URL, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	urls := []model.URL{}
+	seen := make(map[string]bool, len(shortenedUrls))
+	for _, shortenedUrl := range shortenedUrls {
+		if url, ok := r.store.urls[shortenedUrl]; ok && !seen[shortenedUrl] {
+			urls = append(urls, url)
+		}
+		seen[shortenedUrl] = true
+	}
+	return urls, nil
+}
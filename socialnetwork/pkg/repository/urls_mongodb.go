@@ -0,0 +1,55 @@
+package repository
+
+import (
+	"context"
+
+	"socialnetwork/pkg/model"
+	"socialnetwork/pkg/storage"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type mongoDBURLRepository struct {
+	client *mongo.Client
+}
+
+func newMongoDBURLRepository(ctx context.Context, opts Options) (*mongoDBURLRepository, error) {
+	client, err := storage.MongoDBClient(ctx, opts.MongoDBAddr, opts.MongoDBPort)
+	if err != nil {
+		return nil, err
+	}
+	return &mongoDBURLRepository{client: client}, nil
+}
+
+func (r *mongoDBURLRepository) urls() *mongo.Collection {
+	return r.client.Database("url-shorten").Collection("url-shorten")
+}
+
+func (r *mongoDBURLRepository) InsertURLs(ctx context.Context, urls []model.URL) error {
+	if len(urls) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, 0, len(urls))
+	for _, url := range urls {
+		docs = append(docs, url)
+	}
+	_, err := r.urls().InsertMany(ctx, docs)
+	return err
+}
+
+func (r *mongoDBURLRepository) FindURLs(ctx context.Context, shortenedUrls []string) ([]model.URL, error) {
+	urls := []model.URL{}
+	if len(shortenedUrls) == 0 {
+		return urls, nil
+	}
+	cur, err := r.urls().Find(ctx, bson.D{{Key: "shortened_url", Value: bson.D{{Key: "$in", Value: shortenedUrls}}}})
+	if err != nil {
+		return nil, err
+	}
+	err = cur.All(ctx, &urls)
+	if err != nil {
+		return nil, err
+	}
+	return urls, nil
+}
@@ -0,0 +1,87 @@
+package repository
+
+import (
+	"context"
+
+	"socialnetwork/pkg/model"
+)
+
+type memoryUsers struct {
+	memoryStore
+	users map[string]model.User
+	// registered user ids
+	userIDs map[int64]bool
+}
+
+type memoryUserRepository struct {
+	store *memoryUsers
+}
+
+func newMemoryUserRepository(opts Options) *memoryUserRepository {
+	store := memoryDatastore(opts.MongoDBAddr, opts.MongoDBPort, "user", func() *memoryUsers {
+		return &memoryUsers{users: make(map[string]model.User), userIDs: make(map[int64]bool)}
+	})
+	return &memoryUserRepository{store: store}
+}
+
+func (r *memoryUserRepository) EnsureIndexes(ctx context.Context) error {
+	return nil
+}
+
+func (r *memoryUserRepository) InsertUser(ctx context.Context, user model.User) error {
+	taken, err := memoryWrite(r.store, func(s *memoryUsers) error {
+		if _, ok := s.users[user.Username]; ok {
+			return ErrUsernameTaken
+		}
+		if s.userIDs[user.UserID] {
+			return ErrUserIDTaken
+		}
+		s.insert(user)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return taken
+}
+
+func (r *memoryUserRepository) InsertUsers(ctx context.Context, users []model.User) (int, error) {
+	return memoryWrite(r.store, func(s *memoryUsers) int {
+		inserted := 0
+		for _, user := range users {
+			_, ok := s.users[user.Username]
+			if !ok && !s.userIDs[user.UserID] {
+				s.insert(user)
+				inserted++
+			}
+		}
+		return inserted
+	})
+}
+
+func (s *memoryUsers) insert(user model.User) {
+	s.users[user.Username] = user
+	s.userIDs[user.UserID] = true
+}
+
+func (r *memoryUserRepository) FindUser(ctx context.Context, username string) (model.User, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	user, ok := r.store.users[username]
+	if !ok {
+		return model.User{}, ErrNotFound
+	}
+	return user, nil
+}
+
+func (r *memoryUserRepository) FindUserIDs(ctx context.Context, usernames []string) (map[string]int64, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	userIDs := make(map[string]int64, len(usernames))
+	for _, username := range usernames {
+		if user, ok := r.store.users[username]; ok {
+			userIDs[username] = user.UserID
+		}
+	}
+	return userIDs, nil
+}
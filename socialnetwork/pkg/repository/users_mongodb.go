@@ -0,0 +1,187 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"socialnetwork/pkg/model"
+	"socialnetwork/pkg/storage"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoDBUserRepository stores the users in mongodb and caches them in memcached by their username,
+// under "<username>:user" (the whole user) and "<username>:user_id" (only its id)
+type mongoDBUserRepository struct {
+	client      *mongo.Client
+	cacheClient *memcache.Client
+}
+
+func newMongoDBUserRepository(ctx context.Context, opts Options) (*mongoDBUserRepository, error) {
+	client, err := storage.MongoDBClient(ctx, opts.MongoDBAddr, opts.MongoDBPort)
+	if err != nil {
+		return nil, err
+	}
+	cacheClient, err := storage.MemCachedClient(opts.CacheAddr, opts.CachePort)
+	if err != nil {
+		return nil, err
+	}
+	return &mongoDBUserRepository{client: client, cacheClient: cacheClient}, nil
+}
+
+func (r *mongoDBUserRepository) users() *mongo.Collection {
+	return r.client.Database("user").Collection("user")
+}
+
+// EnsureIndexes makes user_id unique, so that no user can register with the id of another user
+func (r *mongoDBUserRepository) EnsureIndexes(ctx context.Context) error {
+	primary, err := storage.IsMongoDBPrimary(ctx, r.client)
+	if err != nil || !primary {
+		return err
+	}
+	_, err = r.users().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "user_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("error creating user index: %s", err.Error())
+	}
+	return nil
+}
+
+func (r *mongoDBUserRepository) InsertUser(ctx context.Context, user model.User) error {
+	_, err := r.findUser(ctx, user.Username)
+	if err == nil {
+		return ErrUsernameTaken
+	}
+	if err != ErrNotFound {
+		return err
+	}
+	_, err = r.users().InsertOne(ctx, user)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrUserIDTaken
+	}
+	return err
+}
+
+// InsertUsers upserts the users by their username, so that loading the same users twice is a no-op
+// users with the id of another user are rejected by the unique index and skipped
+func (r *mongoDBUserRepository) InsertUsers(ctx context.Context, users []model.User) (int, error) {
+	if len(users) == 0 {
+		return 0, nil
+	}
+	writes := make([]mongo.WriteModel, 0, len(users))
+	for _, user := range users {
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"username": user.Username}).
+			SetUpdate(bson.M{"$setOnInsert": user}).
+			SetUpsert(true))
+	}
+	result, err := r.users().BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil {
+		for _, writeErr := range bulkErr.WriteErrors {
+			if writeErr.Code != MONGODB_DUPLICATE_KEY_ERROR {
+				return 0, err
+			}
+		}
+		err = nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int(result.UpsertedCount), nil
+}
+
+// FindUser reads the user from the cache, or from mongodb and caches it
+func (r *mongoDBUserRepository) FindUser(ctx context.Context, username string) (model.User, error) {
+	var user model.User
+	item, err := r.cacheClient.Get(username + ":user")
+	if err != nil && err != memcache.ErrCacheMiss {
+		return user, err
+	}
+	if err == nil {
+		err = json.Unmarshal(item.Value, &user)
+		return user, err
+	}
+	user, err = r.findUser(ctx, username)
+	if err != nil {
+		return user, err
+	}
+	userJSON, err := json.Marshal(user)
+	if err != nil {
+		return user, err
+	}
+	return user, r.cacheClient.Set(&memcache.Item{Key: username + ":user", Value: userJSON})
+}
+
+func (r *mongoDBUserRepository) findUser(ctx context.Context, username string) (model.User, error) {
+	var user model.User
+	err := r.users().FindOne(ctx, bson.D{{Key: "username", Value: username}}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return user, ErrNotFound
+	}
+	return user, err
+}
+
+// FindUserIDs reads the ids from the cache, and those not cached from mongodb
+func (r *mongoDBUserRepository) FindUserIDs(ctx context.Context, usernames []string) (map[string]int64, error) {
+	userIDs := make(map[string]int64, len(usernames))
+	if len(usernames) == 0 {
+		return userIDs, nil
+	}
+	keys := make([]string, 0, len(usernames))
+	for _, username := range usernames {
+		keys = append(keys, username+":user_id")
+	}
+	items, err := r.cacheClient.GetMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+	var notCached []string
+	for _, username := range usernames {
+		item, ok := items[username+":user_id"]
+		if !ok {
+			notCached = append(notCached, username)
+			continue
+		}
+		var userID int64
+		err := json.Unmarshal(item.Value, &userID)
+		if err != nil {
+			return nil, err
+		}
+		userIDs[username] = userID
+	}
+	if len(notCached) == 0 {
+		return userIDs, nil
+	}
+
+	filter := bson.D{{Key: "username", Value: bson.D{{Key: "$in", Value: notCached}}}}
+	opts := options.Find().SetProjection(bson.D{{Key: "user_id", Value: 1}, {Key: "username", Value: 1}})
+	cur, err := r.users().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var users []model.UserMention
+	err = cur.All(ctx, &users)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		userIDs[user.Username] = user.UserID
+		userIDJSON, err := json.Marshal(user.UserID)
+		if err != nil {
+			return nil, err
+		}
+		err = r.cacheClient.Set(&memcache.Item{Key: user.Username + ":user_id", Value: userIDJSON})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return userIDs, nil
+}
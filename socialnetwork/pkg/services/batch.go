@@ -0,0 +1,33 @@
+package services
+
+import (
+	"context"
+
+	"socialnetwork/pkg/model"
+	"socialnetwork/pkg/repository"
+)
+
+// batch writes used by the social graph loader, either through the user and social graph
+// services or straight against their repositories (offline mode)
+// all writes are upserts or conditional updates so that loading the same batch twice is a no-op
+
+// RegisterUsersBatch inserts the users that are not yet registered with their username
+// and returns the number of new users
+func RegisterUsersBatch(ctx context.Context, users repository.UserRepository, registrations []model.UserRegistration) (int, error) {
+	if len(registrations) == 0 {
+		return 0, nil
+	}
+	newUsers := make([]model.User, 0, len(registrations))
+	for _, reg := range registrations {
+		salt := genRandomStr(32)
+		newUsers = append(newUsers, model.User{
+			UserID:    reg.UserID,
+			FirstName: reg.FirstName,
+			LastName:  reg.LastName,
+			Username:  reg.Username,
+			PwdHashed: hashPwd([]byte(reg.Password + salt)),
+			Salt:      salt,
+		})
+	}
+	return users.InsertUsers(ctx, newUsers)
+}
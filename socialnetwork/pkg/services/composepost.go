@@ -4,18 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"strconv"
-	"sync"
 	"time"
 
 	sn_metrics "socialnetwork/pkg/metrics"
 	"socialnetwork/pkg/model"
-	"socialnetwork/pkg/storage"
+	"socialnetwork/pkg/repository"
 	sn_trace "socialnetwork/pkg/trace"
 
 	"github.com/ServiceWeaver/weaver"
-	amqp "github.com/rabbitmq/amqp091-go"
-	"github.com/redis/go-redis/v9"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 )
@@ -24,34 +20,51 @@ type ComposePostService interface {
 	UploadCreator(ctx context.Context, reqID int64, creator model.Creator) error
 	UploadText(ctx context.Context, reqID int64, text string) error
 	UploadMedia(ctx context.Context, reqID int64, medias []model.Media) error
-	UploadUniqueId(ctx context.Context, reqID int64, postID int64, postType model.PostType) error
+	UploadUniqueId(ctx context.Context, reqID int64, postID int64, postType model.PostType, parentPostID int64) error
 	UploadUrls(ctx context.Context, reqID int64, urls []model.URL) error
 	UploadUserMentions(ctx context.Context, reqID int64, userMentions []model.UserMention) error
 }
 
+// every upload is counted in the draft, so a retried upload would compose the post before all its components arrive
+var _ weaver.NotRetriable = ComposePostService.UploadCreator
+var _ weaver.NotRetriable = ComposePostService.UploadText
+var _ weaver.NotRetriable = ComposePostService.UploadMedia
+var _ weaver.NotRetriable = ComposePostService.UploadUniqueId
+var _ weaver.NotRetriable = ComposePostService.UploadUrls
+var _ weaver.NotRetriable = ComposePostService.UploadUserMentions
+
 const NUM_COMPONENTS int = 6 // corresponds to the number of exposed methods
 const REDIS_EXPIRE_TIME int = 12
 
 type composePostService struct {
 	weaver.Implements[ComposePostService]
 	weaver.WithConfig[composePostServiceOptions]
-	postStorageService  weaver.Ref[PostStorageService]
-	userTimelineService weaver.Ref[UserTimelineService]
-	_                   weaver.Ref[WriteHomeTimelineService]
-	redisClient         *redis.Client
-	amqClientPool 		*storage.RabbitMQClientPool
-	
+	postStorageService   weaver.Ref[PostStorageService]
+	userTimelineService  weaver.Ref[UserTimelineService]
+	directMessageService weaver.Ref[DirectMessageService]
+	_                    weaver.Ref[WriteHomeTimelineService]
+	drafts               repository.DraftRepository
 }
 
 type composePostServiceOptions struct {
-	RabbitMQAddr string 	`toml:"rabbitmq_address"`
+	// storage backend of the drafts: "mongodb" (default, i.e. redis) or "memory"
+	StorageBackend string 	`toml:"storage_backend"`
 	RedisAddr    string 	`toml:"redis_address"`
-	RabbitMQPort int    	`toml:"rabbitmq_port"`
 	RedisPort    int    	`toml:"redis_port"`
 	Region       string 	`toml:"region"`
 	Regions      []string 	`toml:"regions"`
 }
 
+// InvalidPostError is returned when the composed post is rejected, e.g. a direct message without recipients
+type InvalidPostError struct {
+	weaver.AutoMarshal
+	Reason string
+}
+
+func (e InvalidPostError) Error() string {
+	return e.Reason
+}
+
 type MethodLabels struct {
 	Caller    string // full calling component name
 	Component string // full callee component name
@@ -62,46 +75,26 @@ type MethodLabels struct {
 func (c *composePostService) Init(ctx context.Context) error {
 	logger := c.Logger(ctx)
 	var err error
-	c.amqClientPool, err = storage.NewRabbitMQClientPool(ctx, c.Config().RabbitMQAddr, c.Config().RabbitMQPort, 0, 500)
+	c.drafts, err = repository.NewDraftRepository(repository.Options{
+		Backend:   c.Config().StorageBackend,
+		CacheAddr: c.Config().RedisAddr,
+		CachePort: c.Config().RedisPort,
+	})
 	if err != nil {
-		logger.Error("error initializing rabbitmq client pool", "msg", err.Error())
+		logger.Error("error initializing draft repository", "msg", err.Error())
 		return err
 	}
-	c.redisClient = storage.RedisClient(c.Config().RedisAddr, c.Config().RedisPort)
-	logger.Info("compose post service running!", "region", c.Config().Region, "regions", c.Config().Regions,
-		"rabbitmq_addr", c.Config().RabbitMQAddr, "rabbitmq_port", c.Config().RabbitMQPort,
+	logger.Info("compose post service running!", "region", c.Config().Region, "regions", c.Config().Regions, "storage_backend", c.Config().StorageBackend,
 		"redis_addr", c.Config().RedisAddr, "redis_port", c.Config().RedisPort,
 	)
 	return nil
 }
 
-func (c *composePostService) uploadComponent(ctx context.Context, reqID int64, fieldsValues ...interface{}) error {
+func (c *composePostService) uploadComponent(ctx context.Context, reqID int64, fields map[string][]byte) error {
 	logger := c.Logger(ctx)
-	reqIDStr := strconv.FormatInt(reqID, 10)
-	cmds, err := c.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
-		err := pipe.HSet(ctx, reqIDStr, fieldsValues).Err()
-		if err != nil {
-			return err
-		}
-		err = pipe.HIncrBy(ctx, reqIDStr, "num_components", 1).Err()
-		if err != nil {
-			return err
-		}
-		err = pipe.Expire(ctx, reqIDStr, time.Second*time.Duration(REDIS_EXPIRE_TIME)).Err()
-		if err != nil {
-			return err
-		}
-		return nil
-	})
-
-	if err != nil || len(cmds) != 3 /* sanity check */ {
-		logger.Error("error writing component to redis", "fieldValues", fieldsValues, "msg", err.Error())
-		return err
-	}
-
-	numComponents, err := cmds[1].(*redis.IntCmd).Result()
+	numComponents, err := c.drafts.SaveComponent(ctx, reqID, fields, time.Second*time.Duration(REDIS_EXPIRE_TIME))
 	if err != nil {
-		logger.Error("error reading number of written components from redis", "fieldValues", fieldsValues, "msg", err.Error())
+		logger.Error("error writing component to draft", "fields", fields, "msg", err.Error())
 		return err
 	}
 
@@ -120,7 +113,7 @@ func (c *composePostService) UploadText(ctx context.Context, reqID int64, text s
 		logger.Error("error converting text to json", "text", text)
 		return err
 	}
-	return c.uploadComponent(ctx, reqID, "text", textJSON)
+	return c.uploadComponent(ctx, reqID, map[string][]byte{"text": textJSON})
 }
 
 func (c *composePostService) UploadMedia(ctx context.Context, reqID int64, medias []model.Media) error {
@@ -131,12 +124,12 @@ func (c *composePostService) UploadMedia(ctx context.Context, reqID int64, media
 		logger.Error("error converting medias to json", "medias", medias)
 		return err
 	}
-	return c.uploadComponent(ctx, reqID, "media", mediasJSON)
+	return c.uploadComponent(ctx, reqID, map[string][]byte{"media": mediasJSON})
 }
 
-func (c *composePostService) UploadUniqueId(ctx context.Context, reqID int64, postID int64, postType model.PostType) error {
+func (c *composePostService) UploadUniqueId(ctx context.Context, reqID int64, postID int64, postType model.PostType, parentPostID int64) error {
 	logger := c.Logger(ctx)
-	logger.Debug("entering UploadUniqueId", "post_id", postID, "post_type", postType)
+	logger.Debug("entering UploadUniqueId", "post_id", postID, "post_type", postType, "parent_post_id", parentPostID)
 	postIDJSON, err := json.Marshal(postID)
 	if err != nil {
 		logger.Error("error converting post id to json", "post_id", postID)
@@ -147,7 +140,16 @@ func (c *composePostService) UploadUniqueId(ctx context.Context, reqID int64, po
 		logger.Error("error converting medias to json", "post_type", postType)
 		return err
 	}
-	return c.uploadComponent(ctx, reqID, "post_id", postIDJSON, "post_type", postTypeJSON)
+	parentPostIDJSON, err := json.Marshal(parentPostID)
+	if err != nil {
+		logger.Error("error converting parent post id to json", "parent_post_id", parentPostID)
+		return err
+	}
+	return c.uploadComponent(ctx, reqID, map[string][]byte{
+		"post_id":        postIDJSON,
+		"post_type":      postTypeJSON,
+		"parent_post_id": parentPostIDJSON,
+	})
 }
 
 func (c *composePostService) UploadUrls(ctx context.Context, reqID int64, urls []model.URL) error {
@@ -158,7 +160,7 @@ func (c *composePostService) UploadUrls(ctx context.Context, reqID int64, urls [
 		logger.Error("error converting urls to json", "urls", urls)
 		return err
 	}
-	return c.uploadComponent(ctx, reqID, "urls", urlsJSON)
+	return c.uploadComponent(ctx, reqID, map[string][]byte{"urls": urlsJSON})
 }
 
 func (c *composePostService) UploadUserMentions(ctx context.Context, reqID int64, userMentions []model.UserMention) error {
@@ -169,7 +171,7 @@ func (c *composePostService) UploadUserMentions(ctx context.Context, reqID int64
 		logger.Error("error converting user mentions to json", "user_mentions", userMentions)
 		return err
 	}
-	return c.uploadComponent(ctx, reqID, "user_mentions", userMentionsJSON)
+	return c.uploadComponent(ctx, reqID, map[string][]byte{"user_mentions": userMentionsJSON})
 }
 
 func (c *composePostService) UploadCreator(ctx context.Context, reqID int64, creator model.Creator) error {
@@ -180,7 +182,7 @@ func (c *composePostService) UploadCreator(ctx context.Context, reqID int64, cre
 		logger.Error("error converting creator to json", "user_mentions", creatorJSON)
 		return err
 	}
-	return c.uploadComponent(ctx, reqID, "creator", creatorJSON)
+	return c.uploadComponent(ctx, reqID, map[string][]byte{"creator": creatorJSON})
 }
 
 func (c *composePostService) composeAndUpload(ctx context.Context, reqID int64) error {
@@ -194,62 +196,41 @@ func (c *composePostService) composeAndUpload(ctx context.Context, reqID int64)
 	var urls []model.URL
 	var userMentions []model.UserMention
 	var postType model.PostType
+	var parentPostID int64
 
-	var errs [7]error
-	var wg sync.WaitGroup
-	wg.Add(7)
-
-	reqIDStr := strconv.FormatInt(reqID, 10)
+	fields, err := c.drafts.LoadFields(ctx, reqID)
+	if err != nil {
+		logger.Error("error reading draft", "msg", err.Error())
+		return err
+	}
 	loadComponent := func(key string, value interface{}) error {
-		logger.Debug("loading component", "reqid", reqIDStr, "key", key)
-		cmd := c.redisClient.HGet(ctx, reqIDStr, key)
-		if cmd == nil || cmd.Err() != nil {
-			return cmd.Err()
-		}
-		result, err := cmd.Bytes()
-		if err != nil {
-			return err
+		logger.Debug("loading component", "reqid", reqID, "key", key)
+		result, ok := fields[key]
+		if !ok {
+			return fmt.Errorf("component %s of request %d not found", key, reqID)
 		}
 		return json.Unmarshal(result, &value)
 	}
-
-	go func() {
-		defer wg.Done()
-		errs[0] = loadComponent("text", &text)
-	}()
-	go func() {
-		defer wg.Done()
-		errs[1] = loadComponent("creator", &creator)
-	}()
-	go func() {
-		defer wg.Done()
-		errs[2] = loadComponent("media", &medias)
-	}()
-	go func() {
-		defer wg.Done()
-		errs[3] = loadComponent("post_id", &postID)
-	}()
-	go func() {
-		defer wg.Done()
-		errs[4] = loadComponent("urls", &urls)
-	}()
-	go func() {
-		defer wg.Done()
-		errs[5] = loadComponent("user_mentions", &userMentions)
-	}()
-	go func() {
-		defer wg.Done()
-		errs[6] = loadComponent("post_type", &postType)
-	}()
-	wg.Wait()
-	logger.Debug("got all components from redis")
-
-	for _, err := range errs {
+	for _, component := range []struct {
+		key   string
+		value interface{}
+	}{
+		{"text", &text},
+		{"creator", &creator},
+		{"media", &medias},
+		{"post_id", &postID},
+		{"urls", &urls},
+		{"user_mentions", &userMentions},
+		{"post_type", &postType},
+		{"parent_post_id", &parentPostID},
+	} {
+		err := loadComponent(component.key, component.value)
 		if err != nil {
-			logger.Error("error reading from redis", "msg", err.Error())
+			logger.Error("error reading draft", "msg", err.Error())
 			return err
 		}
 	}
+	logger.Debug("got all components from draft")
 
 	logger.Debug("parsing post data")
 	timestamp := time.Now().UnixMilli()
@@ -263,19 +244,26 @@ func (c *composePostService) composeAndUpload(ctx context.Context, reqID int64)
 		URLs:         urls,
 		Timestamp:    timestamp,
 		PostType:     postType,
+		ParentPostID: parentPostID,
 	}
 	var userMentionIDs []int64
 	for _, mention := range userMentions {
 		userMentionIDs = append(userMentionIDs, mention.UserID)
 	}
 
+	if postType == model.POST_TYPE_DM {
+		return c.composeDirectMessage(ctx, reqID, post, userMentionIDs)
+	}
+
 	// --- Post Storage
 	logger.Debug("remotely calling PostStorageService")
 
 	regionLabel := sn_metrics.RegionLabel{Region: c.Config().Region}
 	sn_metrics.ComposedPosts.Get(regionLabel).Inc()
 
-	err := c.postStorageService.Get().StorePost(ctx, reqID, post)
+	// the home timeline notification is written to the post storage outbox together with the post
+	notification := c.homeTimelineNotification(ctx, reqID, postID, creator.UserID, timestamp, userMentionIDs)
+	postVersion, err := c.postStorageService.Get().StorePost(ctx, reqID, post, notification, c.Config().Regions)
 	if err != nil {
 		logger.Warn("error calling post storage service", "msg", err.Error())
 		return err
@@ -284,10 +272,7 @@ func (c *composePostService) composeAndUpload(ctx context.Context, reqID int64)
 	trace.SpanFromContext(ctx).SetAttributes(
 		attribute.Int64("post_id", postID),
 	)
-
-	// --- Write Home Timeline
-	logger.Debug("queueing message to rabbitmq")
-	c.uploadHomeTimelineHelper(ctx, reqID, postID, creator.UserID, timestamp, userMentionIDs)
+	logger.Debug("stored post", "post_id", postID, "version", postVersion)
 
 	// --- User Timeline
 	logger.Debug("calling write user timeline")
@@ -297,25 +282,47 @@ func (c *composePostService) composeAndUpload(ctx context.Context, reqID int64)
 	return nil
 }
 
-func (c *composePostService) uploadHomeTimelineHelper(ctx context.Context, reqID int64, postID int64, userID int64, timestamp int64, userMentionIDs []int64) error {
+// composeDirectMessage stores the direct message without notifying the write home timeline services
+// and delivers it to the conversation with the mentioned users instead of the timelines
+func (c *composePostService) composeDirectMessage(ctx context.Context, reqID int64, post model.Post, userMentionIDs []int64) error {
 	logger := c.Logger(ctx)
+	var recipientIDs []int64
+	for _, userID := range userMentionIDs {
+		if userID != post.Creator.UserID {
+			recipientIDs = append(recipientIDs, userID)
+		}
+	}
+	if len(recipientIDs) == 0 {
+		return InvalidPostError{Reason: "direct messages must mention at least one recipient"}
+	}
 
-	ch, err := c.amqClientPool.Pop(ctx)
-	defer c.amqClientPool.Push(ch)
+	regionLabel := sn_metrics.RegionLabel{Region: c.Config().Region}
+	sn_metrics.ComposedPosts.Get(regionLabel).Inc()
 
+	postVersion, err := c.postStorageService.Get().StorePost(ctx, reqID, post, model.Message{}, nil)
 	if err != nil {
-		logger.Error("error getting rabbitmq client from pool", "msg", err.Error())
-		panic(err)
+		logger.Warn("error calling post storage service", "msg", err.Error())
+		return err
 	}
-	err = ch.ExchangeDeclare("write-home-timeline", "topic", false, false, false, false, nil)
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.Int64("post_id", post.PostID),
+	)
+	logger.Debug("stored direct message", "post_id", post.PostID, "version", postVersion)
+
+	conversationID, err := c.directMessageService.Get().WriteDirectMessage(ctx, reqID, post.PostID, post.Creator.UserID, recipientIDs, post.Timestamp)
 	if err != nil {
-		logger.Error("error declaring exchange for rabbitmq", "msg", err.Error())
-		// errors close the channel so we force the service to restart
-		panic(err)
+		logger.Error("error delivering direct message", "post_id", post.PostID, "msg", err.Error())
+		return err
 	}
+	logger.Debug("done!", "conversation_id", conversationID)
+	return nil
+}
 
+// homeTimelineNotification builds the message consumed by the write home timeline service of each region
+func (c *composePostService) homeTimelineNotification(ctx context.Context, reqID int64, postID int64, userID int64, timestamp int64, userMentionIDs []int64) model.Message {
 	spanContext := trace.SpanContextFromContext(ctx)
-	msg := model.Message{
+	return model.Message{
+		Type:           model.MESSAGE_TYPE_POST,
 		ReqID:          reqID,
 		PostID:         postID,
 		UserID:         userID,
@@ -323,38 +330,5 @@ func (c *composePostService) uploadHomeTimelineHelper(ctx context.Context, reqID
 		UserMentionIDs: userMentionIDs,
 		// tracing
 		SpanContext: sn_trace.BuildSpanContext(spanContext),
-		// evaluation metrics
-		NotificationSendTs: time.Now().UnixMilli(),
-	}
-
-	msgJSON, err := json.Marshal(msg)
-	if err != nil {
-		logger.Error("error converting rabbitmq message to json", "msg", err.Error())
-		return err
-	}
-
-	span := trace.SpanFromContext(ctx)
-	if trace.SpanContextFromContext(ctx).IsValid() {
-		logger.Debug("valid span", "s", span.IsRecording())
-	}
-
-	amqMsg := amqp.Publishing{
-		ContentType: "application/json",
-		Body:        []byte(msgJSON),
-	}
-	for _, region := range c.Config().Regions {
-		routingKey := fmt.Sprintf("write-home-timeline-%s", region)
-		err = ch.PublishWithContext(ctx, "write-home-timeline", routingKey, false, false, amqMsg)
-		if err != nil {
-			logger.Error("error publishing to queue", "routing_key", routingKey, "err", err.Error())
-		}
-
-	}
-	c.amqClientPool.Push(ch)
-
-	span = trace.SpanFromContext(ctx)
-	if trace.SpanContextFromContext(ctx).IsValid() {
-		logger.Debug("valid span", "s", span.IsRecording())
 	}
-	return nil
 }
@@ -0,0 +1,162 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"socialnetwork/pkg/model"
+	"socialnetwork/pkg/repository"
+
+	"github.com/ServiceWeaver/weaver"
+)
+
+// direct messages are not written to timelines: each one is delivered to the inbox of the conversation
+// between its sender and recipients, which only the participants can read
+
+type DirectMessageService interface {
+	WriteDirectMessage(ctx context.Context, reqID int64, postID int64, senderID int64, recipientIDs []int64, timestamp int64) (string, error)
+	ReadConversation(ctx context.Context, reqID int64, userID int64, conversationID string, query model.TimelineQuery) (model.TimelinePage, error)
+	ListConversations(ctx context.Context, reqID int64, userID int64, start int64, stop int64) ([]model.Conversation, error)
+}
+
+type directMessageServiceOptions struct {
+	// storage backend of the conversations: "mongodb" (default) or "memory"
+	StorageBackend string `toml:"storage_backend"`
+	MongoDBAddr    string `toml:"mongodb_address"`
+	MongoDBPort    int    `toml:"mongodb_port"`
+	Region         string `toml:"region"`
+}
+
+// ConversationNotFoundError is returned when the conversation does not exist or the user is not one of its participants
+type ConversationNotFoundError struct {
+	weaver.AutoMarshal
+	ConversationID string
+}
+
+func (e ConversationNotFoundError) Error() string {
+	return fmt.Sprintf("conversation %s not found", e.ConversationID)
+}
+
+type directMessageService struct {
+	weaver.Implements[DirectMessageService]
+	weaver.WithConfig[directMessageServiceOptions]
+	postStorageService weaver.Ref[PostStorageService]
+	conversations      repository.ConversationRepository
+}
+
+func (d *directMessageService) Init(ctx context.Context) error {
+	logger := d.Logger(ctx)
+
+	var err error
+	d.conversations, err = repository.NewConversationRepository(ctx, repository.Options{
+		Backend:     d.Config().StorageBackend,
+		MongoDBAddr: d.Config().MongoDBAddr,
+		MongoDBPort: d.Config().MongoDBPort,
+	})
+	if err != nil {
+		logger.Error("error initializing conversation repository", "msg", err.Error())
+		return err
+	}
+	err = d.conversations.EnsureIndexes(ctx)
+	if err != nil {
+		logger.Error("error creating conversation indexes", "msg", err.Error())
+		return err
+	}
+
+	logger.Info("direct message service running!", "region", d.Config().Region, "storage_backend", d.Config().StorageBackend,
+		"mongodb_addr", d.Config().MongoDBAddr, "mongodb_port", d.Config().MongoDBPort,
+	)
+	return nil
+}
+
+// conversationParticipants returns the sorted participants of a conversation without duplicates
+func conversationParticipants(senderID int64, recipientIDs []int64) []int64 {
+	seen := map[int64]bool{senderID: true}
+	participantIDs := []int64{senderID}
+	for _, recipientID := range recipientIDs {
+		if !seen[recipientID] {
+			seen[recipientID] = true
+			participantIDs = append(participantIDs, recipientID)
+		}
+	}
+	sort.Slice(participantIDs, func(i, j int) bool { return participantIDs[i] < participantIDs[j] })
+	return participantIDs
+}
+
+func conversationID(participantIDs []int64) string {
+	ids := make([]string, 0, len(participantIDs))
+	for _, participantID := range participantIDs {
+		ids = append(ids, strconv.FormatInt(participantID, 10))
+	}
+	return strings.Join(ids, "-")
+}
+
+// WriteDirectMessage delivers the post to the conversation between the sender and the recipients
+// and returns the id of the conversation
+func (d *directMessageService) WriteDirectMessage(ctx context.Context, reqID int64, postID int64, senderID int64, recipientIDs []int64, timestamp int64) (string, error) {
+	logger := d.Logger(ctx)
+	logger.Debug("entering WriteDirectMessage", "req_id", reqID, "post_id", postID, "sender_id", senderID, "recipient_ids", recipientIDs)
+
+	participantIDs := conversationParticipants(senderID, recipientIDs)
+	if len(participantIDs) < 2 {
+		return "", fmt.Errorf("direct message %d has no recipients", postID)
+	}
+	id := conversationID(participantIDs)
+
+	message := repository.DirectMessage{ConversationID: id, PostID: postID, SenderID: senderID, Timestamp: timestamp}
+	err := d.conversations.AddMessage(ctx, participantIDs, message)
+	if err != nil {
+		logger.Error("error writing direct message", "conversation_id", id, "msg", err.Error())
+		return "", err
+	}
+	return id, nil
+}
+
+// ReadConversation returns a page of the messages of the conversation, newest first, if the user is one of its participants
+func (d *directMessageService) ReadConversation(ctx context.Context, reqID int64, userID int64, conversationID string, query model.TimelineQuery) (model.TimelinePage, error) {
+	logger := d.Logger(ctx)
+	logger.Debug("entering ReadConversation", "req_id", reqID, "user_id", userID, "conversation_id", conversationID,
+		"start", query.Start, "stop", query.Stop, "max_id", query.MaxID, "since_id", query.SinceID)
+
+	_, err := d.conversations.FindConversation(ctx, conversationID, userID)
+	if errors.Is(err, repository.ErrNotFound) {
+		return model.TimelinePage{}, ConversationNotFoundError{ConversationID: conversationID}
+	}
+	if err != nil {
+		logger.Error("error reading conversation", "msg", err.Error())
+		return model.TimelinePage{}, err
+	}
+	if query.Stop <= query.Start || query.Start < 0 {
+		return model.TimelinePage{Posts: []model.Post{}}, nil
+	}
+
+	posts, err := d.conversations.ReadMessages(ctx, conversationID, query)
+	if err != nil {
+		logger.Error("error reading direct messages", "msg", err.Error())
+		return model.TimelinePage{}, err
+	}
+	readMessages := func(ctx context.Context, reqID int64, postIDs []int64) ([]model.Post, []int64, error) {
+		return d.postStorageService.Get().ReadDirectMessages(ctx, reqID, userID, postIDs)
+	}
+	return newTimelinePage(ctx, readMessages, reqID, query, posts)
+}
+
+// ListConversations returns the conversations of the user in [start, stop), the most recently active first
+func (d *directMessageService) ListConversations(ctx context.Context, reqID int64, userID int64, start int64, stop int64) ([]model.Conversation, error) {
+	logger := d.Logger(ctx)
+	logger.Debug("entering ListConversations", "req_id", reqID, "user_id", userID, "start", start, "stop", stop)
+	if stop <= start || start < 0 {
+		return []model.Conversation{}, nil
+	}
+
+	conversations, err := d.conversations.ListConversations(ctx, userID, start, stop)
+	if err != nil {
+		logger.Error("error reading conversations", "msg", err.Error())
+		return nil, err
+	}
+	return conversations, nil
+}
@@ -0,0 +1,16 @@
+package services
+
+// implementations of the components that hold in-memory datastores, which the integration suite asks for so that
+// weavertest runs them in the test process, where their datastores and notification topics are shared
+type (
+	ComposePostServiceImpl       = composePostService
+	DirectMessageServiceImpl     = directMessageService
+	HomeTimelineServiceImpl      = homeTimelineService
+	PostStorageServiceImpl       = postStorageService
+	SocialGraphServiceImpl       = socialGraphService
+	UrlShortenServiceImpl        = urlShortenService
+	UserMentionServiceImpl       = userMentionService
+	UserServiceImpl              = userService
+	UserTimelineServiceImpl      = userTimelineService
+	WriteHomeTimelineServiceImpl = writeHomeTimelineService
+)
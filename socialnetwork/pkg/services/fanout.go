@@ -0,0 +1,123 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+const DEFAULT_FANOUT_CHUNK_SIZE int = 500
+const DEFAULT_FANOUT_CONCURRENCY int = 8
+const DEFAULT_FANOUT_CHUNK_ATTEMPTS int = 3
+
+// fanoutChunkError is the failure of one chunk of users, which can be retried without the others
+type fanoutChunkError struct {
+	userIDs []int64
+	err     error
+}
+
+// fanoutError reports the chunks that still failed after all attempts
+type fanoutError struct {
+	total  int
+	chunks []fanoutChunkError
+}
+
+func (e *fanoutError) Error() string {
+	return fmt.Sprintf("%d/%d fan-out chunks failed: %s", len(e.chunks), e.total, e.chunks[0].err.Error())
+}
+
+func (e *fanoutError) Unwrap() error {
+	return e.chunks[0].err
+}
+
+// fanoutEngine splits the users of a fan-out into chunks that are written in parallel,
+// so that a large fan-out costs a few pipelined round trips instead of one per user
+//
+// writes must be idempotent: failed chunks are written again up to maxAttempts times
+// and the whole fan-out may be retried when the notification is redelivered
+type fanoutEngine struct {
+	chunkSize   int
+	concurrency int
+	maxAttempts int
+	// called for every failed chunk, e.g. to log and count failures
+	onChunkFailure func(userIDs []int64, attempt int, err error)
+}
+
+func newFanoutEngine(chunkSize int, concurrency int, maxAttempts int) *fanoutEngine {
+	if chunkSize <= 0 {
+		chunkSize = DEFAULT_FANOUT_CHUNK_SIZE
+	}
+	if concurrency <= 0 {
+		concurrency = DEFAULT_FANOUT_CONCURRENCY
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = DEFAULT_FANOUT_CHUNK_ATTEMPTS
+	}
+	return &fanoutEngine{chunkSize: chunkSize, concurrency: concurrency, maxAttempts: maxAttempts}
+}
+
+// chunks splits the users in chunks of at most chunkSize users
+func (f *fanoutEngine) chunks(userIDs []int64) [][]int64 {
+	chunks := make([][]int64, 0, (len(userIDs)+f.chunkSize-1)/f.chunkSize)
+	for start := 0; start < len(userIDs); start += f.chunkSize {
+		stop := min(start+f.chunkSize, len(userIDs))
+		chunks = append(chunks, userIDs[start:stop])
+	}
+	return chunks
+}
+
+// run writes every chunk of users and retries the failed ones
+// returns a *fanoutError with the chunks that failed in the last attempt
+func (f *fanoutEngine) run(ctx context.Context, userIDs []int64, write func(ctx context.Context, userIDs []int64) error) error {
+	chunks := f.chunks(userIDs)
+	total := len(chunks)
+	for attempt := 1; ; attempt++ {
+		failed := f.runChunks(ctx, chunks, write)
+		for _, chunk := range failed {
+			if f.onChunkFailure != nil {
+				f.onChunkFailure(chunk.userIDs, attempt, chunk.err)
+			}
+		}
+		if len(failed) == 0 {
+			return nil
+		}
+		if attempt >= f.maxAttempts || ctx.Err() != nil {
+			return &fanoutError{total: total, chunks: failed}
+		}
+		chunks = chunks[:0]
+		for _, chunk := range failed {
+			chunks = append(chunks, chunk.userIDs)
+		}
+	}
+}
+
+// runChunks writes the chunks with at most concurrency writes in flight
+func (f *fanoutEngine) runChunks(ctx context.Context, chunks [][]int64, write func(ctx context.Context, userIDs []int64) error) []fanoutChunkError {
+	if len(chunks) == 1 {
+		// avoid spawning goroutines for the common case of small fan-outs
+		if err := write(ctx, chunks[0]); err != nil {
+			return []fanoutChunkError{{userIDs: chunks[0], err: err}}
+		}
+		return nil
+	}
+	var mu sync.Mutex
+	var failed []fanoutChunkError
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, f.concurrency)
+	for _, chunk := range chunks {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(chunk []int64) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := write(ctx, chunk)
+			if err != nil {
+				mu.Lock()
+				failed = append(failed, fanoutChunkError{userIDs: chunk, err: err})
+				mu.Unlock()
+			}
+		}(chunk)
+	}
+	wg.Wait()
+	return failed
+}
@@ -2,74 +2,157 @@ package services
 
 import (
 	"context"
+	"time"
+
+	sn_metrics "socialnetwork/pkg/metrics"
 	"socialnetwork/pkg/model"
-	"socialnetwork/pkg/storage"
-	"strconv"
+	"socialnetwork/pkg/repository"
 
 	"github.com/ServiceWeaver/weaver"
-
-	"github.com/redis/go-redis/v9"
 )
 
 type HomeTimelineService interface {
-	ReadHomeTimeline(ctx context.Context, reqID int64, userID int64, start int64, stop int64) ([]model.Post, error)
+	ReadHomeTimeline(ctx context.Context, reqID int64, userID int64, query model.TimelineQuery) (model.TimelinePage, error)
 }
 
 type homeTimelineService struct {
 	weaver.Implements[HomeTimelineService]
 	weaver.WithConfig[homeTimelineServiceOptions]
-	postStorageService weaver.Ref[PostStorageService]
-	redisClient        *redis.Client
+	postStorageService  weaver.Ref[PostStorageService]
+	socialGraphService  weaver.Ref[SocialGraphService]
+	userTimelineService weaver.Ref[UserTimelineService]
+	timelines           repository.TimelineRepository
 }
 
 type homeTimelineServiceOptions struct {
-	RedisAddr string `toml:"redis_address"`
-	RedisPort int    `toml:"redis_port"`
-	Region    string `toml:"region"`
+	// home timelines are cached in redis and stored in mongodb (by WriteHomeTimelineService)
+	// or kept in memory, depending on the storage backend: "mongodb" (default) or "memory"
+	StorageBackend string `toml:"storage_backend"`
+	MongoDBAddr    string `toml:"mongodb_address"`
+	MongoDBPort    int    `toml:"mongodb_port"`
+	RedisAddr      string `toml:"redis_address"`
+	RedisPort      int    `toml:"redis_port"`
+	Region         string `toml:"region"`
+	// cached timelines keep the newest timeline_max_length posts and expire after timeline_ttl_s without reads,
+	// and the whole cache is trimmed every timeline_compaction_interval_s (0 disables each of them)
+	TimelineMaxLength           int `toml:"timeline_max_length"`
+	TimelineTTLS                int `toml:"timeline_ttl_s"`
+	TimelineCompactionIntervalS int `toml:"timeline_compaction_interval_s"`
 }
 
 func (h *homeTimelineService) Init(ctx context.Context) error {
 	logger := h.Logger(ctx)
-	h.redisClient = storage.RedisClient(h.Config().RedisAddr, h.Config().RedisPort)
-	logger.Info("home timeline service running!", "region", h.Config().Region,
-		"rabbitmq_addr", h.Config().RedisAddr, "rabbitmq_port", h.Config().RedisPort,
+	var err error
+	h.timelines, err = repository.NewTimelineRepository(ctx, repository.Options{
+		Backend:     h.Config().StorageBackend,
+		MongoDBAddr: h.Config().MongoDBAddr,
+		MongoDBPort: h.Config().MongoDBPort,
+		CacheAddr:   h.Config().RedisAddr,
+		CachePort:   h.Config().RedisPort,
+	}, "home-timeline", repository.NewTimelineCachePolicy(h.Config().TimelineMaxLength, h.Config().TimelineTTLS))
+	if err != nil {
+		logger.Error("error initializing home timeline repository", "msg", err.Error())
+		return err
+	}
+	if h.Config().TimelineCompactionIntervalS > 0 {
+		regionLabel := sn_metrics.RegionLabel{Region: h.Config().Region}
+		go runTimelineCompaction(ctx, logger, h.timelines, time.Duration(h.Config().TimelineCompactionIntervalS)*time.Second, func(removed int64) {
+			sn_metrics.CompactedTimelinePosts.Get(regionLabel).Add(float64(removed))
+		})
+	}
+	logger.Info("home timeline service running!", "region", h.Config().Region, "storage_backend", h.Config().StorageBackend,
+		"mongodb_addr", h.Config().MongoDBAddr, "mongodb_port", h.Config().MongoDBPort,
+		"redis_addr", h.Config().RedisAddr, "redis_port", h.Config().RedisPort,
+		"timeline_max_length", h.Config().TimelineMaxLength, "timeline_ttl_s", h.Config().TimelineTTLS,
+		"timeline_compaction_interval_s", h.Config().TimelineCompactionIntervalS,
 	)
 	return nil
 }
 
-// readCachedTimeline is an helper function for reading timeline from redis with the same behavior as in the user timeline service
-func (h *homeTimelineService) readCachedTimeline(ctx context.Context, userID int64, start int64, stop int64) ([]int64, error) {
+// ReadHomeTimeline returns a page of the home timeline of the user from redis,
+// falling back to mongodb and repopulating redis on a cache miss
+// posts of followees above the fan-out threshold, which are not pushed to the home timeline, are merged in at read time
+func (h *homeTimelineService) ReadHomeTimeline(ctx context.Context, reqID int64, userID int64, query model.TimelineQuery) (model.TimelinePage, error) {
 	logger := h.Logger(ctx)
+	logger.Debug("entering ReadHomeTimeline", "req_id", reqID, "user_id", userID, "start", query.Start, "stop", query.Stop,
+		"max_id", query.MaxID, "since_id", query.SinceID, "since", query.Since, "until", query.Until)
+	if query.Stop <= query.Start || query.Start < 0 {
+		return model.TimelinePage{Posts: []model.Post{}}, nil
+	}
 
-	userIDStr := strconv.FormatInt(userID, 10)
-	result, err := h.redisClient.ZRevRange(ctx, userIDStr, start, stop-1).Result()
+	pullUserIDs, err := h.pullFollowees(ctx, reqID, userID)
 	if err != nil {
-		logger.Error("error reading home timeline from redis")
-		return nil, err
+		logger.Error("error reading pulled followees", "msg", err.Error())
+		return model.TimelinePage{}, err
 	}
-
-	var postIDs []int64
-	for _, result := range result {
-		id, err := strconv.ParseInt(result, 10, 64)
+	if len(pullUserIDs) == 0 {
+		timelinePosts, err := h.timelines.ReadTimeline(ctx, userID, query)
 		if err != nil {
-			logger.Error("error parsing post id from redis result")
-			return nil, err
+			logger.Error("error reading home timeline", "msg", err.Error())
+			return model.TimelinePage{}, err
 		}
-		postIDs = append(postIDs, id)
+		page, err := newTimelinePage(ctx, h.postStorageService.Get().ReadPosts, reqID, query, timelinePosts)
+		return withoutDirectMessages(page), err
 	}
-	return postIDs, nil
-}
 
-func (h *homeTimelineService) ReadHomeTimeline(ctx context.Context, reqID int64, userID int64, start int64, stop int64) ([]model.Post, error) {
-	logger := h.Logger(ctx)
-	logger.Debug("entering ReadHomeTimeline", "req_id", reqID, "user_id", userID, "start", start, "stop", stop)
-	if stop <= start || start < 0 {
-		return []model.Post{}, nil
+	// cursors may point to pushed or pulled posts, so they are resolved once for both
+	found, err := repository.ResolveCursors(&query, func(postID int64) (int64, bool, error) {
+		post, err := h.postStorageService.Get().ReadPost(ctx, reqID, postID)
+		if err != nil {
+			logger.Warn("cursor not found in post storage", "post_id", postID, "msg", err.Error())
+			return 0, false, nil
+		}
+		return post.Timestamp, true, nil
+	})
+	if err != nil || !found {
+		return model.TimelinePage{Posts: []model.Post{}}, err
 	}
 
-	postIDs, err := h.readCachedTimeline(ctx, userID, start, stop)
+	// both timelines may hold all the posts of the page, so they are read from the start
+	mergedQuery := query
+	mergedQuery.Start = 0
+	pushedPosts, err := h.timelines.ReadTimeline(ctx, userID, mergedQuery)
 	if err != nil {
+		logger.Error("error reading home timeline", "msg", err.Error())
+		return model.TimelinePage{}, err
+	}
+	pulledPosts, err := h.userTimelineService.Get().ReadUserTimelinesPosts(ctx, reqID, pullUserIDs, mergedQuery)
+	if err != nil {
+		logger.Error("error reading user timelines of pulled followees", "msg", err.Error())
+		return model.TimelinePage{}, err
+	}
+
+	timelinePosts := mergeTimelinePosts(pushedPosts, pulledPosts)
+	if int64(len(timelinePosts)) <= query.Start {
+		return model.TimelinePage{Posts: []model.Post{}}, nil
+	}
+	timelinePosts = timelinePosts[query.Start:min(int64(len(timelinePosts)), query.Stop+1)]
+
+	pulled := make(map[int64]bool, len(pulledPosts))
+	for _, post := range pulledPosts {
+		pulled[post.PostID] = true
+	}
+	numPulled := 0
+	for _, post := range timelinePosts[:min(int64(len(timelinePosts)), query.Stop-query.Start)] {
+		if pulled[post.PostID] {
+			numPulled++
+		}
+	}
+	regionLabel := sn_metrics.RegionLabel{Region: h.Config().Region}
+	sn_metrics.PulledTimelinePosts.Get(regionLabel).Add(float64(numPulled))
+	logger.Debug("merged pulled posts into home timeline", "#pushed", len(pushedPosts), "#pulled", numPulled)
+
+	page, err := newTimelinePage(ctx, h.postStorageService.Get().ReadPosts, reqID, query, timelinePosts)
+	return withoutDirectMessages(page), err
+}
+
+// pullFollowees returns the followees of the user whose posts were not pushed to the home timelines by
+// WriteHomeTimelineService (i.e. above its fan-out threshold), which records them before skipping the push
+// followees are pulled from then on, even after dropping below the threshold, so that no post is left out
+func (h *homeTimelineService) pullFollowees(ctx context.Context, reqID int64, userID int64) ([]int64, error) {
+	followeeIDs, err := h.socialGraphService.Get().GetFollowees(ctx, reqID, userID)
+	if err != nil || len(followeeIDs) == 0 {
 		return nil, err
 	}
-	return h.postStorageService.Get().ReadPosts(ctx, reqID, postIDs)
+	return h.timelines.FilterPullUsers(ctx, followeeIDs)
 }
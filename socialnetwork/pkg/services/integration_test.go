@@ -0,0 +1,511 @@
+package services_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"socialnetwork/pkg/model"
+	"socialnetwork/pkg/services"
+
+	"github.com/ServiceWeaver/weaver/weavertest"
+)
+
+// the integration suite runs the services with the in-memory repositories and the channel notifier
+// with the single-process runner, which calls the components locally, the rpc runner, which also
+// serializes the arguments and results of every call and retries every retriable call once, and the
+// multi-process runner, which runs weavertest.DefaultReplication (2) replicas of the other components
+// in separate processes
+// the in-memory datastores and the channel notifier are not shared between processes, so the components
+// that hold them always run in the test process (see deploy), and only the text, media and unique id services,
+// which are stateless, are replicated: the uploads of posts go through other processes and back
+
+// timeout of the notifications delivered to the write home timeline service
+const DELIVERY_TIMEOUT time.Duration = 10 * time.Second
+
+// testConfig returns the weaver config of a deployment whose in-memory datastores and notification topics
+// are identified by name, so that they are not shared with the deployments of other tests
+func testConfig(name string) string {
+	return fmt.Sprintf(`
+["socialnetwork/pkg/services/ComposePostService"]
+storage_backend     = "memory"
+redis_address       = %[1]q
+region              = %[1]q
+regions             = [%[1]q]
+
+["socialnetwork/pkg/services/DirectMessageService"]
+storage_backend     = "memory"
+mongodb_address     = %[1]q
+region              = %[1]q
+
+["socialnetwork/pkg/services/HomeTimelineService"]
+storage_backend     = "memory"
+mongodb_address     = %[1]q
+redis_address       = %[1]q
+region              = %[1]q
+
+["socialnetwork/pkg/services/PostStorageService"]
+storage_backend     = "memory"
+mongodb_address     = %[1]q
+memcached_address   = %[1]q
+region              = %[1]q
+regions             = [%[1]q]
+notifier            = "channel"
+outbox_poll_interval_ms = 10
+cache_write_through = true
+
+["socialnetwork/pkg/services/SocialGraphService"]
+storage_backend     = "memory"
+mongodb_address     = %[1]q
+redis_address       = %[1]q
+region              = %[1]q
+regions             = [%[1]q]
+notifier            = "channel"
+
+["socialnetwork/pkg/services/UrlShortenService"]
+storage_backend     = "memory"
+mongodb_address     = %[1]q
+memcached_address   = %[1]q
+region              = %[1]q
+
+["socialnetwork/pkg/services/UserService"]
+storage_backend     = "memory"
+mongodb_address     = %[1]q
+memcached_address   = %[1]q
+region              = %[1]q
+jwt_kid             = "k1"
+jwt_secrets         = { k1 = "test-secret" }
+
+["socialnetwork/pkg/services/UserMentionService"]
+storage_backend     = "memory"
+mongodb_address     = %[1]q
+memcached_address   = %[1]q
+region              = %[1]q
+
+["socialnetwork/pkg/services/UserTimelineService"]
+storage_backend     = "memory"
+mongodb_address     = %[1]q
+redis_address       = %[1]q
+region              = %[1]q
+
+["socialnetwork/pkg/services/WriteHomeTimelineService"]
+storage_backend     = "memory"
+mongodb_address     = %[1]q
+redis_address       = %[1]q
+home_timeline_mongodb_address = %[1]q
+num_workers         = 2
+region              = %[1]q
+retry_base_delay_ms = 10
+notifier            = "channel"
+`, name)
+}
+
+// number of deployments, which tells apart the runs of the same test (e.g. with -count)
+var deployments atomic.Int64
+
+// runners returns the weavertest runners, configured with datastores that belong to the test and the runner
+// the settings are added to the config of WriteHomeTimelineService, which is the last section
+func runners(t *testing.T, writeHomeTimelineSettings ...string) []weavertest.Runner {
+	var runners []weavertest.Runner
+	for _, runner := range []weavertest.Runner{weavertest.Local, weavertest.RPC, weavertest.Multi} {
+		runner.Config = testConfig(fmt.Sprintf("%s/%s/%d", t.Name(), runner.Name, deployments.Add(1))) +
+			strings.Join(writeHomeTimelineSettings, "\n")
+		runners = append(runners, runner)
+	}
+	return runners
+}
+
+// deployment holds the components called by the tests
+type deployment struct {
+	textService          services.TextService
+	mediaService         services.MediaService
+	uniqueIdService      services.UniqueIdService
+	userService          services.UserService
+	socialGraphService   services.SocialGraphService
+	postStorageService   services.PostStorageService
+	userTimelineService  services.UserTimelineService
+	homeTimelineService  services.HomeTimelineService
+	directMessageService services.DirectMessageService
+}
+
+// deploy runs the test with every runner
+// the test also gets the implementations of the components with in-memory datastores, which weavertest then
+// runs in the test process instead of replicating them with the multi-process runner, but the test only
+// calls them through their interfaces, so that the rpc runner still serializes its calls
+func deploy(t *testing.T, test func(t *testing.T, d deployment), writeHomeTimelineSettings ...string) {
+	for _, runner := range runners(t, writeHomeTimelineSettings...) {
+		runner.Test(t, func(t *testing.T, textService services.TextService, mediaService services.MediaService,
+			uniqueIdService services.UniqueIdService, userService services.UserService, socialGraphService services.SocialGraphService,
+			postStorageService services.PostStorageService, userTimelineService services.UserTimelineService,
+			homeTimelineService services.HomeTimelineService, directMessageService services.DirectMessageService,
+			_ *services.ComposePostServiceImpl, _ *services.DirectMessageServiceImpl, _ *services.HomeTimelineServiceImpl,
+			_ *services.PostStorageServiceImpl, _ *services.SocialGraphServiceImpl, _ *services.UrlShortenServiceImpl,
+			_ *services.UserMentionServiceImpl, _ *services.UserServiceImpl, _ *services.UserTimelineServiceImpl,
+			_ *services.WriteHomeTimelineServiceImpl) {
+			test(t, deployment{
+				textService:          textService,
+				mediaService:         mediaService,
+				uniqueIdService:      uniqueIdService,
+				userService:          userService,
+				socialGraphService:   socialGraphService,
+				postStorageService:   postStorageService,
+				userTimelineService:  userTimelineService,
+				homeTimelineService:  homeTimelineService,
+				directMessageService: directMessageService,
+			})
+		})
+	}
+}
+
+type testUser struct {
+	userID   int64
+	username string
+}
+
+var (
+	ana   = testUser{userID: 1, username: "ana"}
+	bob   = testUser{userID: 2, username: "bob"}
+	carol = testUser{userID: 3, username: "carol"}
+)
+
+func registerUsers(t *testing.T, ctx context.Context, userService services.UserService, users ...testUser) {
+	t.Helper()
+	for _, user := range users {
+		err := userService.RegisterUserWithId(ctx, 0, user.username+"_first", user.username+"_last", user.username, "pwd", user.userID)
+		if err != nil {
+			t.Fatalf("error registering user %s: %s", user.username, err.Error())
+		}
+	}
+}
+
+func follow(t *testing.T, ctx context.Context, socialGraphService services.SocialGraphService, user testUser, followee testUser) {
+	t.Helper()
+	err := socialGraphService.Follow(ctx, 0, user.userID, followee.userID)
+	if err != nil {
+		t.Fatalf("error following %s by %s: %s", followee.username, user.username, err.Error())
+	}
+}
+
+type testPost struct {
+	text         string
+	mediaTypes   []string
+	mediaIDs     []int64
+	postType     model.PostType
+	parentPostID int64
+}
+
+// request ids identify the drafts of the composed posts
+var reqIDs atomic.Int64
+
+// compose uploads the components of the post in parallel, as the wrk2 api does
+func (d deployment) compose(t *testing.T, ctx context.Context, creator testUser, post testPost) int64 {
+	t.Helper()
+	reqID := reqIDs.Add(1)
+	var wg sync.WaitGroup
+	wg.Add(4)
+	var errs [4]error
+	var postID int64
+	go func() {
+		defer wg.Done()
+		errs[0] = d.textService.UploadText(ctx, reqID, post.text)
+	}()
+	go func() {
+		defer wg.Done()
+		errs[1] = d.mediaService.UploadMedia(ctx, reqID, post.mediaTypes, post.mediaIDs)
+	}()
+	go func() {
+		defer wg.Done()
+		postID, errs[2] = d.uniqueIdService.UploadUniqueId(ctx, reqID, post.postType, post.parentPostID)
+	}()
+	go func() {
+		defer wg.Done()
+		errs[3] = d.userService.UploadCreatorWithUserId(ctx, reqID, creator.userID, creator.username)
+	}()
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("error composing post %q: %s", post.text, err.Error())
+		}
+	}
+	return postID
+}
+
+func timelinePostIDs(page model.TimelinePage) []int64 {
+	postIDs := make([]int64, 0, len(page.Posts))
+	for _, post := range page.Posts {
+		postIDs = append(postIDs, post.PostID)
+	}
+	return postIDs
+}
+
+func equalIDs(a []int64, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// waitHomeTimeline polls the home timeline of the user until it has the expected posts, from newest to oldest,
+// since posts are written to home timelines asynchronously by the write home timeline service
+func waitHomeTimeline(t *testing.T, ctx context.Context, homeTimelineService services.HomeTimelineService, user testUser, expected ...int64) model.TimelinePage {
+	t.Helper()
+	deadline := time.Now().Add(DELIVERY_TIMEOUT)
+	for {
+		page, err := homeTimelineService.ReadHomeTimeline(ctx, 0, user.userID, model.TimelineQuery{Start: 0, Stop: 10})
+		if err != nil {
+			t.Fatalf("error reading home timeline of %s: %s", user.username, err.Error())
+		}
+		postIDs := timelinePostIDs(page)
+		if equalIDs(postIDs, expected) {
+			return page
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got home timeline %v for %s, want %v", postIDs, user.username, expected)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func readUserTimeline(t *testing.T, ctx context.Context, userTimelineService services.UserTimelineService, user testUser) model.TimelinePage {
+	t.Helper()
+	page, err := userTimelineService.ReadUserTimeline(ctx, 0, user.userID, model.TimelineQuery{Start: 0, Stop: 10})
+	if err != nil {
+		t.Fatalf("error reading user timeline of %s: %s", user.username, err.Error())
+	}
+	return page
+}
+
+func TestRegisterAndFollow(t *testing.T) {
+	deploy(t, func(t *testing.T, d deployment) {
+		ctx := context.Background()
+		registerUsers(t, ctx, d.userService, ana, bob, carol)
+		err := d.userService.RegisterUserWithId(ctx, 0, "other", "other", ana.username, "pwd", 4)
+		if err == nil {
+			t.Errorf("registered user with taken username %s", ana.username)
+		}
+		userID, err := d.userService.GetUserId(ctx, 0, bob.username)
+		if err != nil {
+			t.Fatalf("error getting user id: %s", err.Error())
+		}
+		if userID != bob.userID {
+			t.Errorf("got user id %d for %s, want %d", userID, bob.username, bob.userID)
+		}
+
+		follow(t, ctx, d.socialGraphService, bob, ana)
+		follow(t, ctx, d.socialGraphService, carol, ana)
+		err = d.socialGraphService.FollowWithUsername(ctx, 0, ana.username, carol.username)
+		if err != nil {
+			t.Fatalf("error following with username: %s", err.Error())
+		}
+		followers, err := d.socialGraphService.GetFollowers(ctx, 0, ana.userID)
+		if err != nil {
+			t.Fatalf("error getting followers: %s", err.Error())
+		}
+		sort.Slice(followers, func(i, j int) bool { return followers[i] < followers[j] })
+		if !equalIDs(followers, []int64{bob.userID, carol.userID}) {
+			t.Errorf("got followers %v of %s, want [%d %d]", followers, ana.username, bob.userID, carol.userID)
+		}
+		followees, err := d.socialGraphService.GetFollowees(ctx, 0, ana.userID)
+		if err != nil {
+			t.Fatalf("error getting followees: %s", err.Error())
+		}
+		if !equalIDs(followees, []int64{carol.userID}) {
+			t.Errorf("got followees %v of %s, want [%d]", followees, ana.username, carol.userID)
+		}
+
+		err = d.socialGraphService.Unfollow(ctx, 0, bob.userID, ana.userID)
+		if err != nil {
+			t.Fatalf("error unfollowing: %s", err.Error())
+		}
+		following, err := d.socialGraphService.IsFollowing(ctx, 0, bob.userID, ana.userID)
+		if err != nil {
+			t.Fatalf("error reading edge: %s", err.Error())
+		}
+		if following {
+			t.Errorf("%s still follows %s after unfollowing", bob.username, ana.username)
+		}
+	})
+}
+
+func TestComposeToTimelines(t *testing.T) {
+	deploy(t, func(t *testing.T, d deployment) {
+		ctx := context.Background()
+		registerUsers(t, ctx, d.userService, ana, bob, carol)
+		follow(t, ctx, d.socialGraphService, bob, ana)
+
+		text := "hello @carol, see https://example.com and http://example.org"
+		postID := d.compose(t, ctx, ana, testPost{text: text, mediaTypes: []string{"png", "jpg"}, mediaIDs: []int64{10, 11}})
+
+		// the user timeline is written before the last upload of the post returns
+		page := readUserTimeline(t, ctx, d.userTimelineService, ana)
+		if !equalIDs(timelinePostIDs(page), []int64{postID}) {
+			t.Fatalf("got user timeline %v for %s, want [%d]", timelinePostIDs(page), ana.username, postID)
+		}
+		post := page.Posts[0]
+		if post.Creator != (model.Creator{UserID: ana.userID, Username: ana.username}) {
+			t.Errorf("got creator %+v, want %s", post.Creator, ana.username)
+		}
+		if post.Text != text {
+			t.Errorf("got text %q, want %q", post.Text, text)
+		}
+		if len(post.UserMentions) != 1 || post.UserMentions[0] != (model.UserMention{UserID: carol.userID, Username: carol.username}) {
+			t.Errorf("got user mentions %+v, want %s", post.UserMentions, carol.username)
+		}
+		if len(post.Media) != 2 || post.Media[0] != (model.Media{MediaID: 10, MediaType: "png"}) || post.Media[1] != (model.Media{MediaID: 11, MediaType: "jpg"}) {
+			t.Errorf("got media %+v, want png 10 and jpg 11", post.Media)
+		}
+		var expandedUrls []string
+		for _, url := range post.URLs {
+			if url.ShortenedUrl == "" || strings.Contains(text, url.ShortenedUrl) {
+				t.Errorf("url %s is not shortened: %q", url.ExpandedUrl, url.ShortenedUrl)
+			}
+			expandedUrls = append(expandedUrls, url.ExpandedUrl)
+		}
+		if strings.Join(expandedUrls, " ") != "https://example.com http://example.org" {
+			t.Errorf("got urls %v, want https://example.com and http://example.org", expandedUrls)
+		}
+
+		// followers and mentioned users receive the post, but not its creator
+		bobPage := waitHomeTimeline(t, ctx, d.homeTimelineService, bob, postID)
+		if bobPage.Posts[0].Text != text || len(bobPage.Posts[0].URLs) != 2 || len(bobPage.Posts[0].Media) != 2 {
+			t.Errorf("got post %+v in the home timeline of %s, want the composed post", bobPage.Posts[0], bob.username)
+		}
+		waitHomeTimeline(t, ctx, d.homeTimelineService, carol, postID)
+		waitHomeTimeline(t, ctx, d.homeTimelineService, ana)
+
+		// newer posts come first
+		secondPostID := d.compose(t, ctx, ana, testPost{text: "second post"})
+		waitHomeTimeline(t, ctx, d.homeTimelineService, bob, secondPostID, postID)
+		waitHomeTimeline(t, ctx, d.homeTimelineService, carol, postID)
+		page = readUserTimeline(t, ctx, d.userTimelineService, ana)
+		if !equalIDs(timelinePostIDs(page), []int64{secondPostID, postID}) {
+			t.Errorf("got user timeline %v for %s, want [%d %d]", timelinePostIDs(page), ana.username, secondPostID, postID)
+		}
+	})
+}
+
+func TestPullFanout(t *testing.T) {
+	deploy(t, func(t *testing.T, d deployment) {
+		ctx := context.Background()
+		registerUsers(t, ctx, d.userService, ana, bob, carol)
+		follow(t, ctx, d.socialGraphService, bob, ana)
+		follow(t, ctx, d.socialGraphService, carol, ana)
+
+		// ana is above the threshold, so her post is pulled as soon as she crosses it
+		pulledPostID := d.compose(t, ctx, ana, testPost{text: "pulled"})
+		waitHomeTimeline(t, ctx, d.homeTimelineService, bob, pulledPostID)
+
+		// and still after dropping below it, when her posts are pushed again
+		err := d.socialGraphService.Unfollow(ctx, 0, carol.userID, ana.userID)
+		if err != nil {
+			t.Fatalf("error unfollowing %s by %s: %s", ana.username, carol.username, err.Error())
+		}
+		pushedPostID := d.compose(t, ctx, ana, testPost{text: "pushed"})
+		waitHomeTimeline(t, ctx, d.homeTimelineService, bob, pushedPostID, pulledPostID)
+	}, "fanout_threshold = 1")
+}
+
+func TestRepliesAndReposts(t *testing.T) {
+	deploy(t, func(t *testing.T, d deployment) {
+		ctx := context.Background()
+		registerUsers(t, ctx, d.userService, ana, bob, carol)
+		follow(t, ctx, d.socialGraphService, carol, bob)
+
+		postID := d.compose(t, ctx, ana, testPost{text: "original"})
+		replyID := d.compose(t, ctx, bob, testPost{text: "reply", postType: model.POST_TYPE_REPLY, parentPostID: postID})
+		repostID := d.compose(t, ctx, bob, testPost{text: "repost", postType: model.POST_TYPE_REPOST, parentPostID: postID})
+
+		thread, err := d.postStorageService.ReadThread(ctx, 0, replyID)
+		if err != nil {
+			t.Fatalf("error reading thread: %s", err.Error())
+		}
+		var threadIDs []int64
+		for _, post := range thread {
+			threadIDs = append(threadIDs, post.PostID)
+		}
+		if !equalIDs(threadIDs, []int64{postID, replyID}) {
+			t.Fatalf("got thread %v, want [%d %d]", threadIDs, postID, replyID)
+		}
+		if thread[1].RootPostID != postID || thread[1].ParentPostID != postID {
+			t.Errorf("got reply with root %d and parent %d, want %d", thread[1].RootPostID, thread[1].ParentPostID, postID)
+		}
+
+		page := waitHomeTimeline(t, ctx, d.homeTimelineService, carol, repostID, replyID)
+		if len(page.RepostedPosts) != 1 || page.RepostedPosts[0].PostID != postID || page.RepostedPosts[0].Text != "original" {
+			t.Errorf("got reposted posts %+v, want the original post %d", page.RepostedPosts, postID)
+		}
+
+		// deleted posts are only kept as tombstones in threads
+		err = d.postStorageService.DeletePost(ctx, 0, bob.userID, replyID)
+		if err != nil {
+			t.Fatalf("error deleting reply: %s", err.Error())
+		}
+		_, err = d.postStorageService.ReadPost(ctx, 0, replyID)
+		if !errors.As(err, &services.PostNotFoundError{}) {
+			t.Errorf("got error %v reading a deleted post, want PostNotFoundError", err)
+		}
+		posts, missing, err := d.postStorageService.ReadPosts(ctx, 0, []int64{replyID, postID})
+		if err != nil || len(posts) != 1 || posts[0].PostID != postID || !equalIDs(missing, []int64{replyID}) {
+			t.Errorf("got posts %v, missing posts %v and error %v, want [%d] and [%d]", timelinePostIDs(model.TimelinePage{Posts: posts}), missing, err, postID, replyID)
+		}
+		thread, err = d.postStorageService.ReadThread(ctx, 0, postID)
+		if err != nil || len(thread) != 2 || thread[1].PostID != replyID || !thread[1].Deleted {
+			t.Errorf("got thread %+v and error %v, want the tombstone of %d after the root post", thread, err, replyID)
+		}
+
+		_, err = d.postStorageService.ReadThread(ctx, 0, 999)
+		if !errors.As(err, &services.PostNotFoundError{}) {
+			t.Errorf("got error %v for the thread of a missing post, want PostNotFoundError", err)
+		}
+	})
+}
+
+func TestDirectMessagesArePrivate(t *testing.T) {
+	deploy(t, func(t *testing.T, d deployment) {
+		ctx := context.Background()
+		registerUsers(t, ctx, d.userService, ana, bob, carol)
+
+		messageID := d.compose(t, ctx, ana, testPost{text: "@bob secret", postType: model.POST_TYPE_DM})
+		postID := d.compose(t, ctx, ana, testPost{text: "public"})
+
+		// direct messages cannot be read by id, even by their participants
+		_, err := d.postStorageService.ReadPost(ctx, 0, messageID)
+		if !errors.As(err, &services.PostNotFoundError{}) {
+			t.Errorf("got error %v reading a direct message, want PostNotFoundError", err)
+		}
+		posts, missing, err := d.postStorageService.ReadPosts(ctx, 0, []int64{messageID, postID})
+		if err != nil || len(posts) != 1 || posts[0].PostID != postID || !equalIDs(missing, []int64{messageID}) {
+			t.Errorf("got posts %v, missing posts %v and error %v, want [%d] and [%d]", timelinePostIDs(model.TimelinePage{Posts: posts}), missing, err, postID, messageID)
+		}
+
+		for _, user := range []testUser{ana, bob, carol} {
+			posts, _, err := d.postStorageService.ReadDirectMessages(ctx, 0, user.userID, []int64{messageID, postID})
+			if err != nil {
+				t.Fatalf("error reading direct messages of %s: %s", user.username, err.Error())
+			}
+			expected := []int64{messageID}
+			if user == carol {
+				expected = []int64{}
+			}
+			if postIDs := timelinePostIDs(model.TimelinePage{Posts: posts}); !equalIDs(postIDs, expected) {
+				t.Errorf("got direct messages %v for %s, want %v", postIDs, user.username, expected)
+			}
+		}
+
+		page, err := d.directMessageService.ReadConversation(ctx, 0, bob.userID, "1-2", model.TimelineQuery{Start: 0, Stop: 10})
+		if err != nil || !equalIDs(timelinePostIDs(page), []int64{messageID}) {
+			t.Errorf("got conversation %v and error %v for bob, want [%d]", timelinePostIDs(page), err, messageID)
+		}
+	})
+}
@@ -12,6 +12,9 @@ type MediaService interface {
 	UploadMedia(ctx context.Context, reqID int64, mediaTypes []string, medaIDs []int64) error
 }
 
+// uploads to the compose post service cannot be retried
+var _ weaver.NotRetriable = MediaService.UploadMedia
+
 type mediaService struct {
 	weaver.Implements[MediaService]
 	weaver.WithConfig[mediaServiceOptions]
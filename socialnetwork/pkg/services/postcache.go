@@ -0,0 +1,164 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"socialnetwork/pkg/model"
+	"socialnetwork/pkg/repository"
+)
+
+// postCache is the cache of posts (memcached) in front of the post repository (mongodb)
+// concurrent misses for the same post are coalesced into a single repository read (singleflight),
+// and the posts read while they are invalidated are not cached, so that the cache never keeps an old version
+type postCache struct {
+	cache repository.PostCache
+	// expiration of the posts cached on reads and on writes (0 for no expiration)
+	ttl      time.Duration
+	writeTTL time.Duration
+
+	mu       sync.Mutex
+	inflight map[int64]*postLoad
+}
+
+// postLoad is an in-flight repository read of a post, shared by all the callers that missed it
+type postLoad struct {
+	done  chan struct{}
+	post  model.Post
+	found bool
+	err   error
+	// the post was invalidated during the read, which may have returned its previous version
+	stale bool
+}
+
+func newPostCache(cache repository.PostCache, ttlS int, writeTTLS int) *postCache {
+	return &postCache{
+		cache:    cache,
+		ttl:      time.Duration(max(ttlS, 0)) * time.Second,
+		writeTTL: time.Duration(max(writeTTLS, 0)) * time.Second,
+		inflight: make(map[int64]*postLoad),
+	}
+}
+
+// get returns the cached posts by id
+func (c *postCache) get(ctx context.Context, postIDs []int64) (map[int64]model.Post, error) {
+	return c.cache.GetPosts(ctx, postIDs)
+}
+
+// set caches the posts, each of them expiring after ttl
+func (c *postCache) set(ctx context.Context, posts []model.Post, ttl time.Duration) error {
+	errs := make([]error, len(posts))
+	var wg sync.WaitGroup
+	for i, post := range posts {
+		wg.Add(1)
+		go func(i int, post model.Post) {
+			defer wg.Done()
+			errs[i] = c.cache.SetPost(ctx, post, ttl)
+		}(i, post)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write caches the new version of a post that was just written (write-through)
+func (c *postCache) write(ctx context.Context, post model.Post) error {
+	c.markStale(post.PostID)
+	return c.set(ctx, []model.Post{post}, c.writeTTL)
+}
+
+// invalidate removes the post from the cache, so that its next read fetches it from the repository
+func (c *postCache) invalidate(ctx context.Context, postID int64) error {
+	c.markStale(postID)
+	return c.cache.DeletePost(ctx, postID)
+}
+
+func (c *postCache) markStale(postID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if load, ok := c.inflight[postID]; ok {
+		load.stale = true
+	}
+}
+
+// load reads the posts from the repository with fetch and caches them
+// posts already being read by a concurrent call are waited for instead of being read again
+// posts that are not found are left out of the result
+func (c *postCache) load(ctx context.Context, postIDs []int64, fetch func(ctx context.Context, postIDs []int64) ([]model.Post, error)) (map[int64]model.Post, error) {
+	loads := make(map[int64]*postLoad, len(postIDs))
+	var ownIDs []int64
+	c.mu.Lock()
+	for _, postID := range postIDs {
+		if load, ok := c.inflight[postID]; ok {
+			loads[postID] = load
+			continue
+		}
+		load := &postLoad{done: make(chan struct{})}
+		c.inflight[postID] = load
+		loads[postID] = load
+		ownIDs = append(ownIDs, postID)
+	}
+	c.mu.Unlock()
+
+	if len(ownIDs) > 0 {
+		c.loadOwn(ctx, ownIDs, loads, fetch)
+	}
+
+	posts := make(map[int64]model.Post, len(loads))
+	for postID, load := range loads {
+		select {
+		case <-load.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if load.err != nil {
+			return nil, load.err
+		}
+		if load.found {
+			posts[postID] = load.post
+		}
+	}
+	return posts, nil
+}
+
+// loadOwn reads the posts this call is responsible for and completes their loads
+func (c *postCache) loadOwn(ctx context.Context, postIDs []int64, loads map[int64]*postLoad, fetch func(ctx context.Context, postIDs []int64) ([]model.Post, error)) {
+	fetched, err := fetch(ctx, postIDs)
+	if err == nil {
+		// posts are cached before their loads complete, so that later reads find them in the cache
+		// failing to cache them is not an error, since the next read loads them again
+		c.set(ctx, fetched, c.ttl)
+	}
+
+	// the posts invalidated after being read may have been cached in their old version, so they are
+	// deleted from the cache before their loads complete, without holding mu during the calls to the cache
+	var staleIDs []int64
+	c.mu.Lock()
+	for _, post := range fetched {
+		if loads[post.PostID].stale {
+			staleIDs = append(staleIDs, post.PostID)
+		}
+	}
+	c.mu.Unlock()
+	for _, postID := range staleIDs {
+		c.cache.DeletePost(ctx, postID)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, post := range fetched {
+		load := loads[post.PostID]
+		load.post, load.found = post, true
+	}
+	for _, postID := range postIDs {
+		load := loads[postID]
+		load.err = err
+		delete(c.inflight, postID)
+		close(load.done)
+	}
+}
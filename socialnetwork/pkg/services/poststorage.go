@@ -3,70 +3,170 @@ package services
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"strconv"
-	"sync"
 	"time"
 
 	sn_metrics "socialnetwork/pkg/metrics"
 	"socialnetwork/pkg/model"
+	"socialnetwork/pkg/repository"
 	"socialnetwork/pkg/storage"
+	sn_trace "socialnetwork/pkg/trace"
 
 	"github.com/ServiceWeaver/weaver"
-	"github.com/bradfitz/gomemcache/memcache"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 )
 
 type PostStorageService interface {
-	StorePost(ctx context.Context, reqID int64, post model.Post) error
+	StorePost(ctx context.Context, reqID int64, post model.Post, notification model.Message, regions []string) (model.VersionToken, error)
 	ReadPost(ctx context.Context, reqID int64, postID int64) (model.Post, error)
-	ReadPosts(ctx context.Context, reqID int64, postIDs []int64) ([]model.Post, error)
+	ReadPosts(ctx context.Context, reqID int64, postIDs []int64) ([]model.Post, []int64, error)
+	ReadDirectMessages(ctx context.Context, reqID int64, userID int64, postIDs []int64) ([]model.Post, []int64, error)
+	ReadThread(ctx context.Context, reqID int64, postID int64) ([]model.Post, error)
+	EditPost(ctx context.Context, reqID int64, userID int64, postID int64, text string) (model.Post, error)
+	DeletePost(ctx context.Context, reqID int64, userID int64, postID int64) error
+	InvalidatePosts(ctx context.Context, reqID int64, postIDs []int64) error
 }
 
 var _ weaver.NotRetriable = PostStorageService.StorePost
 
+// a retried edit would add the edited text to the edit history
+var _ weaver.NotRetriable = PostStorageService.EditPost
+
+// a retried delete would find the tombstone and fail with PostNotFoundError
+var _ weaver.NotRetriable = PostStorageService.DeletePost
+
 type postStorageServiceOptions struct {
-	MongoDBAddr   string `toml:"mongodb_address"`
-	MemCachedAddr string `toml:"memcached_address"`
-	MongoDBPort   int    `toml:"mongodb_port"`
-	MemCachedPort int    `toml:"memcached_port"`
-	Region        string `toml:"region"`
+	// storage backend of the posts and their cache: "mongodb" (default) or "memory"
+	StorageBackend string `toml:"storage_backend"`
+	MongoDBAddr    string `toml:"mongodb_address"`
+	MemCachedAddr  string `toml:"memcached_address"`
+	RabbitMQAddr   string `toml:"rabbitmq_address"`
+	MongoDBPort    int    `toml:"mongodb_port"`
+	MemCachedPort  int    `toml:"memcached_port"`
+	RabbitMQPort   int    `toml:"rabbitmq_port"`
+	Region         string `toml:"region"`
+	// regions notified of edits and deletions, which update their caches and timelines
+	Regions []string `toml:"regions"`
+	// posts are cached when read, and also when written with cache_write_through, expiring after
+	// cache_ttl_s and cache_write_ttl_s respectively (0 for no expiration, at most 30 days)
+	CacheWriteThrough bool `toml:"cache_write_through"`
+	CacheTTLS         int  `toml:"cache_ttl_s"`
+	CacheWriteTTLS    int  `toml:"cache_write_ttl_s"`
+	// rabbitmq credentials and publisher confirms (wait for the broker ack before marking outbox entries as sent)
+	RabbitMQUser              string `toml:"rabbitmq_username"`
+	RabbitMQPass              string `toml:"rabbitmq_password"`
+	RabbitMQPublisherConfirms bool   `toml:"rabbitmq_publisher_confirms"`
+	// notification transport used by the outbox relay: "rabbitmq" (default), "channel" or "redis"
+	Notifier          string `toml:"notifier"`
+	NotifierRedisAddr string `toml:"notifier_redis_address"`
+	NotifierRedisPort int    `toml:"notifier_redis_port"`
+	// outbox relay
+	OutboxPollIntervalMs int `toml:"outbox_poll_interval_ms"`
+	OutboxBatchSize      int `toml:"outbox_batch_size"`
+	OutboxLeaseMs        int `toml:"outbox_lease_ms"`
+}
+
+// PostNotFoundError is returned when the post does not exist, e.g. the parent of a reply or repost
+type PostNotFoundError struct {
+	weaver.AutoMarshal
+	PostID int64
+}
+
+func (e PostNotFoundError) Error() string {
+	return fmt.Sprintf("post %d not found", e.PostID)
 }
 
+// NotPostCreatorError is returned when a user other than the creator of the post edits or deletes it
+type NotPostCreatorError struct {
+	weaver.AutoMarshal
+	PostID int64
+	UserID int64
+}
+
+func (e NotPostCreatorError) Error() string {
+	return fmt.Sprintf("user %d is not the creator of post %d", e.UserID, e.PostID)
+}
+
+const DEFAULT_OUTBOX_POLL_INTERVAL_MS int = 50
+const DEFAULT_OUTBOX_BATCH_SIZE int = 100
+const DEFAULT_OUTBOX_LEASE_MS int = 5000
+
 type postStorageService struct {
 	weaver.Implements[PostStorageService]
 	weaver.WithConfig[postStorageServiceOptions]
-	mongoClient     *mongo.Client
-	memCachedClient *memcache.Client
+	posts    repository.PostRepository
+	cache    *postCache
+	notifier storage.Notifier
 }
 
 func (p *postStorageService) Init(ctx context.Context) error {
 	logger := p.Logger(ctx)
+	storageOpts := repository.Options{
+		Backend:     p.Config().StorageBackend,
+		MongoDBAddr: p.Config().MongoDBAddr,
+		MongoDBPort: p.Config().MongoDBPort,
+		CacheAddr:   p.Config().MemCachedAddr,
+		CachePort:   p.Config().MemCachedPort,
+	}
 	var err error
-	p.mongoClient, err = storage.MongoDBClient(ctx, p.Config().MongoDBAddr, p.Config().MongoDBPort)
+	p.posts, err = repository.NewPostRepository(ctx, storageOpts)
+	if err != nil {
+		logger.Error("error initializing post repository", "msg", err.Error())
+		return err
+	}
+	err = p.posts.EnsureIndexes(ctx)
+	if err != nil {
+		logger.Error("error creating post storage indexes", "msg", err.Error())
+		return err
+	}
+	// claiming outbox entries is a write, so only the relay of the region of the primary can run
+	primary, err := p.posts.IsPrimary(ctx)
+	if err != nil {
+		logger.Error("error reading post storage replica status", "msg", err.Error())
+		return err
+	}
+	postCache, err := repository.NewPostCache(storageOpts)
 	if err != nil {
-		logger.Error(err.Error())
+		logger.Error("error initializing post cache", "msg", err.Error())
 		return err
 	}
+	p.cache = newPostCache(postCache, p.Config().CacheTTLS, p.Config().CacheWriteTTLS)
 
-	p.memCachedClient = storage.MemCachedClient(p.Config().MemCachedAddr, p.Config().MemCachedPort)
-	if p.memCachedClient == nil {
-		errMsg := "error connecting to memcached"
-		logger.Error(errMsg)
-		return fmt.Errorf(errMsg)
+	p.notifier, err = storage.NewNotifier(ctx, storage.NotificationOptions{
+		Backend:           p.Config().Notifier,
+		Exchange:          "write-home-timeline",
+		RabbitMQAddr:      p.Config().RabbitMQAddr,
+		RabbitMQPort:      p.Config().RabbitMQPort,
+		RabbitMQUser:      p.Config().RabbitMQUser,
+		RabbitMQPass:      p.Config().RabbitMQPass,
+		RedisAddr:         p.Config().NotifierRedisAddr,
+		RedisPort:         p.Config().NotifierRedisPort,
+		PublisherConfirms: p.Config().RabbitMQPublisherConfirms,
+	})
+	if err != nil {
+		logger.Error("error initializing notifier", "msg", err.Error())
+		return err
+	}
+
+	if primary {
+		go p.outboxRelay(ctx)
 	}
 
-	logger.Info("post storage service running!", "region", p.Config().Region,
+	logger.Info("post storage service running!", "region", p.Config().Region, "storage_backend", p.Config().StorageBackend,
 		"mongodb_addr", p.Config().MongoDBAddr, "mongodb_port", p.Config().MongoDBPort,
 		"memcached_addr", p.Config().MemCachedAddr, "memcached_port", p.Config().MemCachedPort,
+		"rabbitmq_addr", p.Config().RabbitMQAddr, "rabbitmq_port", p.Config().RabbitMQPort, "rabbitmq_publisher_confirms", p.Config().RabbitMQPublisherConfirms,
+		"notifier", p.Config().Notifier, "outbox_relay", primary, "outbox_poll_interval_ms", p.outboxPollInterval().Milliseconds(),
+		"cache_write_through", p.Config().CacheWriteThrough, "cache_ttl_s", p.Config().CacheTTLS, "cache_write_ttl_s", p.Config().CacheWriteTTLS,
 	)
 	return nil
 }
 
-func (p *postStorageService) StorePost(ctx context.Context, reqID int64, post model.Post) error {
+// StorePost writes the post together with one outbox entry per region in a single transaction
+// the entries are published asynchronously by the outbox relay
+func (p *postStorageService) StorePost(ctx context.Context, reqID int64, post model.Post, notification model.Message, regions []string) (model.VersionToken, error) {
 	logger := p.Logger(ctx)
 	logger.Info("entering StorePost", "reqid", reqID, "post", post)
 
@@ -75,146 +175,497 @@ func (p *postStorageService) StorePost(ctx context.Context, reqID int64, post mo
 	)
 	writePostStartMs := time.Now().UnixMilli()
 
-	collection := p.mongoClient.Database("post-storage").Collection("posts")
-	r, err := collection.InsertOne(ctx, post)
+	// the version of the write is the version token that consumers in other regions can wait for
+	version, err := p.posts.Transaction(ctx, func(ctx context.Context, tx repository.PostTransaction) error {
+		if post.PostType == model.POST_TYPE_REPLY || post.PostType == model.POST_TYPE_REPOST {
+			err := linkParentPost(ctx, tx, &post)
+			if err != nil {
+				return err
+			}
+		}
+		err := tx.InsertPost(ctx, post)
+		if err != nil {
+			return err
+		}
+		return insertOutboxEntries(ctx, tx, post.PostID, notification, p.Config().Region, regions)
+	})
 	if err != nil {
 		logger.Error("error writing post", "msg", err.Error())
+		return version, err
+	}
+	if p.Config().CacheWriteThrough {
+		// the post is already stored, so failing to cache it only costs a miss on its first read
+		err = p.cache.write(ctx, post)
+		if err != nil {
+			logger.Warn("error writing post to cache", "post_id", post.PostID, "msg", err.Error())
+			sn_metrics.FailedPostCacheWrites.Get(sn_metrics.RegionLabel{Region: p.Config().Region}).Inc()
+		}
 	}
 	regionLabel := sn_metrics.RegionLabel{Region: p.Config().Region}
 	logger.Debug("before write post metric 1", "region_label", regionLabel)
 	sn_metrics.WritePostDurationMs.Get(regionLabel)
 	logger.Debug("before write post metric 2", "region_label", regionLabel)
 	sn_metrics.WritePostDurationMs.Get(regionLabel).Put(float64(time.Now().UnixMilli() - writePostStartMs))
-	logger.Debug("inserted post", "objectid", r.InsertedID)
+	logger.Debug("stored post and outbox entries", "post_id", post.PostID, "regions", regions, "version", version)
+
+	return version, nil
+}
+
+// insertOutboxEntries writes the notification of the post to the outbox of each region
+// the notification carries the region and time of the write, from which consumers measure the visibility lag of the post
+func insertOutboxEntries(ctx context.Context, tx repository.PostTransaction, postID int64, notification model.Message, sourceRegion string, regions []string) error {
+	if len(regions) == 0 {
+		return nil
+	}
+	now := time.Now().UnixMilli()
+	notification.SourceRegion = sourceRegion
+	notification.PostWriteTs = now
+	var entries []repository.OutboxEntry
+	for _, region := range regions {
+		entries = append(entries, repository.OutboxEntry{
+			PostID:     postID,
+			Region:     region,
+			RoutingKey: fmt.Sprintf("write-home-timeline-%s", region),
+			Message:    notification,
+			Status:     repository.OUTBOX_STATUS_PENDING,
+			CreatedAt:  now,
+		})
+	}
+	return tx.InsertOutboxEntries(ctx, entries)
+}
 
+// linkParentPost checks that the parent of the reply or repost exists and sets the root of the conversation
+// replies and reposts of a repost refer to its original post, so reposts always point to an original post
+func linkParentPost(ctx context.Context, tx repository.PostTransaction, post *model.Post) error {
+	var parent model.Post
+	for {
+		var err error
+		parent, err = tx.FindPost(ctx, post.ParentPostID)
+		// direct messages are hidden from everyone but their participants
+		if errors.Is(err, repository.ErrNotFound) || (err == nil && parent.PostType == model.POST_TYPE_DM) {
+			return PostNotFoundError{PostID: post.ParentPostID}
+		}
+		if err != nil {
+			return err
+		}
+		if parent.PostType != model.POST_TYPE_REPOST {
+			break
+		}
+		post.ParentPostID = parent.ParentPostID
+	}
+	post.RootPostID = 0
+	if post.PostType == model.POST_TYPE_REPLY {
+		post.RootPostID = parent.RootPostID
+		if post.RootPostID == 0 {
+			post.RootPostID = parent.PostID
+		}
+	}
 	return nil
 }
 
-func (p *postStorageService) ReadPost(ctx context.Context, reqID int64, postID int64) (model.Post, error) {
-	logger := p.Logger(ctx)
-	logger.Info("entering ReadPost", "req_id", reqID, "post_id", postID)
+func (p *postStorageService) outboxPollInterval() time.Duration {
+	if p.Config().OutboxPollIntervalMs <= 0 {
+		return time.Duration(DEFAULT_OUTBOX_POLL_INTERVAL_MS) * time.Millisecond
+	}
+	return time.Duration(p.Config().OutboxPollIntervalMs) * time.Millisecond
+}
 
-	var post model.Post
-	postIDStr := strconv.FormatInt(postID, 10)
-	item, err := p.memCachedClient.Get(postIDStr)
+func (p *postStorageService) outboxBatchSize() int {
+	if p.Config().OutboxBatchSize <= 0 {
+		return DEFAULT_OUTBOX_BATCH_SIZE
+	}
+	return p.Config().OutboxBatchSize
+}
 
-	if err != nil && err != memcache.ErrCacheMiss {
-		// error reading cache
-		logger.Error("error reading post from cache", "msg", err.Error())
-		return post, err
+func (p *postStorageService) outboxLease() time.Duration {
+	if p.Config().OutboxLeaseMs <= 0 {
+		return time.Duration(DEFAULT_OUTBOX_LEASE_MS) * time.Millisecond
+	}
+	return time.Duration(p.Config().OutboxLeaseMs) * time.Millisecond
+}
+
+// outboxRelay periodically publishes the pending outbox entries until the context is cancelled
+func (p *postStorageService) outboxRelay(ctx context.Context) {
+	logger := p.Logger(ctx)
+	ticker := time.NewTicker(p.outboxPollInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// drain the outbox before waiting for the next tick
+			for {
+				n, err := p.relayOutboxBatch(ctx)
+				if err != nil {
+					logger.Error("error relaying outbox entries", "msg", err.Error())
+					break
+				}
+				if n < p.outboxBatchSize() {
+					break
+				}
+			}
+		}
 	}
-	if err == nil {
-		// post found in cache
-		err := json.Unmarshal(item.Value, &post)
+}
+
+// relayOutboxBatch claims up to one batch of outbox entries and publishes them
+// entries are claimed with a lease so that concurrent relays (e.g. replicas of this component)
+// never publish the same entry twice unless the relay crashes before marking it as sent,
+// in which case the consumers discard the duplicate by its notification id
+func (p *postStorageService) relayOutboxBatch(ctx context.Context) (int, error) {
+	logger := p.Logger(ctx)
+
+	relayed := 0
+	for relayed < p.outboxBatchSize() {
+		now := time.Now().UnixMilli()
+		// the version of the claim is at least the commit version of the post
+		entry, version, found, err := p.posts.ClaimOutboxEntry(ctx, now, now+p.outboxLease().Milliseconds())
 		if err != nil {
-			logger.Error("error parsing post from cache result", "msg", err.Error())
-			return post, err
+			return relayed, err
 		}
-	} else {
-		// post does not exist in cache
-		// so we get it from db
-		collection := p.mongoClient.Database("post-storage").Collection("posts")
-		filter := bson.D{
-			{Key: "post_id", Value: postID},
+		if !found {
+			return relayed, nil
 		}
-		result := collection.FindOne(ctx, filter)
-		if result.Err() != nil {
-			return post, err
+
+		msg := entry.Message
+		msg.NotificationID = entry.ID
+		msg.PostVersion = version
+		msg.NotificationSendTs = time.Now().UnixMilli()
+		msgJSON, err := json.Marshal(msg)
+		if err != nil {
+			return relayed, err
+		}
+
+		err = p.notifier.Publish(ctx, entry.RoutingKey, msgJSON)
+		if err != nil {
+			// release the claim so that the entry is retried in the next poll
+			logger.Error("error publishing notification", "routing_key", entry.RoutingKey, "err", err.Error())
+			regionLabel := sn_metrics.RegionLabel{Region: p.Config().Region}
+			sn_metrics.FailedOutboxPublishes.Get(regionLabel).Inc()
+			releaseErr := p.posts.ReleaseOutboxEntry(ctx, entry.ID)
+			if releaseErr != nil {
+				// the entry is retried once its lease expires
+				logger.Error("error releasing outbox entry", "id", entry.ID, "lease_ms", p.outboxLease().Milliseconds(), "err", releaseErr.Error())
+				sn_metrics.FailedOutboxReleases.Get(regionLabel).Inc()
+			}
+			return relayed, err
 		}
-		err = result.Decode(&post)
+		err = p.posts.MarkOutboxEntrySent(ctx, entry.ID, time.Now().UnixMilli())
 		if err != nil {
-			errMsg := fmt.Sprintf("post_id: %s not found in mongodb", postIDStr)
-			logger.Warn(errMsg)
-			return post, fmt.Errorf(errMsg)
+			return relayed, err
 		}
+		sn_metrics.RelayedNotifications.Get(sn_metrics.RegionLabel{Region: p.Config().Region}).Inc()
+		relayed++
 	}
-	return post, nil
+	return relayed, nil
+}
+
+// ReadPost returns the post, from the cache if possible
+// direct messages are not found, since they can only be read by their participants with ReadDirectMessages,
+// and neither are deleted posts
+func (p *postStorageService) ReadPost(ctx context.Context, reqID int64, postID int64) (model.Post, error) {
+	logger := p.Logger(ctx)
+	logger.Info("entering ReadPost", "req_id", reqID, "post_id", postID)
+
+	posts, missingPostIDs, err := p.readPosts(ctx, []int64{postID})
+	if err != nil {
+		logger.Error("error reading post", "post_id", postID, "msg", err.Error())
+		return model.Post{}, err
+	}
+	posts, hiddenPostIDs := visiblePosts(posts, 0)
+	if len(missingPostIDs) > 0 || len(hiddenPostIDs) > 0 {
+		logger.Warn("post not found", "post_id", postID)
+		return model.Post{}, PostNotFoundError{PostID: postID}
+	}
+	return posts[0], nil
 }
 
-func (p *postStorageService) ReadPosts(ctx context.Context, reqID int64, postIDs []int64) ([]model.Post, error) {
+// ReadPosts returns the posts in the same order as the requested ids (e.g. newest first for timelines)
+// together with the ids of the posts that were not found (e.g. not replicated to this region yet)
+// direct messages and deleted posts are returned as not found, as in ReadPost
+func (p *postStorageService) ReadPosts(ctx context.Context, reqID int64, postIDs []int64) ([]model.Post, []int64, error) {
 	logger := p.Logger(ctx)
 	logger.Info("entering ReadPosts", "req_id", reqID, "post_ids", postIDs)
+	return p.readVisiblePosts(ctx, postIDs, 0)
+}
+
+// ReadDirectMessages returns the direct messages that the user sent or received in the same order as the requested ids,
+// together with the ids of the ones that were not found, which include the posts that are not direct messages of the user
+func (p *postStorageService) ReadDirectMessages(ctx context.Context, reqID int64, userID int64, postIDs []int64) ([]model.Post, []int64, error) {
+	logger := p.Logger(ctx)
+	logger.Info("entering ReadDirectMessages", "req_id", reqID, "user_id", userID, "post_ids", postIDs)
+	return p.readVisiblePosts(ctx, postIDs, userID)
+}
 
+// readVisiblePosts reads the public posts if userID is 0, or else the direct messages of the user
+func (p *postStorageService) readVisiblePosts(ctx context.Context, postIDs []int64, userID int64) ([]model.Post, []int64, error) {
+	logger := p.Logger(ctx)
+	posts, missingPostIDs, err := p.readPosts(ctx, postIDs)
+	if err != nil {
+		logger.Error("error reading posts", "msg", err.Error())
+		return nil, nil, err
+	}
+	if len(missingPostIDs) > 0 {
+		logger.Warn("posts not found", "post_ids", missingPostIDs)
+		sn_metrics.MissingPosts.Get(sn_metrics.RegionLabel{Region: p.Config().Region}).Add(float64(len(missingPostIDs)))
+	}
+	posts, hiddenPostIDs := visiblePosts(posts, userID)
+	return posts, append(missingPostIDs, hiddenPostIDs...), nil
+}
+
+// visiblePosts splits the posts in the ones visible to the user and the ids of the hidden ones:
+// the public posts are only visible with userID 0, and direct messages only to their sender and recipients
+// deleted posts are hidden from everyone, their tombstones are only kept in threads (see ReadThread)
+func visiblePosts(posts []model.Post, userID int64) ([]model.Post, []int64) {
+	visible := make([]model.Post, 0, len(posts))
+	var hiddenPostIDs []int64
+	for _, post := range posts {
+		isVisible := post.PostType != model.POST_TYPE_DM
+		if userID != 0 {
+			isVisible = post.PostType == model.POST_TYPE_DM && isParticipant(post, userID)
+		}
+		if isVisible && !post.Deleted {
+			visible = append(visible, post)
+		} else {
+			hiddenPostIDs = append(hiddenPostIDs, post.PostID)
+		}
+	}
+	return visible, hiddenPostIDs
+}
+
+// isParticipant returns true if the user sent the direct message or is one of its recipients (i.e. mentioned users)
+func isParticipant(post model.Post, userID int64) bool {
+	if post.Creator.UserID == userID {
+		return true
+	}
+	for _, mention := range post.UserMentions {
+		if mention.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// readPosts reads the posts from the cache and the missing ones from the repository
+func (p *postStorageService) readPosts(ctx context.Context, postIDs []int64) ([]model.Post, []int64, error) {
+	posts := []model.Post{}
+	missingPostIDs := []int64{}
 	if len(postIDs) == 0 {
-		return []model.Post{}, nil
+		return posts, missingPostIDs, nil
+	}
+	regionLabel := sn_metrics.RegionLabel{Region: p.Config().Region}
+
+	postsByID, err := p.cache.get(ctx, postIDs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading posts from cache: %s", err.Error())
+	}
+	var notCachedIDs []int64
+	seen := make(map[int64]bool, len(postIDs))
+	for _, postID := range postIDs {
+		if _, ok := postsByID[postID]; !ok && !seen[postID] {
+			notCachedIDs = append(notCachedIDs, postID)
+		}
+		seen[postID] = true
 	}
+	sn_metrics.PostCacheHits.Get(regionLabel).Add(float64(len(postsByID)))
+	sn_metrics.PostCacheMisses.Get(regionLabel).Add(float64(len(notCachedIDs)))
 
-	postIDsNotCached := make(map[int64]bool)
-	for _, pid := range postIDs {
-		postIDsNotCached[pid] = true
+	if len(notCachedIDs) > 0 {
+		loaded, err := p.cache.load(ctx, notCachedIDs, p.posts.FindPosts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading posts from repository: %s", err.Error())
+		}
+		for postID, post := range loaded {
+			postsByID[postID] = post
+		}
 	}
 
-	var keys []string
-	for _, pid := range postIDs {
-		keys = append(keys, strconv.FormatInt(pid, 10))
+	for _, postID := range postIDs {
+		if post, ok := postsByID[postID]; ok {
+			posts = append(posts, post)
+		} else {
+			missingPostIDs = append(missingPostIDs, postID)
+		}
+	}
+	return posts, missingPostIDs, nil
+}
+
+// ReadThread returns the conversation of the post, i.e. its root post followed by all the replies in depth-first
+// order, where the replies to the same post are sorted from oldest to newest
+func (p *postStorageService) ReadThread(ctx context.Context, reqID int64, postID int64) ([]model.Post, error) {
+	logger := p.Logger(ctx)
+	logger.Debug("entering ReadThread", "req_id", reqID, "post_id", postID)
+
+	post, err := p.posts.FindPost(ctx, postID, model.VersionToken{})
+	if errors.Is(err, repository.ErrNotFound) || (err == nil && post.PostType == model.POST_TYPE_DM) {
+		return nil, PostNotFoundError{PostID: postID}
 	}
-	result, err := p.memCachedClient.GetMulti(keys)
 	if err != nil {
-		logger.Error("error reading keys from memcached", "msg", err.Error())
+		logger.Error("error reading post", "msg", err.Error())
 		return nil, err
 	}
-	posts := []model.Post{}
-	for _, key := range keys {
-		if val, ok := result[key]; ok {
-			var cachedPost model.Post
-			err := json.Unmarshal(val.Value, &cachedPost)
-			if err != nil {
-				logger.Error("error parsing ids from memcached result", "msg", err.Error())
-				return nil, err
-			}
-			posts = append(posts, cachedPost)
+	rootPostID := post.RootPostID
+	if rootPostID == 0 {
+		rootPostID = post.PostID
+	}
+
+	posts, err := p.posts.FindThread(ctx, rootPostID)
+	if err != nil {
+		logger.Error("error reading thread", "msg", err.Error())
+		return nil, err
+	}
+
+	var root *model.Post
+	replies := make(map[int64][]model.Post)
+	for i, post := range posts {
+		if post.PostID == rootPostID {
+			root = &posts[i]
+		} else {
+			replies[post.ParentPostID] = append(replies[post.ParentPostID], post)
+		}
+	}
+	if root == nil {
+		return nil, PostNotFoundError{PostID: rootPostID}
+	}
+	thread := make([]model.Post, 0, len(posts))
+	var visit func(post model.Post)
+	visit = func(post model.Post) {
+		thread = append(thread, post)
+		for _, reply := range replies[post.PostID] {
+			visit(reply)
 		}
 	}
+	visit(*root)
+	return thread, nil
+}
 
-	for _, post := range posts {
-		delete(postIDsNotCached, post.PostID)
+// EditPost replaces the text of the post, keeping the previous one in its edit history
+// every region is notified so that its cached copy of the post is invalidated
+func (p *postStorageService) EditPost(ctx context.Context, reqID int64, userID int64, postID int64, text string) (model.Post, error) {
+	logger := p.Logger(ctx)
+	logger.Debug("entering EditPost", "req_id", reqID, "user_id", userID, "post_id", postID)
+
+	now := time.Now().UnixMilli()
+	post, err := p.changePost(ctx, userID, postID, func(post *model.Post) model.Message {
+		version := post.Timestamp
+		if post.EditedAt != 0 {
+			version = post.EditedAt
+		}
+		post.EditHistory = append(post.EditHistory, model.PostEdit{Text: post.Text, Timestamp: version})
+		post.Text = text
+		post.EditedAt = now
+		return p.postChangeNotification(ctx, reqID, model.MESSAGE_TYPE_EDIT, *post, now)
+	})
+	if err != nil {
+		logger.Warn("error editing post", "post_id", postID, "msg", err.Error())
+		return post, err
 	}
-	if len(postIDsNotCached) != 0 {
-		collection := p.mongoClient.Database("post-storage").Collection("posts")
+	return post, nil
+}
+
+// DeletePost replaces the post with a tombstone
+// every region is notified so that it invalidates its cached copy of the post and removes it from the
+// user timeline of the creator and the home timelines of its followers and mentioned users
+func (p *postStorageService) DeletePost(ctx context.Context, reqID int64, userID int64, postID int64) error {
+	logger := p.Logger(ctx)
+	logger.Debug("entering DeletePost", "req_id", reqID, "user_id", userID, "post_id", postID)
+
+	now := time.Now().UnixMilli()
+	_, err := p.changePost(ctx, userID, postID, func(post *model.Post) model.Message {
+		// the mentioned users are notified before the mentions are removed from the tombstone
+		notification := p.postChangeNotification(ctx, reqID, model.MESSAGE_TYPE_DELETE, *post, post.Timestamp)
+		post.Deleted = true
+		post.DeletedAt = now
+		post.Text = ""
+		post.UserMentions = []model.UserMention{}
+		post.Media = []model.Media{}
+		post.URLs = []model.URL{}
+		post.EditHistory = []model.PostEdit{}
+		return notification
+	})
+	if err != nil {
+		logger.Warn("error deleting post", "post_id", postID, "msg", err.Error())
+		return err
+	}
+	return nil
+}
 
-		queryPostIDArray := bson.A{}
-		for id := range postIDsNotCached {
-			queryPostIDArray = append(queryPostIDArray, id)
+// changePost replaces the post of the user with the one modified by change in the same transaction as the
+// outbox entries of the notification returned by change, and caches (with cache_write_through) or invalidates the post
+// deleted posts cannot be changed
+func (p *postStorageService) changePost(ctx context.Context, userID int64, postID int64, change func(post *model.Post) model.Message) (model.Post, error) {
+	var changedPost model.Post
+	_, err := p.posts.Transaction(ctx, func(ctx context.Context, tx repository.PostTransaction) error {
+		post, err := tx.FindPost(ctx, postID)
+		if errors.Is(err, repository.ErrNotFound) || (err == nil && post.Deleted) {
+			return PostNotFoundError{PostID: postID}
 		}
-		filter := bson.D{
-			{Key: "post_id", Value: bson.D{
-				{Key: "$in", Value: queryPostIDArray},
-			}},
+		if err != nil {
+			return err
+		}
+		if post.Creator.UserID != userID {
+			return NotPostCreatorError{PostID: postID, UserID: userID}
 		}
-		cur, err := collection.Find(ctx, filter)
+		notification := change(&post)
+		err = tx.ReplacePost(ctx, post)
 		if err != nil {
-			logger.Error("error reading posts from mongodb", "msg", err.Error())
-			return nil, err
+			return err
+		}
+		changedPost = post
+		return insertOutboxEntries(ctx, tx, postID, notification, p.Config().Region, p.Config().Regions)
+	})
+	if err != nil {
+		return changedPost, err
+	}
+	// the change is committed, so cache errors are logged instead of returned
+	// the cached copy is also invalidated in every region once the notification of the change is applied
+	logger := p.Logger(ctx)
+	if p.Config().CacheWriteThrough {
+		err = p.cache.write(ctx, changedPost)
+		if err == nil {
+			return changedPost, nil
 		}
+		// the cache may still hold the previous version, so it falls back to invalidating the post
+		logger.Warn("error writing changed post to cache, invalidating it", "post_id", postID, "msg", err.Error())
+		sn_metrics.FailedPostCacheWrites.Get(sn_metrics.RegionLabel{Region: p.Config().Region}).Inc()
+	}
+	err = p.cache.invalidate(ctx, postID)
+	if err != nil {
+		logger.Warn("error invalidating changed post", "post_id", postID, "msg", err.Error())
+	}
+	return changedPost, nil
+}
 
-		exists := cur.TryNext(ctx)
-		if exists {
-			var postsToCache []model.Post
-			err = cur.All(ctx, &postsToCache)
-			if err != nil {
-				logger.Error("error parsing new posts from mongodb", "msg", err.Error())
-				return nil, err
-			}
-			posts = append(posts, postsToCache...)
-
-			var wg sync.WaitGroup
-			for _, newPost := range postsToCache {
-				wg.Add(1)
-
-				go func(newPost model.Post) error {
-					defer wg.Done()
-					postJson, err := json.Marshal(newPost)
-					if err != nil {
-						logger.Error("error converting post to json", "post", newPost)
-						return err
-					}
-					postIDstr := strconv.FormatInt(newPost.PostID, 10)
-					p.memCachedClient.Set(&memcache.Item{Key: postIDstr, Value: postJson})
-					return nil
-				}(newPost)
-			}
-			wg.Wait()
+// postChangeNotification builds the message consumed by the write home timeline service of each region
+// when the post is edited or deleted
+func (p *postStorageService) postChangeNotification(ctx context.Context, reqID int64, msgType string, post model.Post, timestamp int64) model.Message {
+	var userMentionIDs []int64
+	for _, mention := range post.UserMentions {
+		userMentionIDs = append(userMentionIDs, mention.UserID)
+	}
+	return model.Message{
+		Type:           msgType,
+		ReqID:          reqID,
+		PostID:         post.PostID,
+		UserID:         post.Creator.UserID,
+		Timestamp:      timestamp,
+		UserMentionIDs: userMentionIDs,
+		// tracing
+		SpanContext: sn_trace.BuildSpanContext(trace.SpanContextFromContext(ctx)),
+	}
+}
+
+// InvalidatePosts removes the posts from the cache, so that their next read fetches them from the repository
+func (p *postStorageService) InvalidatePosts(ctx context.Context, reqID int64, postIDs []int64) error {
+	logger := p.Logger(ctx)
+	logger.Debug("entering InvalidatePosts", "req_id", reqID, "post_ids", postIDs)
+	for _, postID := range postIDs {
+		err := p.cache.invalidate(ctx, postID)
+		if err != nil {
+			logger.Error("error invalidating cached post", "post_id", postID, "msg", err.Error())
+			return err
 		}
 	}
-	return posts, nil
+	return nil
 }
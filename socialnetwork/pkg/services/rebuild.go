@@ -0,0 +1,40 @@
+package services
+
+import (
+	"context"
+
+	"socialnetwork/pkg/repository"
+)
+
+// home timelines are rebuilt from the social graph and post storage, i.e. the same posts that
+// WriteHomeTimelineService adds on every notification: posts of the followees and posts that mention the user
+
+// HomeTimelineStores are the repositories read and written when rebuilding home timelines
+type HomeTimelineStores struct {
+	SocialGraph repository.SocialGraphRepository
+	Posts       repository.PostRepository
+	// home timelines that are replaced with the rebuilt timelines (e.g. one per region cache)
+	HomeTimelines []repository.TimelineRepository
+}
+
+// RebuildHomeTimeline replaces the stored and cached home timeline of the user with the newest
+// posts of its followees and the posts that mention it (all of them if limit is 0)
+// and returns the number of posts in the rebuilt timeline
+func RebuildHomeTimeline(ctx context.Context, stores HomeTimelineStores, userID int64, limit int64) (int, error) {
+	followeeIDs, err := stores.SocialGraph.GetFollowees(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	// direct messages are delivered to conversations instead of timelines, and deleted posts are tombstones
+	posts, err := stores.Posts.FindTimelinePosts(ctx, followeeIDs, userID, limit)
+	if err != nil {
+		return 0, err
+	}
+	for _, timelines := range stores.HomeTimelines {
+		err = timelines.ReplaceTimeline(ctx, userID, posts)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(posts), nil
+}
@@ -2,437 +2,294 @@ package services
 
 import (
 	"context"
-	"strconv"
-	"sync"
+	"encoding/json"
+	"fmt"
 	"time"
 
+	"socialnetwork/pkg/model"
+	"socialnetwork/pkg/repository"
 	"socialnetwork/pkg/storage"
+	sn_trace "socialnetwork/pkg/trace"
 
 	"github.com/ServiceWeaver/weaver"
-	"github.com/redis/go-redis/v9"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type SocialGraphService interface {
 	GetFollowers(ctx context.Context, reqID int64, userID int64) ([]int64, error)
 	GetFollowees(ctx context.Context, reqID int64, userID int64) ([]int64, error)
+	CountFollowers(ctx context.Context, reqID int64, userIDs []int64) ([]int64, error)
+	IsFollowing(ctx context.Context, reqID int64, userID int64, followeeID int64) (bool, error)
 	Follow(ctx context.Context, reqID int64, userID int64, followeeID int64) error
 	Unfollow(ctx context.Context, reqID int64, userID int64, followeeID int64) error
 	FollowWithUsername(ctx context.Context, reqID int64, userUsername string, followeeUsername string) error
 	UnfollowWithUsername(ctx context.Context, reqID int64, userUsername string, followeeUsername string) error
 	InsertUser(ctx context.Context, reqID int64, userID int64) error
+	BatchInsertUsers(ctx context.Context, reqID int64, userIDs []int64) (int, error)
+	BatchFollow(ctx context.Context, reqID int64, edges []model.FollowEdge) (int, error)
 }
 
+// a retried batch would report that nothing was inserted
+var _ weaver.NotRetriable = SocialGraphService.BatchInsertUsers
+var _ weaver.NotRetriable = SocialGraphService.BatchFollow
+
 type socialGraphService struct {
 	weaver.Implements[SocialGraphService]
 	weaver.WithConfig[socialGraphServiceOptions]
-	userService weaver.Ref[UserService]
-	mongoClient *mongo.Client
-	redisClient *redis.Client
+	graph    repository.SocialGraphRepository
+	users    repository.UserRepository
+	notifier storage.Notifier
 }
 
 type socialGraphServiceOptions struct {
+	// storage backend of the graph: "mongodb" (default) or "memory"
+	StorageBackend string 	`toml:"storage_backend"`
 	MongoDBAddr string 	`toml:"mongodb_address"`
 	RedisAddr   string 	`toml:"redis_address"`
 	MongoDBPort int    	`toml:"mongodb_port"`
 	RedisPort   int    	`toml:"redis_port"`
 	Region 	 	string 	`toml:"region"`
-}
-
-type FollowerInfo struct {
-	FollowerID int64 `bson:"follower_id"`
-	Timestamp  int64 `bson:"timestamp"`
-}
-
-type FolloweeInfo struct {
-	FolloweeID int64 `bson:"followee_id"`
-	Timestamp  int64 `bson:"timestamp"`
-}
-
-type UserInfo struct {
-	UserID    int64          `bson:"user_id"`
-	Followers []FollowerInfo `bson:"followers"`
-	Followees []FolloweeInfo `bson:"followees"`
+	// usernames are resolved from the users in mongodb and the UserService cache (memcached)
+	MemCachedAddr string `toml:"memcached_address"`
+	MemCachedPort int    `toml:"memcached_port"`
+	// follow and unfollow events are published to the write home timeline service of each region
+	// (no events are published if regions is empty)
+	Regions                   []string `toml:"regions"`
+	Notifier                  string   `toml:"notifier"`
+	NotifierRedisAddr         string   `toml:"notifier_redis_address"`
+	NotifierRedisPort         int      `toml:"notifier_redis_port"`
+	RabbitMQAddr              string   `toml:"rabbitmq_address"`
+	RabbitMQPort              int      `toml:"rabbitmq_port"`
+	RabbitMQUser              string   `toml:"rabbitmq_username"`
+	RabbitMQPass              string   `toml:"rabbitmq_password"`
+	RabbitMQPublisherConfirms bool     `toml:"rabbitmq_publisher_confirms"`
 }
 
 func (s *socialGraphService) Init(ctx context.Context) error {
 	logger := s.Logger(ctx)
 	var err error
-	s.mongoClient, err = storage.MongoDBClient(ctx, s.Config().MongoDBAddr, s.Config().MongoDBPort)
+	s.graph, err = repository.NewSocialGraphRepository(ctx, repository.Options{
+		Backend:     s.Config().StorageBackend,
+		MongoDBAddr: s.Config().MongoDBAddr,
+		MongoDBPort: s.Config().MongoDBPort,
+		CacheAddr:   s.Config().RedisAddr,
+		CachePort:   s.Config().RedisPort,
+	})
 	if err != nil {
-		logger.Error(err.Error())
+		logger.Error("error initializing social graph repository", "msg", err.Error())
+		return err
+	}
+	s.users, err = repository.NewUserRepository(ctx, repository.Options{
+		Backend:     s.Config().StorageBackend,
+		MongoDBAddr: s.Config().MongoDBAddr,
+		MongoDBPort: s.Config().MongoDBPort,
+		CacheAddr:   s.Config().MemCachedAddr,
+		CachePort:   s.Config().MemCachedPort,
+	})
+	if err != nil {
+		logger.Error("error initializing user repository", "msg", err.Error())
 		return err
 	}
 
-	s.redisClient = storage.RedisClient(s.Config().RedisAddr, s.Config().RedisPort)
+	if len(s.Config().Regions) > 0 {
+		s.notifier, err = storage.NewNotifier(ctx, storage.NotificationOptions{
+			Backend:           s.Config().Notifier,
+			Exchange:          "write-home-timeline",
+			RabbitMQAddr:      s.Config().RabbitMQAddr,
+			RabbitMQPort:      s.Config().RabbitMQPort,
+			RabbitMQUser:      s.Config().RabbitMQUser,
+			RabbitMQPass:      s.Config().RabbitMQPass,
+			RedisAddr:         s.Config().NotifierRedisAddr,
+			RedisPort:         s.Config().NotifierRedisPort,
+			PublisherConfirms: s.Config().RabbitMQPublisherConfirms,
+		})
+		if err != nil {
+			logger.Error("error initializing notifier", "msg", err.Error())
+			return err
+		}
+	}
 
-	logger.Info("social graph service running!", "region", s.Config().Region,
+	logger.Info("social graph service running!", "region", s.Config().Region, "regions", s.Config().Regions, "storage_backend", s.Config().StorageBackend,
 		"mongodb_addr", s.Config().MongoDBAddr, "mongodb_port", s.Config().MongoDBPort,
 		"redis_addr", s.Config().RedisAddr, "redis_port", s.Config().RedisPort,
+		"memcached_addr", s.Config().MemCachedAddr, "memcached_port", s.Config().MemCachedPort,
+		"notifier", s.Config().Notifier, "rabbitmq_addr", s.Config().RabbitMQAddr, "rabbitmq_port", s.Config().RabbitMQPort,
 	)
 	return nil
 }
 
+// GetFollowers returns the followers of the user, which are cached in redis after the first read
 func (s *socialGraphService) GetFollowers(ctx context.Context, reqID int64, userID int64) ([]int64, error) {
 	logger := s.Logger(ctx)
 	logger.Debug("entering GetFollowers", "req_id", reqID, "user_id", userID)
 
-	var followerIDs []int64
-	userIDStr := strconv.FormatInt(userID, 10)
-	numFollowers, err := s.redisClient.ZCard(ctx, userIDStr+":followers").Result()
+	followerIDs, err := s.graph.GetFollowers(ctx, userID)
 	if err != nil {
-		logger.Error("error reading number of followers from cache", "msg", err.Error())
-	}
-	if numFollowers > 0 {
-		// followers are cached in redis so we retrieve them
-		result, err := s.redisClient.ZRange(ctx, userIDStr+":followers", 0, -1).Result()
-		if err != nil {
-			logger.Error("error reading followers from cache", "msg", err.Error())
-			return nil, err
-		}
-		for _, r := range result {
-			followerID, err := strconv.ParseInt(r, 10, 64)
-			if err != nil {
-				logger.Error("error parsing follower id from redis to int64", "msg", err.Error())
-				return nil, err
-			}
-			followerIDs = append(followerIDs, followerID)
-		}
-		return followerIDs, nil
-	} else {
-		// did not find followers in redis
-		// look up in mongodb and update redis
-		collection := s.mongoClient.Database("social-graph").Collection("social-graph")
-		filter := bson.D{
-			{Key: "user_id", Value: userIDStr},
-		}
-		var userInfo UserInfo
-		err := collection.FindOne(ctx, filter).Decode(&userInfo)
-		if err != nil {
-			if err != mongo.ErrNoDocuments {
-				logger.Error("error reading followers from mongodb", "msg", err.Error())
-				return nil, err
-			}
-			// return empty array of ids
-			return followerIDs, nil
-		}
-		// add ids to return value
-		for _, f := range userInfo.Followers {
-			followerIDs = append(followerIDs, f.FollowerID)
-		}
-		// update redis
-		_, err = s.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
-			for _, f := range userInfo.Followers {
-				err = pipe.ZAddNX(ctx, userIDStr+":followers", redis.Z{
-					Member: f.FollowerID,
-					Score:  float64(f.Timestamp),
-				}).Err()
-				if err != nil {
-					return err
-				}
-			}
-			return nil
-		})
-		if err != nil {
-			logger.Error("error getting updating redis with followers from mongodb")
-			return nil, err
-		}
+		logger.Error("error reading followers", "msg", err.Error())
+		return nil, err
 	}
 	return followerIDs, nil
 }
 
-// GetFollowees attempts to get the ids from redis if cached
-// Otherwise, it gets the followees from mongodb and updates redis with the ids
+// GetFollowees returns the followees of the user, which are cached in redis after the first read
 func (s *socialGraphService) GetFollowees(ctx context.Context, reqID int64, userID int64) ([]int64, error) {
 	logger := s.Logger(ctx)
 	logger.Debug("entering GetFollowees", "req_id", reqID, "user_id", userID)
 
-	var followerIDs []int64
-	var followerInfos []FollowerInfo
-	userIDStr := strconv.FormatInt(userID, 10)
-	numFollowees, err := s.redisClient.ZCard(ctx, userIDStr+":followees").Result()
+	followeeIDs, err := s.graph.GetFollowees(ctx, userID)
 	if err != nil {
-		logger.Error("error reading number of followees from redis", "msg", err.Error())
+		logger.Error("error reading followees", "msg", err.Error())
+		return nil, err
 	}
-	if numFollowees > 0 {
-		// followees are cached in redis so we retrieve them
-		result, err := s.redisClient.ZRange(ctx, userIDStr+":followees", 0, -1).Result()
-		if err != nil {
-			logger.Error("error reading followees from redis", "msg", err.Error())
-			return nil, err
-		}
-		for _, r := range result {
-			followerID, err := strconv.ParseInt(r, 10, 64)
-			if err != nil {
-				logger.Error("error parsing follower id from redis to int64", "msg", err.Error())
-				return nil, err
-			}
-			followerIDs = append(followerIDs, followerID)
-		}
-		return followerIDs, nil
-	} else {
-		// did not find followees in redis
-		// look up in mongodb and update redis
-		collection := s.mongoClient.Database("social-graph").Collection("social-graph")
-		filter := bson.D{
-			{Key: "user_id", Value: userIDStr},
-		}
-		var userInfo UserInfo
-		err := collection.FindOne(ctx, filter).Decode(&userInfo)
-		if err != nil {
-			logger.Error("error reading followees from mongodb", "msg", err.Error())
-			return nil, err
-		}
-		// add ids to return value
-		for _, f := range followerInfos {
-			followerIDs = append(followerIDs, f.FollowerID)
-		}
-		// update redis
-		_, err = s.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
-			for _, f := range followerInfos {
-				err = pipe.ZAddNX(ctx, userIDStr+":followees", redis.Z{
-					Member: f.FollowerID,
-					Score:  float64(f.Timestamp),
-				}).Err()
-				if err != nil {
-					return err
-				}
-			}
-			return nil
-		})
-		if err != nil {
-			logger.Error("error getting updating redis with followees from mongodb")
-			return nil, err
-		}
+	return followeeIDs, nil
+}
+
+// CountFollowers returns the number of (cached) followers of each user
+func (s *socialGraphService) CountFollowers(ctx context.Context, reqID int64, userIDs []int64) ([]int64, error) {
+	logger := s.Logger(ctx)
+	logger.Debug("entering CountFollowers", "req_id", reqID, "#users", len(userIDs))
+
+	counts, err := s.graph.CountFollowers(ctx, userIDs)
+	if err != nil {
+		logger.Error("error reading number of followers", "msg", err.Error())
+		return nil, err
 	}
-	return followerIDs, nil
+	return counts, nil
 }
 
+// Follow adds the edge between the user and the followee and notifies the write home timeline services
 func (s *socialGraphService) Follow(ctx context.Context, reqID int64, userID int64, followeeID int64) error {
 	logger := s.Logger(ctx)
 	logger.Debug("entering Follow", "req_id", reqID, "user_id", userID, "followee_id", followeeID)
 
-	timestamp := time.Now()
-	userIDStr := strconv.FormatInt(userID, 10)
-	followeeIDstr := strconv.FormatInt(followeeID, 10)
-	var mongoUpdateFollowerErr, mongoUpdateFolloweeErr, redisUpdateErr error
-	var wg sync.WaitGroup
-	wg.Add(3)
-	go func() {
-		// Update follower->followee edges
-		defer wg.Done()
-		collection := s.mongoClient.Database("social-graph").Collection("social-graph")
-		searchNotExist := bson.M{
-			"$and": []bson.M{
-				{"user_id": userID},
-				{"followees": bson.M{"$not": bson.M{"$elemMatch": bson.M{"user_id": followeeID}}}},
-			},
-		}
-		pushFollower := bson.M{
-			"$push": bson.M{
-				"followees": bson.M{
-					"user_id":   followeeID,
-					"timestamp": timestamp.String(),
-				},
-			},
-		}
-		updateResult, mongoUpdateFollowerErr := collection.UpdateOne(ctx, searchNotExist, pushFollower)
-		if mongoUpdateFollowerErr != nil {
-			logger.Error("error updating followees in mongodb")
-		}
-		logger.Debug("updated follower->followee edges in mongodb", "#matched", updateResult.MatchedCount, "#modified", updateResult.ModifiedCount)
-	}()
-	go func() {
-		// Update followee->follower edges
-		defer wg.Done()
-		collection := s.mongoClient.Database("social-graph").Collection("social-graph")
-		searchNotExist := bson.M{
-			"$and": []bson.M{
-				{"user_id": followeeID},
-				{"followers": bson.M{"$not": bson.M{"$elemMatch": bson.M{"user_id": userID}}}},
-			},
-		}
-		pushFollowees := bson.M{
-			"$push": bson.M{
-				"followers": bson.M{
-					"user_id":   userID,
-					"timestamp": timestamp.String(),
-				},
-			},
-		}
-		updateResult, mongoUpdateFolloweeErr := collection.UpdateOne(ctx, searchNotExist, pushFollowees)
-		if mongoUpdateFolloweeErr != nil {
-			logger.Error("error updating followers in mongodb")
-		}
-		logger.Debug("updated followee->follower edges in mongodb", "#matched", updateResult.MatchedCount, "#modified", updateResult.ModifiedCount)
-	}()
-	go func() {
-		defer wg.Done()
-		_, redisUpdateErr = s.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
-			// followees
-			_, err := pipe.ZCard(ctx, userIDStr+":followees").Result()
-			if err == nil {
-				pipe.ZAddNX(ctx, userIDStr+":followees", redis.Z{
-					Member: followeeID,
-					Score:  float64(timestamp.Unix()),
-				})
-			}
-			// followers
-			_, err = pipe.ZCard(ctx, followeeIDstr+":followers").Result()
-			if err == nil {
-				pipe.ZAddNX(ctx, followeeIDstr+":followers", redis.Z{
-					Member: userID,
-					Score:  float64(timestamp.Unix()),
-				})
-			}
-			return nil
-		})
-	}()
-	wg.Wait()
-	if mongoUpdateFollowerErr != nil {
-		return mongoUpdateFollowerErr
-	}
-	if mongoUpdateFolloweeErr != nil {
-		return mongoUpdateFolloweeErr
+	_, err := s.graph.Follow(ctx, []model.FollowEdge{{UserID: userID, FolloweeID: followeeID}})
+	if err != nil {
+		logger.Error("error following user", "msg", err.Error())
+		return err
 	}
-	return redisUpdateErr
+	return s.publishGraphEvent(ctx, reqID, model.MESSAGE_TYPE_FOLLOW, userID, followeeID)
 }
 
-// Unfollow removed the follower (from userID) and followee in mongodb and then in redis
+// Unfollow removes the edge between the user and the followee and notifies the write home timeline services
 func (s *socialGraphService) Unfollow(ctx context.Context, reqID int64, userID int64, followeeID int64) error {
 	logger := s.Logger(ctx)
 	logger.Debug("entering Unfollow", "req_id", reqID, "user_id", userID, "followee_id", followeeID)
 
-	userIDStr := strconv.FormatInt(userID, 10)
-	followeeIDstr := strconv.FormatInt(followeeID, 10)
-	var err1, err2, err3 error
-	var wg sync.WaitGroup
-	wg.Add(3)
-	go func() {
-		// update follower->followee edges
-		defer wg.Done()
-		collection := s.mongoClient.Database("social-graph").Collection("social-graph")
-		filter := bson.D{
-			{Key: "user_id", Value: userID},
-		}
-		update := bson.M{
-			"$pull": bson.M{
-				"followees": bson.M{
-					"user_id": followeeID,
-				},
-			},
-		}
-		updateResult, err1 := collection.UpdateOne(ctx, filter, update)
-		if err1 != nil {
-			logger.Error("error pulling followee in mongodb")
-		}
-		logger.Debug("updated followee->follower edges in mongodb", "#matched", updateResult.MatchedCount, "#modified", updateResult.ModifiedCount)
-	}()
-	go func() {
-		// update followee->follower edges
-		defer wg.Done()
-		collection := s.mongoClient.Database("social-graph").Collection("social-graph")
-		filter := bson.D{
-			{Key: "user_id", Value: followeeID},
-		}
-		update := bson.M{
-			"$pull": bson.M{
-				"followers": bson.M{
-					"user_id": userID,
-				},
-			},
-		}
-		updateResult, err2 := collection.UpdateOne(ctx, filter, update)
-		if err2 != nil {
-			logger.Error("error pulling follower in mongodb")
+	err := s.graph.Unfollow(ctx, userID, followeeID)
+	if err != nil {
+		logger.Error("error unfollowing user", "msg", err.Error())
+		return err
+	}
+	return s.publishGraphEvent(ctx, reqID, model.MESSAGE_TYPE_UNFOLLOW, userID, followeeID)
+}
+
+// IsFollowing returns true if the user follows the followee
+func (s *socialGraphService) IsFollowing(ctx context.Context, reqID int64, userID int64, followeeID int64) (bool, error) {
+	logger := s.Logger(ctx)
+	logger.Debug("entering IsFollowing", "req_id", reqID, "user_id", userID, "followee_id", followeeID)
+
+	following, err := s.graph.IsFollowing(ctx, userID, followeeID)
+	if err != nil {
+		logger.Error("error reading followees", "msg", err.Error())
+		return false, err
+	}
+	return following, nil
+}
+
+// publishGraphEvent notifies the write home timeline service of each region about the follow or unfollow,
+// which backfills or cleans up the home timeline of the user asynchronously
+// the graph is already updated if publishing fails, but retrying the request is safe since both are idempotent
+func (s *socialGraphService) publishGraphEvent(ctx context.Context, reqID int64, msgType string, userID int64, followeeID int64) error {
+	if s.notifier == nil {
+		return nil
+	}
+	msg := model.Message{
+		Type:       msgType,
+		ReqID:      reqID,
+		UserID:     userID,
+		FolloweeID: followeeID,
+		Timestamp:  time.Now().UnixMilli(),
+		// tracing
+		SpanContext: sn_trace.BuildSpanContext(trace.SpanContextFromContext(ctx)),
+	}
+	msg.NotificationSendTs = msg.Timestamp
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	for _, region := range s.Config().Regions {
+		err = s.notifier.Publish(ctx, fmt.Sprintf("write-home-timeline-%s", region), body)
+		if err != nil {
+			s.Logger(ctx).Error("error publishing graph event", "type", msgType, "region", region, "msg", err.Error())
+			return err
 		}
-		logger.Debug("updated followee->follower edges in mongodb", "#matched", updateResult.MatchedCount, "#modified", updateResult.ModifiedCount)
-	}()
-	go func() {
-		defer wg.Done()
-		_, err3 = s.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
-			// followees
-			_, err := pipe.ZCard(ctx, userIDStr+":followees").Result()
-			if err == nil {
-				pipe.ZRem(ctx, userIDStr+":followees", followeeID)
-			}
-			// followers
-			_, err = pipe.ZCard(ctx, followeeIDstr+":followers").Result()
-			if err == nil {
-				pipe.ZRem(ctx, followeeIDstr+":followers", userID)
-			}
-			return nil
-		})
-	}()
-	wg.Wait()
-	if err1 != nil {
-		return err1
 	}
-	if err2 != nil {
-		return err2
+	return nil
+}
+
+// findUserIDs returns the ids of the user and the followee, which are cached by the user repository
+// the users are read directly instead of calling UserService, which depends on this service
+func (s *socialGraphService) findUserIDs(ctx context.Context, userUsername string, followeeUsername string) (int64, int64, error) {
+	logger := s.Logger(ctx)
+	userIDs, err := s.users.FindUserIDs(ctx, []string{userUsername, followeeUsername})
+	if err != nil {
+		logger.Error("error reading user ids", "msg", err.Error())
+		return 0, 0, err
+	}
+	for _, username := range []string{userUsername, followeeUsername} {
+		if _, ok := userIDs[username]; !ok {
+			msg := fmt.Sprintf("username %s does not exist", username)
+			logger.Debug(msg)
+			return 0, 0, fmt.Errorf(msg)
+		}
 	}
-	return err3
+	return userIDs[userUsername], userIDs[followeeUsername], nil
 }
 
 // FollowWithUsername
 func (s *socialGraphService) FollowWithUsername(ctx context.Context, reqID int64, userUsername string, followeeUsername string) error {
-	var userId, followeeId int64
-	var err1, err2 error
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go func() {
-		defer wg.Done()
-		userId, err1 = s.userService.Get().GetUserId(ctx, reqID, userUsername)
-	}()
-	go func() {
-		defer wg.Done()
-		followeeId, err2 = s.userService.Get().GetUserId(ctx, reqID, followeeUsername)
-	}()
-	wg.Wait()
-	if err1 != nil {
-		return err1
-	}
-	if err2 != nil {
-		return err2
+	userId, followeeId, err := s.findUserIDs(ctx, userUsername, followeeUsername)
+	if err != nil {
+		return err
 	}
 	return s.Follow(ctx, reqID, userId, followeeId)
 }
 
 // UnfollowWithUsername
 func (s *socialGraphService) UnfollowWithUsername(ctx context.Context, reqID int64, userUsername string, followeeUsername string) error {
-	var userId, followeeId int64
-	var err1, err2 error
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go func() {
-		defer wg.Done()
-		userId, err1 = s.userService.Get().GetUserId(ctx, reqID, userUsername)
-	}()
-	go func() {
-		defer wg.Done()
-		followeeId, err2 = s.userService.Get().GetUserId(ctx, reqID, followeeUsername)
-	}()
-	wg.Wait()
-	if err1 != nil {
-		return err1
-	}
-	if err2 != nil {
-		return err2
+	userId, followeeId, err := s.findUserIDs(ctx, userUsername, followeeUsername)
+	if err != nil {
+		return err
 	}
 	return s.Unfollow(ctx, reqID, userId, followeeId)
 }
 
-// InsertUser writes the user to mongodb
+// InsertUser adds the user to the graph
 func (s *socialGraphService) InsertUser(ctx context.Context, reqID int64, userID int64) error {
 	logger := s.Logger(ctx)
 	logger.Debug("entering InsertUser", "req_id", reqID, "user_id", userID)
-	collection := s.mongoClient.Database("social-graph").Collection("social-graph")
-	doc := bson.D{
-		{Key: "user_id", Value: userID},
-		{Key: "followers", Value: bson.A{}},
-		{Key: "followees", Value: bson.A{}},
-	}
-	_, err := collection.InsertOne(ctx, doc)
+	_, err := s.graph.InsertUsers(ctx, []int64{userID})
 	return err
 }
+
+// BatchInsertUsers adds the users that are not in the graph yet
+func (s *socialGraphService) BatchInsertUsers(ctx context.Context, reqID int64, userIDs []int64) (int, error) {
+	logger := s.Logger(ctx)
+	logger.Debug("entering BatchInsertUsers", "req_id", reqID, "num_users", len(userIDs))
+	inserted, err := s.graph.InsertUsers(ctx, userIDs)
+	if err != nil {
+		logger.Error("error inserting users", "msg", err.Error())
+	}
+	return inserted, err
+}
+
+// BatchFollow adds the edges that do not exist yet and returns the number of new edges
+func (s *socialGraphService) BatchFollow(ctx context.Context, reqID int64, edges []model.FollowEdge) (int, error) {
+	logger := s.Logger(ctx)
+	logger.Debug("entering BatchFollow", "req_id", reqID, "num_edges", len(edges))
+	followed, err := s.graph.Follow(ctx, edges)
+	if err != nil {
+		logger.Error("error following users in batch", "msg", err.Error())
+	}
+	return followed, err
+}
@@ -15,6 +15,9 @@ type TextService interface {
 	UploadText(ctx context.Context, reqID int64, text string) error
 }
 
+// uploads to the compose post service cannot be retried
+var _ weaver.NotRetriable = TextService.UploadText
+
 type textServiceOptions struct {
 	Region    string `toml:"region"`
 }
@@ -0,0 +1,105 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"time"
+
+	"socialnetwork/pkg/model"
+	"socialnetwork/pkg/repository"
+)
+
+// timelines are sorted by timestamp (newest first) and then by post id, and stored by the timeline repositories
+
+// mergeTimelinePosts merges timelines into a single one without duplicates
+func mergeTimelinePosts(timelines ...[]model.TimelinePostInfo) []model.TimelinePostInfo {
+	seen := make(map[int64]bool)
+	var merged []model.TimelinePostInfo
+	for _, timeline := range timelines {
+		for _, post := range timeline {
+			if !seen[post.PostID] {
+				seen[post.PostID] = true
+				merged = append(merged, post)
+			}
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return repository.OlderThan(merged[j], merged[i])
+	})
+	return merged
+}
+
+// runTimelineCompaction compacts the timeline cache every interval until the context is cancelled
+func runTimelineCompaction(ctx context.Context, logger *slog.Logger, timelines repository.TimelineRepository, interval time.Duration, onCompact func(removed int64)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			removed, err := timelines.Compact(ctx)
+			if err != nil {
+				logger.Error("error compacting timeline cache", "msg", err.Error())
+			}
+			onCompact(removed)
+		}
+	}
+}
+
+// withoutDirectMessages removes the direct messages from the page, i.e. those written to timelines
+// before they were delivered to conversations
+func withoutDirectMessages(page model.TimelinePage) model.TimelinePage {
+	posts := page.Posts[:0]
+	for _, post := range page.Posts {
+		if post.PostType != model.POST_TYPE_DM {
+			posts = append(posts, post)
+		}
+	}
+	page.Posts = posts
+	return page
+}
+
+// postReader reads posts by id in the requested order, e.g. PostStorageService.ReadPosts for timelines
+type postReader func(ctx context.Context, reqID int64, postIDs []int64) ([]model.Post, []int64, error)
+
+// newTimelinePage fetches the posts of the page, which holds up to stop - start of the timeline posts,
+// and the original posts of its reposts
+// the next page is read with max_id set to the returned cursor and start set to 0
+func newTimelinePage(ctx context.Context, readPosts postReader, reqID int64, query model.TimelineQuery, timelinePosts []model.TimelinePostInfo) (model.TimelinePage, error) {
+	page := model.TimelinePage{Posts: []model.Post{}}
+	limit := int(query.Stop - query.Start)
+	if len(timelinePosts) > limit {
+		timelinePosts = timelinePosts[:limit]
+		page.NextMaxID = timelinePosts[limit-1].PostID
+	}
+	postIDs := make([]int64, 0, len(timelinePosts))
+	for _, post := range timelinePosts {
+		postIDs = append(postIDs, post.PostID)
+	}
+	// posts missing in post storage (e.g. not replicated to this region yet) are left out of the page,
+	// as well as deleted posts, which may remain in timelines until their removal is propagated
+	posts, _, err := readPosts(ctx, reqID, postIDs)
+	if err != nil {
+		return page, err
+	}
+	page.Posts = append(page.Posts, posts...)
+
+	// reposts are hydrated with their original posts
+	var originalPostIDs []int64
+	seen := make(map[int64]bool)
+	for _, post := range page.Posts {
+		if post.PostType == model.POST_TYPE_REPOST && post.ParentPostID != 0 && !seen[post.ParentPostID] {
+			seen[post.ParentPostID] = true
+			originalPostIDs = append(originalPostIDs, post.ParentPostID)
+		}
+	}
+	if len(originalPostIDs) > 0 {
+		page.RepostedPosts, _, err = readPosts(ctx, reqID, originalPostIDs)
+		if err != nil {
+			return page, err
+		}
+	}
+	return page, nil
+}
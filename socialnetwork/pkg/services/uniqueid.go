@@ -13,9 +13,12 @@ import (
 )
 
 type UniqueIdService interface {
-	UploadUniqueId(ctx context.Context, reqID int64, postType model.PostType) error
+	UploadUniqueId(ctx context.Context, reqID int64, postType model.PostType, parentPostID int64) (int64, error)
 }
 
+// uploads to the compose post service cannot be retried, and every call generates a new id
+var _ weaver.NotRetriable = UniqueIdService.UploadUniqueId
+
 type uniqueIdOptions struct {
 	Region    string `toml:"region"`
 }
@@ -46,9 +49,9 @@ func (u *uniqueIdService) getCounter(timestamp int64) (int64, error) {
 		return 0, fmt.Errorf("timestamps are not incremental")
 	}
 	if u.currentTimestamp == timestamp {
-		counter := u.counter
+		// the first id of the timestamp already used counter 1
 		u.counter += 1
-		return counter, nil
+		return u.counter, nil
 	} else {
 		u.currentTimestamp = timestamp
 		u.counter = 1
@@ -57,19 +60,25 @@ func (u *uniqueIdService) getCounter(timestamp int64) (int64, error) {
 
 }
 
-func (u *uniqueIdService) UploadUniqueId(ctx context.Context, reqID int64, postType model.PostType) error {
+// UploadUniqueId generates the id of the post and returns it once uploaded to the compose post service
+// together with the type and parent (replied or reposted post, 0 if none) of the post
+func (u *uniqueIdService) UploadUniqueId(ctx context.Context, reqID int64, postType model.PostType, parentPostID int64) (int64, error) {
 	logger := u.Logger(ctx)
-	logger.Debug("entering UploadUniqueId", "req_id", reqID, "post_type", postType)
+	logger.Debug("entering UploadUniqueId", "req_id", reqID, "post_type", postType, "parent_post_id", parentPostID)
 
 	timestamp := time.Now().UnixMilli() - utils.CUSTOM_EPOCH
 	counter, err := u.getCounter(timestamp)
 	if err != nil {
 		logger.Error("error getting counter", "msg", err.Error())
-		return err
+		return 0, err
 	}
 	id, err := utils.GenUniqueID(u.machineID, timestamp, counter)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	err = u.composePostService.Get().UploadUniqueId(ctx, reqID, id, postType, parentPostID)
+	if err != nil {
+		return 0, err
 	}
-	return u.composePostService.Get().UploadUniqueId(ctx, reqID, id, postType)
+	return id, nil
 }
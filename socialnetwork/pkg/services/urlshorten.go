@@ -5,11 +5,9 @@ import (
 	"math/rand"
 
 	"socialnetwork/pkg/model"
-	"socialnetwork/pkg/storage"
+	"socialnetwork/pkg/repository"
 
 	"github.com/ServiceWeaver/weaver"
-	"github.com/bradfitz/gomemcache/memcache"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
@@ -19,16 +17,20 @@ type UrlShortenService interface {
 	GetExtendedUrls(ctx context.Context, reqID int64, shortenedUrls []string) ([]string, error)
 }
 
+// uploads to the compose post service cannot be retried
+var _ weaver.NotRetriable = UrlShortenService.UploadUrls
+
 type urlShortenService struct {
 	weaver.Implements[UrlShortenService]
 	weaver.WithConfig[urlShortenServiceOptions]
 	composePostService weaver.Ref[ComposePostService]
-	mongoClient        *mongo.Client
-	memCachedClient    *memcache.Client
+	urls               repository.URLRepository
 	hostname           string
 }
 
 type urlShortenServiceOptions struct {
+	// storage backend of the urls: "mongodb" (default) or "memory"
+	StorageBackend 	string 	`toml:"storage_backend"`
 	MongoDBAddr 	string 	`toml:"mongodb_address"`
 	MemCachedAddr 	string 	`toml:"memcached_address"`
 	MongoDBPort 	int    	`toml:"mongodb_port"`
@@ -47,14 +49,19 @@ func (u *urlShortenService) genRandomStr(length int) string {
 func (u *urlShortenService) Init(ctx context.Context) error {
 	logger := u.Logger(ctx)
 	var err error
-	u.mongoClient, err = storage.MongoDBClient(ctx, u.Config().MongoDBAddr, u.Config().MongoDBPort)
+	u.urls, err = repository.NewURLRepository(ctx, repository.Options{
+		Backend:     u.Config().StorageBackend,
+		MongoDBAddr: u.Config().MongoDBAddr,
+		MongoDBPort: u.Config().MongoDBPort,
+		CacheAddr:   u.Config().MemCachedAddr,
+		CachePort:   u.Config().MemCachedPort,
+	})
 	if err != nil {
-		logger.Error(err.Error())
+		logger.Error("error initializing url repository", "msg", err.Error())
 		return err
 	}
 
-	u.memCachedClient = storage.MemCachedClient(u.Config().MemCachedAddr, u.Config().MemCachedPort)
-	logger.Info("url shorten service running!", "region", u.Config().Region,
+	logger.Info("url shorten service running!", "region", u.Config().Region, "storage_backend", u.Config().StorageBackend,
 		"mongodb_addr", u.Config().MongoDBAddr, "mongodb_port", u.Config().MongoDBPort,
 		"memcached_addr", u.Config().MemCachedAddr, "memcached_port", u.Config().MemCachedPort,
 	)
@@ -66,29 +73,42 @@ func (u *urlShortenService) UploadUrls(ctx context.Context, reqID int64, urls []
 	logger.Debug("entering upload urls", "req_id", reqID, "urls", urls)
 
 	var targetUrls []model.URL
-	var targetUrl_docs []interface{}
 	for _, url := range urls {
 		targetUrl := model.URL{
 			ExpandedUrl:  url,
 			ShortenedUrl: u.hostname + u.genRandomStr(10),
 		}
 		targetUrls = append(targetUrls, targetUrl)
-		targetUrl_docs = append(targetUrl_docs, targetUrl)
 	}
 
-	if len(targetUrls) > 0 {
-		collection := u.mongoClient.Database("url-shorten").Collection("url-shorten")
-		_, err := collection.InsertMany(ctx, targetUrl_docs)
-		if err != nil {
-			logger.Error("error inserting target urls in mongodb", "msg", err.Error())
-			return err
-		}
+	err := u.urls.InsertURLs(ctx, targetUrls)
+	if err != nil {
+		logger.Error("error inserting target urls", "msg", err.Error())
+		return err
 	}
 
 	return u.composePostService.Get().UploadUrls(ctx, reqID, targetUrls)
 }
 
+// GetExtendedUrls returns the expanded urls in the same order as the shortened ones, skipping those not found
 func (u *urlShortenService) GetExtendedUrls(ctx context.Context, reqID int64, shortenedUrls []string) ([]string, error) {
-	// not implemented in original dsb
-	return nil, nil
+	logger := u.Logger(ctx)
+	logger.Debug("entering GetExtendedUrls", "req_id", reqID, "shortened_urls", shortenedUrls)
+
+	urls, err := u.urls.FindURLs(ctx, shortenedUrls)
+	if err != nil {
+		logger.Error("error reading urls", "msg", err.Error())
+		return nil, err
+	}
+	expandedUrls := make(map[string]string, len(urls))
+	for _, url := range urls {
+		expandedUrls[url.ShortenedUrl] = url.ExpandedUrl
+	}
+	extendedUrls := make([]string, 0, len(shortenedUrls))
+	for _, shortenedUrl := range shortenedUrls {
+		if expandedUrl, ok := expandedUrls[shortenedUrl]; ok {
+			extendedUrls = append(extendedUrls, expandedUrl)
+		}
+	}
+	return extendedUrls, nil
 }
@@ -4,21 +4,17 @@ import (
 	"context"
 	"crypto/sha1"
 	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
+	"socialnetwork/pkg/auth"
 	"socialnetwork/pkg/model"
-	"socialnetwork/pkg/storage"
+	"socialnetwork/pkg/repository"
 	"socialnetwork/pkg/utils"
-	"strconv"
 	"sync"
 	"time"
 
 	"github.com/ServiceWeaver/weaver"
-	"github.com/bradfitz/gomemcache/memcache"
-	"github.com/dgrijalva/jwt-go"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type UserService interface {
@@ -28,20 +24,15 @@ type UserService interface {
 	UploadCreatorWithUserId(ctx context.Context, reqID int64, userID int64, username string) error
 	UploadCreatorWithUsername(ctx context.Context, reqID int64, username string) error
 	GetUserId(ctx context.Context, reqID int64, username string) (int64, error)
+	BatchRegisterUsersWithId(ctx context.Context, reqID int64, users []model.UserRegistration) (int, error)
 }
 
-type LoginInfo struct {
-	UserID   int64  `bson:"user_id"`
-	Password string `bson:"password"`
-	Salt     string `bson:"salt"`
-}
-
-type Claims struct {
-	Username  string `bson:"username"`
-	UserID    string `bson:"user_id"`
-	Timestamp int64  `bson:"timestamp"`
-	jwt.StandardClaims
-}
+// a retried registration fails with a taken username (or registers nobody in a batch), and uploads to the compose post service cannot be retried
+var _ weaver.NotRetriable = UserService.RegisterUserWithId
+var _ weaver.NotRetriable = UserService.RegisterUser
+var _ weaver.NotRetriable = UserService.BatchRegisterUsersWithId
+var _ weaver.NotRetriable = UserService.UploadCreatorWithUserId
+var _ weaver.NotRetriable = UserService.UploadCreatorWithUsername
 
 type userService struct {
 	weaver.Implements[UserService]
@@ -51,18 +42,24 @@ type userService struct {
 	machineID          string
 	counter            int64
 	currentTimestamp   int64
-	secret             string
-	mongoClient        *mongo.Client
-	memCachedClient    *memcache.Client
+	keyring            *auth.Keyring
+	users              repository.UserRepository
 	mu                 sync.Mutex
 }
 
 type userServiceOptions struct {
-	MongoDBAddr   string `toml:"mongodb_address"`
-	MemCachedAddr string `toml:"memcached_address"`
-	MongoDBPort   int    `toml:"mongodb_port"`
-	MemCachedPort int    `toml:"memcached_port"`
-	Region    	  string `toml:"region"`
+	// storage backend of the users: "mongodb" (default) or "memory"
+	StorageBackend string `toml:"storage_backend"`
+	MongoDBAddr    string `toml:"mongodb_address"`
+	MemCachedAddr  string `toml:"memcached_address"`
+	MongoDBPort    int    `toml:"mongodb_port"`
+	MemCachedPort  int    `toml:"memcached_port"`
+	Region    	   string `toml:"region"`
+	// login tokens are signed with the secret of the active kid
+	// secrets are also read from jwt_secrets_file and $SN_JWT_SECRETS, which should be used outside local deployments
+	JWTKid         string            `toml:"jwt_kid"`
+	JWTSecrets     map[string]string `toml:"jwt_secrets"`
+	JWTSecretsFile string            `toml:"jwt_secrets_file"`
 }
 
 func (u *userService) getCounter(timestamp int64) (int64, error) {
@@ -72,9 +69,9 @@ func (u *userService) getCounter(timestamp int64) (int64, error) {
 		return 0, fmt.Errorf("timestamps are not incremental")
 	}
 	if u.currentTimestamp == timestamp {
-		counter := u.counter
+		// the first id of the timestamp already used counter 1
 		u.counter += 1
-		return counter, nil
+		return u.counter, nil
 	} else {
 		u.currentTimestamp = timestamp
 		u.counter = 1
@@ -83,7 +80,7 @@ func (u *userService) getCounter(timestamp int64) (int64, error) {
 
 }
 
-func (u *userService) genRandomStr(length int) string {
+func genRandomStr(length int) string {
 	b := make([]rune, length)
 	for i := range b {
 		b[i] = letterRunes[rand.Intn(len(letterRunes))]
@@ -91,7 +88,7 @@ func (u *userService) genRandomStr(length int) string {
 	return string(b)
 }
 
-func (u *userService) hashPwd(pwd []byte) string {
+func hashPwd(pwd []byte) string {
 	hasher := sha1.New()
 	hasher.Write(pwd)
 	return base64.URLEncoding.EncodeToString(hasher.Sum(nil))
@@ -103,14 +100,34 @@ func (u *userService) Init(ctx context.Context) error {
 	u.machineID = utils.GetMachineID()
 	u.currentTimestamp = -1
 	u.counter = 0
-	u.mongoClient, err = storage.MongoDBClient(ctx, u.Config().MongoDBAddr, u.Config().MongoDBPort)
+	secrets, err := auth.LoadSecrets(u.Config().JWTSecrets, u.Config().JWTSecretsFile)
+	if err != nil {
+		logger.Error("error loading jwt secrets", "msg", err.Error())
+		return err
+	}
+	u.keyring, err = auth.NewKeyring(u.Config().JWTKid, secrets)
 	if err != nil {
-		logger.Error(err.Error())
+		logger.Error("error loading jwt secrets", "msg", err.Error())
+		return err
+	}
+	u.users, err = repository.NewUserRepository(ctx, repository.Options{
+		Backend:     u.Config().StorageBackend,
+		MongoDBAddr: u.Config().MongoDBAddr,
+		MongoDBPort: u.Config().MongoDBPort,
+		CacheAddr:   u.Config().MemCachedAddr,
+		CachePort:   u.Config().MemCachedPort,
+	})
+	if err != nil {
+		logger.Error("error initializing user repository", "msg", err.Error())
+		return err
+	}
+	err = u.users.EnsureIndexes(ctx)
+	if err != nil {
+		logger.Error("error creating user indexes", "msg", err.Error())
 		return err
 	}
 
-	u.memCachedClient = storage.MemCachedClient(u.Config().MemCachedAddr, u.Config().MemCachedPort)
-	logger.Info("user service running!", "region", u.Config().Region,
+	logger.Info("user service running!", "region", u.Config().Region, "storage_backend", u.Config().StorageBackend,
 		"mongodb_addr", u.Config().MongoDBAddr, "mongodb_port", u.Config().MongoDBPort,
 		"memcached_addr", u.Config().MemCachedAddr, "memcached_port", u.Config().MemCachedPort,
 		"machine_id", u.machineID,
@@ -120,79 +137,23 @@ func (u *userService) Init(ctx context.Context) error {
 
 func (u *userService) Login(ctx context.Context, reqID int64, username string, password string) (string, error) {
 	logger := u.Logger(ctx)
-	timestamp := time.Now().UnixNano() / int64(time.Millisecond)
-	var loginInfo LoginInfo
-	item, err := u.memCachedClient.Get(username + ":login")
-	if err != nil && err != memcache.ErrCacheMiss {
-		// error reading cache
-		logger.Error("error reading user login info from cache", "msg", err.Error())
-		return "", err
+	user, err := u.users.FindUser(ctx, username)
+	if errors.Is(err, repository.ErrNotFound) {
+		msg := fmt.Sprintf("username %s does not exist", username)
+		logger.Debug(msg)
+		return "", fmt.Errorf(msg)
 	}
-	if err == nil {
-		// user login info found in cache
-		err := json.Unmarshal(item.Value, &loginInfo)
-		if err != nil {
-			logger.Error("error parsing post from cache result", "msg", err.Error())
-			return "", err
-		}
-	} else {
-		// user login info not cached
-		// so we get it from db
-		user := model.User{
-			UserID: -1,
-		}
-		collection := u.mongoClient.Database("user").Collection("user")
-		filter := bson.D{
-			{Key: "username", Value: username},
-		}
-		cur, err := collection.Find(ctx, filter)
-		if err != nil {
-			logger.Error("error finding user in mongodb", "msg", err.Error())
-			return "", err
-		}
-		exists := cur.TryNext(ctx)
-		if !exists {
-			msg := fmt.Sprintf("username %s does not exist", username)
-			logger.Debug(msg)
-			return "", fmt.Errorf(msg)
-		}
-		err = cur.Decode(&user)
-		if err != nil {
-			logger.Error("error parsing user from mongodb result", "msg", err.Error())
-			return "", err
-		}
-		loginInfo.Password = user.PwdHashed
-		loginInfo.Salt = user.Salt
-		loginInfo.UserID = user.UserID
-	}
-	var tokenStr string
-	hashed_pwd := u.hashPwd([]byte(password + loginInfo.Salt))
-	if hashed_pwd != loginInfo.Password {
-		return "", fmt.Errorf("invalid credentials")
-	} else {
-		expiration_time := time.Now().Add(6 * time.Minute)
-		claims := &Claims{
-			Username:       username,
-			UserID:         strconv.FormatInt(loginInfo.UserID, 10),
-			Timestamp:      timestamp,
-			StandardClaims: jwt.StandardClaims{ExpiresAt: expiration_time.Unix()},
-		}
-		var err error
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-		tokenStr, err = token.SignedString([]byte(u.secret))
-		if err != nil {
-			return "", fmt.Errorf("failed to create login token")
-		}
-	}
-	loginInfoJson, err := json.Marshal(loginInfo)
 	if err != nil {
-		logger.Error("error converting login info to json", "login_info", loginInfo)
+		logger.Error("error reading user", "msg", err.Error())
 		return "", err
 	}
-	err = u.memCachedClient.Set(&memcache.Item{Key: username + ":login", Value: loginInfoJson})
+	hashed_pwd := hashPwd([]byte(password + user.Salt))
+	if hashed_pwd != user.PwdHashed {
+		return "", fmt.Errorf("invalid credentials")
+	}
+	tokenStr, err := u.keyring.Sign(username, user.UserID)
 	if err != nil {
-		logger.Error("error caching login info", "login_info", loginInfo)
-		return "", err
+		return "", fmt.Errorf("failed to create login token")
 	}
 	return tokenStr, nil
 }
@@ -201,23 +162,8 @@ func (u *userService) RegisterUserWithId(ctx context.Context, reqID int64, first
 	logger := u.Logger(ctx)
 	logger.Debug("entering RegisterUserWithId", "req_id", reqID, "first_name", firstName, "last_name", lastName, "username", username, "password", password, "user_id", userID)
 
-	collection := u.mongoClient.Database("user").Collection("user")
-	filter := bson.D{
-		{Key: "username", Value: username},
-	}
-	cur, err := collection.Find(ctx, filter)
-	if err != nil {
-		logger.Error("error finding user in mongodb", "msg", err.Error())
-		return err
-	}
-	exists := cur.TryNext(ctx)
-	if exists {
-		errMsg := fmt.Sprintf("username %s already registered", username)
-		logger.Error(errMsg)
-		return fmt.Errorf(errMsg)
-	}
-	salt := u.genRandomStr(32)
-	hashedPwd := u.hashPwd([]byte(password + salt))
+	salt := genRandomStr(32)
+	hashedPwd := hashPwd([]byte(password + salt))
 	user := model.User{
 		UserID:    userID,
 		FirstName: firstName,
@@ -226,9 +172,19 @@ func (u *userService) RegisterUserWithId(ctx context.Context, reqID int64, first
 		PwdHashed: hashedPwd,
 		Salt:      salt,
 	}
-	_, err = collection.InsertOne(ctx, user)
+	err := u.users.InsertUser(ctx, user)
+	if errors.Is(err, repository.ErrUsernameTaken) {
+		errMsg := fmt.Sprintf("username %s already registered", username)
+		logger.Error(errMsg)
+		return fmt.Errorf(errMsg)
+	}
+	if errors.Is(err, repository.ErrUserIDTaken) {
+		errMsg := fmt.Sprintf("user id %d already registered", userID)
+		logger.Error(errMsg)
+		return fmt.Errorf(errMsg)
+	}
 	if err != nil {
-		logger.Error("error inserting new user in mongodb")
+		logger.Error("error inserting new user", "msg", err.Error())
 		return err
 	}
 	return u.socialGraphService.Get().InsertUser(ctx, reqID, userID)
@@ -251,6 +207,28 @@ func (u *userService) RegisterUser(ctx context.Context, reqID int64, firstName s
 	return u.RegisterUserWithId(ctx, reqID, firstName, lastName, username, password, id)
 }
 
+// BatchRegisterUsersWithId registers the users that are not yet registered and returns the number of new users
+// it can be safely retried since users are matched by their username
+func (u *userService) BatchRegisterUsersWithId(ctx context.Context, reqID int64, users []model.UserRegistration) (int, error) {
+	logger := u.Logger(ctx)
+	logger.Debug("entering BatchRegisterUsersWithId", "req_id", reqID, "num_users", len(users))
+
+	registered, err := RegisterUsersBatch(ctx, u.users, users)
+	if err != nil {
+		logger.Error("error inserting users", "msg", err.Error())
+		return 0, err
+	}
+	userIDs := make([]int64, 0, len(users))
+	for _, user := range users {
+		userIDs = append(userIDs, user.UserID)
+	}
+	_, err = u.socialGraphService.Get().BatchInsertUsers(ctx, reqID, userIDs)
+	if err != nil {
+		return 0, err
+	}
+	return registered, nil
+}
+
 // UploadCreatorWithUserId returns a new creator object
 func (u *userService) UploadCreatorWithUserId(ctx context.Context, reqID int64, userID int64, username string) error {
 	logger := u.Logger(ctx)
@@ -262,122 +240,37 @@ func (u *userService) UploadCreatorWithUserId(ctx context.Context, reqID int64,
 	return u.composePostService.Get().UploadCreator(ctx, reqID, creator)
 }
 
-// UploadCreatorWithUsername attempts to read the user id from cache and return it
-// If not found, it fetches the user from the db and uploads it to cache
+// UploadCreatorWithUsername uploads the creator with the id of the user, which is cached by the user repository
 func (u *userService) UploadCreatorWithUsername(ctx context.Context, reqID int64, username string) error {
 	logger := u.Logger(ctx)
 	logger.Debug("entering UploadCreatorWithUsername", "req_id", reqID, "username", username)
 
-	var userID int64
-	item, err := u.memCachedClient.Get(username + ":user_id")
-	if err != nil && err != memcache.ErrCacheMiss {
-		// error reading cache
-		logger.Error("error reading user id from cache", "msg", err.Error())
+	userID, err := u.findUserID(ctx, username)
+	if err != nil {
 		return err
 	}
-	if err == nil {
-		// user id info found in cache
-		err := json.Unmarshal(item.Value, &userID)
-		if err != nil {
-			logger.Error("error parsing user id from cache result", "msg", err.Error())
-			return err
-		}
-	} else {
-		// user not found in cache
-		// so we get it from db and write to cache
-		var user model.User
-		collection := u.mongoClient.Database("user").Collection("user")
-		filter := bson.D{
-			{Key: "username", Value: username},
-		}
-		cur, err := collection.Find(ctx, filter)
-		if err != nil {
-			logger.Debug("error finding user in mongodb", "msg", err.Error())
-			return err
-		}
-		exists := cur.TryNext(ctx)
-		if !exists {
-			msg := fmt.Sprintf("username %s does not exist", username)
-			logger.Debug(msg)
-			return fmt.Errorf(msg)
-		}
-		err = cur.Decode(&user)
-		if err != nil {
-			logger.Error("error parsing user from mongodb result", "msg", err.Error())
-			return err
-		}
-		userID = user.UserID
-		userIDJson, err := json.Marshal(userID)
-		if err != nil {
-			logger.Error("error converting user ID to json", "userID", userID)
-			return err
-		}
-		err = u.memCachedClient.Set(&memcache.Item{Key: username + ":user_id", Value: userIDJson})
-		if err != nil {
-			logger.Error("error caching user id", "userID", userID)
-			return err
-		}
-	}
 	return u.UploadCreatorWithUserId(ctx, reqID, userID, username)
 }
 
-// GetUserId attempts to read the user id from cache and return it
-// If not found, it fetches the user from the db and uploads it to cache
+// GetUserId returns the id of the user, which is cached by the user repository
 func (u *userService) GetUserId(ctx context.Context, reqID int64, username string) (int64, error) {
 	logger := u.Logger(ctx)
 	logger.Debug("entering GetUserId", "req_id", reqID, "username", username)
+	return u.findUserID(ctx, username)
+}
 
-	var userID int64
-	item, err := u.memCachedClient.Get(username + ":user_id")
-	if err != nil && err != memcache.ErrCacheMiss {
-		// error reading cache
-		logger.Error("error reading user id from cache", "msg", err.Error())
+func (u *userService) findUserID(ctx context.Context, username string) (int64, error) {
+	logger := u.Logger(ctx)
+	userIDs, err := u.users.FindUserIDs(ctx, []string{username})
+	if err != nil {
+		logger.Error("error reading user id", "msg", err.Error())
 		return 0, err
 	}
-	if err == nil {
-		// user id info found in cache
-		err := json.Unmarshal(item.Value, &userID)
-		if err != nil {
-			logger.Error("error parsing user id from cache result", "msg", err.Error())
-			return 0, err
-		}
-	} else {
-		// user not found in cache
-		// so we get it from db and write to cache
-		user := model.User{
-			UserID: -1,
-		}
-		collection := u.mongoClient.Database("user").Collection("user")
-		filter := bson.D{
-			{Key: "username", Value: username},
-		}
-		cur, err := collection.Find(ctx, filter)
-		if err != nil {
-			logger.Debug("error finding user in mongodb", "msg", err.Error())
-			return 0, err
-		}
-		exists := cur.TryNext(ctx)
-		if !exists {
-			msg := fmt.Sprintf("username %s does not exist", username)
-			logger.Debug(msg)
-			return 0, fmt.Errorf(msg)
-		}
-		err = cur.Decode(&user)
-		if err != nil {
-			logger.Error("error parsing user from mongodb result", "msg", err.Error())
-			return 0, err
-		}
-		userID = user.UserID
-		userIDJson, err := json.Marshal(userID)
-		if err != nil {
-			logger.Error("error converting user ID to json", "userID", userID)
-			return 0, err
-		}
-		err = u.memCachedClient.Set(&memcache.Item{Key: username + ":user_id", Value: userIDJson})
-		if err != nil {
-			logger.Error("error caching user id", "userID", userID)
-			return 0, err
-		}
+	userID, ok := userIDs[username]
+	if !ok {
+		msg := fmt.Sprintf("username %s does not exist", username)
+		logger.Debug(msg)
+		return 0, fmt.Errorf(msg)
 	}
 	return userID, nil
 }
@@ -2,54 +2,77 @@ package services
 
 import (
 	"context"
-	"strconv"
 	"sync"
+	"time"
 
+	sn_metrics "socialnetwork/pkg/metrics"
 	"socialnetwork/pkg/model"
-	"socialnetwork/pkg/storage"
+	"socialnetwork/pkg/repository"
 
 	"github.com/ServiceWeaver/weaver"
-	"github.com/redis/go-redis/v9"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type UserTimelineService interface {
-	ReadUserTimeline(ctx context.Context, reqID int64, userID int64, start int64, stop int64) ([]model.Post, error)
+	ReadUserTimeline(ctx context.Context, reqID int64, userID int64, query model.TimelineQuery) (model.TimelinePage, error)
+	ReadUserTimelinesPosts(ctx context.Context, reqID int64, userIDs []int64, query model.TimelineQuery) ([]model.TimelinePostInfo, error)
 	WriteUserTimeline(ctx context.Context, reqID int64, postID int64, userID int64, timestamp int64) error
+	RemoveUserTimelinePosts(ctx context.Context, reqID int64, userID int64, postIDs []int64) error
 }
 
 type userTimelineServiceOptions struct {
+	// storage backend of the user timelines: "mongodb" (default) or "memory"
+	StorageBackend string `toml:"storage_backend"`
 	MongoDBAddr string 	`toml:"mongodb_address"`
 	RedisAddr   string 	`toml:"redis_address"`
 	MongoDBPort int    	`toml:"mongodb_port"`
 	RedisPort   int    	`toml:"redis_port"`
 	Region 		string 	`toml:"region"`
+	// cached timelines keep the newest timeline_max_length posts and expire after timeline_ttl_s without reads,
+	// and the whole cache is trimmed every timeline_compaction_interval_s (0 disables each of them)
+	TimelineMaxLength           int `toml:"timeline_max_length"`
+	TimelineTTLS                int `toml:"timeline_ttl_s"`
+	TimelineCompactionIntervalS int `toml:"timeline_compaction_interval_s"`
 }
 
 type userTimelineService struct {
 	weaver.Implements[UserTimelineService]
 	weaver.WithConfig[userTimelineServiceOptions]
 	postStorageService weaver.Ref[PostStorageService]
-	mongoClient        *mongo.Client
-	redisClient        *redis.Client
+	timelines          repository.TimelineRepository
 }
 
 func (u *userTimelineService) Init(ctx context.Context) error {
 	logger := u.Logger(ctx)
 
 	var err error
-	u.mongoClient, err = storage.MongoDBClient(ctx, u.Config().MongoDBAddr, u.Config().MongoDBPort)
+	u.timelines, err = repository.NewTimelineRepository(ctx, repository.Options{
+		Backend:     u.Config().StorageBackend,
+		MongoDBAddr: u.Config().MongoDBAddr,
+		MongoDBPort: u.Config().MongoDBPort,
+		CacheAddr:   u.Config().RedisAddr,
+		CachePort:   u.Config().RedisPort,
+	}, "user-timeline", repository.NewTimelineCachePolicy(u.Config().TimelineMaxLength, u.Config().TimelineTTLS))
 	if err != nil {
-		logger.Error(err.Error())
+		logger.Error("error initializing user timeline repository", "msg", err.Error())
+		return err
+	}
+	err = u.timelines.EnsureIndexes(ctx)
+	if err != nil {
+		logger.Error("error creating user timeline indexes", "msg", err.Error())
 		return err
 	}
 
-	u.redisClient = storage.RedisClient(u.Config().RedisAddr, u.Config().RedisPort)
-	logger.Info("user timeline service running!", "region", u.Config().Region,
+	if u.Config().TimelineCompactionIntervalS > 0 {
+		regionLabel := sn_metrics.RegionLabel{Region: u.Config().Region}
+		go runTimelineCompaction(ctx, logger, u.timelines, time.Duration(u.Config().TimelineCompactionIntervalS)*time.Second, func(removed int64) {
+			sn_metrics.CompactedTimelinePosts.Get(regionLabel).Add(float64(removed))
+		})
+	}
+	logger.Info("user timeline service running!", "region", u.Config().Region, "storage_backend", u.Config().StorageBackend,
 		"mongodb_addr", u.Config().MongoDBAddr, "mongodb_port", u.Config().MongoDBPort,
 		"redis_addr", u.Config().RedisAddr, "redis_port", u.Config().RedisPort,
+		"timeline_max_length", u.Config().TimelineMaxLength, "timeline_ttl_s", u.Config().TimelineTTLS,
+		"timeline_compaction_interval_s", u.Config().TimelineCompactionIntervalS,
 	)
 	return nil
 }
@@ -60,154 +83,85 @@ func (u *userTimelineService) WriteUserTimeline(ctx context.Context, reqID int64
 	logger := u.Logger(ctx)
 	logger.Debug("entering WriteUserTimeline", "req_id", reqID, "post_id", postID, "user_id", userID, "timestamp", timestamp)
 
-	collection := u.mongoClient.Database("user-timeline").Collection("user-timeline")
-
-	userIDStr := strconv.FormatInt(userID, 10)
-	filter := bson.M{"user_id": userIDStr}
-	cur, err := collection.Find(ctx, filter)
+	err := u.timelines.PushPost(ctx, []int64{userID}, model.TimelinePostInfo{PostID: postID, Timestamp: timestamp})
 	if err != nil {
-		logger.Error("error reading posts from mongodb", "msg", err.Error())
+		logger.Error("failed to insert user timeline", "msg", err.Error())
 		return err
 	}
-	var timelines []model.Timeline
-	cur.Decode(&timelines) // ignore errors
-
-	if len(timelines) == 0 {
-		timeline := model.Timeline{UserID: userID, Posts: []model.TimelinePostInfo{{
-			PostID:    postID,
-			Timestamp: timestamp,
-		}}}
-		_, err := collection.InsertOne(ctx, timeline)
-		if err != nil {
-			logger.Error("failed to insert user timeline")
-			return err
-		}
-	} else {
-		postIDstr := strconv.FormatInt(postID, 10)
-		timestampstr := strconv.FormatInt(timestamp, 10)
-		pushPosts := bson.D{
-			{Key: "$push", Value: bson.D{
-				{Key: "posts", Value: bson.D{
-					{Key: "$each", Value: bson.A{
-						bson.D{
-							{Key: "post_id", Value: postIDstr},
-							{Key: "timestamp", Value: timestampstr},
-						},
-					}},
-					{Key: "$position", Value: 0},
-				}},
-			}},
-		}
-		_, err := collection.UpdateMany(ctx, filter, pushPosts)
-		if err != nil {
-			logger.Error("failed to insert user timeline")
-			return err
-		}
-	}
-	return u.redisClient.ZAddNX(ctx, userIDStr, redis.Z{
-		Member: postID,
-		Score:  float64(timestamp),
-	}).Err()
+	return nil
 }
 
-// readCachedTimeline is an helper function for reading timeline from redis with the same behavior as in the home timeline service
-func (u *userTimelineService) readCachedTimeline(ctx context.Context, userIDStr string, start int64, stop int64) ([]int64, error) {
+// RemoveUserTimelinePosts removes the posts (e.g. deleted ones) from the user timeline
+func (u *userTimelineService) RemoveUserTimelinePosts(ctx context.Context, reqID int64, userID int64, postIDs []int64) error {
 	logger := u.Logger(ctx)
+	logger.Debug("entering RemoveUserTimelinePosts", "req_id", reqID, "user_id", userID, "post_ids", postIDs)
 
-	result, err := u.redisClient.ZRevRange(ctx, userIDStr, start, stop-1).Result()
+	err := u.timelines.RemovePosts(ctx, userID, postIDs)
 	if err != nil {
-		logger.Error("error reading user timeline from redis")
-		return nil, err
-	}
-
-	var postIDs []int64
-	for _, result := range result {
-		id, err := strconv.ParseInt(result, 10, 64)
-		if err != nil {
-			logger.Error("error parsing post id from redis result")
-			return nil, err
-		}
-		postIDs = append(postIDs, id)
+		logger.Error("error removing posts from user timeline", "msg", err.Error())
+		return err
 	}
-	return postIDs, nil
+	return nil
 }
 
-func (u *userTimelineService) ReadUserTimeline(ctx context.Context, reqID int64, userID int64, start int64, stop int64) ([]model.Post, error) {
+// ReadUserTimeline returns a page of the user timeline
+func (u *userTimelineService) ReadUserTimeline(ctx context.Context, reqID int64, userID int64, query model.TimelineQuery) (model.TimelinePage, error) {
 	logger := u.Logger(ctx)
-	logger.Debug("entering ReadUserTimeline", "req_id", reqID, "user_id", userID, "start", start, "stop", stop)
-	if stop <= start || start < 0 {
-		return nil, nil
+	logger.Debug("entering ReadUserTimeline", "req_id", reqID, "user_id", userID, "start", query.Start, "stop", query.Stop,
+		"max_id", query.MaxID, "since_id", query.SinceID, "since", query.Since, "until", query.Until)
+	if query.Stop <= query.Start || query.Start < 0 {
+		return model.TimelinePage{Posts: []model.Post{}}, nil
 	}
 
-	userIDStr := strconv.FormatInt(userID, 10)
-	postIDs, err := u.readCachedTimeline(ctx, userIDStr, start, stop)
+	timelinePosts, err := u.timelines.ReadTimeline(ctx, userID, query)
 	if err != nil {
-		return nil, err
+		logger.Error("error reading user timeline", "msg", err.Error())
+		return model.TimelinePage{}, err
 	}
 
-	logger.Debug("read cached timeline", "post_ids", postIDs)
+	page, err := newTimelinePage(ctx, u.postStorageService.Get().ReadPosts, reqID, query, timelinePosts)
+	if err != nil {
+		logger.Error("error fetching posts from post storage service", "msg", err.Error())
+		return model.TimelinePage{}, err
+	}
+	// direct messages are only read from their conversation
+	return withoutDirectMessages(page), nil
+}
 
-	mongoStart := start + int64(len(postIDs))
-	logger.Debug("mongo?", "mongoStart", mongoStart, "start", start, "stop", stop)
-	var postsToCache []redis.Z
-	logger.Debug("going to mongodb?", "mongostart", mongoStart, "stop", stop)
-	if mongoStart < stop {
-		collection := u.mongoClient.Database("user-timeline").Collection("user-timeline")
-		query := bson.D{
-			{Key: "user_id", Value: userID},
-		}
-		opts := options.FindOneOptions{
-			Projection: bson.D{
-				{Key: "posts", Value: bson.D{
-					{Key: "$slice", Value: bson.A{0, stop}},
-				}},
-			},
-		}
-		result := collection.FindOne(ctx, query, &opts)
-		if result.Err() != nil {
-			logger.Error("error reading user-timeline posts from mongodb", "msg", result.Err().Error())
-			return nil, err
-		}
-		var userTimeline model.Timeline
-		err := result.Decode(&userTimeline)
-		if err != nil && err != mongo.ErrNoDocuments {
-			logger.Error("error parsing user-timeline posts from mongodb", "msg", err.Error())
-			return nil, err
-		}
-		for idx, post := range userTimeline.Posts {
-			if int64(idx) >= mongoStart {
-				postIDs = append(postIDs, post.PostID)
-			}
-			postsToCache = append(postsToCache, redis.Z{
-				Member: post.PostID,
-				Score:  float64(post.Timestamp),
-			})
-		}
-		logger.Debug("got user-timeline posts from mongodb", "#posts", len(userTimeline.Posts))
+// ReadUserTimelinesPosts merges the user timelines of the users and returns the ids and timestamps
+// of the posts of the page, plus one past its end as in TimelineRepository.ReadTimeline
+// the cursors of the query must be resolved, since they may not belong to any of these timelines
+func (u *userTimelineService) ReadUserTimelinesPosts(ctx context.Context, reqID int64, userIDs []int64, query model.TimelineQuery) ([]model.TimelinePostInfo, error) {
+	logger := u.Logger(ctx)
+	logger.Debug("entering ReadUserTimelinesPosts", "req_id", reqID, "user_ids", userIDs, "start", query.Start, "stop", query.Stop)
+	if query.Stop <= query.Start || query.Start < 0 {
+		return []model.TimelinePostInfo{}, nil
 	}
 
+	// every timeline may hold all the posts of the page, so they are read from the start
+	userQuery := query
+	userQuery.Start = 0
+	timelines := make([][]model.TimelinePostInfo, len(userIDs))
+	errs := make([]error, len(userIDs))
 	var wg sync.WaitGroup
-	posts := []model.Post{}
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		posts, err = u.postStorageService.Get().ReadPosts(ctx, reqID, postIDs)
-	}()
-
-	if len(postsToCache) > 0 {
-		_, err = u.redisClient.ZAddNX(ctx, userIDStr, postsToCache...).Result()
+	for i, userID := range userIDs {
+		wg.Add(1)
+		go func(i int, userID int64) {
+			defer wg.Done()
+			timelines[i], errs[i] = u.timelines.ReadTimeline(ctx, userID, userQuery)
+		}(i, userID)
+	}
+	wg.Wait()
+	for _, err := range errs {
 		if err != nil {
-			logger.Error("error updating redis with new posts", "msg", err.Error())
+			logger.Error("error reading user timelines", "msg", err.Error())
 			return nil, err
 		}
 	}
 
-	wg.Wait()
-	if err != nil {
-		logger.Error("error fetching posts from post storage service", "msg", err.Error())
-		return nil, err
+	posts := mergeTimelinePosts(timelines...)
+	if int64(len(posts)) <= query.Start {
+		return []model.TimelinePostInfo{}, nil
 	}
-
-	return posts, nil
+	return posts[query.Start:min(int64(len(posts)), query.Stop+1)], nil
 }
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"socialnetwork/pkg/model"
+)
+
+const DEFAULT_VISIBILITY_PROBE_TIMEOUT_MS int = 60000
+
+// visibilityProbe measures the visibility lag of new posts: how long after their write in the source region
+// they become readable in the local post-storage replica
+//
+// the lag is measured when a notification first finds its post, which also counts the redelivery delays
+// of the notifications that missed it, so posts that are not readable yet are polled every interval
+// by the background prober (if enabled) until they are or the timeout since their write expires
+// every post is measured once, and the lag depends on the clocks of both regions being synchronized
+type visibilityProbe struct {
+	// 0 disables the prober
+	interval time.Duration
+	timeout  time.Duration
+	// reads the post from the local replica, returns nil if it is readable
+	find func(ctx context.Context, postID int64) error
+	// called once per post with its visibility lag, or with its source region when the timeout expires first
+	onVisible func(sourceRegion string, lag time.Duration)
+	onTimeout func(sourceRegion string)
+
+	mu sync.Mutex
+	// posts already measured or still waiting to be readable, until their timeout expires
+	posts map[int64]*probedPost
+}
+
+type probedPost struct {
+	sourceRegion string
+	writtenAt    time.Time
+	visible      bool
+}
+
+func newVisibilityProbe(intervalMs int, timeoutMs int) *visibilityProbe {
+	if timeoutMs <= 0 {
+		timeoutMs = DEFAULT_VISIBILITY_PROBE_TIMEOUT_MS
+	}
+	return &visibilityProbe{
+		interval: time.Duration(max(intervalMs, 0)) * time.Millisecond,
+		timeout:  time.Duration(timeoutMs) * time.Millisecond,
+		posts:    make(map[int64]*probedPost),
+	}
+}
+
+// observe records the result of reading the post of the notification from the local replica
+// notifications published before the probe (without the write time of the post) are ignored
+func (v *visibilityProbe) observe(msg model.Message, readable bool) {
+	if msg.PostWriteTs == 0 || msg.SourceRegion == "" {
+		return
+	}
+	now := time.Now()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	post, ok := v.posts[msg.PostID]
+	if ok && post.visible {
+		return
+	}
+	if !ok {
+		post = &probedPost{sourceRegion: msg.SourceRegion, writtenAt: time.UnixMilli(msg.PostWriteTs)}
+		if now.Sub(post.writtenAt) > v.timeout && !readable {
+			// too late to be polled, e.g. a notification redelivered long after the write
+			return
+		}
+		v.posts[msg.PostID] = post
+	}
+	if readable {
+		v.visible(post, now)
+	}
+}
+
+// visible records the lag of the post, must be called with the lock held
+func (v *visibilityProbe) visible(post *probedPost, now time.Time) {
+	post.visible = true
+	// clock skew between the regions may make the lag negative
+	lag := max(now.Sub(post.writtenAt), 0)
+	if v.onVisible != nil {
+		v.onVisible(post.sourceRegion, lag)
+	}
+}
+
+// run polls the posts that are not readable yet until the context is done
+// without the prober, it only forgets the posts whose timeout expired
+func (v *visibilityProbe) run(ctx context.Context) {
+	interval := v.interval
+	if interval <= 0 {
+		interval = v.timeout
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			v.poll(ctx)
+		}
+	}
+}
+
+func (v *visibilityProbe) poll(ctx context.Context) {
+	now := time.Now()
+	var pending []int64
+	v.mu.Lock()
+	for postID, post := range v.posts {
+		if now.Sub(post.writtenAt) <= v.timeout {
+			if !post.visible {
+				pending = append(pending, postID)
+			}
+			continue
+		}
+		delete(v.posts, postID)
+		if !post.visible && v.onTimeout != nil {
+			v.onTimeout(post.sourceRegion)
+		}
+	}
+	v.mu.Unlock()
+	if v.interval <= 0 || v.find == nil {
+		return
+	}
+
+	for _, postID := range pending {
+		if ctx.Err() != nil {
+			return
+		}
+		// other errors (e.g. an unreachable replica) are retried at the next poll
+		if v.find(ctx, postID) != nil {
+			continue
+		}
+		now := time.Now()
+		v.mu.Lock()
+		post, ok := v.posts[postID]
+		if ok && !post.visible {
+			v.visible(post, now)
+		}
+		v.mu.Unlock()
+	}
+}
@@ -0,0 +1,109 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"socialnetwork/pkg/model"
+	"socialnetwork/pkg/repository"
+)
+
+type visibilityRecorder struct {
+	mu       sync.Mutex
+	lags     map[string][]time.Duration
+	timeouts map[string]int
+}
+
+func newRecordedProbe(intervalMs int, timeoutMs int) (*visibilityProbe, *visibilityRecorder) {
+	r := &visibilityRecorder{lags: make(map[string][]time.Duration), timeouts: make(map[string]int)}
+	probe := newVisibilityProbe(intervalMs, timeoutMs)
+	probe.onVisible = func(sourceRegion string, lag time.Duration) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.lags[sourceRegion] = append(r.lags[sourceRegion], lag)
+	}
+	probe.onTimeout = func(sourceRegion string) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.timeouts[sourceRegion]++
+	}
+	return probe, r
+}
+
+func (r *visibilityRecorder) recorded(sourceRegion string) ([]time.Duration, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]time.Duration(nil), r.lags[sourceRegion]...), r.timeouts[sourceRegion]
+}
+
+func postMessage(postID int64, writtenAt time.Time) model.Message {
+	return model.Message{Type: model.MESSAGE_TYPE_POST, PostID: postID, SourceRegion: "eu", PostWriteTs: writtenAt.UnixMilli()}
+}
+
+func TestVisibilityLagIsRecordedOnce(t *testing.T) {
+	probe, recorder := newRecordedProbe(0, 0)
+	probe.observe(postMessage(1, time.Now().Add(-200*time.Millisecond)), false)
+	probe.observe(postMessage(1, time.Now().Add(-200*time.Millisecond)), true)
+	probe.observe(postMessage(1, time.Now().Add(-200*time.Millisecond)), true)
+	// notifications of posts written before the probe are ignored
+	probe.observe(model.Message{Type: model.MESSAGE_TYPE_POST, PostID: 2}, true)
+
+	lags, timeouts := recorder.recorded("eu")
+	if len(lags) != 1 || timeouts != 0 {
+		t.Fatalf("got lags %v and %d timeouts, want one lag", lags, timeouts)
+	}
+	if lags[0] < 200*time.Millisecond {
+		t.Errorf("got lag %s, want at least 200ms", lags[0])
+	}
+}
+
+func TestVisibilityProber(t *testing.T) {
+	probe, recorder := newRecordedProbe(10, 500)
+	var readable atomic.Bool
+	probe.find = func(ctx context.Context, postID int64) error {
+		if postID == 1 && readable.Load() {
+			return nil
+		}
+		return repository.ErrNotFound
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go probe.run(ctx)
+
+	writtenAt := time.Now()
+	probe.observe(postMessage(1, writtenAt), false)
+	probe.observe(postMessage(2, writtenAt), false)
+	time.Sleep(100 * time.Millisecond)
+	readable.Store(true)
+	// the prober finds the post before its notification is redelivered
+	time.Sleep(100 * time.Millisecond)
+	lags, _ := recorder.recorded("eu")
+	if len(lags) != 1 || lags[0] < 100*time.Millisecond || lags[0] > 200*time.Millisecond {
+		t.Errorf("got lags %v, want one lag between 100ms and 200ms", lags)
+	}
+	probe.observe(postMessage(1, writtenAt), true)
+
+	// post 2 never becomes readable
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lags, timeouts := recorder.recorded("eu")
+		if timeouts == 1 {
+			if len(lags) != 1 {
+				t.Errorf("got lags %v, want one lag", lags)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d timeouts, want 1", timeouts)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	probe.mu.Lock()
+	defer probe.mu.Unlock()
+	if len(probe.posts) != 0 {
+		t.Errorf("got %d probed posts after their timeout, want 0", len(probe.posts))
+	}
+}
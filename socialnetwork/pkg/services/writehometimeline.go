@@ -3,20 +3,17 @@ package services
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"strconv"
-	"sync"
 	"time"
 
 	sn_metrics "socialnetwork/pkg/metrics"
 	"socialnetwork/pkg/model"
+	"socialnetwork/pkg/repository"
 	"socialnetwork/pkg/storage"
 	sn_trace "socialnetwork/pkg/trace"
 
 	"github.com/ServiceWeaver/weaver"
-	"github.com/redis/go-redis/v9"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 )
@@ -34,48 +31,184 @@ type writeHomeTimelineServiceOptions struct {
 	RedisPort    int    `toml:"redis_port"`
 	NumWorkers   int    `toml:"num_workers"`
 	Region       string `toml:"region"`
+	// consistency barrier: wait until the local post-storage replica
+	// has caught up with the version of the post in the notification
+	ConsistencyBarrier bool `toml:"consistency_barrier"`
+	BarrierTimeoutMs   int  `toml:"barrier_timeout_ms"`
+	// redelivery of failed or inconsistent notifications
+	MaxAttempts      int `toml:"max_attempts"`
+	RetryBaseDelayMs int `toml:"retry_base_delay_ms"`
+	// notification transport: "rabbitmq" (default), "channel" or "redis"
+	Notifier          string `toml:"notifier"`
+	NotifierRedisAddr string `toml:"notifier_redis_address"`
+	NotifierRedisPort int    `toml:"notifier_redis_port"`
+	// rabbitmq credentials and publisher confirms (wait for the broker ack when requeuing failed notifications)
+	RabbitMQUser              string `toml:"rabbitmq_username"`
+	RabbitMQPass              string `toml:"rabbitmq_password"`
+	RabbitMQPublisherConfirms bool   `toml:"rabbitmq_publisher_confirms"`
+	// storage backend of the posts, home timelines and processed notifications: "mongodb" (default) or "memory"
+	StorageBackend string `toml:"storage_backend"`
+	// durable home timelines, which must be written to the mongodb primary
+	HomeTimelineMongoDBAddr string `toml:"home_timeline_mongodb_address"`
+	HomeTimelineMongoDBPort int    `toml:"home_timeline_mongodb_port"`
+	// posts of users with more followers than the threshold are not pushed to their followers' home timelines,
+	// which pull them at read time instead (0 pushes every post)
+	FanoutThreshold int `toml:"fanout_threshold"`
+	// home timelines are written in pipelined chunks of users, with at most fanout_concurrency chunks in flight
+	// and each failed chunk written again up to fanout_chunk_attempts times
+	FanoutChunkSize     int `toml:"fanout_chunk_size"`
+	FanoutConcurrency   int `toml:"fanout_concurrency"`
+	FanoutChunkAttempts int `toml:"fanout_chunk_attempts"`
+	// cached home timelines keep the newest timeline_max_length posts and expire after timeline_ttl_s
+	// without reads (0 disables each of them), as in HomeTimelineService
+	TimelineMaxLength int `toml:"timeline_max_length"`
+	TimelineTTLS      int `toml:"timeline_ttl_s"`
+	// number of posts of the followee merged into the home timeline of a new follower (0 disables the backfill)
+	FollowBackfillPosts int `toml:"follow_backfill_posts"`
+	// follow and unfollow events that still do not match the social graph replica graph_replication_lag_ms after
+	// they were published were undone by a later event, and are discarded instead of retried
+	GraphReplicationLagMs int `toml:"graph_replication_lag_ms"`
+	// new posts not readable in the local post-storage replica yet are polled every visibility_probe_interval_ms
+	// (0 disables the prober) for up to visibility_probe_timeout_ms after their write, to measure their visibility lag
+	VisibilityProbeIntervalMs int `toml:"visibility_probe_interval_ms"`
+	VisibilityProbeTimeoutMs  int `toml:"visibility_probe_timeout_ms"`
 }
 
+const DEFAULT_BARRIER_TIMEOUT_MS int = 1000
+const DEFAULT_GRAPH_REPLICATION_LAG_MS int = 10000
+
+const WORKER_RESTART_BASE_DELAY time.Duration = 100 * time.Millisecond
+const WORKER_RESTART_MAX_DELAY time.Duration = 10 * time.Second
+
+// processed notifications are remembered for this long to discard duplicates published by the outbox relay
+const NOTIFICATION_DEDUP_TTL time.Duration = 24 * time.Hour
+
+var errPostNotFound = errors.New("post not found in post-storage")
+var errMalformedNotification = fmt.Errorf("malformed notification: %w", storage.ErrNotRetriable)
+var errStaleGraphEvent = errors.New("follow or unfollow event does not match the social graph")
+var errPostChangeNotApplied = errors.New("post edit or deletion not applied by post-storage yet")
+
 type writeHomeTimelineService struct {
 	weaver.Implements[WriteHomeTimelineService]
 	weaver.WithConfig[writeHomeTimelineServiceOptions]
-	socialGraphService weaver.Ref[SocialGraphService]
-	mongoClient        *mongo.Client
-	redisClient        *redis.Client
-	amqClientPool 		*storage.RabbitMQClientPool
+	socialGraphService  weaver.Ref[SocialGraphService]
+	userTimelineService weaver.Ref[UserTimelineService]
+	postStorageService  weaver.Ref[PostStorageService]
+	posts               repository.PostRepository
+	homeTimelines       repository.TimelineRepository
+	// processed notifications
+	notifications repository.NotificationRepository
+	subscriber    storage.Subscriber
+	fanout        *fanoutEngine
+	visibility    *visibilityProbe
 }
 
 func (w *writeHomeTimelineService) Init(ctx context.Context) error {
 	logger := w.Logger(ctx)
 	var err error
-	w.mongoClient, err = storage.MongoDBClient(ctx, w.Config().MongoDBAddr, w.Config().MongoDBPort)
+	w.posts, err = repository.NewPostRepository(ctx, repository.Options{
+		Backend:     w.Config().StorageBackend,
+		MongoDBAddr: w.Config().MongoDBAddr,
+		MongoDBPort: w.Config().MongoDBPort,
+	})
+	if err != nil {
+		logger.Error("error initializing post repository", "msg", err.Error())
+		return err
+	}
+	w.homeTimelines, err = repository.NewTimelineRepository(ctx, repository.Options{
+		Backend:     w.Config().StorageBackend,
+		MongoDBAddr: w.Config().HomeTimelineMongoDBAddr,
+		MongoDBPort: w.Config().HomeTimelineMongoDBPort,
+		CacheAddr:   w.Config().RedisAddr,
+		CachePort:   w.Config().RedisPort,
+	}, "home-timeline", repository.NewTimelineCachePolicy(w.Config().TimelineMaxLength, w.Config().TimelineTTLS))
+	if err != nil {
+		logger.Error("error initializing home timeline repository", "msg", err.Error())
+		return err
+	}
+	err = w.homeTimelines.EnsureIndexes(ctx)
 	if err != nil {
-		logger.Error("error initializing mongodb client", "msg", err.Error())
+		logger.Error("error creating home timeline indexes", "msg", err.Error())
 		return err
 	}
-	w.redisClient = storage.RedisClient(w.Config().RedisAddr, w.Config().RedisPort)
-	w.amqClientPool, err = storage.NewRabbitMQClientPool(ctx, w.Config().RabbitMQAddr, w.Config().RabbitMQPort, 0, 500)
+	w.notifications, err = repository.NewNotificationRepository(repository.Options{
+		Backend:   w.Config().StorageBackend,
+		CacheAddr: w.Config().RedisAddr,
+		CachePort: w.Config().RedisPort,
+	})
+	if err != nil {
+		logger.Error("error initializing notification repository", "msg", err.Error())
+		return err
+	}
+	regionLabel := sn_metrics.RegionLabel{Region: w.Config().Region}
+	w.fanout = newFanoutEngine(w.Config().FanoutChunkSize, w.Config().FanoutConcurrency, w.Config().FanoutChunkAttempts)
+	w.fanout.onChunkFailure = func(userIDs []int64, attempt int, err error) {
+		logger.Warn("failed fan-out chunk", "num", len(userIDs), "attempt", attempt, "cause", err.Error())
+		sn_metrics.FailedFanoutChunks.Get(regionLabel).Inc()
+	}
+	w.visibility = newVisibilityProbe(w.Config().VisibilityProbeIntervalMs, w.Config().VisibilityProbeTimeoutMs)
+	w.visibility.find = func(ctx context.Context, postID int64) error {
+		_, err := w.posts.FindPost(ctx, postID, model.VersionToken{})
+		return err
+	}
+	w.visibility.onVisible = func(sourceRegion string, lag time.Duration) {
+		label := sn_metrics.ReplicationLabel{SourceRegion: sourceRegion, Region: w.Config().Region}
+		sn_metrics.PostVisibilityLagMs.Get(label).Put(float64(lag.Milliseconds()))
+	}
+	w.visibility.onTimeout = func(sourceRegion string) {
+		logger.Warn("post not visible before the visibility probe timeout", "source_region", sourceRegion)
+		sn_metrics.VisibilityProbeTimeouts.Get(sn_metrics.ReplicationLabel{SourceRegion: sourceRegion, Region: w.Config().Region}).Inc()
+	}
+	w.subscriber, err = storage.NewSubscriber(ctx, storage.NotificationOptions{
+		Backend:           w.Config().Notifier,
+		Exchange:          "write-home-timeline",
+		RabbitMQAddr:      w.Config().RabbitMQAddr,
+		RabbitMQPort:      w.Config().RabbitMQPort,
+		RabbitMQUser:      w.Config().RabbitMQUser,
+		RabbitMQPass:      w.Config().RabbitMQPass,
+		RedisAddr:         w.Config().NotifierRedisAddr,
+		RedisPort:         w.Config().NotifierRedisPort,
+		PublisherConfirms: w.Config().RabbitMQPublisherConfirms,
+		Retry: storage.RetryPolicy{
+			MaxAttempts: w.Config().MaxAttempts,
+			BaseDelay:   time.Duration(w.Config().RetryBaseDelayMs) * time.Millisecond,
+		},
+		OnRetry: func(attempts int, cause error) {
+			logger.Debug("scheduled notification retry", "attempts", attempts, "cause", cause.Error())
+			sn_metrics.RetriedNotifications.Get(regionLabel).Inc()
+		},
+		OnDeadLetter: func(attempts int, cause error) {
+			logger.Warn("dead-lettered notification", "attempts", attempts, "cause", cause.Error())
+			sn_metrics.DeadLetteredNotifications.Get(regionLabel).Inc()
+		},
+		OnConsumeError: func(err error) {
+			logger.Warn("error consuming notifications, resuming", "msg", err.Error())
+		},
+	})
 	if err != nil {
-		logger.Error("error initializing rabbitmq client pool", "msg", err.Error())
+		logger.Error("error initializing notification subscriber", "msg", err.Error())
 		return err
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(w.Config().NumWorkers)
+	// workers run in the background, since single-process deployments initialize components synchronously
+	go w.visibility.run(ctx)
 	for i := 1; i <= w.Config().NumWorkers; i++ {
-		go func(i int) {
-			defer wg.Done()
-			err := w.workerThread(ctx, i)
-			logger.Error("error in worker thread", "msg", err.Error())
-		}(i)
+		go w.runWorker(ctx, i)
 	}
 
-	logger.Info("write home timeline service running!", "region", w.Config().Region, "n_workers", w.Config().NumWorkers,
-		"rabbitmq_addr", w.Config().RabbitMQAddr, "rabbitmq_port", w.Config().RabbitMQPort,
+	logger.Info("write home timeline service running!", "region", w.Config().Region, "n_workers", w.Config().NumWorkers, "storage_backend", w.Config().StorageBackend,
+		"consistency_barrier", w.Config().ConsistencyBarrier, "barrier_timeout_ms", w.barrierTimeout().Milliseconds(),
+		"notifier", w.Config().Notifier, "notifier_redis_addr", w.Config().NotifierRedisAddr, "notifier_redis_port", w.Config().NotifierRedisPort,
+		"rabbitmq_addr", w.Config().RabbitMQAddr, "rabbitmq_port", w.Config().RabbitMQPort, "rabbitmq_publisher_confirms", w.Config().RabbitMQPublisherConfirms,
 		"mongodb_addr", w.Config().MongoDBAddr, "mongodb_port", w.Config().MongoDBPort,
+		"home_timeline_mongodb_addr", w.Config().HomeTimelineMongoDBAddr, "home_timeline_mongodb_port", w.Config().HomeTimelineMongoDBPort,
+		"fanout_threshold", w.Config().FanoutThreshold, "fanout_chunk_size", w.fanout.chunkSize,
+		"fanout_concurrency", w.fanout.concurrency, "fanout_chunk_attempts", w.fanout.maxAttempts,
+		"timeline_max_length", w.Config().TimelineMaxLength, "timeline_ttl_s", w.Config().TimelineTTLS,
+		"follow_backfill_posts", w.Config().FollowBackfillPosts,
+		"visibility_probe_interval_ms", w.visibility.interval.Milliseconds(), "visibility_probe_timeout_ms", w.visibility.timeout.Milliseconds(),
 		"redis_addr", w.Config().RedisAddr, "redis_port", w.Config().RedisPort,
 	)
-	wg.Wait()
 	return nil
 }
 
@@ -90,31 +223,47 @@ func (w *writeHomeTimelineService) WriteHomeTimeline(ctx context.Context, msg mo
 	regionLabel := sn_metrics.RegionLabel{Region: w.Config().Region}
 	sn_metrics.QueueDurationMs.Get(regionLabel).Put(float64(time.Now().UnixMilli() - msg.NotificationSendTs))
 
-	db := w.mongoClient.Database("post-storage")
-	collection := db.Collection("posts")
+	if msg.NotificationID != "" {
+		processed, err := w.notifications.IsProcessed(ctx, msg.NotificationID)
+		if err != nil {
+			logger.Error("error checking processed notifications", "msg", err.Error())
+			return err
+		}
+		if processed {
+			logger.Debug("discarding duplicate notification", "notification_id", msg.NotificationID)
+			sn_metrics.DuplicateNotifications.Get(regionLabel).Inc()
+			return nil
+		}
+	}
 
-	var post model.Post
-	filter := bson.D{{Key: "post_id", Value: msg.PostID}}
-	err := collection.FindOne(ctx, filter, nil).Decode(&post)
+	post, err := w.readPost(ctx, msg)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
+		if errors.Is(err, repository.ErrNotFound) || errors.Is(err, context.DeadlineExceeded) {
+			w.visibility.observe(msg, false)
 			trace.SpanFromContext(ctx).SetAttributes(
 				attribute.Bool("poststorage_consistent_read", false),
 			)
 			logger.Debug("inconsistency!")
 			sn_metrics.Inconsistencies.Get(regionLabel).Inc()
-			return nil
+			// notify the caller so that the notification can be redelivered later
+			return errPostNotFound
 		} else {
-			logger.Error("error reading post from mongodb", "msg", err.Error())
+			logger.Error("error reading post", "msg", err.Error())
 			return err
 		}
 	}
 
+	w.visibility.observe(msg, true)
 	trace.SpanFromContext(ctx).SetAttributes(
 		attribute.Bool("poststorage_consistent_read", true),
 	)
 
 	logger.Debug("found post! :)", "post_id", post.PostID, "text", post.Text)
+	if post.Deleted {
+		// the deletion may be processed before the post, which must not be added back to the timelines
+		logger.Debug("skipping deleted post", "post_id", post.PostID)
+		return nil
+	}
 
 	followersID, err := w.socialGraphService.Get().GetFollowers(ctx, msg.ReqID, msg.UserID)
 	if err != nil {
@@ -124,30 +273,247 @@ func (w *writeHomeTimelineService) WriteHomeTimeline(ctx context.Context, msg mo
 
 	logger.Debug("got followers to write to their hometimeline", "num", len(followersID))
 	uniqueIDs := make(map[int64]bool, 0)
-	for _, followerID := range followersID {
-		uniqueIDs[followerID] = true
+	if w.Config().FanoutThreshold > 0 && len(followersID) > w.Config().FanoutThreshold {
+		// followers pull the post when reading their home timeline, but mentioned users still get it pushed
+		// the user is recorded before skipping the push, so that readers pull its posts from now on
+		err = w.homeTimelines.AddPullUser(ctx, msg.UserID)
+		if err != nil {
+			logger.Error("error recording pull user", "user_id", msg.UserID, "msg", err.Error())
+			return err
+		}
+		logger.Debug("skipping fan-out to followers", "user_id", msg.UserID, "num", len(followersID))
+		sn_metrics.PullFanouts.Get(regionLabel).Inc()
+	} else {
+		for _, followerID := range followersID {
+			uniqueIDs[followerID] = true
+		}
 	}
 	for _, userMentionID := range msg.UserMentionIDs {
 		uniqueIDs[userMentionID] = true
 	}
-	value := redis.Z{
-		Member: msg.PostID,
-		Score:  float64(msg.Timestamp),
-	}
-	_, err = w.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
-		for id := range uniqueIDs {
-			idStr := strconv.FormatInt(id, 10)
-			err = w.redisClient.ZAddNX(ctx, idStr, value).Err()
-			if err != nil {
-				return err
-			}
+	userIDs := make([]int64, 0, len(uniqueIDs))
+	for id := range uniqueIDs {
+		userIDs = append(userIDs, id)
+	}
+
+	start := time.Now()
+	timelinePost := model.TimelinePostInfo{PostID: msg.PostID, Timestamp: msg.Timestamp}
+	err = w.fanout.run(ctx, userIDs, func(ctx context.Context, userIDs []int64) error {
+		return w.writeHomeTimelines(ctx, userIDs, timelinePost)
+	})
+	sn_metrics.FanoutSize.Get(regionLabel).Put(float64(len(userIDs)))
+	sn_metrics.FanoutDurationMs.Get(regionLabel).Put(float64(time.Since(start).Milliseconds()))
+	if err != nil {
+		logger.Error("error writing home timelines", "msg", err.Error())
+		return err
+	}
+	sn_metrics.PushedTimelineWrites.Get(regionLabel).Add(float64(len(userIDs)))
+	if msg.NotificationID != "" {
+		err = w.notifications.MarkProcessed(ctx, msg.NotificationID, NOTIFICATION_DEDUP_TTL)
+		if err != nil {
+			logger.Error("error marking notification as processed", "msg", err.Error())
 		}
+	}
+	logger.Debug("leaving write home timeline")
+	return nil
+}
+
+// backfillHomeTimeline merges the newest posts of the followee into the home timeline of the new follower
+// events that do not match the social graph are retried while the replica may not have caught up yet,
+// and discarded afterwards, since the user unfollowed since
+func (w *writeHomeTimelineService) backfillHomeTimeline(ctx context.Context, msg model.Message) error {
+	logger := w.Logger(ctx)
+	logger.Debug("entering backfillHomeTimeline", "user_id", msg.UserID, "followee_id", msg.FolloweeID)
+	if w.Config().FollowBackfillPosts <= 0 {
+		return nil
+	}
+	following, err := w.socialGraphService.Get().IsFollowing(ctx, msg.ReqID, msg.UserID, msg.FolloweeID)
+	if err != nil {
+		logger.Error("error reading social graph", "msg", err.Error())
+		return err
+	}
+	if !following {
+		return w.staleGraphEvent(ctx, msg)
+	}
+	pullUserIDs, err := w.homeTimelines.FilterPullUsers(ctx, []int64{msg.FolloweeID})
+	if err != nil {
+		logger.Error("error reading pull users", "msg", err.Error())
+		return err
+	}
+	if len(pullUserIDs) > 0 {
+		// posts of the followee are pulled when reading the home timeline
+		return nil
+	}
+
+	limit := int64(w.Config().FollowBackfillPosts)
+	posts, err := w.userTimelineService.Get().ReadUserTimelinesPosts(ctx, msg.ReqID, []int64{msg.FolloweeID}, model.TimelineQuery{Stop: limit})
+	if err != nil {
+		logger.Error("error reading user timeline of followee", "msg", err.Error())
+		return err
+	}
+	posts = posts[:min(int64(len(posts)), limit)]
+	err = w.homeTimelines.AddPosts(ctx, msg.UserID, posts)
+	if err != nil {
+		logger.Error("error backfilling home timeline", "msg", err.Error())
+		return err
+	}
+	sn_metrics.BackfilledTimelinePosts.Get(sn_metrics.RegionLabel{Region: w.Config().Region}).Add(float64(len(posts)))
+	return nil
+}
+
+// cleanupHomeTimeline removes the posts of the unfollowed user from the home timeline of the follower,
+// except for those that mention the follower
+func (w *writeHomeTimelineService) cleanupHomeTimeline(ctx context.Context, msg model.Message) error {
+	logger := w.Logger(ctx)
+	logger.Debug("entering cleanupHomeTimeline", "user_id", msg.UserID, "followee_id", msg.FolloweeID)
+	following, err := w.socialGraphService.Get().IsFollowing(ctx, msg.ReqID, msg.UserID, msg.FolloweeID)
+	if err != nil {
+		logger.Error("error reading social graph", "msg", err.Error())
+		return err
+	}
+	if following {
+		return w.staleGraphEvent(ctx, msg)
+	}
+
+	timelinePostIDs, err := w.homeTimelines.ReadPostIDs(ctx, msg.UserID)
+	if err != nil {
+		logger.Error("error reading home timeline", "msg", err.Error())
+		return err
+	}
+	if len(timelinePostIDs) == 0 {
 		return nil
+	}
+	postIDs, err := w.posts.FindCreatorPostIDs(ctx, timelinePostIDs, msg.FolloweeID, msg.UserID)
+	if err != nil {
+		logger.Error("error reading posts of followee", "msg", err.Error())
+		return err
+	}
+	err = w.homeTimelines.RemovePosts(ctx, msg.UserID, postIDs)
+	if err != nil {
+		logger.Error("error removing posts from home timeline", "msg", err.Error())
+		return err
+	}
+	sn_metrics.RemovedTimelinePosts.Get(sn_metrics.RegionLabel{Region: w.Config().Region}).Add(float64(len(postIDs)))
+	return nil
+}
+
+// applyPostChange invalidates the cached copy of the edited or deleted post in this region and, for deletions,
+// removes the post from the user timeline of its creator and from the home timelines of its followers and mentioned users
+// changes not applied by the local post-storage replica yet are retried, since the next read would cache the old post again
+func (w *writeHomeTimelineService) applyPostChange(ctx context.Context, msg model.Message) error {
+	logger := w.Logger(ctx)
+	logger.Debug("entering applyPostChange", "type", msg.Type, "post_id", msg.PostID)
+	regionLabel := sn_metrics.RegionLabel{Region: w.Config().Region}
+
+	post, err := w.readPost(ctx, msg)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) && !errors.Is(err, context.DeadlineExceeded) {
+		logger.Error("error reading post", "msg", err.Error())
+		return err
+	}
+	applied := err == nil && (post.Deleted || (msg.Type == model.MESSAGE_TYPE_EDIT && post.EditedAt >= msg.Timestamp))
+	if !applied {
+		sn_metrics.Inconsistencies.Get(regionLabel).Inc()
+		return errPostChangeNotApplied
+	}
+	err = w.postStorageService.Get().InvalidatePosts(ctx, msg.ReqID, []int64{msg.PostID})
+	if err != nil {
+		logger.Error("error invalidating cached post", "msg", err.Error())
+		return err
+	}
+	if msg.Type == model.MESSAGE_TYPE_EDIT {
+		return nil
+	}
+
+	err = w.userTimelineService.Get().RemoveUserTimelinePosts(ctx, msg.ReqID, msg.UserID, []int64{msg.PostID})
+	if err != nil {
+		logger.Error("error removing post from user timeline", "msg", err.Error())
+		return err
+	}
+	followersID, err := w.socialGraphService.Get().GetFollowers(ctx, msg.ReqID, msg.UserID)
+	if err != nil {
+		logger.Error("error getting followers from social graph service", "msg", err.Error())
+		return err
+	}
+	// followers above the fan-out threshold may still have the post if it was pushed before, so none are skipped
+	uniqueIDs := make(map[int64]bool, len(followersID)+len(msg.UserMentionIDs))
+	for _, followerID := range followersID {
+		uniqueIDs[followerID] = true
+	}
+	for _, userMentionID := range msg.UserMentionIDs {
+		uniqueIDs[userMentionID] = true
+	}
+	userIDs := make([]int64, 0, len(uniqueIDs))
+	for id := range uniqueIDs {
+		userIDs = append(userIDs, id)
+	}
+	err = w.fanout.run(ctx, userIDs, func(ctx context.Context, userIDs []int64) error {
+		return w.homeTimelines.RemovePost(ctx, userIDs, msg.PostID)
 	})
-	logger.Debug("leaving write home timeline")
+	if err != nil {
+		logger.Error("error removing post from home timelines", "msg", err.Error())
+		return err
+	}
+	return nil
+}
+
+// writeHomeTimelines adds the post to the home timelines of a chunk of users
+// mongodb is written before the cache so that a failed chunk is retried until the post is durable
+func (w *writeHomeTimelineService) writeHomeTimelines(ctx context.Context, userIDs []int64, post model.TimelinePostInfo) error {
+	err := w.homeTimelines.PushPost(ctx, userIDs, post)
+	if err != nil {
+		return fmt.Errorf("error writing home timelines: %s", err.Error())
+	}
+	return nil
+}
+
+// staleGraphEvent retries the follow or unfollow event that does not match the social graph while the replica
+// may be lagging behind, and acks it once it is older than the replication lag, as it was superseded
+// by a later unfollow or follow of the same users (whose own event is applied instead)
+func (w *writeHomeTimelineService) staleGraphEvent(ctx context.Context, msg model.Message) error {
+	lag := w.Config().GraphReplicationLagMs
+	if lag <= 0 {
+		lag = DEFAULT_GRAPH_REPLICATION_LAG_MS
+	}
+	if time.Now().UnixMilli()-msg.Timestamp < int64(lag) {
+		return errStaleGraphEvent
+	}
+	w.Logger(ctx).Debug("discarding superseded graph event", "type", msg.Type, "user_id", msg.UserID, "followee_id", msg.FolloweeID)
+	sn_metrics.SupersededGraphEvents.Get(sn_metrics.RegionLabel{Region: w.Config().Region}).Inc()
 	return nil
 }
 
+func (w *writeHomeTimelineService) barrierTimeout() time.Duration {
+	if w.Config().BarrierTimeoutMs <= 0 {
+		return time.Duration(DEFAULT_BARRIER_TIMEOUT_MS) * time.Millisecond
+	}
+	return time.Duration(w.Config().BarrierTimeoutMs) * time.Millisecond
+}
+
+// readPost reads the post from the local post-storage replica
+// if the consistency barrier is enabled, the read blocks (up to the configured deadline)
+// until the replica has applied the write identified by the message's version token
+func (w *writeHomeTimelineService) readPost(ctx context.Context, msg model.Message) (model.Post, error) {
+	logger := w.Logger(ctx)
+
+	if !w.Config().ConsistencyBarrier || msg.PostVersion.IsZero() {
+		return w.posts.FindPost(ctx, msg.PostID, model.VersionToken{})
+	}
+
+	barrierCtx, cancel := context.WithTimeout(ctx, w.barrierTimeout())
+	defer cancel()
+
+	barrierStartMs := time.Now().UnixMilli()
+	post, err := w.posts.FindPost(barrierCtx, msg.PostID, msg.PostVersion)
+	regionLabel := sn_metrics.RegionLabel{Region: w.Config().Region}
+	sn_metrics.BarrierWaitDurationMs.Get(regionLabel).Put(float64(time.Now().UnixMilli() - barrierStartMs))
+	if err != nil && barrierCtx.Err() == context.DeadlineExceeded {
+		logger.Warn("consistency barrier timed out", "post_id", msg.PostID, "version", msg.PostVersion)
+		sn_metrics.BarrierTimeouts.Get(regionLabel).Inc()
+		return post, context.DeadlineExceeded
+	}
+	return post, err
+}
+
 // onReceivedWorker adds the post to all the post's subscribed users (followers, mentioned users, etc)
 func (w *writeHomeTimelineService) onReceivedWorker(ctx context.Context, workerid int, body []byte) error {
 	logger := w.Logger(ctx)
@@ -156,15 +522,15 @@ func (w *writeHomeTimelineService) onReceivedWorker(ctx context.Context, workeri
 	err := json.Unmarshal(body, &msg)
 	if err != nil {
 		logger.Error("error parsing json message", "workerid", workerid, "msg", err.Error())
-		return err
+		return fmt.Errorf("%w: %s", errMalformedNotification, err.Error())
 	}
 	regionLabel := sn_metrics.RegionLabel{Region: w.Config().Region}
 	sn_metrics.ReceivedNotifications.Get(regionLabel).Add(1)
-	logger.Debug("received rabbitmq message", "workerid", workerid, "post_id", msg.PostID, "msg", msg)
+	logger.Debug("received notification", "workerid", workerid, "post_id", msg.PostID, "msg", msg)
 
 	spanContext, err := sn_trace.ParseSpanContext(msg.SpanContext)
 	if err != nil {		logger.Error("error parsing span context", "workerid", workerid, "msg", err.Error())
-		return err
+		return fmt.Errorf("%w: %s", errMalformedNotification, err.Error())
 	}
 
 	ctx = trace.ContextWithRemoteSpanContext(ctx, spanContext)
@@ -175,53 +541,50 @@ func (w *writeHomeTimelineService) onReceivedWorker(ctx context.Context, workeri
 		span.End()
 	}() */
 
-	return w.WriteHomeTimeline(ctx, msg)
+	switch msg.Type {
+	case model.MESSAGE_TYPE_FOLLOW:
+		return w.backfillHomeTimeline(ctx, msg)
+	case model.MESSAGE_TYPE_UNFOLLOW:
+		return w.cleanupHomeTimeline(ctx, msg)
+	case model.MESSAGE_TYPE_EDIT, model.MESSAGE_TYPE_DELETE:
+		return w.applyPostChange(ctx, msg)
+	default:
+		return w.WriteHomeTimeline(ctx, msg)
+	}
 }
 
-func (w *writeHomeTimelineService) workerThread(ctx context.Context, workerid int) error {
+// runWorker restarts the worker thread with exponential backoff until the context is cancelled,
+// so that the region keeps consuming notifications after the subscriber fails
+func (w *writeHomeTimelineService) runWorker(ctx context.Context, workerid int) {
 	logger := w.Logger(ctx)
-
-	ch, err := w.amqClientPool.Pop(ctx)
-	defer w.amqClientPool.Push(ch)
-
-	if err != nil {
-		logger.Error("error getting rabbitmq client from pool", "msg", err.Error())
-		panic(err)
+	delay := WORKER_RESTART_BASE_DELAY
+	for {
+		start := time.Now()
+		err := w.workerThread(ctx, workerid)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Error("error in worker thread, restarting", "workerid", workerid, "delay", delay, "msg", err.Error())
+		// reset the backoff if the worker was healthy for a while
+		if time.Since(start) > WORKER_RESTART_MAX_DELAY {
+			delay = WORKER_RESTART_BASE_DELAY
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, WORKER_RESTART_MAX_DELAY)
 	}
+}
 
-	err = ch.ExchangeDeclare("write-home-timeline", "topic", false, false, false, false, nil)
-	if err != nil {
-		logger.Error("error declaring exchange for rabbitmq", "workerid", workerid, "msg", err.Error())
-		return err
-	}
+func (w *writeHomeTimelineService) workerThread(ctx context.Context, workerid int) error {
 	routingKey := fmt.Sprintf("write-home-timeline-%s", w.Config().Region)
-	_, err = ch.QueueDeclare(routingKey, false, false, false, false, nil)
-	if err != nil {
-		logger.Error("error declaring queue for rabbitmq", "workerid", workerid, "msg", err.Error())
-		return err
-	}
-
-	err = ch.QueueBind(routingKey, routingKey, "write-home-timeline", false, nil)
-	if err != nil {
-		logger.Error("error binding queue for rabbitmq", "workerid", workerid, "msg", err.Error())
-		return err
-	}
-
-	msgs, err := ch.Consume(routingKey, "", true, false, false, false, nil)
-	if err != nil {
-		logger.Error("error consuming queue", "workerid", workerid, "msg", err.Error())
-		return err
-	}
-
-	var forever chan struct{}
-	go func() {
-		for msg := range msgs {
-			err = w.onReceivedWorker(ctx, workerid, msg.Body)
-			if err != nil {
-				logger.Warn("error in worker thread", "msg", err.Error())
-			}
+	return w.subscriber.Consume(ctx, routingKey, func(ctx context.Context, body []byte) error {
+		err := w.onReceivedWorker(ctx, workerid, body)
+		if err != nil {
+			w.Logger(ctx).Warn("error in worker thread", "msg", err.Error())
 		}
-	}()
-	<-forever
-	return nil
+		return err
+	})
 }
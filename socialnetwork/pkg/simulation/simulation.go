@@ -0,0 +1,179 @@
+package simulation
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"socialnetwork/pkg/repository"
+
+	"github.com/ServiceWeaver/weaver/weavertest"
+)
+
+// a simulation runs one deployment of the services per region in the same process, like the eu and us deployments
+// of deploy/weaver, with the in-memory datastores and the in-process channel notifier
+// every region has its own datastores: the post, user, social graph and url databases are written in the first
+// (primary) region and replicated to the others with their replication lag, like the mongodb replica set of
+// docker-compose.yml, while the timelines, conversations and caches are only written and read by their region
+// posts are composed in the primary region, and notified to the write home timeline service of every region
+
+type Options struct {
+	// Name tells apart the datastores and notification topics of the simulations of the same process
+	Name string
+	// Regions are the simulated regions, starting with the primary region
+	Regions []string
+	// ReplicationLag is the lag of the datastores of every other region behind the primary region,
+	// or DefaultReplicationLag if not set
+	ReplicationLag        map[string]time.Duration
+	DefaultReplicationLag time.Duration
+	// ConsistencyBarrier makes the write home timeline services wait up to BarrierTimeout for their replicas
+	ConsistencyBarrier bool
+	BarrierTimeout     time.Duration
+}
+
+type Simulation struct {
+	opts Options
+}
+
+// NewSimulation replicates the datastores of the regions, which must not be used before
+func NewSimulation(opts Options) (*Simulation, error) {
+	if opts.Name == "" || len(opts.Regions) == 0 {
+		return nil, fmt.Errorf("simulations need a name and at least one region")
+	}
+	seen := make(map[string]bool, len(opts.Regions))
+	for _, region := range opts.Regions {
+		if region == "" || seen[region] {
+			return nil, fmt.Errorf("invalid or duplicate region %q", region)
+		}
+		seen[region] = true
+	}
+	for region, lag := range opts.ReplicationLag {
+		if !seen[region] || lag < 0 {
+			return nil, fmt.Errorf("invalid replication lag of region %q", region)
+		}
+	}
+	s := &Simulation{opts: opts}
+	var replicas []repository.MemoryReplica
+	for _, region := range opts.Regions[1:] {
+		replicas = append(replicas, repository.MemoryReplica{Addr: s.address(region), Lag: s.ReplicationLag(region)})
+	}
+	err := repository.ReplicateMemoryDatastores(s.address(opts.Regions[0]), 0, replicas)
+	if err != nil {
+		return nil, fmt.Errorf("error replicating datastores of simulation %s: %s", opts.Name, err.Error())
+	}
+	return s, nil
+}
+
+// ReplicationLag returns the lag of the datastores of the region behind the primary region
+func (s *Simulation) ReplicationLag(region string) time.Duration {
+	if region == s.opts.Regions[0] {
+		return 0
+	}
+	if lag, ok := s.opts.ReplicationLag[region]; ok {
+		return lag
+	}
+	return s.opts.DefaultReplicationLag
+}
+
+// address of the in-memory datastores of the region, which is also its name
+func (s *Simulation) address(region string) string {
+	return s.Region(region)
+}
+
+// Region returns the name of the region in the configs, metrics and notification topics of the simulation
+func (s *Simulation) Region(region string) string {
+	return fmt.Sprintf("%s/%s", s.opts.Name, region)
+}
+
+// Config returns the weaver config of the deployment of the region
+func (s *Simulation) Config(region string) string {
+	regions := make([]string, 0, len(s.opts.Regions))
+	for _, region := range s.opts.Regions {
+		regions = append(regions, fmt.Sprintf("%q", s.Region(region)))
+	}
+	return fmt.Sprintf(`
+["socialnetwork/pkg/services/ComposePostService"]
+storage_backend     = "memory"
+redis_address       = %[1]q
+region              = %[2]q
+regions             = [%[3]s]
+
+["socialnetwork/pkg/services/DirectMessageService"]
+storage_backend     = "memory"
+mongodb_address     = %[1]q
+region              = %[2]q
+
+["socialnetwork/pkg/services/HomeTimelineService"]
+storage_backend     = "memory"
+mongodb_address     = %[1]q
+redis_address       = %[1]q
+region              = %[2]q
+
+["socialnetwork/pkg/services/PostStorageService"]
+storage_backend     = "memory"
+mongodb_address     = %[1]q
+memcached_address   = %[1]q
+region              = %[2]q
+regions             = [%[3]s]
+notifier            = "channel"
+outbox_poll_interval_ms = 10
+
+["socialnetwork/pkg/services/SocialGraphService"]
+storage_backend     = "memory"
+mongodb_address     = %[1]q
+redis_address       = %[1]q
+memcached_address   = %[1]q
+region              = %[2]q
+regions             = [%[3]s]
+notifier            = "channel"
+
+["socialnetwork/pkg/services/UrlShortenService"]
+storage_backend     = "memory"
+mongodb_address     = %[1]q
+memcached_address   = %[1]q
+region              = %[2]q
+
+["socialnetwork/pkg/services/UserService"]
+storage_backend     = "memory"
+mongodb_address     = %[1]q
+memcached_address   = %[1]q
+region              = %[2]q
+jwt_kid             = "k1"
+jwt_secrets         = { k1 = "simulation-secret" }
+
+["socialnetwork/pkg/services/UserMentionService"]
+storage_backend     = "memory"
+mongodb_address     = %[1]q
+memcached_address   = %[1]q
+region              = %[2]q
+
+["socialnetwork/pkg/services/UserTimelineService"]
+storage_backend     = "memory"
+mongodb_address     = %[1]q
+redis_address       = %[1]q
+region              = %[2]q
+
+["socialnetwork/pkg/services/WriteHomeTimelineService"]
+storage_backend     = "memory"
+mongodb_address     = %[1]q
+redis_address       = %[1]q
+home_timeline_mongodb_address = %[1]q
+num_workers         = 2
+region              = %[2]q
+consistency_barrier = %[4]t
+barrier_timeout_ms  = %[5]d
+max_attempts        = 10
+retry_base_delay_ms = 10
+visibility_probe_interval_ms = 10
+notifier            = "channel"
+`, s.address(region), s.Region(region), strings.Join(regions, ", "), s.opts.ConsistencyBarrier, s.opts.BarrierTimeout.Milliseconds())
+}
+
+// Runner returns the single-process weavertest runner of the region
+// the runners of every region can be nested to run them at the same time
+func (s *Simulation) Runner(region string) weavertest.Runner {
+	runner := weavertest.Local
+	runner.Name = region
+	runner.Config = s.Config(region)
+	return runner
+}
@@ -0,0 +1,147 @@
+package simulation_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"socialnetwork/pkg/model"
+	"socialnetwork/pkg/services"
+	"socialnetwork/pkg/simulation"
+)
+
+const (
+	REPLICATION_LAG  time.Duration = 300 * time.Millisecond
+	DELIVERY_TIMEOUT time.Duration = 10 * time.Second
+)
+
+// number of simulations, which tells apart the runs of the same test (e.g. with -count)
+var simulations atomic.Int64
+
+var reqIDs atomic.Int64
+
+func newSimulation(t *testing.T, barrier bool) *simulation.Simulation {
+	sim, err := simulation.NewSimulation(simulation.Options{
+		Name:                  fmt.Sprintf("%s/%d", t.Name(), simulations.Add(1)),
+		Regions:               []string{"eu", "us"},
+		DefaultReplicationLag: REPLICATION_LAG,
+		ConsistencyBarrier:    barrier,
+		BarrierTimeout:        DELIVERY_TIMEOUT,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sim
+}
+
+// compose uploads the components of a text post in parallel, as the wrk2 api does
+func compose(t *testing.T, ctx context.Context, textService services.TextService, mediaService services.MediaService,
+	uniqueIdService services.UniqueIdService, userService services.UserService, userID int64, username string, text string) int64 {
+	t.Helper()
+	reqID := reqIDs.Add(1)
+	var wg sync.WaitGroup
+	wg.Add(4)
+	var errs [4]error
+	var postID int64
+	go func() {
+		defer wg.Done()
+		errs[0] = textService.UploadText(ctx, reqID, text)
+	}()
+	go func() {
+		defer wg.Done()
+		errs[1] = mediaService.UploadMedia(ctx, reqID, []string{}, []int64{})
+	}()
+	go func() {
+		defer wg.Done()
+		postID, errs[2] = uniqueIdService.UploadUniqueId(ctx, reqID, model.POST_TYPE_POST, 0)
+	}()
+	go func() {
+		defer wg.Done()
+		errs[3] = userService.UploadCreatorWithUserId(ctx, reqID, userID, username)
+	}()
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("error composing post: %s", err.Error())
+		}
+	}
+	return postID
+}
+
+// waitFor polls the condition until it holds, and returns how long it took
+func waitFor(t *testing.T, what string, condition func() bool) time.Duration {
+	t.Helper()
+	start := time.Now()
+	for !condition() {
+		if time.Since(start) > DELIVERY_TIMEOUT {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return time.Since(start)
+}
+
+func TestCrossRegionReplication(t *testing.T) {
+	for _, barrier := range []bool{false, true} {
+		t.Run(fmt.Sprintf("barrier=%t", barrier), func(t *testing.T) {
+			sim := newSimulation(t, barrier)
+			sim.Runner("eu").Test(t, func(t *testing.T, textService services.TextService, mediaService services.MediaService,
+				uniqueIdService services.UniqueIdService, userService services.UserService, socialGraphService services.SocialGraphService,
+				postStorageService services.PostStorageService, homeTimelineService services.HomeTimelineService) {
+				sim.Runner("us").Test(t, func(t *testing.T, usUserService services.UserService, usSocialGraphService services.SocialGraphService,
+					usPostStorageService services.PostStorageService, usHomeTimelineService services.HomeTimelineService) {
+					ctx := context.Background()
+					for userID, username := range []string{"ana", "bob"} {
+						err := userService.RegisterUserWithId(ctx, 0, username, username, username, "pwd", int64(userID+1))
+						if err != nil {
+							t.Fatalf("error registering %s: %s", username, err.Error())
+						}
+					}
+					// like mongodb secondaries, replicas do not accept writes
+					err := usUserService.RegisterUserWithId(ctx, 0, "carol", "carol", "carol", "pwd", 3)
+					if err == nil {
+						t.Errorf("registered user in replica region")
+					}
+
+					// bob follows ana, which is replicated to us after the lag
+					err = socialGraphService.Follow(ctx, 0, 2, 1)
+					if err != nil {
+						t.Fatalf("error following: %s", err.Error())
+					}
+					following, err := usSocialGraphService.IsFollowing(ctx, 0, 2, 1)
+					if err != nil {
+						t.Fatalf("error reading edge in us: %s", err.Error())
+					}
+					if following {
+						t.Errorf("follow replicated to us before the replication lag")
+					}
+					waitFor(t, "replication of follow to us", func() bool {
+						following, err := usSocialGraphService.IsFollowing(ctx, 0, 2, 1)
+						return err == nil && following
+					})
+
+					postID := compose(t, ctx, textService, mediaService, uniqueIdService, userService, 1, "ana", "hello from eu")
+					_, missing, err := postStorageService.ReadPosts(ctx, 0, []int64{postID})
+					if err != nil || len(missing) != 0 {
+						t.Errorf("got missing posts %v and error %v in eu", missing, err)
+					}
+					// the notification reaches us before the post
+					_, missing, err = usPostStorageService.ReadPosts(ctx, 0, []int64{postID})
+					if err != nil || len(missing) != 1 {
+						t.Errorf("got missing posts %v and error %v in us before the replication lag, want [%d]", missing, err, postID)
+					}
+
+					for region, homeTimelineService := range map[string]services.HomeTimelineService{"eu": homeTimelineService, "us": usHomeTimelineService} {
+						waitFor(t, "delivery to the home timeline of bob in "+region, func() bool {
+							page, err := homeTimelineService.ReadHomeTimeline(ctx, 0, 2, model.TimelineQuery{Start: 0, Stop: 10})
+							return err == nil && len(page.Posts) == 1 && page.Posts[0].PostID == postID
+						})
+					}
+				})
+			})
+		})
+	}
+}
@@ -0,0 +1,383 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	sn_metrics "socialnetwork/pkg/metrics"
+
+	"github.com/BurntSushi/toml"
+)
+
+// fault injection wraps the connections of the mongodb, redis, memcached and rabbitmq clients to the configured
+// addresses, adding latency, errors and partitions to their requests without the root access and docker
+// containers needed by the tc/netem rules of docker/mongodb-delayed
+// a request is everything written to a connection until its first response is read, e.g. a mongodb message,
+// a redis pipeline or a memcached command even if the client splits it in several writes, so that latency and
+// errors are drawn once per request (rabbitmq frames are asynchronous, so every publish not followed by a frame
+// of the broker, like a publisher confirm, belongs to the same request)
+// faults are loaded from the toml file in SN_FAULTS_CONFIG when the first client is created, or set with InjectFaults,
+// and only apply to the clients created afterwards
+
+const FAULTS_CONFIG_ENV = "SN_FAULTS_CONFIG"
+
+const (
+	LATENCY_CONSTANT    = "constant"
+	LATENCY_UNIFORM     = "uniform"
+	LATENCY_NORMAL      = "normal"
+	LATENCY_EXPONENTIAL = "exponential"
+)
+
+const (
+	FAULT_ERROR     = "error"
+	FAULT_PARTITION = "partition"
+)
+
+// dial timeout of the rabbitmq client, which has no context
+const FAULTS_RABBITMQ_DIAL_TIMEOUT time.Duration = 30 * time.Second
+
+var ErrInjectedFault = errors.New("injected fault")
+
+type FaultOptions struct {
+	// seed of the random draws of every target, so that runs with the same seed inject the same faults
+	Seed    int64         `toml:"seed"`
+	Targets []FaultTarget `toml:"targets"`
+}
+
+type FaultTarget struct {
+	// address of the datastore (host:port) as configured in the services, e.g. "localhost:27018"
+	Address string `toml:"address"`
+	// latency added to every request sent to the datastore:
+	// "constant" (latency_ms), "uniform" (latency_ms +- jitter_ms), "normal" (mean latency_ms and standard deviation jitter_ms)
+	// or "exponential" (mean latency_ms)
+	LatencyDistribution string  `toml:"latency_distribution"`
+	LatencyMs           float64 `toml:"latency_ms"`
+	JitterMs            float64 `toml:"jitter_ms"`
+	// probability of failing a request, which also closes its connection
+	ErrorRate float64 `toml:"error_rate"`
+	// periods when the datastore is unreachable
+	Partitions []FaultPartition `toml:"partitions"`
+}
+
+// FaultPartition drops the traffic with the datastore for duration_ms, starting start_ms after the faults are loaded
+// and repeated every period_ms if set
+// as with dropped packets, requests and new connections hang until the partition ends or their deadline expires
+type FaultPartition struct {
+	StartMs    int64 `toml:"start_ms"`
+	DurationMs int64 `toml:"duration_ms"`
+	PeriodMs   int64 `toml:"period_ms"`
+}
+
+// faultInjector draws the faults of a target from its own seeded source, so that the sequence of faults of every
+// target does not depend on the requests sent to the others
+// requests of concurrent connections draw from the same sequence in the order they are sent
+type faultInjector struct {
+	target FaultTarget
+	start  time.Time
+	mu     sync.Mutex
+	rand   *rand.Rand
+}
+
+var faults struct {
+	mu        sync.Mutex
+	loaded    bool
+	injectors map[string]*faultInjector
+	// error reading SN_FAULTS_CONFIG, returned to every client created afterwards
+	err error
+}
+
+// LoadFaults reads the fault options from a toml file
+func LoadFaults(path string) (FaultOptions, error) {
+	var opts FaultOptions
+	_, err := toml.DecodeFile(path, &opts)
+	if err != nil {
+		return opts, fmt.Errorf("error reading faults config %s: %s", path, err.Error())
+	}
+	return opts, opts.validate()
+}
+
+// InjectFaults replaces the faults injected in the clients created from now on
+// partitions are scheduled from the time of the call, and empty options disable the injection
+func InjectFaults(opts FaultOptions) error {
+	err := opts.validate()
+	if err != nil {
+		return err
+	}
+	faults.mu.Lock()
+	defer faults.mu.Unlock()
+	faults.injectors = newFaultInjectors(opts)
+	faults.loaded = true
+	faults.err = nil
+	return nil
+}
+
+func (opts FaultOptions) validate() error {
+	addresses := make(map[string]bool, len(opts.Targets))
+	for _, target := range opts.Targets {
+		if _, _, err := net.SplitHostPort(target.Address); err != nil {
+			return fmt.Errorf("invalid fault target address %q: %s", target.Address, err.Error())
+		}
+		if addresses[target.Address] {
+			return fmt.Errorf("duplicate fault target %s", target.Address)
+		}
+		addresses[target.Address] = true
+		switch target.LatencyDistribution {
+		case "", LATENCY_CONSTANT, LATENCY_UNIFORM, LATENCY_NORMAL, LATENCY_EXPONENTIAL:
+		default:
+			return fmt.Errorf("unknown latency distribution %q of fault target %s", target.LatencyDistribution, target.Address)
+		}
+		if target.LatencyMs < 0 || target.JitterMs < 0 {
+			return fmt.Errorf("negative latency of fault target %s", target.Address)
+		}
+		if target.ErrorRate < 0 || target.ErrorRate > 1 {
+			return fmt.Errorf("error rate of fault target %s must be between 0 and 1", target.Address)
+		}
+		for _, partition := range target.Partitions {
+			if partition.StartMs < 0 || partition.DurationMs <= 0 {
+				return fmt.Errorf("partitions of fault target %s must have a non-negative start and a positive duration", target.Address)
+			}
+			if partition.PeriodMs != 0 && partition.PeriodMs < partition.DurationMs {
+				return fmt.Errorf("partition period of fault target %s must be 0 or at least its duration", target.Address)
+			}
+		}
+	}
+	return nil
+}
+
+func newFaultInjectors(opts FaultOptions) map[string]*faultInjector {
+	start := time.Now()
+	injectors := make(map[string]*faultInjector, len(opts.Targets))
+	for _, target := range opts.Targets {
+		h := fnv.New64a()
+		h.Write([]byte(target.Address))
+		injectors[target.Address] = &faultInjector{
+			target: target,
+			start:  start,
+			rand:   rand.New(rand.NewSource(opts.Seed ^ int64(h.Sum64()))),
+		}
+	}
+	return injectors
+}
+
+// faultInjectorFor returns the injector of the datastore, or nil if it has no faults
+// the faults of SN_FAULTS_CONFIG are loaded on the first call, and an invalid config fails the creation of
+// every client (and so the initialization of the services) so that experiments do not silently run without faults
+func faultInjectorFor(address string, port int) (*faultInjector, error) {
+	faults.mu.Lock()
+	defer faults.mu.Unlock()
+	if !faults.loaded {
+		faults.loaded = true
+		if path := os.Getenv(FAULTS_CONFIG_ENV); path != "" {
+			opts, err := LoadFaults(path)
+			if err != nil {
+				faults.err = fmt.Errorf("invalid %s: %s", FAULTS_CONFIG_ENV, err.Error())
+			} else {
+				faults.injectors = newFaultInjectors(opts)
+			}
+		}
+	}
+	if faults.err != nil {
+		return nil, faults.err
+	}
+	return faults.injectors[fmt.Sprintf("%s:%d", address, port)], nil
+}
+
+// partitionEnd returns the end of the partition at the given time, or the zero time if the datastore is reachable
+func (f *faultInjector) partitionEnd(now time.Time) time.Time {
+	elapsed := now.Sub(f.start).Milliseconds()
+	for _, partition := range f.target.Partitions {
+		if elapsed < partition.StartMs {
+			continue
+		}
+		offset := elapsed - partition.StartMs
+		if partition.PeriodMs > 0 {
+			offset %= partition.PeriodMs
+		}
+		if offset < partition.DurationMs {
+			return now.Add(time.Duration(partition.DurationMs-offset) * time.Millisecond)
+		}
+	}
+	return time.Time{}
+}
+
+// request draws the latency of the next request and whether it fails
+// both are always drawn, so that the sequence does not depend on the outcome of previous requests
+func (f *faultInjector) request() (time.Duration, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var latencyMs float64
+	switch f.target.LatencyDistribution {
+	case LATENCY_UNIFORM:
+		latencyMs = f.target.LatencyMs + (2*f.rand.Float64()-1)*f.target.JitterMs
+	case LATENCY_NORMAL:
+		latencyMs = f.target.LatencyMs + f.rand.NormFloat64()*f.target.JitterMs
+	case LATENCY_EXPONENTIAL:
+		latencyMs = f.rand.ExpFloat64() * f.target.LatencyMs
+	default:
+		latencyMs = f.target.LatencyMs
+	}
+	failed := f.rand.Float64() < f.target.ErrorRate
+	return time.Duration(max(latencyMs, 0) * float64(time.Millisecond)), failed
+}
+
+// waitPartition blocks while the datastore is partitioned, and fails if the deadline expires first
+func (f *faultInjector) waitPartition(ctx context.Context, deadline time.Time) error {
+	end := f.partitionEnd(time.Now())
+	if end.IsZero() {
+		return nil
+	}
+	sn_metrics.InjectedFaults.Get(sn_metrics.FaultLabel{Addr: f.target.Address, Fault: FAULT_PARTITION}).Inc()
+	return sleepUntil(ctx, end, deadline)
+}
+
+// sleepUntil blocks until the given time, and fails with a timeout if the deadline (if any) or the context expire first
+func sleepUntil(ctx context.Context, until time.Time, deadline time.Time) error {
+	timeout := false
+	if !deadline.IsZero() && deadline.Before(until) {
+		until = deadline
+		timeout = true
+	}
+	timer := time.NewTimer(time.Until(until))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+	}
+	if timeout {
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// faultDialer dials the datastore through the injector
+// it implements the dialers of the mongodb driver (options.ContextDialer), redis and memcached
+type faultDialer struct {
+	injector *faultInjector
+	dial     func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+func (f *faultInjector) dialer(dial func(ctx context.Context, network, address string) (net.Conn, error)) *faultDialer {
+	return &faultDialer{injector: f, dial: dial}
+}
+
+func (d *faultDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	err := d.injector.waitPartition(ctx, time.Time{})
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	conn, err := d.dial(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &faultConn{Conn: conn, injector: d.injector}, nil
+}
+
+// Dial is the dialer of the rabbitmq client, which has no context
+func (d *faultDialer) Dial(network, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), FAULTS_RABBITMQ_DIAL_TIMEOUT)
+	defer cancel()
+	return d.DialContext(ctx, network, address)
+}
+
+// faultConn delays or fails the requests written to the datastore, and holds the traffic of both directions
+// while the datastore is partitioned
+// the deadlines of the clients are kept, so that delayed requests time out as they would over a slow network
+type faultConn struct {
+	net.Conn
+	injector      *faultInjector
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// a request was written since the last read, and its faults were already drawn
+	inRequest bool
+}
+
+func (c *faultConn) deadlines() (time.Time, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.readDeadline, c.writeDeadline
+}
+
+// startRequest returns true if the write starts a new request, i.e. it is the first write since the last read
+func (c *faultConn) startRequest() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	started := !c.inRequest
+	c.inRequest = true
+	return started
+}
+
+func (c *faultConn) Write(b []byte) (int, error) {
+	_, deadline := c.deadlines()
+	if c.startRequest() {
+		latency, failed := c.injector.request()
+		label := sn_metrics.FaultLabel{Addr: c.injector.target.Address}
+		if failed {
+			label.Fault = FAULT_ERROR
+			sn_metrics.InjectedFaults.Get(label).Inc()
+			c.Conn.Close()
+			return 0, &net.OpError{Op: "write", Net: c.LocalAddr().Network(), Addr: c.RemoteAddr(), Err: ErrInjectedFault}
+		}
+		if latency > 0 {
+			sn_metrics.InjectedLatencyMs.Get(sn_metrics.FaultTargetLabel{Addr: label.Addr}).Put(float64(latency.Milliseconds()))
+			err := sleepUntil(context.Background(), time.Now().Add(latency), deadline)
+			if err != nil {
+				return 0, &net.OpError{Op: "write", Net: c.LocalAddr().Network(), Addr: c.RemoteAddr(), Err: err}
+			}
+		}
+	}
+	err := c.injector.waitPartition(context.Background(), deadline)
+	if err != nil {
+		return 0, &net.OpError{Op: "write", Net: c.LocalAddr().Network(), Addr: c.RemoteAddr(), Err: err}
+	}
+	return c.Conn.Write(b)
+}
+
+// Read holds the data received during a partition until it ends
+// if the deadline expires first, the data is lost and the connection is closed
+// the next write starts a new request
+func (c *faultConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n == 0 {
+		return n, err
+	}
+	c.mu.Lock()
+	c.inRequest = false
+	c.mu.Unlock()
+	deadline, _ := c.deadlines()
+	waitErr := c.injector.waitPartition(context.Background(), deadline)
+	if waitErr != nil {
+		c.Conn.Close()
+		return 0, &net.OpError{Op: "read", Net: c.LocalAddr().Network(), Addr: c.RemoteAddr(), Err: waitErr}
+	}
+	return n, err
+}
+
+func (c *faultConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *faultConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *faultConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
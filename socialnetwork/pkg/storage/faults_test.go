@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFaultsAreReproducible(t *testing.T) {
+	target := FaultTarget{Address: "localhost:27018", LatencyDistribution: LATENCY_NORMAL, LatencyMs: 50, JitterMs: 20, ErrorRate: 0.1}
+	draws := func(seed int64, address string) ([]time.Duration, int) {
+		target := target
+		target.Address = address
+		injector := newFaultInjectors(FaultOptions{Seed: seed, Targets: []FaultTarget{target}})[address]
+		var latencies []time.Duration
+		failures := 0
+		for i := 0; i < 1000; i++ {
+			latency, failed := injector.request()
+			latencies = append(latencies, latency)
+			if failed {
+				failures++
+			}
+		}
+		return latencies, failures
+	}
+	equal := func(a, b []time.Duration) bool {
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return len(a) == len(b)
+	}
+
+	latencies, failures := draws(1, "localhost:27018")
+	again, failuresAgain := draws(1, "localhost:27018")
+	if !equal(latencies, again) || failures != failuresAgain {
+		t.Errorf("got different faults for the same seed")
+	}
+	if failures < 50 || failures > 150 {
+		t.Errorf("got %d failed requests out of 1000, want about 100", failures)
+	}
+	for _, latency := range latencies {
+		if latency < 0 {
+			t.Fatalf("got negative latency %s", latency)
+		}
+	}
+	otherSeed, _ := draws(2, "localhost:27018")
+	otherTarget, _ := draws(1, "localhost:27017")
+	if equal(latencies, otherSeed) || equal(latencies, otherTarget) {
+		t.Errorf("got the same faults for different seeds or targets")
+	}
+}
+
+func TestPartitions(t *testing.T) {
+	injector := &faultInjector{
+		target: FaultTarget{Partitions: []FaultPartition{{StartMs: 100, DurationMs: 50, PeriodMs: 1000}}},
+		start:  time.Now(),
+	}
+	ms := func(ms int64) time.Time { return injector.start.Add(time.Duration(ms) * time.Millisecond) }
+	for _, tc := range []struct {
+		elapsedMs int64
+		endMs     int64
+	}{{0, 0}, {99, 0}, {100, 150}, {149, 150}, {150, 0}, {1099, 0}, {1120, 1150}, {2149, 2150}} {
+		end := injector.partitionEnd(ms(tc.elapsedMs))
+		if (tc.endMs == 0 && !end.IsZero()) || (tc.endMs != 0 && !end.Equal(ms(tc.endMs))) {
+			t.Errorf("got partition end %v at %dms, want %dms", end.Sub(injector.start), tc.elapsedMs, tc.endMs)
+		}
+	}
+}
+
+func TestFaultConn(t *testing.T) {
+	err := InjectFaults(FaultOptions{Targets: []FaultTarget{
+		{Address: "localhost:1", ErrorRate: 1},
+		{Address: "localhost:2", Partitions: []FaultPartition{{DurationMs: 60_000}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer InjectFaults(FaultOptions{})
+	injectorFor := func(port int) *faultInjector {
+		injector, err := faultInjectorFor("localhost", port)
+		if err != nil {
+			t.Fatalf("error getting injector: %s", err.Error())
+		}
+		return injector
+	}
+	if injectorFor(3) != nil {
+		t.Errorf("got injector for address without faults")
+	}
+	pipe := func(ctx context.Context, network, address string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			buf := make([]byte, 16)
+			for {
+				n, err := server.Read(buf)
+				if err != nil {
+					return
+				}
+				server.Write(buf[:n])
+			}
+		}()
+		return client, nil
+	}
+
+	conn, err := injectorFor(1).dialer(pipe).DialContext(context.Background(), "tcp", "localhost:1")
+	if err != nil {
+		t.Fatalf("error dialing: %s", err.Error())
+	}
+	_, err = conn.Write([]byte("ping"))
+	if !errors.Is(err, ErrInjectedFault) {
+		t.Errorf("got error %v, want ErrInjectedFault", err)
+	}
+
+	// requests and dials hang until their deadline during partitions
+	partitioned := injectorFor(2).dialer(pipe)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = partitioned.DialContext(ctx, "tcp", "localhost:2")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got dial error %v during partition, want context.DeadlineExceeded", err)
+	}
+	// connected before the partition
+	client, _ := pipe(context.Background(), "tcp", "localhost:2")
+	conn = &faultConn{Conn: client, injector: partitioned.injector}
+	conn.SetDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err = conn.Write([]byte("ping"))
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("got write error %v during partition, want timeout", err)
+	}
+}
+
+func TestInvalidFaultsConfig(t *testing.T) {
+	faults.mu.Lock()
+	faults.loaded = false
+	faults.mu.Unlock()
+	defer InjectFaults(FaultOptions{})
+	t.Setenv(FAULTS_CONFIG_ENV, filepath.Join(t.TempDir(), "missing.toml"))
+	// every client fails instead of running without faults
+	for i := 0; i < 2; i++ {
+		_, err := RedisClient("localhost", 6379)
+		if err == nil {
+			t.Errorf("got no error creating a client with an invalid %s", FAULTS_CONFIG_ENV)
+		}
+	}
+}
+
+func TestFaultsAreDrawnPerRequest(t *testing.T) {
+	latency := 200 * time.Millisecond
+	injector := newFaultInjectors(FaultOptions{Targets: []FaultTarget{
+		{Address: "localhost:1", LatencyMs: float64(latency.Milliseconds())},
+	}})["localhost:1"]
+	client, server := net.Pipe()
+	defer client.Close()
+	// the server responds once it received a whole request, terminated by a newline
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			n, err := server.Read(buf)
+			if err != nil {
+				return
+			}
+			if buf[n-1] == '\n' {
+				server.Write([]byte("ok\n"))
+			}
+		}
+	}()
+	conn := &faultConn{Conn: client, injector: injector}
+	write := func(what string, data string, delayed bool) {
+		t.Helper()
+		start := time.Now()
+		_, err := conn.Write([]byte(data))
+		if err != nil {
+			t.Fatalf("error writing %s: %s", what, err.Error())
+		}
+		if elapsed := time.Since(start); (elapsed >= latency) != delayed {
+			t.Errorf("%s took %s, want delayed %t by %s", what, elapsed, delayed, latency)
+		}
+	}
+
+	write("start of the request", "get ", true)
+	write("end of the request", "key\n", false)
+	buf := make([]byte, 16)
+	_, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("error reading response: %s", err.Error())
+	}
+	write("next request", "get key\n", true)
+}
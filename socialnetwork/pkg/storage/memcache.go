@@ -2,13 +2,22 @@ package storage
 
 import (
 	"fmt"
+	"net"
 
 	"github.com/bradfitz/gomemcache/memcache"
 )
 
-func MemCachedClient(address string, port int) *memcache.Client {
+func MemCachedClient(address string, port int) (*memcache.Client, error) {
+	injector, err := faultInjectorFor(address, port)
+	if err != nil {
+		return nil, err
+	}
 	uri := fmt.Sprintf("%s:%d", address, port)
 	client := memcache.New(uri)
 	client.MaxIdleConns = 1000
-	return client
+	if injector != nil {
+		dialer := &net.Dialer{Timeout: memcache.DefaultTimeout}
+		client.DialContext = injector.dialer(dialer.DialContext).DialContext
+	}
+	return client, nil
 }
@@ -3,6 +3,8 @@ package storage
 import (
 	"context"
 	"fmt"
+	"net"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -10,8 +12,14 @@ import (
 func MongoDBClient (ctx context.Context, address string, port int) (*mongo.Client, error) {
 	uri := fmt.Sprintf("mongodb://%s:%d/?directConnection=true", address, port)
 	clientOptions := options.Client().ApplyURI(uri)
+	injector, err := faultInjectorFor(address, port)
+	if err != nil {
+		return nil, err
+	}
+	if injector != nil {
+		clientOptions.SetDialer(injector.dialer((&net.Dialer{}).DialContext))
+	}
 
-	var err error
 	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
 		return nil, fmt.Errorf("error connecting to mongodb: %s", err.Error())
@@ -22,3 +30,16 @@ func MongoDBClient (ctx context.Context, address string, port int) (*mongo.Clien
 	}
 	return client, nil
 }
+
+// IsMongoDBPrimary tells whether the client is connected to the writable primary of its replica set,
+// since clients with a direct connection to a secondary (e.g. the replica of another region) cannot write
+func IsMongoDBPrimary(ctx context.Context, client *mongo.Client) (bool, error) {
+	var hello struct {
+		IsWritablePrimary bool `bson:"isWritablePrimary"`
+	}
+	err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	if err != nil {
+		return false, fmt.Errorf("error reading mongodb replica set status: %s", err.Error())
+	}
+	return hello.IsWritablePrimary, nil
+}
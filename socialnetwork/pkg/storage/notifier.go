@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	NOTIFIER_RABBITMQ = "rabbitmq"
+	NOTIFIER_CHANNEL  = "channel"
+	NOTIFIER_REDIS    = "redis"
+)
+
+const DEFAULT_MAX_ATTEMPTS int = 5
+const DEFAULT_RETRY_BASE_DELAY time.Duration = 100 * time.Millisecond
+
+// ErrNotRetriable can be wrapped by handlers to send a notification straight to the dead-letter queue
+var ErrNotRetriable = errors.New("notification cannot be retried")
+
+// Notifier publishes notifications to a topic
+type Notifier interface {
+	Publish(ctx context.Context, topic string, body []byte) error
+	Close(ctx context.Context) error
+}
+
+// NotificationHandler processes the body of a notification
+// if it returns an error, the notification is redelivered according to the retry policy
+type NotificationHandler func(ctx context.Context, body []byte) error
+
+// Subscriber consumes notifications from a topic
+type Subscriber interface {
+	// Consume blocks and calls the handler for every notification received from the topic
+	// until the context is cancelled or the connection with the backend fails
+	Consume(ctx context.Context, topic string, handler NotificationHandler) error
+	Close(ctx context.Context) error
+}
+
+// RetryPolicy controls how failed notifications are redelivered
+type RetryPolicy struct {
+	// MaxAttempts is the total number of deliveries before a notification is dead-lettered
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry, which doubles for every following retry
+	BaseDelay time.Duration
+}
+
+func (p RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts <= 0 {
+		return DEFAULT_MAX_ATTEMPTS
+	}
+	return p.MaxAttempts
+}
+
+// Delay returns the exponential delay before the given retry (starting at 1)
+func (p RetryPolicy) Delay(retry int) time.Duration {
+	baseDelay := p.BaseDelay
+	if baseDelay <= 0 {
+		baseDelay = DEFAULT_RETRY_BASE_DELAY
+	}
+	return baseDelay << (retry - 1)
+}
+
+// ShouldRetry returns true if a notification that failed after the given number of attempts can be redelivered
+func (p RetryPolicy) ShouldRetry(attempts int, cause error) bool {
+	return attempts < p.maxAttempts() && !errors.Is(cause, ErrNotRetriable)
+}
+
+type NotificationOptions struct {
+	// Backend is one of "rabbitmq" (default), "channel" or "redis"
+	Backend string
+	// Exchange groups the topics of the notifier (e.g. the rabbitmq exchange)
+	Exchange     string
+	RabbitMQAddr string
+	RabbitMQPort int
+	RabbitMQUser string
+	RabbitMQPass string
+	// PublisherConfirms makes the rabbitmq notifier publish persistent notifications and wait for their broker ack
+	PublisherConfirms bool
+	RedisAddr         string
+	RedisPort         int
+	// RedisStreamMaxLen is the approximate number of entries kept in the redis streams (DEFAULT_REDIS_STREAM_MAX_LEN if 0)
+	RedisStreamMaxLen int64
+	// ConsumerName names the consumer of the replica in the redis consumer group (the hostname if empty)
+	ConsumerName string
+	Retry        RetryPolicy
+	// optional hooks used by callers to export metrics
+	OnRetry      func(attempts int, cause error)
+	OnDeadLetter func(attempts int, cause error)
+	// called when consuming fails and is resumed after a delay
+	OnConsumeError func(err error)
+}
+
+func (o NotificationOptions) onRetry(attempts int, cause error) {
+	if o.OnRetry != nil {
+		o.OnRetry(attempts, cause)
+	}
+}
+
+func (o NotificationOptions) onDeadLetter(attempts int, cause error) {
+	if o.OnDeadLetter != nil {
+		o.OnDeadLetter(attempts, cause)
+	}
+}
+
+func (o NotificationOptions) onConsumeError(err error) {
+	if o.OnConsumeError != nil {
+		o.OnConsumeError(err)
+	}
+}
+
+// NewNotifier returns a notifier for the backend selected in the options
+func NewNotifier(ctx context.Context, opts NotificationOptions) (Notifier, error) {
+	switch opts.Backend {
+	case NOTIFIER_RABBITMQ, "":
+		return newRabbitMQNotifier(ctx, opts)
+	case NOTIFIER_CHANNEL:
+		return newChannelNotifier(opts), nil
+	case NOTIFIER_REDIS:
+		return newRedisNotifier(opts)
+	}
+	return nil, fmt.Errorf("unknown notifier backend: %s", opts.Backend)
+}
+
+// NewSubscriber returns a subscriber for the backend selected in the options
+func NewSubscriber(ctx context.Context, opts NotificationOptions) (Subscriber, error) {
+	switch opts.Backend {
+	case NOTIFIER_RABBITMQ, "":
+		return newRabbitMQSubscriber(ctx, opts)
+	case NOTIFIER_CHANNEL:
+		return newChannelSubscriber(opts), nil
+	case NOTIFIER_REDIS:
+		return newRedisSubscriber(opts)
+	}
+	return nil, fmt.Errorf("unknown subscriber backend: %s", opts.Backend)
+}
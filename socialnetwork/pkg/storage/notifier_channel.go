@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const CHANNEL_BUFFER_SIZE int = 10000
+
+// the in-process channel backend only delivers notifications between components
+// running in the same process (e.g. weaver single deployments and tests)
+var channelTopics = struct {
+	mu          sync.Mutex
+	queues      map[string]chan channelDelivery
+	deadLetters map[string][][]byte
+}{
+	queues:      make(map[string]chan channelDelivery),
+	deadLetters: make(map[string][][]byte),
+}
+
+type channelDelivery struct {
+	body     []byte
+	attempts int
+}
+
+func channelQueue(exchange string, topic string) chan channelDelivery {
+	key := exchange + "/" + topic
+	channelTopics.mu.Lock()
+	defer channelTopics.mu.Unlock()
+	queue, ok := channelTopics.queues[key]
+	if !ok {
+		queue = make(chan channelDelivery, CHANNEL_BUFFER_SIZE)
+		channelTopics.queues[key] = queue
+	}
+	return queue
+}
+
+// ChannelDeadLetters returns the notifications dead-lettered in a topic of the in-process channel backend
+func ChannelDeadLetters(exchange string, topic string) [][]byte {
+	channelTopics.mu.Lock()
+	defer channelTopics.mu.Unlock()
+	return append([][]byte{}, channelTopics.deadLetters[exchange+"/"+topic]...)
+}
+
+type channelNotifier struct {
+	opts NotificationOptions
+}
+
+type channelSubscriber struct {
+	opts NotificationOptions
+	// closed by Close, to stop the pending retries
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newChannelNotifier(opts NotificationOptions) *channelNotifier {
+	return &channelNotifier{opts: opts}
+}
+
+func newChannelSubscriber(opts NotificationOptions) *channelSubscriber {
+	return &channelSubscriber{opts: opts, done: make(chan struct{})}
+}
+
+func (n *channelNotifier) Publish(ctx context.Context, topic string, body []byte) error {
+	select {
+	case channelQueue(n.opts.Exchange, topic) <- channelDelivery{body: body}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (n *channelNotifier) Close(ctx context.Context) error {
+	return nil
+}
+
+func (s *channelSubscriber) deadLetter(topic string, delivery channelDelivery, cause error) {
+	channelTopics.mu.Lock()
+	key := s.opts.Exchange + "/" + topic
+	channelTopics.deadLetters[key] = append(channelTopics.deadLetters[key], delivery.body)
+	channelTopics.mu.Unlock()
+	s.opts.onDeadLetter(delivery.attempts, cause)
+}
+
+// onFailedDelivery requeues the delivery after its retry delay, or dead-letters it
+// retries that cannot be requeued (the queue is full) once the consumer stopped or the subscriber was closed
+// are dead-lettered too, instead of waiting forever for a consumer
+func (s *channelSubscriber) onFailedDelivery(ctx context.Context, queue chan channelDelivery, topic string, delivery channelDelivery, cause error) {
+	delivery.attempts++
+	if !s.opts.Retry.ShouldRetry(delivery.attempts, cause) {
+		s.deadLetter(topic, delivery, cause)
+		return
+	}
+	s.opts.onRetry(delivery.attempts, cause)
+	time.AfterFunc(s.opts.Retry.Delay(delivery.attempts), func() {
+		select {
+		case queue <- delivery:
+			return
+		default:
+		}
+		select {
+		case queue <- delivery:
+		case <-ctx.Done():
+			s.deadLetter(topic, delivery, cause)
+		case <-s.done:
+			s.deadLetter(topic, delivery, cause)
+		}
+	})
+}
+
+func (s *channelSubscriber) Consume(ctx context.Context, topic string, handler NotificationHandler) error {
+	queue := channelQueue(s.opts.Exchange, topic)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case delivery := <-queue:
+			err := handler(ctx, delivery.body)
+			if err != nil {
+				s.onFailedDelivery(ctx, queue, topic, delivery, err)
+			}
+		}
+	}
+}
+
+func (s *channelSubscriber) Close(ctx context.Context) error {
+	s.closeOnce.Do(func() { close(s.done) })
+	return nil
+}
@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// channelTests makes the exchange of each test run unique, since the channel queues are global
+var channelTests atomic.Int64
+
+func TestChannelRetryOfStoppedConsumerIsDeadLettered(t *testing.T) {
+	exchange := fmt.Sprintf("%s/%d", t.Name(), channelTests.Add(1))
+	opts := NotificationOptions{Backend: NOTIFIER_CHANNEL, Exchange: exchange, Retry: RetryPolicy{BaseDelay: 200 * time.Millisecond}}
+	notifier := newChannelNotifier(opts)
+	subscriber := newChannelSubscriber(opts)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := notifier.Publish(ctx, "topic", []byte("failed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	consumed := make(chan error, 1)
+	go func() {
+		consumed <- subscriber.Consume(ctx, "topic", func(ctx context.Context, body []byte) error {
+			cancel()
+			return errors.New("failed")
+		})
+	}()
+	select {
+	case <-consumed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer not stopped")
+	}
+	// the retry finds the queue full and its consumer stopped
+	for i := 0; i < CHANNEL_BUFFER_SIZE; i++ {
+		err := notifier.Publish(context.Background(), "topic", []byte("pending"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ChannelDeadLetters(exchange, "topic")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("retry of stopped consumer not dead-lettered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	deadLetters := ChannelDeadLetters(exchange, "topic")
+	if len(deadLetters) != 1 || string(deadLetters[0]) != "failed" {
+		t.Errorf("got dead letters %q, want [failed]", deadLetters)
+	}
+}
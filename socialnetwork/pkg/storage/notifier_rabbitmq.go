@@ -0,0 +1,272 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const AMQP_PREFETCH_COUNT int = 16
+const AMQP_POOL_MAX_SIZE int = 500
+
+// header used to track how many times a notification was delivered
+const AMQP_ATTEMPTS_HEADER string = "x-attempts"
+
+var errDeliveriesClosed = errors.New("rabbitmq deliveries channel closed")
+
+type rabbitMQNotifier struct {
+	pool *RabbitMQClientPool
+	opts NotificationOptions
+}
+
+type rabbitMQSubscriber struct {
+	pool *RabbitMQClientPool
+	opts NotificationOptions
+}
+
+func rabbitMQPoolOptions(opts NotificationOptions) RabbitMQPoolOptions {
+	return RabbitMQPoolOptions{
+		Username:          opts.RabbitMQUser,
+		Password:          opts.RabbitMQPass,
+		MinSize:           0,
+		MaxSize:           AMQP_POOL_MAX_SIZE,
+		PublisherConfirms: opts.PublisherConfirms,
+	}
+}
+
+func newRabbitMQNotifier(ctx context.Context, opts NotificationOptions) (*rabbitMQNotifier, error) {
+	pool, err := NewRabbitMQClientPool(ctx, opts.RabbitMQAddr, opts.RabbitMQPort, rabbitMQPoolOptions(opts))
+	if err != nil {
+		return nil, err
+	}
+	return &rabbitMQNotifier{pool: pool, opts: opts}, nil
+}
+
+func newRabbitMQSubscriber(ctx context.Context, opts NotificationOptions) (*rabbitMQSubscriber, error) {
+	pool, err := NewRabbitMQClientPool(ctx, opts.RabbitMQAddr, opts.RabbitMQPort, rabbitMQPoolOptions(opts))
+	if err != nil {
+		return nil, err
+	}
+	return &rabbitMQSubscriber{pool: pool, opts: opts}, nil
+}
+
+func (n *rabbitMQNotifier) Publish(ctx context.Context, topic string, body []byte) error {
+	ch, err := n.pool.Pop(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting rabbitmq client from pool: %s", err.Error())
+	}
+	defer n.pool.Push(ch)
+
+	err = ch.ExchangeDeclare(n.opts.Exchange, "topic", true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("error declaring exchange for rabbitmq: %s", err.Error())
+	}
+	msg := amqp.Publishing{
+		ContentType: "application/json",
+		Body:        body,
+	}
+	return n.pool.Publish(ctx, ch, n.opts.Exchange, topic, msg)
+}
+
+func (n *rabbitMQNotifier) Close(ctx context.Context) error {
+	return n.pool.DestroyRabbitMQClientPool(ctx)
+}
+
+func (s *rabbitMQSubscriber) retryExchange() string {
+	return s.opts.Exchange + "-retry"
+}
+
+func (s *rabbitMQSubscriber) deadLetterExchange() string {
+	return s.opts.Exchange + "-dlx"
+}
+
+// retry queues are named after their delay (the x-message-ttl of the queue), so that changing the retry policy
+// declares new queues instead of failing to redeclare the existing ones with another ttl
+func retryQueueName(topic string, retry int, delay time.Duration) string {
+	return fmt.Sprintf("%s-retry-%d-%dms", topic, retry, delay.Milliseconds())
+}
+
+func deadLetterQueueName(topic string) string {
+	return fmt.Sprintf("%s-dlq", topic)
+}
+
+// declareTopology declares the exchange and queue of the topic together with one delayed queue
+// per retry (which dead-letters back to the exchange once the message expires) and the
+// dead-letter queue for notifications that exhausted all attempts
+// the exchanges and queues are durable, so that the persistent notifications confirmed by the broker survive its restarts
+func (s *rabbitMQSubscriber) declareTopology(ch *amqp.Channel, topic string) error {
+	err := ch.ExchangeDeclare(s.opts.Exchange, "topic", true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("error declaring exchange: %s", err.Error())
+	}
+	err = ch.ExchangeDeclare(s.retryExchange(), "direct", true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("error declaring retry exchange: %s", err.Error())
+	}
+	err = ch.ExchangeDeclare(s.deadLetterExchange(), "direct", true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("error declaring dead-letter exchange: %s", err.Error())
+	}
+
+	_, err = ch.QueueDeclare(topic, true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("error declaring queue: %s", err.Error())
+	}
+	err = ch.QueueBind(topic, topic, s.opts.Exchange, false, nil)
+	if err != nil {
+		return fmt.Errorf("error binding queue: %s", err.Error())
+	}
+
+	for retry := 1; retry < s.opts.Retry.maxAttempts(); retry++ {
+		queue := retryQueueName(topic, retry, s.opts.Retry.Delay(retry))
+		args := amqp.Table{
+			"x-message-ttl":             s.opts.Retry.Delay(retry).Milliseconds(),
+			"x-dead-letter-exchange":    s.opts.Exchange,
+			"x-dead-letter-routing-key": topic,
+		}
+		_, err = ch.QueueDeclare(queue, true, false, false, false, args)
+		if err != nil {
+			return fmt.Errorf("error declaring retry queue %s: %s", queue, err.Error())
+		}
+		err = ch.QueueBind(queue, queue, s.retryExchange(), false, nil)
+		if err != nil {
+			return fmt.Errorf("error binding retry queue %s: %s", queue, err.Error())
+		}
+	}
+
+	dlq := deadLetterQueueName(topic)
+	_, err = ch.QueueDeclare(dlq, true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("error declaring dead-letter queue: %s", err.Error())
+	}
+	err = ch.QueueBind(dlq, topic, s.deadLetterExchange(), false, nil)
+	if err != nil {
+		return fmt.Errorf("error binding dead-letter queue: %s", err.Error())
+	}
+	return nil
+}
+
+// deliveryAttempts returns the number of times the notification was already processed
+func deliveryAttempts(delivery amqp.Delivery) int {
+	switch attempts := delivery.Headers[AMQP_ATTEMPTS_HEADER].(type) {
+	case int32:
+		return int(attempts)
+	case int64:
+		return int(attempts)
+	case int:
+		return attempts
+	}
+	return 0
+}
+
+// onFailedDelivery publishes the notification to the next delayed retry queue or,
+// if it cannot be retried anymore, to the dead-letter queue of the topic
+func (s *rabbitMQSubscriber) onFailedDelivery(ctx context.Context, ch *amqp.Channel, topic string, delivery amqp.Delivery, cause error) error {
+	attempts := deliveryAttempts(delivery) + 1
+	publishing := amqp.Publishing{
+		ContentType: delivery.ContentType,
+		Headers: amqp.Table{
+			AMQP_ATTEMPTS_HEADER: int32(attempts),
+			"x-last-error":       cause.Error(),
+		},
+		Body: delivery.Body,
+	}
+
+	var err error
+	if s.opts.Retry.ShouldRetry(attempts, cause) {
+		err = s.pool.Publish(ctx, ch, s.retryExchange(), retryQueueName(topic, attempts, s.opts.Retry.Delay(attempts)), publishing)
+		if err == nil {
+			s.opts.onRetry(attempts, cause)
+		}
+	} else {
+		err = s.pool.Publish(ctx, ch, s.deadLetterExchange(), topic, publishing)
+		if err == nil {
+			s.opts.onDeadLetter(attempts, cause)
+		}
+	}
+	if err != nil {
+		// keep the original message in the queue so that it is not lost
+		return delivery.Nack(false, true)
+	}
+	return delivery.Ack(false)
+}
+
+// Consume keeps consuming the topic until the context is cancelled
+// if the channel or the connection fails (e.g. closed by the broker, or dropped while declaring the topology),
+// it resumes on a new channel of the pool with exponential backoff
+func (s *rabbitMQSubscriber) Consume(ctx context.Context, topic string, handler NotificationHandler) error {
+	delay := RABBITMQ_RECONNECT_BASE_DELAY
+	for {
+		consumed, err := s.consume(ctx, topic, handler)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		s.opts.onConsumeError(err)
+		// reset the backoff if the previous channel was healthy for a while
+		if consumed {
+			delay = RABBITMQ_RECONNECT_BASE_DELAY
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, RABBITMQ_RECONNECT_MAX_DELAY)
+	}
+}
+
+// consume returns true if at least one notification was consumed before returning
+func (s *rabbitMQSubscriber) consume(ctx context.Context, topic string, handler NotificationHandler) (bool, error) {
+	ch, err := s.pool.Pop(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error getting rabbitmq client from pool: %s", err.Error())
+	}
+	defer s.pool.Push(ch)
+
+	err = s.declareTopology(ch, topic)
+	if err != nil {
+		return false, err
+	}
+	err = ch.Qos(AMQP_PREFETCH_COUNT, 0, false)
+	if err != nil {
+		return false, fmt.Errorf("error setting prefetch count: %s", err.Error())
+	}
+	// messages are acked manually so that failed notifications are redelivered
+	deliveries, err := ch.Consume(topic, "", false, false, false, false, nil)
+	if err != nil {
+		return false, fmt.Errorf("error consuming queue: %s", err.Error())
+	}
+
+	consumed := false
+	for {
+		select {
+		case <-ctx.Done():
+			return consumed, ctx.Err()
+		case delivery, ok := <-deliveries:
+			if !ok {
+				return consumed, errDeliveriesClosed
+			}
+			consumed = true
+			err := handler(ctx, delivery.Body)
+			if err == nil {
+				err = delivery.Ack(false)
+			} else {
+				err = s.onFailedDelivery(ctx, ch, topic, delivery, err)
+			}
+			if err != nil {
+				if ch.IsClosed() {
+					// unacked notifications are redelivered by the broker
+					return consumed, errDeliveriesClosed
+				}
+				return consumed, fmt.Errorf("error acknowledging message: %s", err.Error())
+			}
+		}
+	}
+}
+
+func (s *rabbitMQSubscriber) Close(ctx context.Context) error {
+	return s.pool.DestroyRabbitMQClientPool(ctx)
+}
@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const REDIS_STREAM_READ_COUNT int64 = 16
+const REDIS_STREAM_BLOCK time.Duration = time.Second
+
+// entries pending for longer than REDIS_STREAM_CLAIM_MIN_IDLE (e.g. of a consumer that crashed before acking them)
+// are claimed by the other consumers at startup and every REDIS_STREAM_CLAIM_INTERVAL
+const REDIS_STREAM_CLAIM_MIN_IDLE time.Duration = 30 * time.Second
+const REDIS_STREAM_CLAIM_INTERVAL time.Duration = 10 * time.Second
+
+// streams are trimmed to approximately DEFAULT_REDIS_STREAM_MAX_LEN entries on every XADD
+const DEFAULT_REDIS_STREAM_MAX_LEN int64 = 100000
+
+// redisStreamEntry is used to park failed notifications in the retry sorted set until they are due
+type redisStreamEntry struct {
+	ID       string `json:"id"`
+	Body     []byte `json:"body"`
+	Attempts int    `json:"attempts"`
+}
+
+type redisNotifier struct {
+	client *redis.Client
+	opts   NotificationOptions
+}
+
+type redisSubscriber struct {
+	client *redis.Client
+	opts   NotificationOptions
+}
+
+func newRedisNotifier(opts NotificationOptions) (*redisNotifier, error) {
+	client, err := RedisClient(opts.RedisAddr, opts.RedisPort)
+	if err != nil {
+		return nil, err
+	}
+	return &redisNotifier{client: client, opts: opts}, nil
+}
+
+func newRedisSubscriber(opts NotificationOptions) (*redisSubscriber, error) {
+	client, err := RedisClient(opts.RedisAddr, opts.RedisPort)
+	if err != nil {
+		return nil, err
+	}
+	return &redisSubscriber{client: client, opts: opts}, nil
+}
+
+func redisStreamName(exchange string, topic string) string {
+	return exchange + ":" + topic
+}
+
+func redisStreamMaxLen(opts NotificationOptions) int64 {
+	if opts.RedisStreamMaxLen <= 0 {
+		return DEFAULT_REDIS_STREAM_MAX_LEN
+	}
+	return opts.RedisStreamMaxLen
+}
+
+// redisConsumerName returns the name of the consumer in the consumer group, which must be stable across restarts
+// so that the group does not keep a consumer for every restart of a replica
+func redisConsumerName(opts NotificationOptions) string {
+	if opts.ConsumerName != "" {
+		return opts.ConsumerName
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "consumer"
+	}
+	return hostname
+}
+
+func addToStream(ctx context.Context, client *redis.Client, opts NotificationOptions, stream string, body []byte, attempts int) error {
+	return client.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: redisStreamMaxLen(opts),
+		Approx: true,
+		Values: map[string]interface{}{"body": body, "attempts": attempts},
+	}).Err()
+}
+
+func (n *redisNotifier) Publish(ctx context.Context, topic string, body []byte) error {
+	return addToStream(ctx, n.client, n.opts, redisStreamName(n.opts.Exchange, topic), body, 0)
+}
+
+func (n *redisNotifier) Close(ctx context.Context) error {
+	return n.client.Close()
+}
+
+// promoteDueRetries moves the failed notifications whose delay has expired back to the stream
+// ZRem guarantees that only one of the concurrent consumers re-adds each entry
+func (s *redisSubscriber) promoteDueRetries(ctx context.Context, stream string) error {
+	retryKey := stream + ":retry"
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	members, err := s.client.ZRangeByScore(ctx, retryKey, &redis.ZRangeBy{Min: "-inf", Max: now}).Result()
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		removed, err := s.client.ZRem(ctx, retryKey, member).Result()
+		if err != nil {
+			return err
+		}
+		if removed == 0 {
+			continue
+		}
+		var entry redisStreamEntry
+		err = json.Unmarshal([]byte(member), &entry)
+		if err != nil {
+			return err
+		}
+		err = addToStream(ctx, s.client, s.opts, stream, entry.Body, entry.Attempts)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *redisSubscriber) onFailedDelivery(ctx context.Context, stream string, message redis.XMessage, body []byte, attempts int, cause error) error {
+	attempts++
+	if s.opts.Retry.ShouldRetry(attempts, cause) {
+		member, err := json.Marshal(redisStreamEntry{ID: message.ID, Body: body, Attempts: attempts})
+		if err != nil {
+			return err
+		}
+		due := time.Now().Add(s.opts.Retry.Delay(attempts)).UnixMilli()
+		err = s.client.ZAdd(ctx, stream+":retry", redis.Z{Score: float64(due), Member: member}).Err()
+		if err != nil {
+			return err
+		}
+		s.opts.onRetry(attempts, cause)
+	} else {
+		err := addToStream(ctx, s.client, s.opts, stream+":dlq", body, attempts)
+		if err != nil {
+			return err
+		}
+		s.opts.onDeadLetter(attempts, cause)
+	}
+	return s.client.XAck(ctx, stream, stream, message.ID).Err()
+}
+
+// deliver calls the handler for a message of the stream and acks it, or schedules its retry if the handler fails
+func (s *redisSubscriber) deliver(ctx context.Context, stream string, message redis.XMessage, handler NotificationHandler) error {
+	body, _ := message.Values["body"].(string)
+	attempts := 0
+	if attemptsStr, ok := message.Values["attempts"].(string); ok {
+		attempts, _ = strconv.Atoi(attemptsStr)
+	}
+	err := handler(ctx, []byte(body))
+	if err == nil {
+		err = s.client.XAck(ctx, stream, stream, message.ID).Err()
+	} else {
+		err = s.onFailedDelivery(ctx, stream, message, []byte(body), attempts, err)
+	}
+	if err != nil {
+		return fmt.Errorf("error acknowledging redis stream message: %s", err.Error())
+	}
+	return nil
+}
+
+// claimIdleEntries delivers the entries that other consumers (or a previous run of this one) read
+// but did not ack for REDIS_STREAM_CLAIM_MIN_IDLE
+// entries trimmed from the stream while pending are only acked
+func (s *redisSubscriber) claimIdleEntries(ctx context.Context, stream string, consumer string, handler NotificationHandler) error {
+	start := "0-0"
+	for {
+		messages, next, err := s.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   stream,
+			Group:    stream,
+			Consumer: consumer,
+			MinIdle:  REDIS_STREAM_CLAIM_MIN_IDLE,
+			Start:    start,
+			Count:    REDIS_STREAM_READ_COUNT,
+		}).Result()
+		if err != nil {
+			return fmt.Errorf("error claiming idle entries of redis stream: %s", err.Error())
+		}
+		for _, message := range messages {
+			if message.Values == nil {
+				err = s.client.XAck(ctx, stream, stream, message.ID).Err()
+				if err != nil {
+					return fmt.Errorf("error acknowledging redis stream message: %s", err.Error())
+				}
+				continue
+			}
+			err = s.deliver(ctx, stream, message, handler)
+			if err != nil {
+				return err
+			}
+		}
+		if next == "0-0" {
+			return nil
+		}
+		start = next
+	}
+}
+
+func (s *redisSubscriber) Consume(ctx context.Context, topic string, handler NotificationHandler) error {
+	stream := redisStreamName(s.opts.Exchange, topic)
+	// all consumers of a topic share the same consumer group
+	err := s.client.XGroupCreateMkStream(ctx, stream, stream, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("error creating redis consumer group: %s", err.Error())
+	}
+	consumer := redisConsumerName(s.opts)
+
+	// the first iteration claims the entries left pending by consumers that stopped
+	var lastClaim time.Time
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if time.Since(lastClaim) >= REDIS_STREAM_CLAIM_INTERVAL {
+			err := s.claimIdleEntries(ctx, stream, consumer, handler)
+			if err != nil {
+				return err
+			}
+			lastClaim = time.Now()
+		}
+		err := s.promoteDueRetries(ctx, stream)
+		if err != nil {
+			return fmt.Errorf("error promoting retries of redis stream: %s", err.Error())
+		}
+		streams, err := s.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    stream,
+			Consumer: consumer,
+			Streams:  []string{stream, ">"},
+			Count:    REDIS_STREAM_READ_COUNT,
+			Block:    REDIS_STREAM_BLOCK,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error reading redis stream: %s", err.Error())
+		}
+		for _, result := range streams {
+			for _, message := range result.Messages {
+				err := s.deliver(ctx, stream, message, handler)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func (s *redisSubscriber) Close(ctx context.Context) error {
+	return s.client.Close()
+}
@@ -3,99 +3,312 @@ package storage
 import (
 	"context"
 	"fmt"
+	"net"
 	"sync"
+	"time"
+
+	sn_metrics "socialnetwork/pkg/metrics"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+const RABBITMQ_RECONNECT_BASE_DELAY time.Duration = 100 * time.Millisecond
+const RABBITMQ_RECONNECT_MAX_DELAY time.Duration = 10 * time.Second
+
+type RabbitMQPoolOptions struct {
+	Username string
+	Password string
+	MinSize  int
+	MaxSize  int
+	// PublisherConfirms puts every channel in confirm mode so that Publish sends persistent messages and waits for the broker ack
+	PublisherConfirms bool
+}
+
 type RabbitMQClientPool struct {
+	// idle channels
 	clients 	chan *amqp.Channel
 	conn 		*amqp.Connection
+	uri 		string
 	address 	string
 	port 		int
-	minSize 	int
-	maxSize 	int
+	opts 		RabbitMQPoolOptions
+	// number of open channels (idle and in use)
 	currSize 	int
+	closed 		bool
+	// closed when the pool is destroyed, to interrupt reconnections
+	done 		chan struct{}
+	// closed when the reconnection in progress (if any) ends, so that a single caller dials at a time
+	reconnecting chan struct{}
 	mu          sync.Mutex
+	label 		sn_metrics.RabbitMQPoolLabel
+	// nil if no faults are injected in the connections with rabbitmq
+	faults 		*faultInjector
 }
 
-func NewRabbitMQClientPool (ctx context.Context, address string, port int, minSize int, maxSize int) (*RabbitMQClientPool, error) {
-	uri := fmt.Sprintf("amqp://%s:%s@%s:%d/", "admin", "admin", address, port)
-	conn, err := amqp.Dial(uri)
+func NewRabbitMQClientPool (ctx context.Context, address string, port int, opts RabbitMQPoolOptions) (*RabbitMQClientPool, error) {
+	uri := amqp.URI{
+		Scheme:   "amqp",
+		Host:     address,
+		Port:     port,
+		Username: opts.Username,
+		Password: opts.Password,
+		Vhost:    "/",
+	}
+	injector, err := faultInjectorFor(address, port)
 	if err != nil {
-		return nil, fmt.Errorf("error establishing connection with rabbitmq: %s", err.Error())
+		return nil, err
 	}
-
 	pool := &RabbitMQClientPool{
-		clients: 	make(chan *amqp.Channel),
-		conn:       conn,
+		clients: 	make(chan *amqp.Channel, opts.MaxSize),
+		uri:        uri.String(),
 		address:    address,
 		port:		port,
-		minSize: 	minSize,
-		maxSize: 	maxSize,
+		opts: 		opts,
 		currSize:   0,
+		done: 		make(chan struct{}),
+		label: 		sn_metrics.RabbitMQPoolLabel{Addr: fmt.Sprintf("%s:%d", address, port)},
+		faults: 	injector,
+	}
+	_, err = pool.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < opts.MinSize; i++ {
+		ch, err := pool.newClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		pool.mu.Lock()
+		pool.setSize(1)
+		pool.mu.Unlock()
+		pool.Push(ch)
 	}
 	return pool, nil
 }
 
 func (pool *RabbitMQClientPool) DestroyRabbitMQClientPool(ctx context.Context) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if !pool.closed {
+		close(pool.done)
+	}
+	pool.closed = true
+	if pool.conn == nil || pool.conn.IsClosed() {
+		return nil
+	}
 	return pool.conn.Close()
 }
 
+// connection returns the current connection with rabbitmq
+// if the connection was dropped, a single caller reconnects with exponential backoff (without holding the pool's lock)
+// while the others wait for it, until their context is cancelled or the pool is destroyed
+func (pool *RabbitMQClientPool) connection(ctx context.Context) (*amqp.Connection, error) {
+	pool.mu.Lock()
+	for {
+		if pool.closed {
+			pool.mu.Unlock()
+			return nil, fmt.Errorf("rabbitmq client pool is closed")
+		}
+		if pool.conn != nil && !pool.conn.IsClosed() {
+			conn := pool.conn
+			pool.mu.Unlock()
+			return conn, nil
+		}
+		if pool.reconnecting == nil {
+			break
+		}
+		reconnecting := pool.reconnecting
+		pool.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("error establishing connection with rabbitmq: %s", ctx.Err().Error())
+		case <-reconnecting:
+		}
+		pool.mu.Lock()
+	}
+	reconnecting := make(chan struct{})
+	pool.reconnecting = reconnecting
+	reconnect := pool.conn != nil
+	pool.mu.Unlock()
+
+	conn, err := pool.dialWithBackoff(ctx)
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.reconnecting = nil
+	close(reconnecting)
+	if err != nil {
+		return nil, err
+	}
+	if pool.closed {
+		conn.Close()
+		return nil, fmt.Errorf("rabbitmq client pool is closed")
+	}
+	if reconnect {
+		sn_metrics.RabbitMQReconnections.Get(pool.label).Inc()
+	}
+	pool.conn = conn
+	return conn, nil
+}
+
+// dialWithBackoff dials rabbitmq with exponential backoff until the context is cancelled or the pool is destroyed
+func (pool *RabbitMQClientPool) dialWithBackoff(ctx context.Context) (*amqp.Connection, error) {
+	delay := RABBITMQ_RECONNECT_BASE_DELAY
+	for {
+		conn, err := pool.dial()
+		if err == nil {
+			return conn, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("error establishing connection with rabbitmq: %s", err.Error())
+		case <-pool.done:
+			return nil, fmt.Errorf("rabbitmq client pool is closed")
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, RABBITMQ_RECONNECT_MAX_DELAY)
+	}
+}
+
+// dial connects to rabbitmq with the defaults of amqp.Dial, through the fault injection if enabled
+func (pool *RabbitMQClientPool) dial() (*amqp.Connection, error) {
+	if pool.faults == nil {
+		return amqp.Dial(pool.uri)
+	}
+	dial := amqp.DefaultDial(FAULTS_RABBITMQ_DIAL_TIMEOUT)
+	dialer := pool.faults.dialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		return dial(network, address)
+	})
+	return amqp.DialConfig(pool.uri, amqp.Config{Heartbeat: 10 * time.Second, Locale: "en_US", Dial: dialer.Dial})
+}
+
+func (pool *RabbitMQClientPool) setSize(delta int) {
+	pool.currSize += delta
+	sn_metrics.RabbitMQPoolSize.Get(pool.label).Set(float64(pool.currSize))
+}
+
 func (pool *RabbitMQClientPool) Pop(ctx context.Context) (*amqp.Channel, error) {
-	// wait until we can pop a client from pool unless the context is cancelled
-    select {
+	popStart := time.Now()
+	defer func() {
+		sn_metrics.RabbitMQPoolWaitDurationMs.Get(pool.label).Put(float64(time.Since(popStart).Milliseconds()))
+	}()
+
+	for {
+		// wait until we can pop a client from pool unless the context is cancelled
+		select {
 		case client := <-pool.clients:
+			if pool.discardIfClosed(client) {
+				continue
+			}
 			return client, nil
 		case <-ctx.Done():
 			return nil, fmt.Errorf("timeout occurred while waiting to pop client from pool")
 		// otherwise, we continue ahead
 		default:
-    }
-	// create a new client if current pool size is less than max pool size
-	pool.mu.Lock()
-	if (pool.currSize < pool.maxSize) {
-		client, err := pool.newClient(ctx)
-		if err != nil {
+		}
+		// create a new client if current pool size is less than max pool size
+		pool.mu.Lock()
+		if (pool.currSize < pool.opts.MaxSize) {
+			// the slot is reserved so that the client can be created without holding the lock
+			pool.setSize(1)
 			pool.mu.Unlock()
-			return nil, fmt.Errorf("error while creating new client: %s", err.Error())
+			client, err := pool.newClient(ctx)
+			if err != nil {
+				pool.mu.Lock()
+				pool.setSize(-1)
+				pool.mu.Unlock()
+				return nil, fmt.Errorf("error while creating new client: %s", err.Error())
+			}
+			return client, nil
 		}
 		pool.mu.Unlock()
-		return client, nil
-	}
-	pool.mu.Unlock()
 
-	// if pool is full, we wait until a client becomes available to pop unless the context is cancelled
-	select {
-	case <-ctx.Done():
-		return nil, fmt.Errorf("timeout occurred while waiting to pop client from pool")
-	case client := <- pool.clients:
-		pool.mu.Lock()
-		pool.currSize--
-		pool.mu.Unlock()
-		return client, nil
+		// if pool is full, we wait until a client becomes available to pop unless the context is cancelled
+		// or the pool is destroyed
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timeout occurred while waiting to pop client from pool")
+		case <-pool.done:
+			return nil, fmt.Errorf("rabbitmq client pool is closed")
+		case client := <- pool.clients:
+			if pool.discardIfClosed(client) {
+				continue
+			}
+			return client, nil
+		}
 	}
+}
 
+// discardIfClosed removes channels closed by the broker (e.g. after an error or a dropped connection) from the pool
+func (pool *RabbitMQClientPool) discardIfClosed(ch *amqp.Channel) bool {
+	if !ch.IsClosed() {
+		return false
+	}
+	pool.mu.Lock()
+	pool.setSize(-1)
+	pool.mu.Unlock()
+	return true
 }
 
 func (pool *RabbitMQClientPool) Push(ch *amqp.Channel) error {
+	if ch == nil {
+		return nil
+	}
+	if pool.discardIfClosed(ch) {
+		return nil
+	}
     select {
 		case pool.clients <- ch:
-			pool.mu.Lock()
-			pool.currSize++
-			pool.mu.Unlock()
 		// if some unexpected error occurs, close connection
 		default:
+			pool.mu.Lock()
+			pool.setSize(-1)
+			pool.mu.Unlock()
 			ch.Close()
 			return fmt.Errorf("could not push connection to queue")
 		}
 	return nil
 }
 
+// newClient opens a channel in the current connection, must be called without the pool's lock held
+// the caller accounts for the channel in the pool size
 func (pool *RabbitMQClientPool) newClient (ctx context.Context) (*amqp.Channel, error) {
-	ch, err := pool.conn.Channel()
+	conn, err := pool.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
 	if err != nil {
 		return nil, fmt.Errorf("error openning channel for rabbitmq: %s", err.Error())
 	}
+	if pool.opts.PublisherConfirms {
+		err = ch.Confirm(false)
+		if err != nil {
+			ch.Close()
+			return nil, fmt.Errorf("error enabling confirm mode for rabbitmq channel: %s", err.Error())
+		}
+	}
 	return ch, nil
 }
+
+// Publish publishes a message in a channel of the pool
+// in publisher confirm mode, the message is persistent and it only returns after the broker acks (or nacks) it,
+// i.e. once it is written to disk if it is routed to durable queues
+func (pool *RabbitMQClientPool) Publish(ctx context.Context, ch *amqp.Channel, exchange string, key string, msg amqp.Publishing) error {
+	if !pool.opts.PublisherConfirms {
+		return ch.PublishWithContext(ctx, exchange, key, false, false, msg)
+	}
+	msg.DeliveryMode = amqp.Persistent
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, exchange, key, false, false, msg)
+	if err != nil {
+		return err
+	}
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("error waiting for rabbitmq publisher confirm: %s", err.Error())
+	}
+	if !acked {
+		return fmt.Errorf("message was nacked by rabbitmq")
+	}
+	return nil
+}
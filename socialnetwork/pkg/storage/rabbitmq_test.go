@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	sn_metrics "socialnetwork/pkg/metrics"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// unreachablePool returns a pool of a rabbitmq address that refuses connections, without dialing it
+func unreachablePool() *RabbitMQClientPool {
+	uri := amqp.URI{Scheme: "amqp", Host: "127.0.0.1", Port: 1, Username: "guest", Password: "guest", Vhost: "/"}
+	return &RabbitMQClientPool{
+		clients: make(chan *amqp.Channel, 1),
+		uri:     uri.String(),
+		opts:    RabbitMQPoolOptions{MaxSize: 1},
+		done:    make(chan struct{}),
+		label:   sn_metrics.RabbitMQPoolLabel{Addr: "127.0.0.1:1"},
+	}
+}
+
+func TestReconnectDoesNotHoldPoolLock(t *testing.T) {
+	pool := unreachablePool()
+	popped := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := pool.Pop(context.Background())
+			popped <- err
+		}()
+	}
+	time.Sleep(2 * RABBITMQ_RECONNECT_BASE_DELAY)
+	if !pool.mu.TryLock() {
+		t.Fatalf("pool lock held while reconnecting")
+	}
+	pool.mu.Unlock()
+
+	// destroying the pool interrupts the reconnection and the callers waiting for it
+	err := pool.DestroyRabbitMQClientPool(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-popped:
+			if err == nil {
+				t.Errorf("popped a client from a destroyed pool")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("reconnection not interrupted by destroying the pool")
+		}
+	}
+	if pool.currSize != 0 {
+		t.Errorf("got pool size %d after failed pops, want 0", pool.currSize)
+	}
+}
@@ -2,14 +2,26 @@ package storage
 
 import (
 	"fmt"
+	"net"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
-func RedisClient(address string, port int) *redis.Client {
-	return redis.NewClient(&redis.Options{
+func RedisClient(address string, port int) (*redis.Client, error) {
+	opts := &redis.Options{
 		Addr:     fmt.Sprintf("%s:%d", address, port),
 		Password: "",
 		DB:       0, // use default DB
-	})
+	}
+	injector, err := faultInjectorFor(address, port)
+	if err != nil {
+		return nil, err
+	}
+	if injector != nil {
+		// same timeouts as the default dialer of redis
+		dialer := &net.Dialer{Timeout: 5 * time.Second, KeepAlive: 5 * time.Minute}
+		opts.Dialer = injector.dialer(dialer.DialContext).DialContext
+	}
+	return redis.NewClient(opts), nil
 }
@@ -0,0 +1,622 @@
+package wrk2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	sn_metrics "socialnetwork/pkg/metrics"
+	"socialnetwork/pkg/model"
+	"socialnetwork/pkg/services"
+)
+
+// the v2 api takes and returns json bodies and replies to failed requests with typed error objects
+// the wrk2 api is kept as is for compatibility with the wrk2 lua scripts
+const API_V2_PREFIX = "/api/v2/"
+
+const API_V2_MAX_BODY_BYTES int64 = 1 << 20
+
+const (
+	API_ERROR_INVALID_ARGUMENT   = "invalid_argument"
+	API_ERROR_UNAUTHENTICATED    = "unauthenticated"
+	API_ERROR_PERMISSION_DENIED  = "permission_denied"
+	API_ERROR_NOT_FOUND          = "not_found"
+	API_ERROR_METHOD_NOT_ALLOWED = "method_not_allowed"
+	API_ERROR_INTERNAL           = "internal"
+)
+
+func (s *server) registerAPIv2(mux *http.ServeMux) {
+	mux.Handle(API_V2_PREFIX+"users/register", s.instrument("v2/users/register", s.registerV2Handler, false, http.MethodPost))
+	mux.Handle(API_V2_PREFIX+"users/login", s.instrument("v2/users/login", s.loginV2Handler, false, http.MethodPost))
+	mux.Handle(API_V2_PREFIX+"users/follow", s.instrument("v2/users/follow", s.followV2Handler, true, http.MethodPost))
+	mux.Handle(API_V2_PREFIX+"users/unfollow", s.instrument("v2/users/unfollow", s.unfollowV2Handler, true, http.MethodPost))
+	mux.Handle(API_V2_PREFIX+"posts", s.instrument("v2/posts", s.composePostV2Handler, true, http.MethodPost))
+	mux.Handle(API_V2_PREFIX+"posts/edit", s.instrument("v2/posts/edit", s.editPostV2Handler, true, http.MethodPost))
+	mux.Handle(API_V2_PREFIX+"posts/delete", s.instrument("v2/posts/delete", s.deletePostV2Handler, true, http.MethodPost))
+	mux.Handle(API_V2_PREFIX+"posts/thread", s.instrument("v2/posts/thread", s.readThreadV2Handler, true, http.MethodGet))
+	mux.Handle(API_V2_PREFIX+"home-timeline", s.instrument("v2/home-timeline", s.readHomeTimelineV2Handler, true, http.MethodGet))
+	mux.Handle(API_V2_PREFIX+"user-timeline", s.instrument("v2/user-timeline", s.readUserTimelineV2Handler, true, http.MethodGet))
+	mux.Handle(API_V2_PREFIX+"conversations", s.instrument("v2/conversations", s.listConversationsV2Handler, true, http.MethodGet))
+	mux.Handle(API_V2_PREFIX+"conversations/messages", s.instrument("v2/conversations/messages", s.readConversationV2Handler, true, http.MethodGet))
+	mux.HandleFunc(API_V2_PREFIX, func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, genReqID(), fmt.Sprintf("unknown endpoint %s", r.URL.Path))
+	})
+}
+
+type apiError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+type apiErrorResponse struct {
+	Error apiError `json:"error"`
+}
+
+func apiErrorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return API_ERROR_INVALID_ARGUMENT
+	case http.StatusUnauthorized:
+		return API_ERROR_UNAUTHENTICATED
+	case http.StatusForbidden:
+		return API_ERROR_PERMISSION_DENIED
+	case http.StatusNotFound:
+		return API_ERROR_NOT_FOUND
+	case http.StatusMethodNotAllowed:
+		return API_ERROR_METHOD_NOT_ALLOWED
+	}
+	return API_ERROR_INTERNAL
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, reqID int64, msg string) {
+	writeJSON(w, status, apiErrorResponse{Error: apiError{
+		Code:      apiErrorCode(status),
+		Message:   msg,
+		RequestID: strconv.FormatInt(reqID, 10),
+	}})
+}
+
+// decodeJSON parses the request body and rejects unknown fields
+func decodeJSON(w http.ResponseWriter, r *http.Request, body any) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, API_V2_MAX_BODY_BYTES))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(body)
+	if errors.Is(err, io.EOF) {
+		return fmt.Errorf("request body must be a json object")
+	}
+	if err != nil {
+		return fmt.Errorf("invalid json body: %s", err.Error())
+	}
+	return nil
+}
+
+type registerV2Request struct {
+	UserID    *int64 `json:"user_id"`
+	Username  string `json:"username"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Password  string `json:"password"`
+}
+
+type registerV2Response struct {
+	Username string `json:"username"`
+	UserID   *int64 `json:"user_id,omitempty"`
+}
+
+func (s *server) registerV2Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	reqID := genReqID()
+	var req registerV2Request
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, reqID, err.Error())
+		return
+	}
+	if req.Username == "" || req.FirstName == "" || req.LastName == "" || req.Password == "" {
+		writeAPIError(w, http.StatusBadRequest, reqID, "must provide a valid username, first_name, last_name and password")
+		return
+	}
+	// anyone can register, so a chosen user id would let them log in as the user that has it
+	if req.UserID != nil && !s.Config().AuthDisabled {
+		writeAPIError(w, http.StatusForbidden, reqID, "user_id can only be chosen with auth_disabled")
+		return
+	}
+	var err error
+	if req.UserID == nil {
+		err = s.userService.Get().RegisterUser(ctx, reqID, req.FirstName, req.LastName, req.Username, req.Password)
+	} else {
+		err = s.userService.Get().RegisterUserWithId(ctx, reqID, req.FirstName, req.LastName, req.Username, req.Password, *req.UserID)
+	}
+	if err != nil {
+		s.Logger(ctx).Error("error registering user", "msg", err.Error())
+		writeAPIError(w, http.StatusInternalServerError, reqID, "error registering user: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, registerV2Response{Username: req.Username, UserID: req.UserID})
+}
+
+type loginV2Request struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type loginV2Response struct {
+	Token string `json:"token"`
+}
+
+func (s *server) loginV2Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	reqID := genReqID()
+	var req loginV2Request
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, reqID, err.Error())
+		return
+	}
+	if req.Username == "" || req.Password == "" {
+		writeAPIError(w, http.StatusBadRequest, reqID, "must provide a valid username and password")
+		return
+	}
+	token, err := s.userService.Get().Login(ctx, reqID, req.Username, req.Password)
+	if err != nil {
+		// do not disclose whether the username exists
+		writeAPIError(w, http.StatusUnauthorized, reqID, "invalid credentials")
+		return
+	}
+	writeJSON(w, http.StatusOK, loginV2Response{Token: token})
+}
+
+// follow relationships are identified either by user ids or by usernames
+type followV2Request struct {
+	UserID       *int64 `json:"user_id"`
+	FolloweeID   *int64 `json:"followee_id"`
+	Username     string `json:"username"`
+	FolloweeName string `json:"followee_name"`
+}
+
+func (s *server) followV2(w http.ResponseWriter, r *http.Request, unfollow bool) {
+	ctx := r.Context()
+	reqID := genReqID()
+	var req followV2Request
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, reqID, err.Error())
+		return
+	}
+	byID := req.UserID != nil && req.FolloweeID != nil
+	byName := req.Username != "" && req.FolloweeName != ""
+	if !byID && !byName {
+		writeAPIError(w, http.StatusBadRequest, reqID, "must provide either user_id and followee_id or username and followee_name")
+		return
+	}
+	userID := int64(-1)
+	if req.UserID != nil {
+		userID = *req.UserID
+	}
+	if err := authorize(r, userID, req.Username); err != nil {
+		writeAPIError(w, http.StatusForbidden, reqID, err.Error())
+		return
+	}
+
+	var err error
+	socialGraphService := s.socialGraphService.Get()
+	switch {
+	case byID && unfollow:
+		err = socialGraphService.Unfollow(ctx, reqID, *req.UserID, *req.FolloweeID)
+	case byID:
+		err = socialGraphService.Follow(ctx, reqID, *req.UserID, *req.FolloweeID)
+	case unfollow:
+		err = socialGraphService.UnfollowWithUsername(ctx, reqID, req.Username, req.FolloweeName)
+	default:
+		err = socialGraphService.FollowWithUsername(ctx, reqID, req.Username, req.FolloweeName)
+	}
+	if err != nil {
+		s.Logger(ctx).Error("error updating follow relationship", "unfollow", unfollow, "msg", err.Error())
+		writeAPIError(w, http.StatusInternalServerError, reqID, "error updating follow relationship: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, req)
+}
+
+func (s *server) followV2Handler(w http.ResponseWriter, r *http.Request) {
+	s.followV2(w, r, false)
+}
+
+func (s *server) unfollowV2Handler(w http.ResponseWriter, r *http.Request) {
+	s.followV2(w, r, true)
+}
+
+type mediaV2 struct {
+	MediaID   int64  `json:"media_id"`
+	MediaType string `json:"media_type"`
+}
+
+type composePostV2Request struct {
+	UserID   int64          `json:"user_id"`
+	Username string         `json:"username"`
+	Text     string         `json:"text"`
+	PostType model.PostType `json:"post_type"`
+	Media    []mediaV2      `json:"media"`
+	// replied or reposted post
+	ParentPostID int64 `json:"parent_post_id"`
+}
+
+type composePostV2Response struct {
+	PostID int64 `json:"post_id"`
+}
+
+func (s *server) composePostV2Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	composePostStartMs := time.Now().UnixMilli()
+	reqID := genReqID()
+	var req composePostV2Request
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, reqID, err.Error())
+		return
+	}
+	if req.Username == "" || req.Text == "" {
+		writeAPIError(w, http.StatusBadRequest, reqID, "must provide a valid username and text")
+		return
+	}
+	if req.PostType < model.POST_TYPE_POST || req.PostType > model.POST_TYPE_DM {
+		writeAPIError(w, http.StatusBadRequest, reqID, "invalid post_type. Available types: 0-POST, 1-REPOST, 2-REPLY, 3-DM")
+		return
+	}
+	if err := validateParentPost(req.PostType, req.ParentPostID); err != nil {
+		writeAPIError(w, http.StatusBadRequest, reqID, err.Error())
+		return
+	}
+	if err := authorize(r, req.UserID, req.Username); err != nil {
+		writeAPIError(w, http.StatusForbidden, reqID, err.Error())
+		return
+	}
+
+	params := &ComposePostParams{
+		reqID:        reqID,
+		userID:       req.UserID,
+		username:     req.Username,
+		text:         req.Text,
+		postType:     req.PostType,
+		parentPostID: req.ParentPostID,
+	}
+	for _, media := range req.Media {
+		params.mediaIDs = append(params.mediaIDs, media.MediaID)
+		params.mediaTypes = append(params.mediaTypes, media.MediaType)
+	}
+	postID, err := s.composePost(ctx, params)
+	if err != nil {
+		s.Logger(ctx).Error("error composing post", "msg", err.Error())
+		writeAPIError(w, serviceErrorStatus(err), reqID, "error composing post: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, composePostV2Response{PostID: postID})
+	regionLabel := sn_metrics.RegionLabel{Region: s.Config().Region}
+	sn_metrics.ComposePostDuration.Get(regionLabel).Put(float64(time.Now().UnixMilli() - composePostStartMs))
+}
+
+type creatorV2 struct {
+	UserID   int64  `json:"user_id"`
+	Username string `json:"username"`
+}
+
+type userMentionV2 struct {
+	UserID   int64  `json:"user_id"`
+	Username string `json:"username"`
+}
+
+type urlV2 struct {
+	ExpandedUrl  string `json:"expanded_url"`
+	ShortenedUrl string `json:"shortened_url"`
+}
+
+type postV2 struct {
+	PostID       int64           `json:"post_id"`
+	Creator      creatorV2       `json:"creator"`
+	Text         string          `json:"text"`
+	UserMentions []userMentionV2 `json:"user_mentions"`
+	Media        []mediaV2       `json:"media"`
+	URLs         []urlV2         `json:"urls"`
+	Timestamp    int64           `json:"timestamp"`
+	PostType     model.PostType  `json:"post_type"`
+	ParentPostID int64           `json:"parent_post_id,omitempty"`
+	RootPostID   int64           `json:"root_post_id,omitempty"`
+	// original post of reposts, if found
+	OriginalPost *postV2 `json:"original_post,omitempty"`
+	// previous versions of edited posts, oldest first
+	EditedAt    int64        `json:"edited_at,omitempty"`
+	EditHistory []postEditV2 `json:"edit_history,omitempty"`
+	// tombstones of deleted posts (e.g. in threads) have no content
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+type postEditV2 struct {
+	Text      string `json:"text"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+func newPostV2(post model.Post) postV2 {
+	p := postV2{
+		PostID:       post.PostID,
+		Creator:      creatorV2{UserID: post.Creator.UserID, Username: post.Creator.Username},
+		Text:         post.Text,
+		UserMentions: make([]userMentionV2, 0, len(post.UserMentions)),
+		Media:        make([]mediaV2, 0, len(post.Media)),
+		URLs:         make([]urlV2, 0, len(post.URLs)),
+		Timestamp:    post.Timestamp,
+		PostType:     post.PostType,
+		ParentPostID: post.ParentPostID,
+		RootPostID:   post.RootPostID,
+		EditedAt:     post.EditedAt,
+		Deleted:      post.Deleted,
+	}
+	for _, mention := range post.UserMentions {
+		p.UserMentions = append(p.UserMentions, userMentionV2{UserID: mention.UserID, Username: mention.Username})
+	}
+	for _, media := range post.Media {
+		p.Media = append(p.Media, mediaV2{MediaID: media.MediaID, MediaType: media.MediaType})
+	}
+	for _, url := range post.URLs {
+		p.URLs = append(p.URLs, urlV2{ExpandedUrl: url.ExpandedUrl, ShortenedUrl: url.ShortenedUrl})
+	}
+	for _, edit := range post.EditHistory {
+		p.EditHistory = append(p.EditHistory, postEditV2{Text: edit.Text, Timestamp: edit.Timestamp})
+	}
+	return p
+}
+
+type editPostV2Request struct {
+	UserID int64  `json:"user_id"`
+	PostID int64  `json:"post_id"`
+	Text   string `json:"text"`
+}
+
+// editPostV2Handler replaces the text of a post of the user and returns the edited post
+func (s *server) editPostV2Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	reqID := genReqID()
+	var req editPostV2Request
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, reqID, err.Error())
+		return
+	}
+	if req.PostID <= 0 || req.Text == "" {
+		writeAPIError(w, http.StatusBadRequest, reqID, "must provide a valid post_id and text")
+		return
+	}
+	if err := authorize(r, req.UserID, ""); err != nil {
+		writeAPIError(w, http.StatusForbidden, reqID, err.Error())
+		return
+	}
+	post, err := s.postStorageService.Get().EditPost(ctx, reqID, req.UserID, req.PostID, req.Text)
+	if err != nil {
+		s.Logger(ctx).Error("error editing post", "post_id", req.PostID, "msg", err.Error())
+		writeAPIError(w, serviceErrorStatus(err), reqID, "error editing post: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, newPostV2(post))
+}
+
+type deletePostV2Request struct {
+	UserID int64 `json:"user_id"`
+	PostID int64 `json:"post_id"`
+}
+
+// deletePostV2Handler deletes a post of the user, which is removed from the timelines asynchronously
+func (s *server) deletePostV2Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	reqID := genReqID()
+	var req deletePostV2Request
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, reqID, err.Error())
+		return
+	}
+	if req.PostID <= 0 {
+		writeAPIError(w, http.StatusBadRequest, reqID, "must provide a valid post_id")
+		return
+	}
+	if err := authorize(r, req.UserID, ""); err != nil {
+		writeAPIError(w, http.StatusForbidden, reqID, err.Error())
+		return
+	}
+	err := s.postStorageService.Get().DeletePost(ctx, reqID, req.UserID, req.PostID)
+	if err != nil {
+		s.Logger(ctx).Error("error deleting post", "post_id", req.PostID, "msg", err.Error())
+		writeAPIError(w, serviceErrorStatus(err), reqID, "error deleting post: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, req)
+}
+
+type paginationV2 struct {
+	Start int64 `json:"start"`
+	Stop  int64 `json:"stop"`
+	Count int   `json:"count"`
+	// the next page is read either with the same parameters and start=next_start,
+	// or with max_id=next_max_id and start=0; both are null if this is the last page
+	NextStart *int64 `json:"next_start"`
+	NextMaxID *int64 `json:"next_max_id"`
+}
+
+type timelineV2Response struct {
+	Posts      []postV2     `json:"posts"`
+	Pagination paginationV2 `json:"pagination"`
+}
+
+func (s *server) readTimelineV2(w http.ResponseWriter, r *http.Request, read func(reqID int64, userID int64, query model.TimelineQuery) (model.TimelinePage, error)) {
+	reqID := genReqID()
+	values := r.URL.Query()
+	userID, err := strconv.ParseInt(values.Get("user_id"), 10, 64)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, reqID, "must provide a valid user_id")
+		return
+	}
+	query, err := parseTimelineQuery(values)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, reqID, err.Error())
+		return
+	}
+	if err := authorize(r, userID, ""); err != nil {
+		writeAPIError(w, http.StatusForbidden, reqID, err.Error())
+		return
+	}
+	page, err := read(reqID, userID, query)
+	if err != nil {
+		s.Logger(r.Context()).Error("error reading timeline", "user_id", userID, "msg", err.Error())
+		writeAPIError(w, serviceErrorStatus(err), reqID, "error reading timeline: "+err.Error())
+		return
+	}
+
+	response := timelineV2Response{
+		Posts:      make([]postV2, 0, len(page.Posts)),
+		Pagination: paginationV2{Start: query.Start, Stop: query.Stop, Count: len(page.Posts)},
+	}
+	originalPosts := make(map[int64]model.Post, len(page.RepostedPosts))
+	for _, post := range page.RepostedPosts {
+		originalPosts[post.PostID] = post
+	}
+	for _, post := range page.Posts {
+		p := newPostV2(post)
+		if original, ok := originalPosts[post.ParentPostID]; ok && post.PostType == model.POST_TYPE_REPOST {
+			originalV2 := newPostV2(original)
+			p.OriginalPost = &originalV2
+		}
+		response.Posts = append(response.Posts, p)
+	}
+	if page.NextMaxID != 0 {
+		response.Pagination.NextStart = &query.Stop
+		response.Pagination.NextMaxID = &page.NextMaxID
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *server) readHomeTimelineV2Handler(w http.ResponseWriter, r *http.Request) {
+	s.readTimelineV2(w, r, func(reqID int64, userID int64, query model.TimelineQuery) (model.TimelinePage, error) {
+		return s.homeTimelineService.Get().ReadHomeTimeline(r.Context(), reqID, userID, query)
+	})
+}
+
+func (s *server) readUserTimelineV2Handler(w http.ResponseWriter, r *http.Request) {
+	s.readTimelineV2(w, r, func(reqID int64, userID int64, query model.TimelineQuery) (model.TimelinePage, error) {
+		return s.userTimelineService.Get().ReadUserTimeline(r.Context(), reqID, userID, query)
+	})
+}
+
+// readConversationV2Handler returns a page of the direct messages of a conversation of the user, newest first
+func (s *server) readConversationV2Handler(w http.ResponseWriter, r *http.Request) {
+	conversationID := r.URL.Query().Get("conversation_id")
+	if conversationID == "" {
+		writeAPIError(w, http.StatusBadRequest, genReqID(), "must provide a conversation_id")
+		return
+	}
+	s.readTimelineV2(w, r, func(reqID int64, userID int64, query model.TimelineQuery) (model.TimelinePage, error) {
+		return s.directMessageService.Get().ReadConversation(r.Context(), reqID, userID, conversationID, query)
+	})
+}
+
+type conversationV2 struct {
+	ConversationID string  `json:"conversation_id"`
+	ParticipantIDs []int64 `json:"participant_ids"`
+	LastTimestamp  int64   `json:"last_timestamp"`
+}
+
+type conversationsV2Response struct {
+	Conversations []conversationV2 `json:"conversations"`
+	Pagination    paginationV2     `json:"pagination"`
+}
+
+// listConversationsV2Handler returns the conversations of the user, the most recently active first
+func (s *server) listConversationsV2Handler(w http.ResponseWriter, r *http.Request) {
+	reqID := genReqID()
+	values := r.URL.Query()
+	userID, err := strconv.ParseInt(values.Get("user_id"), 10, 64)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, reqID, "must provide a valid user_id")
+		return
+	}
+	query, err := parseTimelineQuery(values)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, reqID, err.Error())
+		return
+	}
+	if err := authorize(r, userID, ""); err != nil {
+		writeAPIError(w, http.StatusForbidden, reqID, err.Error())
+		return
+	}
+	// one past the end of the page tells whether there are more conversations
+	conversations, err := s.directMessageService.Get().ListConversations(r.Context(), reqID, userID, query.Start, query.Stop+1)
+	if err != nil {
+		s.Logger(r.Context()).Error("error listing conversations", "user_id", userID, "msg", err.Error())
+		writeAPIError(w, http.StatusInternalServerError, reqID, "error listing conversations: "+err.Error())
+		return
+	}
+
+	response := conversationsV2Response{
+		Conversations: make([]conversationV2, 0, len(conversations)),
+		Pagination:    paginationV2{Start: query.Start, Stop: query.Stop},
+	}
+	if int64(len(conversations)) > query.Stop-query.Start {
+		conversations = conversations[:query.Stop-query.Start]
+		response.Pagination.NextStart = &query.Stop
+	}
+	for _, conversation := range conversations {
+		response.Conversations = append(response.Conversations, conversationV2{
+			ConversationID: conversation.ConversationID,
+			ParticipantIDs: conversation.ParticipantIDs,
+			LastTimestamp:  conversation.LastTimestamp,
+		})
+	}
+	response.Pagination.Count = len(response.Conversations)
+	writeJSON(w, http.StatusOK, response)
+}
+
+type threadPostV2 struct {
+	postV2
+	// number of replies between the post and the root of the thread
+	Depth int `json:"depth"`
+}
+
+type threadV2Response struct {
+	RootPostID int64          `json:"root_post_id"`
+	Posts      []threadPostV2 `json:"posts"`
+}
+
+// readThreadV2Handler returns the conversation of the post in depth-first order, starting with its root
+func (s *server) readThreadV2Handler(w http.ResponseWriter, r *http.Request) {
+	reqID := genReqID()
+	postID, err := strconv.ParseInt(r.URL.Query().Get("post_id"), 10, 64)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, reqID, "must provide a valid post_id")
+		return
+	}
+	thread, err := s.postStorageService.Get().ReadThread(r.Context(), reqID, postID)
+	if err != nil {
+		var notFound services.PostNotFoundError
+		if errors.As(err, &notFound) {
+			writeAPIError(w, http.StatusNotFound, reqID, err.Error())
+			return
+		}
+		s.Logger(r.Context()).Error("error reading thread", "post_id", postID, "msg", err.Error())
+		writeAPIError(w, http.StatusInternalServerError, reqID, "error reading thread: "+err.Error())
+		return
+	}
+
+	response := threadV2Response{RootPostID: thread[0].PostID, Posts: make([]threadPostV2, 0, len(thread))}
+	depths := make(map[int64]int, len(thread))
+	for _, post := range thread {
+		depth := 0
+		if post.PostID != response.RootPostID {
+			depth = depths[post.ParentPostID] + 1
+		}
+		depths[post.PostID] = depth
+		response.Posts = append(response.Posts, threadPostV2{postV2: newPostV2(post), Depth: depth})
+	}
+	writeJSON(w, http.StatusOK, response)
+}
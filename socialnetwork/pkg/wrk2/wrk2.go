@@ -3,15 +3,18 @@ package wrk2
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"socialnetwork/pkg/auth"
 	"socialnetwork/pkg/model"
 	"socialnetwork/pkg/services"
 	sn_metrics "socialnetwork/pkg/metrics"
@@ -22,38 +25,66 @@ import (
 type server struct {
 	weaver.Implements[weaver.Main]
 	weaver.WithConfig[serverOptions]
-	homeTimelineService weaver.Ref[services.HomeTimelineService]
-	userTimelineService weaver.Ref[services.UserTimelineService]
-	textService         weaver.Ref[services.TextService]
-	mediaService        weaver.Ref[services.MediaService]
-	uniqueIdService     weaver.Ref[services.UniqueIdService]
-	userService         weaver.Ref[services.UserService]
-	socialGraphService  weaver.Ref[services.SocialGraphService]
-	lis                 weaver.Listener `weaver:"wrk2"`
+	homeTimelineService  weaver.Ref[services.HomeTimelineService]
+	userTimelineService  weaver.Ref[services.UserTimelineService]
+	textService          weaver.Ref[services.TextService]
+	mediaService         weaver.Ref[services.MediaService]
+	uniqueIdService      weaver.Ref[services.UniqueIdService]
+	userService          weaver.Ref[services.UserService]
+	socialGraphService   weaver.Ref[services.SocialGraphService]
+	postStorageService   weaver.Ref[services.PostStorageService]
+	directMessageService weaver.Ref[services.DirectMessageService]
+	lis                  weaver.Listener `weaver:"wrk2"`
+	keyring              *auth.Keyring
 }
 
 type serverOptions struct {
 	Region    		string `toml:"region"`
+	// benchmarking mode: endpoints trust the user in the request parameters
+	AuthDisabled    bool              `toml:"auth_disabled"`
+	// secrets used to verify the tokens issued by UserService.Login, indexed by kid
+	// (also read from jwt_secrets_file and $SN_JWT_SECRETS, as in UserService)
+	JWTKid          string            `toml:"jwt_kid"`
+	JWTSecrets      map[string]string `toml:"jwt_secrets"`
+	JWTSecretsFile  string            `toml:"jwt_secrets_file"`
 }
 
 func Serve(ctx context.Context, s *server) error {
+	if !s.Config().AuthDisabled {
+		secrets, err := auth.LoadSecrets(s.Config().JWTSecrets, s.Config().JWTSecretsFile)
+		if err != nil {
+			s.Logger(ctx).Error("error loading jwt secrets", "msg", err.Error())
+			return err
+		}
+		s.keyring, err = auth.NewKeyring(s.Config().JWTKid, secrets)
+		if err != nil {
+			s.Logger(ctx).Error("error loading jwt secrets", "msg", err.Error())
+			return err
+		}
+	}
+
 	mux := http.NewServeMux()
 
 	// declare api endpoints
-	mux.Handle("/wrk2-api/user/register", instrument("user/register", s.registerHandler, http.MethodGet, http.MethodPost))
-	mux.Handle("/wrk2-api/user/follow", instrument("user/follow", s.followHandler, http.MethodGet, http.MethodPost))
-	mux.Handle("/wrk2-api/user/unfollow", instrument("user/unfollow", s.unfollowHandler, http.MethodGet, http.MethodPost))
-	mux.Handle("/wrk2-api/user/login", instrument("user/login", s.loginHandler, http.MethodGet, http.MethodPost))
-	mux.Handle("/wrk2-api/post/compose", instrument("post/compose", s.composePostHandler, http.MethodGet, http.MethodPost))
-	mux.Handle("/wrk2-api/home-timeline/read", instrument("home-timeline/read", s.readHomeTimelineHandler, http.MethodGet, http.MethodPost))
-	mux.Handle("/wrk2-api/user-timeline/read", instrument("user-timeline/read", s.readUserTimelineHandler, http.MethodGet, http.MethodPost))
+	mux.Handle("/wrk2-api/user/register", s.instrument("user/register", s.registerHandler, false, http.MethodGet, http.MethodPost))
+	mux.Handle("/wrk2-api/user/register-batch", s.instrument("user/register-batch", s.registerBatchHandler, false, http.MethodPost))
+	mux.Handle("/wrk2-api/user/follow", s.instrument("user/follow", s.followHandler, true, http.MethodGet, http.MethodPost))
+	mux.Handle("/wrk2-api/user/follow-batch", s.instrument("user/follow-batch", s.followBatchHandler, false, http.MethodPost))
+	mux.Handle("/wrk2-api/user/unfollow", s.instrument("user/unfollow", s.unfollowHandler, true, http.MethodGet, http.MethodPost))
+	mux.Handle("/wrk2-api/user/login", s.instrument("user/login", s.loginHandler, false, http.MethodGet, http.MethodPost))
+	mux.Handle("/wrk2-api/post/compose", s.instrument("post/compose", s.composePostHandler, true, http.MethodGet, http.MethodPost))
+	mux.Handle("/wrk2-api/home-timeline/read", s.instrument("home-timeline/read", s.readHomeTimelineHandler, true, http.MethodGet, http.MethodPost))
+	mux.Handle("/wrk2-api/user-timeline/read", s.instrument("user-timeline/read", s.readUserTimelineHandler, true, http.MethodGet, http.MethodPost))
+	s.registerAPIv2(mux)
 
 	var handler http.Handler = mux
-	s.Logger(ctx).Info("wrk2-api available", "addr", s.lis, "region", s.Config().Region)
+	s.Logger(ctx).Info("wrk2-api available", "addr", s.lis, "region", s.Config().Region, "auth_disabled", s.Config().AuthDisabled)
 	return http.Serve(s.lis, handler)
 }
 
-func instrument(label string, fn func(http.ResponseWriter, *http.Request), methods ...string) http.Handler {
+// instrument wraps the handler with method checks and, for authenticated endpoints,
+// verifies the bearer token and adds the authenticated user to the request context
+func (s *server) instrument(label string, fn func(http.ResponseWriter, *http.Request), authenticated bool, methods ...string) http.Handler {
 	allowed := map[string]struct{}{}
 	for _, method := range methods {
 		allowed[method] = struct{}{}
@@ -61,14 +92,52 @@ func instrument(label string, fn func(http.ResponseWriter, *http.Request), metho
 	handler := func(w http.ResponseWriter, r *http.Request) {
 		if _, ok := allowed[r.Method]; len(allowed) > 0 && !ok {
 			msg := fmt.Sprintf("method %q not allowed", r.Method)
-			http.Error(w, msg, http.StatusMethodNotAllowed)
+			writeError(w, r, http.StatusMethodNotAllowed, msg)
 			return
 		}
+		if authenticated && !s.Config().AuthDisabled {
+			token, err := auth.BearerToken(r)
+			if err != nil {
+				writeError(w, r, http.StatusUnauthorized, "unauthorized: "+err.Error())
+				return
+			}
+			claims, err := s.keyring.Verify(token)
+			if err != nil {
+				writeError(w, r, http.StatusUnauthorized, "unauthorized: invalid token: "+err.Error())
+				return
+			}
+			r = r.WithContext(auth.WithUser(r.Context(), claims))
+		}
 		fn(w, r)
 	}
 	return weaver.InstrumentHandlerFunc(label, handler)
 }
 
+// writeError replies with a json error object to the v2 api and with plain text to the wrk2 api
+func writeError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	if strings.HasPrefix(r.URL.Path, API_V2_PREFIX) {
+		writeAPIError(w, status, genReqID(), msg)
+		return
+	}
+	http.Error(w, msg, status)
+}
+
+// authorize checks that the user id and username in the request parameters (if set)
+// belong to the authenticated user, which is always the case in benchmarking mode
+func authorize(r *http.Request, userID int64, username string) error {
+	claims, ok := auth.UserFromContext(r.Context())
+	if !ok {
+		return nil
+	}
+	if userID != -1 && userID != claims.UserID {
+		return fmt.Errorf("user_id %d does not match the authenticated user", userID)
+	}
+	if username != "" && username != claims.Username {
+		return fmt.Errorf("username %s does not match the authenticated user", username)
+	}
+	return nil
+}
+
 func genReqID() int64 {
 	return rand.New(rand.NewSource(time.Now().UnixNano())).Int63()
 }
@@ -134,6 +203,11 @@ func (s *server) registerHandler(w http.ResponseWriter, r *http.Request) {
 	if params == nil {
 		return
 	}
+	// anyone can register, so a chosen user id would let them log in as the user that has it
+	if params.userID != -1 && !s.Config().AuthDisabled {
+		http.Error(w, "forbidden: user_id can only be chosen with auth_disabled", http.StatusForbidden)
+		return
+	}
 	var err error
 	if params.userID == -1 {
 		logger.Debug("calling userService.RegisterUser()", "reqID", params.reqID, "firstName", params.firstName, "lastName", params.lastName, "username", params.username, "password", params.password)
@@ -208,6 +282,10 @@ func (s *server) followHandler(w http.ResponseWriter, r *http.Request) {
 	if params == nil {
 		return
 	}
+	if err := authorize(r, params.userID, params.username); err != nil {
+		http.Error(w, "forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
 
 	if params.userID != -1 && params.followeeID != -1 {
 		logger.Debug("calling socialGraphService.Follow()", "reqID", params.reqID, "userID", params.userID, "followeeID", params.followeeID)
@@ -242,6 +320,10 @@ func (s *server) unfollowHandler(w http.ResponseWriter, r *http.Request) {
 	if params == nil {
 		return
 	}
+	if err := authorize(r, params.userID, params.username); err != nil {
+		http.Error(w, "forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
 	if params.userID != -1 && params.followeeID != -1 {
 		err = s.socialGraphService.Get().Unfollow(ctx, params.reqID, params.userID, params.followeeID)
 	} else if params.username != "" && params.followeeName != "" {
@@ -262,6 +344,76 @@ func (s *server) unfollowHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(response))
 }
 
+type registerBatchParams struct {
+	Users []model.UserRegistration `json:"users"`
+}
+
+// registerBatchHandler registers the users in the json body, skipping the ones already registered
+func (s *server) registerBatchHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := s.Logger(ctx)
+	logger.Info("entering wkr2-api/user/register-batch")
+	// any client could otherwise mass-create accounts with chosen user ids
+	if !s.Config().AuthDisabled {
+		http.Error(w, "forbidden: batch register is only available with auth_disabled (use the offline loader instead)", http.StatusForbidden)
+		return
+	}
+
+	var params registerBatchParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, "error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, user := range params.Users {
+		if user.Username == "" || user.FirstName == "" || user.LastName == "" {
+			http.Error(w, "must provide a valid username, first_name and last_name for every user", http.StatusBadRequest)
+			return
+		}
+	}
+
+	registered, err := s.userService.Get().BatchRegisterUsersWithId(ctx, genReqID(), params.Users)
+	if err != nil {
+		logger.Error("error registering users", "msg", err.Error())
+		http.Error(w, "error registering users: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := fmt.Sprintf("success! registered %d new users out of %d\n", registered, len(params.Users))
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(response))
+}
+
+type followBatchParams struct {
+	Edges []model.FollowEdge `json:"edges"`
+}
+
+// followBatchHandler adds the follow edges in the json body, skipping the ones that already exist
+func (s *server) followBatchHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := s.Logger(ctx)
+	logger.Info("entering wkr2-api/user/follow-batch")
+	// any client could otherwise add edges on behalf of other users
+	if !s.Config().AuthDisabled {
+		http.Error(w, "forbidden: batch follow is only available with auth_disabled (use the offline loader instead)", http.StatusForbidden)
+		return
+	}
+
+	var params followBatchParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, "error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	followed, err := s.socialGraphService.Get().BatchFollow(ctx, genReqID(), params.Edges)
+	if err != nil {
+		logger.Error("error following users", "msg", err.Error())
+		http.Error(w, "error following users: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := fmt.Sprintf("success! added %d new edges out of %d\n", followed, len(params.Edges))
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(response))
+}
+
 type LoginParams struct {
 	reqID    int64
 	username string
@@ -322,6 +474,8 @@ type ComposePostParams struct {
 	mediaTypes []string
 	mediaIDs   []int64
 	postType   model.PostType
+	// replied or reposted post
+	parentPostID int64
 }
 
 func validateComposePostParams(logger *slog.Logger, r *http.Request) (*ComposePostParams, error) {
@@ -339,6 +493,7 @@ func validateComposePostParams(logger *slog.Logger, r *http.Request) (*ComposePo
 	params.text = r.Form.Get("text")
 	userIDstr := r.Form.Get("user_id")
 	postTypeStr := r.Form.Get("post_type")
+	parentPostIDStr := r.Form.Get("parent_post_id")
 	mediaTypesStr := r.Form.Get("media_types")
 	mediaIDsStr := r.Form.Get("media_ids")
 
@@ -356,6 +511,12 @@ func validateComposePostParams(logger *slog.Logger, r *http.Request) (*ComposePo
 		}
 		params.postType = model.PostType(postType)
 	}
+	if parentPostIDStr != "" {
+		params.parentPostID, err = strconv.ParseInt(parentPostIDStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid parent_post_id")
+		}
+	}
 	if mediaTypesStr != "" && mediaTypesStr != "[]" {
 		mediaTypesStr = strings.TrimPrefix(mediaTypesStr, "[")
 		mediaTypesStr = strings.TrimSuffix(mediaTypesStr, "]")
@@ -387,6 +548,9 @@ func validateComposePostParams(logger *slog.Logger, r *http.Request) (*ComposePo
 	if params.postType < 0 || params.postType > 3 {
 		return nil, fmt.Errorf("invalid post_type. Available types: 0-POST, 1-REPOST, 2-REPLY, 3-DM")
 	}
+	if err := validateParentPost(params.postType, params.parentPostID); err != nil {
+		return nil, err
+	}
 
 	return &params, nil
 }
@@ -402,12 +566,65 @@ func (s *server) composePostHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if err := authorize(r, params.userID, params.username); err != nil {
+		http.Error(w, "forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
 
 	logger.Debug("valid parameters", "params", params)
 
+	_, err = s.composePost(ctx, params)
+	if err != nil {
+		logger.Debug("error composing post", "msg", err.Error())
+		http.Error(w, "error composing post: "+err.Error(), serviceErrorStatus(err))
+		return
+	}
+	logger.Debug("success! composed post", "username", params.username, "userID", params.userID, "text", params.text)
+	response := fmt.Sprintf("success! user %s (id=%d) composed post: %s\n", params.username, params.userID, params.text)
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(response))
+	regionLabel := sn_metrics.RegionLabel{Region: s.Config().Region}
+	sn_metrics.ComposePostDuration.Get(regionLabel).Put(float64(time.Now().UnixMilli() - composePostStartMs))
+}
+
+// validateParentPost checks that replies and reposts have a parent post, which other posts cannot have
+func validateParentPost(postType model.PostType, parentPostID int64) error {
+	hasParent := postType == model.POST_TYPE_REPLY || postType == model.POST_TYPE_REPOST
+	if hasParent && parentPostID <= 0 {
+		return fmt.Errorf("must provide a parent_post_id for replies and reposts")
+	}
+	if !hasParent && parentPostID != 0 {
+		return fmt.Errorf("parent_post_id is only allowed for replies and reposts")
+	}
+	return nil
+}
+
+// serviceErrorStatus returns 404 if the post (e.g. the parent of a reply) or the conversation does not exist,
+// 403 if the user cannot change the post, 400 if the post was rejected and 500 otherwise
+func serviceErrorStatus(err error) int {
+	var postNotFound services.PostNotFoundError
+	var conversationNotFound services.ConversationNotFoundError
+	var notCreator services.NotPostCreatorError
+	var invalidPost services.InvalidPostError
+	if errors.As(err, &postNotFound) || errors.As(err, &conversationNotFound) {
+		return http.StatusNotFound
+	}
+	if errors.As(err, &notCreator) {
+		return http.StatusForbidden
+	}
+	if errors.As(err, &invalidPost) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// composePost uploads all the components of the post in parallel and returns the id of the new post
+func (s *server) composePost(ctx context.Context, params *ComposePostParams) (int64, error) {
+	logger := s.Logger(ctx)
 	var wg sync.WaitGroup
 	wg.Add(4)
 	var errs [4]error
+	var postID int64
 	go func() {
 		defer wg.Done()
 		logger.Debug("calling text service")
@@ -423,7 +640,7 @@ func (s *server) composePostHandler(w http.ResponseWriter, r *http.Request) {
 	go func() {
 		defer wg.Done()
 		logger.Debug("calling upload id service")
-		errs[2] = s.uniqueIdService.Get().UploadUniqueId(ctx, params.reqID, params.postType)
+		postID, errs[2] = s.uniqueIdService.Get().UploadUniqueId(ctx, params.reqID, params.postType, params.parentPostID)
 		logger.Debug("upload unique id done!")
 	}()
 	go func() {
@@ -435,24 +652,61 @@ func (s *server) composePostHandler(w http.ResponseWriter, r *http.Request) {
 	wg.Wait()
 	for _, err := range errs {
 		if err != nil {
-			logger.Debug("error composing post", "msg", err.Error())
-			http.Error(w, "error composing post: "+err.Error(), http.StatusInternalServerError)
-			return
+			return 0, err
 		}
 	}
-	logger.Debug("success! composed post", "username", params.username, "userID", params.userID, "text", params.text)
-	response := fmt.Sprintf("success! user %s (id=%d) composed post: %s\n", params.username, params.userID, params.text)
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte(response))
-	regionLabel := sn_metrics.RegionLabel{Region: s.Config().Region}
-	sn_metrics.ComposePostDuration.Get(regionLabel).Put(float64(time.Now().UnixMilli() - composePostStartMs))
+	return postID, nil
 }
 
+// timeline pages are [start, stop) and hold at most TIMELINE_MAX_PAGE_SIZE posts
+const TIMELINE_DEFAULT_PAGE_SIZE int64 = 10
+const TIMELINE_MAX_PAGE_SIZE int64 = 100
+
 type ReadTimelineParams struct {
 	reqID  int64
 	userID int64
-	start  int64
-	stop   int64
+	query  model.TimelineQuery
+}
+
+// parseTimelineQuery reads the start and stop offsets, the max_id and since_id cursors
+// and the since and until timestamps (unix milliseconds) of a timeline read
+func parseTimelineQuery(values url.Values) (model.TimelineQuery, error) {
+	query := model.TimelineQuery{}
+	params := []struct {
+		name  string
+		value *int64
+	}{
+		{"start", &query.Start},
+		{"stop", &query.Stop},
+		{"max_id", &query.MaxID},
+		{"since_id", &query.SinceID},
+		{"since", &query.Since},
+		{"until", &query.Until},
+	}
+	for _, param := range params {
+		valueStr := values.Get(param.name)
+		if valueStr == "" {
+			continue
+		}
+		value, err := strconv.ParseInt(valueStr, 10, 64)
+		if err != nil || value < 0 {
+			return query, fmt.Errorf("%s must be a non-negative integer", param.name)
+		}
+		*param.value = value
+	}
+	if query.Stop == 0 {
+		query.Stop = query.Start + TIMELINE_DEFAULT_PAGE_SIZE
+	}
+	if query.Stop <= query.Start {
+		return query, fmt.Errorf("stop must be greater than start")
+	}
+	if query.Stop-query.Start > TIMELINE_MAX_PAGE_SIZE {
+		return query, fmt.Errorf("page size (stop - start) must be at most %d", TIMELINE_MAX_PAGE_SIZE)
+	}
+	if query.Since > 0 && query.Until > 0 && query.Since > query.Until {
+		return query, fmt.Errorf("since must not be greater than until")
+	}
+	return query, nil
 }
 
 func validateReadTimelineParams(w http.ResponseWriter, r *http.Request) *ReadTimelineParams {
@@ -464,8 +718,6 @@ func validateReadTimelineParams(w http.ResponseWriter, r *http.Request) *ReadTim
 	params := ReadTimelineParams{
 		reqID:  genReqID(),
 		userID: -1,
-		start:  0,
-		stop:   10,
 	}
 	// get params
 	userIDstr := r.Form.Get("user_id")
@@ -481,6 +733,11 @@ func validateReadTimelineParams(w http.ResponseWriter, r *http.Request) *ReadTim
 		http.Error(w, "must provide a user_id", http.StatusBadRequest)
 		return nil
 	}
+	params.query, err = parseTimelineQuery(r.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
 
 	return &params
 }
@@ -494,13 +751,23 @@ func (s *server) readHomeTimelineHandler(w http.ResponseWriter, r *http.Request)
 	if params == nil {
 		return
 	}
-	posts, err := s.homeTimelineService.Get().ReadHomeTimeline(ctx, params.reqID, params.userID, params.start, params.stop)
+	if err := authorize(r, params.userID, ""); err != nil {
+		http.Error(w, "forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	page, err := s.homeTimelineService.Get().ReadHomeTimeline(ctx, params.reqID, params.userID, params.query)
 	if err != nil {
 		http.Error(w, "error: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	posts := page.Posts
+	// the body is kept as is for wrk2, so the cursor of the next page goes in a header
+	if page.NextMaxID != 0 {
+		w.Header().Set("X-Next-Max-Id", strconv.FormatInt(page.NextMaxID, 10))
+	}
 	// response, err := json.Marshal(posts)
 	// iterate to add new line in between posts
+	w.Header().Set("Content-Type", "text/plain")
 	for i, post := range posts {
 		postJSON, err := json.Marshal(post)
 		if err != nil {
@@ -512,7 +779,6 @@ func (s *server) readHomeTimelineHandler(w http.ResponseWriter, r *http.Request)
 			w.Write([]byte("\n"))
 		}
 	}
-	w.Header().Set("Content-Type", "text/plain")
 }
 
 func (s *server) readUserTimelineHandler(w http.ResponseWriter, r *http.Request) {
@@ -524,14 +790,24 @@ func (s *server) readUserTimelineHandler(w http.ResponseWriter, r *http.Request)
 	if params == nil {
 		return
 	}
-	posts, err := s.userTimelineService.Get().ReadUserTimeline(ctx, params.reqID, params.userID, params.start, params.stop)
+	if err := authorize(r, params.userID, ""); err != nil {
+		http.Error(w, "forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	page, err := s.userTimelineService.Get().ReadUserTimeline(ctx, params.reqID, params.userID, params.query)
 	if err != nil {
 		http.Error(w, "error: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	posts := page.Posts
+	// the body is kept as is for wrk2, so the cursor of the next page goes in a header
+	if page.NextMaxID != 0 {
+		w.Header().Set("X-Next-Max-Id", strconv.FormatInt(page.NextMaxID, 10))
+	}
 
 	// response, err := json.Marshal(posts)
 	// iterate to add new line in between posts
+	w.Header().Set("Content-Type", "text/plain")
 	for i, post := range posts {
 		postJSON, err := json.Marshal(post)
 		if err != nil {
@@ -543,5 +819,4 @@ func (s *server) readUserTimelineHandler(w http.ResponseWriter, r *http.Request)
 			w.Write([]byte("\n"))
 		}
 	}
-	w.Header().Set("Content-Type", "text/plain")
 }